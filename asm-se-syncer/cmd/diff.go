@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/plan"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/status"
+)
+
+// settler is implemented by the watchers publishing their ServiceEntries on their own
+type settler interface {
+	// Settled reports whether all ServiceEntries received so far were published
+	Settled() bool
+}
+
+func diff() *cobra.Command {
+	var timeout time.Duration
+	cmd := &cobra.Command{
+		Use:     "diff",
+		Short:   "Prints the ServiceEntries, WorkloadEntries and DestinationRules the syncer would create, update and delete",
+		Long:    "Runs the configured watchers until they fetched all services once, and prints the ServiceEntries, WorkloadEntries and DestinationRules which would be created, updated and deleted, without writing anything.",
+		Example: "asm-se-syncer diff --kubeconfig ~/.kube/config -o json",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configs, err := common.GetServiceRegistryConfig()
+			if err != nil {
+				return errors.Wrap(err, "failed to get service registry config")
+			}
+			cfg, err := restConfig()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var owner metav1.OwnerReference
+			if statusClient, err := status.NewClient(cfg); err != nil {
+				return errors.Wrap(err, "failed to create the ASMServiceRegistry client")
+			} else if owner, err = statusClient.OwnerReference(ctx); err != nil {
+				log.Warnf("ServiceEntries are planned without owner reference: %v", err)
+			}
+
+			recorder := plan.NewRecorder(nil)
+			s, err := newSyncer(ctx, cfg, leader.Always(), owner, recorder, nil)
+			if err != nil {
+				return err
+			}
+			if !cache.WaitForCacheSync(ctx.Done(), s.informerSynced) {
+				return errors.New("failed to list the ServiceEntries in the cluster")
+			}
+
+			watchers := make(map[provider.Watcher]string, len(configs)) // watcher->namespace
+			registries := make(map[provider.Watcher]common.RegistryConfig, len(configs))
+			for _, registryConfig := range configs {
+				monitoring.Register(registryConfig.Name, string(registryConfig.Type))
+				watcher, toNamespace, err := s.startWatcher(ctx, registryConfig)
+				if err != nil {
+					return err
+				}
+				watchers[watcher] = toNamespace
+				if gc := registryConfig.GarbageCollection; gc != nil {
+					// the plan shows the deletions due once the grace period passed
+					noGrace := *gc
+					noGrace.GracePeriod = 0
+					registryConfig.GarbageCollection = &noGrace
+				}
+				registries[watcher] = registryConfig
+			}
+			if err := waitForWatchers(watchers, timeout); err != nil {
+				return err
+			}
+			for watcher, toNamespace := range watchers {
+				if watcher.Cache() != nil {
+					s.newSynchronizer(watcher, toNamespace, registries[watcher]).SyncOnce()
+				}
+			}
+			return plan.Write(os.Stdout, recorder.Plan(), output)
+		},
+	}
+	addClusterFlags(cmd.Flags())
+	cmd.Flags().StringVarP(&output,
+		"output", "o", plan.FormatYAML, "the format of the printed changes: yaml or json")
+	cmd.Flags().DurationVar(&timeout,
+		"timeout", 2*time.Minute, "how long to wait for the watchers to fetch all services")
+	return cmd
+}
+
+// waitForWatchers waits until all watchers completed their initial sync, and the watchers publishing on their own
+// handled all the ServiceEntries received
+func waitForWatchers(watchers map[provider.Watcher]string, timeout time.Duration) error {
+	var unsynced []string
+	err := wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		unsynced = nil
+		for _, state := range monitoring.States() {
+			if !state.Synced {
+				unsynced = append(unsynced, state.Name)
+			}
+		}
+		for watcher := range watchers {
+			if s, ok := watcher.(settler); ok && !s.Settled() {
+				unsynced = append(unsynced, watcher.Name())
+			}
+		}
+		return len(unsynced) == 0, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("registries %v didn't complete their initial sync within %s", unsynced, timeout)
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	restclient "k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/plan"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+func export() *cobra.Command {
+	var timeout time.Duration
+	var outputDir string
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Exports the services of the registries as ServiceEntry manifests",
+		Long: "Runs the configured watchers until they fetched all services once, and writes the ServiceEntries, and " +
+			"WorkloadEntries and DestinationRules, the syncer would publish as YAML, sorted by namespace and name. No cluster is needed.",
+		Example: "asm-se-syncer export --output-dir manifests",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configs, err := common.GetServiceRegistryConfig()
+			if err != nil {
+				return errors.Wrap(err, "failed to get service registry config")
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s := &syncer{
+				// the watchers publishing on their own plan against an empty cluster, so the config is never used
+				cfg:      &restclient.Config{},
+				istio:    serviceentry.New(metav1.OwnerReference{}),
+				claims:   serviceentry.NewHostClaims(),
+				elector:  leader.Always(),
+				recorder: plan.NewOfflineRecorder(nil),
+			}
+			watchers := make(map[provider.Watcher]string, len(configs)) // watcher->namespace
+			registries := make(map[provider.Watcher]common.RegistryConfig, len(configs))
+			var ordered []provider.Watcher
+			for _, registryConfig := range configs {
+				monitoring.Register(registryConfig.Name, string(registryConfig.Type))
+				watcher, toNamespace, err := s.startWatcher(ctx, registryConfig)
+				if err != nil {
+					return err
+				}
+				watchers[watcher] = toNamespace
+				registries[watcher] = registryConfig
+				ordered = append(ordered, watcher)
+			}
+			if err := waitForWatchers(watchers, timeout); err != nil {
+				return err
+			}
+
+			var entries []object
+			for _, watcher := range ordered {
+				if watcher.Cache() != nil {
+					entries = append(entries, s.build(watcher, watchers[watcher], registries[watcher])...)
+				}
+			}
+			for _, change := range s.recorder.Plan() {
+				if change.Action == plan.Create {
+					entries = append(entries, change.Desired.(object))
+				}
+			}
+			sort.SliceStable(entries, func(i, j int) bool {
+				if entries[i].GetNamespace() != entries[j].GetNamespace() {
+					return entries[i].GetNamespace() < entries[j].GetNamespace()
+				}
+				return entries[i].GetName() < entries[j].GetName()
+			})
+			if outputDir == "" {
+				return writeManifests(os.Stdout, entries)
+			}
+			return writeManifestFiles(outputDir, entries)
+		},
+	}
+	cmd.Flags().StringVar(&outputDir,
+		"output-dir", "", "if set, every object is written to <output-dir>/<namespace>/<name>.yaml rather than to stdout")
+	cmd.Flags().DurationVar(&timeout,
+		"timeout", 2*time.Minute, "how long to wait for the watchers to fetch all services")
+	return cmd
+}
+
+// object is a ServiceEntry, WorkloadEntry or DestinationRule
+type object interface {
+	runtime.Object
+	metav1.Object
+}
+
+// build returns the ServiceEntries of the hosts found by watcher, each followed by its DestinationRule and, in
+// workloadEntry endpoint mode, its WorkloadEntries. Hosts already claimed by another registry are skipped.
+func (s *syncer) build(watcher provider.Watcher, namespace string, registryConfig common.RegistryConfig) []object {
+	hosts := watcher.Cache().Hosts()
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	// no owner reference, the manifests may be applied anywhere
+	identity := serviceentry.Identity{Type: watcher.WatcherType(), Registry: watcher.Name()}
+	labels := identity.Labels()
+	out := make([]object, 0, len(hosts))
+	for _, host := range names {
+		if owner, ok := s.claims.Claim(host, watcher.Name()); !ok {
+			log.Warnf("host %s of registry %q is skipped, it is exported for registry %q", host, watcher.Name(), owner)
+			continue
+		}
+		endpoints := append([]*v1alpha3.WorkloadEntry(nil), hosts[host]...)
+		sortEndpoints(endpoints)
+		seNamespace, exportTo := serviceentry.Route(registryConfig.Namespaces, namespace, registryConfig.ExportTo, host, endpoints)
+		se := serviceentry.Builder(seNamespace, watcher.Prefix(), host, v1alpha3.ServiceEntry_MESH_EXTERNAL, endpoints, labels)
+		se.Spec.ExportTo = exportTo
+		identity.Stamp(se)
+		serviceentry.ApplyPortRules(se, host, registryConfig.Ports)
+		out = append(out, se)
+		if c := registryConfig.DestinationRule; c != nil {
+			if dr := serviceentry.BuildDestinationRule(se, c.SubsetKeys, c.TrafficPolicy); dr != nil {
+				out = append(out, dr)
+			}
+		}
+		if registryConfig.EndpointMode == common.EndpointModeWorkloadEntry {
+			for _, we := range serviceentry.SelectWorkloadEntries(se, labels) {
+				identity.Stamp(we)
+				out = append(out, we)
+			}
+		}
+	}
+	return out
+}
+
+// sortEndpoints sorts endpoints by address and ports, so that the manifests don't depend on the registry order
+func sortEndpoints(endpoints []*v1alpha3.WorkloadEntry) {
+	key := func(ep *v1alpha3.WorkloadEntry) string {
+		ports, _ := json.Marshal(ep.Ports) // map keys are sorted
+		return ep.Address + string(ports)
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool { return key(endpoints[i]) < key(endpoints[j]) })
+}
+
+// writeManifests writes the objects as a multi-document YAML
+func writeManifests(w io.Writer, entries []object) error {
+	for _, obj := range entries {
+		manifest, err := manifest(obj)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "---\n%s", manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeManifestFiles writes every object to dir/namespace/name.yaml
+func writeManifestFiles(dir string, entries []object) error {
+	for _, obj := range entries {
+		manifest, err := manifest(obj)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, obj.GetNamespace(), obj.GetName()+".yaml")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, manifest, 0644); err != nil {
+			return err
+		}
+	}
+	log.Infof("exported %d objects into %s", len(entries), dir)
+	return nil
+}
+
+// manifest returns the YAML of a ServiceEntry, WorkloadEntry or DestinationRule without its server side fields
+func manifest(obj object) ([]byte, error) {
+	obj = obj.DeepCopyObject().(object)
+	switch obj.(type) {
+	case *ic.WorkloadEntry:
+		obj.GetObjectKind().SetGroupVersionKind(ic.SchemeGroupVersion.WithKind(plan.KindWorkloadEntry))
+	case *ic.DestinationRule:
+		obj.GetObjectKind().SetGroupVersionKind(ic.SchemeGroupVersion.WithKind(plan.KindDestinationRule))
+	default:
+		obj.GetObjectKind().SetGroupVersionKind(ic.SchemeGroupVersion.WithKind(kind))
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+	delete(object, "status")
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "creationTimestamp")
+	}
+	// the keys are sorted
+	return yaml.Marshal(object)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+type fakeWatcher struct {
+	provider.Watcher
+	cache provider.Cache
+}
+
+func (w fakeWatcher) Cache() provider.Cache { return w.cache }
+func (w fakeWatcher) Name() string          { return "consul" }
+func (w fakeWatcher) Prefix() string        { return "" }
+func (w fakeWatcher) WatcherType() string   { return "consul" }
+
+func TestExportManifests(t *testing.T) {
+	cache := provider.NewCache()
+	cache.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"web.service.consul": {
+			serviceentry.Endpoint("10.0.0.2", 80),
+			serviceentry.Endpoint("10.0.0.1", 80),
+		},
+		"db.service.consul": {
+			serviceentry.Endpoint("10.0.1.1", 3306),
+		},
+	})
+	s := &syncer{claims: serviceentry.NewHostClaims()}
+	var out bytes.Buffer
+	if err := writeManifests(&out, s.build(fakeWatcher{cache: cache}, "external", common.RegistryConfig{})); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `---
+apiVersion: networking.istio.io/v1alpha3
+kind: ServiceEntry
+metadata:
+  annotations:
+    asm-syncer.istio.alibabacloud.com/owner: consul/consul
+  labels:
+    ASM_Syncer: consul
+    ASM_Syncer_Registry: consul
+  name: db.service.consul
+  namespace: external
+spec:
+  addresses:
+  - 10.0.1.1
+  endpoints:
+  - address: 10.0.1.1
+    ports:
+      mysql: 3306
+  hosts:
+  - db.service.consul
+  ports:
+  - name: mysql
+    number: 3306
+    protocol: MYSQL
+  resolution: STATIC
+---
+apiVersion: networking.istio.io/v1alpha3
+kind: ServiceEntry
+metadata:
+  annotations:
+    asm-syncer.istio.alibabacloud.com/owner: consul/consul
+  labels:
+    ASM_Syncer: consul
+    ASM_Syncer_Registry: consul
+  name: web.service.consul
+  namespace: external
+spec:
+  addresses:
+  - 10.0.0.1
+  endpoints:
+  - address: 10.0.0.1
+    ports:
+      http: 80
+  - address: 10.0.0.2
+    ports:
+      http: 80
+  hosts:
+  - web.service.consul
+  ports:
+  - name: http
+    number: 80
+    protocol: HTTP
+  resolution: STATIC
+`
+	if out.String() != want {
+		t.Errorf("unexpected manifests:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
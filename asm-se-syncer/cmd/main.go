@@ -5,31 +5,26 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/cast"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
-	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/consul"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/control"
-	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/nacos"
-	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
-	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
-	"istio.io/api/networking/v1alpha3"
-	ic "istio.io/client-go/pkg/clientset/versioned"
-	icinformer "istio.io/client-go/pkg/informers/externalversions/networking/v1alpha3"
-	"istio.io/istio/pilot/pkg/config/memory"
-	"istio.io/istio/pkg/config/schema/collections"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/mcp"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/plan"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/status"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/writer"
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	k8sruntime "k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/kubernetes/scheme"
 	restclient "k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -40,11 +35,25 @@ const (
 	kind          = "ServiceEntry"
 	allNamespaces = ""
 	resyncPeriod  = 30
+
+	// interval of checking the registry config file for changes
+	configReloadInterval = 10 * time.Second
+	// interval of starting the registries which failed to start again
+	registryRetryInterval = 30 * time.Second
+	// interval of reporting the status of the registries on the ASMServiceRegistry
+	statusInterval = 30 * time.Second
+
+	leaseName             = "asm-se-syncer"
+	defaultLeaseNamespace = "istio-system"
+	// how long the shutdown waits for the lease to be released
+	leaseReleaseTimeout = 5 * time.Second
 )
 
 var (
 	debug           bool
 	kubeConfig      string
+	kubeContext     string
+	credentials     string
 	namespace       string
 	consulEndpoint  string
 	consulNamespace string
@@ -53,6 +62,19 @@ var (
 	regionId        string
 	accessKeyId     string
 	accessKeySecret string
+
+	leaderElect          bool
+	leaderElectNamespace string
+
+	monitoringAddress string
+	mcpAddress        string
+
+	dryRun bool
+	output string
+
+	writeQPS     float32
+	writeBurst   int
+	fieldManager string
 )
 
 func serve() (serve *cobra.Command) {
@@ -63,177 +85,193 @@ func serve() (serve *cobra.Command) {
 		Short:   "Starts the ASM ServiceEntry Syncer server",
 		Example: "asm-se-syncer serve",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			var cfg *restclient.Config
-			var serviceRegistryConfigList []map[string]interface{}
-
-			if meshId == "" {
-				return errors.New("meshId is required")
-			}
 			serviceRegistryConfigList, err := common.GetServiceRegistryConfig()
-			if err != nil || len(serviceRegistryConfigList) == 0 {
+			if err != nil {
 				return errors.Wrap(err, "failed to get service registry config")
 			}
-			akId, err := common.GetAccessKeyID()
+			cfg, err := restConfig()
 			if err != nil {
 				return err
 			}
-			akSecret, err := common.GetAccessKeySecret()
-			if err != nil {
-				return err
+
+			// common context for cancellation across all loops/routines, cancelled on SIGTERM or SIGINT
+			ctx := signalContext()
+			if mcpAddress != "" && dryRun {
+				return errors.New("--dry-run can't be combined with --mcpAddress")
 			}
-			accessKeyId = string(akId)
-			accessKeySecret = string(akSecret)
-			cfg, err = common.GetASMRestConfig(meshId, regionId, accessKeyId, accessKeySecret)
-			if err != nil {
-				return errors.Wrap(err, "failed to get asm rest config")
+
+			if monitoringAddress != "" {
+				go func() {
+					log.Infof("Serving metrics and health checks on %s", monitoringAddress)
+					if err := http.ListenAndServe(monitoringAddress, monitoring.Handler()); err != nil {
+						log.Fatalf("failed to serve metrics and health checks: %v", err)
+					}
+				}()
 			}
 
-			//viper.SetConfigName("config") // name of config file (without extension)
-			//viper.AddConfigPath(serviceRegistryConfigDir)   // path to look for the config file in
-			//err = viper.ReadInConfig() // Find and read the config file
-			//if err != nil { // Handle errors reading the config file
-			//	log.Errorf("Fatal error config file: %+v \n", err)
-			//	return errors.Wrapf(err, "Fatal error config file")
-			//}
-			//viper.WatchConfig()
-			//viper.OnConfigChange(func(e fsnotify.Event) {
-			//	log.Infof("Config file changed: %s", e.Name)
-			//	if err := viper.Unmarshal(&serviceRegistryConfig); err != nil {
-			//		log.Errorf("error Unmarshal config file %q\n", serviceRegistryConfigFilePath)
-			//	}
-			//})
+			var recorder *plan.Recorder
+			elector := leader.Always()
+			var released <-chan struct{}
+			if dryRun {
+				// nothing is written, not even the lease or the status, the planned changes are printed instead
+				log.Infof("Dry run, the ServiceEntries which would be written are printed as %s", output)
+				recorder = plan.NewRecorder(func(c plan.Change) {
+					if err := plan.Write(os.Stdout, []plan.Change{c}, output); err != nil {
+						log.Errorf("error printing the planned change of %s/%s: %v", c.Namespace, c.Name, err)
+					}
+				})
+			} else if leaderElect {
+				elector, released, err = runLeaderElection(ctx, cfg)
+				if err != nil {
+					return err
+				}
+			}
 
-			ic, err := ic.NewForConfig(cfg)
+			// the published ServiceEntries are owned by the ASMServiceRegistry, which also holds the status of the registries
+			var owner metav1.OwnerReference
+			statusClient, err := status.NewClient(cfg)
 			if err != nil {
-				return errors.Wrap(err, "failed to create an istio client from the k8s rest config")
+				return errors.Wrap(err, "failed to create the ASMServiceRegistry client")
 			}
+			owner, err = statusClient.OwnerReference(ctx)
+			if err != nil {
+				log.Warnf("ServiceEntries are published without owner reference and the status isn't reported: %v", err)
+			}
+			reportStatus := err == nil && !dryRun
 
-			ctx := context.Background() // common context for cancellation across all loops/routines
-
-			if len(namespace) == 0 {
-				if ns, set := os.LookupEnv("PUBLISH_NAMESPACE"); set {
-					namespace = ns
+			var server *mcp.Server
+			syncElector := elector
+			if mcpAddress != "" {
+				if server, err = serveMCP(ctx, mcpAddress); err != nil {
+					return err
 				}
+				// istiod may connect to any replica, so they all serve the ServiceEntries
+				syncElector = leader.Always()
 			}
-
-			// only support one Nacos service registry or multi consul service registries for now
-			watchers, err := getWatcher(serviceRegistryConfigList, cfg)
+			var writes *writer.Queue
+			if server == nil && recorder == nil {
+				writes = writer.NewQueue(writer.Config{QPS: writeQPS, Burst: writeBurst})
+				go writes.Run(ctx)
+				// the writes are limited by the queue, the clients of the registries leave room for their reads
+				cfg.QPS, cfg.Burst = 2*writeQPS, 2*writeBurst
+			}
+			s, err := newSyncer(ctx, cfg, syncElector, owner, recorder, server)
 			if err != nil {
 				return err
 			}
-			//check if has two kind  service registry
-			hasMulti := hasMultiKindServiceRegistry(watchers)
-			if hasMulti {
-				return errors.New("Multiple kind service registries is not supported.")
+			if writes != nil {
+				// the other clients don't support server-side apply
+				s.writes, s.fieldManager = writes, fieldManager
 			}
-			for _, watcher := range watchers {
-				if watcher.WatcherType() == string(common.Nacos) {
-					go watcher.Run(ctx)
-					//nacos only support one cluster
-					break
-				} else {
-					//Consul
-					go watcher.Run(ctx)
-				}
+			// every replica starts from the snapshots, the leader keeps them up to date
+			if s.snapshots, err = snapshotStore(); err != nil {
+				return err
 			}
-			for _, watcher := range watchers {
-				// we get the service entry for namespace `namespace` for the synchronizer to publish service entries in to
-				// (if we use an `allNamespaces` client here we can't publish). Listening for ServiceEntries is done with
-				// the informer, which uses allNamespace.
-				toNamespace := findNamespace(watcher.ToNamespace())
-				err = populateNamespace(cfg, toNamespace)
-				if err != nil {
-					return err
+			s.snapshotElector = elector
+			if reportStatus {
+				go status.Report(ctx, statusClient, elector, s.claims, statusInterval)
+			}
+			manager := control.NewManager(s.start, s.claims)
+			if err := manager.Apply(ctx, serviceRegistryConfigList); err != nil {
+				log.Errorf("failed to start service registries, they are tried again every %s: %v", registryRetryInterval, err)
+			}
+			go manager.Retry(ctx, registryRetryInterval)
+			go common.WatchRegistryConfig(ctx, configReloadInterval, func(configs []common.RegistryConfig) {
+				if err := manager.Apply(ctx, configs); err != nil {
+					log.Errorf("error applying the changed registry config: %v", err)
 				}
-				serviceRegistryType := watcher.WatcherType()
-				if serviceRegistryType == string(common.Consul) {
-					istio := serviceentry.New()
-					if debug {
-						istio = serviceentry.NewLoggingStore(istio, log.Infof)
-					}
-					log.Info("Starting Synchronizer control loop, prefix %s", watcher.Prefix())
-					write := ic.NetworkingV1alpha3().ServiceEntries(toNamespace)
-					location := v1alpha3.ServiceEntry_MESH_EXTERNAL
-					interval := time.Second * 5
-					sync := control.NewSynchronizer(namespace, istio, watcher.Cache(), watcher.Prefix(), location, interval, write)
-					go sync.Run(ctx)
+				log.Infof("running registries: %v", manager.Running())
+			})
 
-					informer := icinformer.NewServiceEntryInformer(ic, allNamespaces, 5*time.Second,
-						cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
-					serviceentry.AttachHandler(istio, informer)
-					log.Infof("Watching %s.%s across all namespaces with resync period %d and %q", apiType, kind, resyncPeriod)
-					go informer.Run(ctx.Done())
+			<-ctx.Done()
+			if released != nil {
+				// the lease is released so that another replica takes over at once
+				select {
+				case <-released:
+				case <-time.After(leaseReleaseTimeout):
+					log.Warnf("the lease %s wasn't released within %s", leaseName, leaseReleaseTimeout)
 				}
 			}
-
-			<-ctx.Done()
 			return nil
 		},
 	}
 
 	serve.PersistentFlags().BoolVar(&debug, "debug", true, "if true, enables more logging")
-	serve.PersistentFlags().StringVar(&meshId,
-		"meshId", "", "the id of asm instance")
-	serve.PersistentFlags().StringVar(&regionId,
-		"regionId", "cn-hangzhou", "the id of the region where the asm instance is running")
+	addClusterFlags(serve.PersistentFlags())
 	serve.PersistentFlags().StringVar(&accessKeyId,
 		"accessKeyId", "xxx", "user accessKeyId")
 	serve.PersistentFlags().StringVar(&accessKeySecret,
 		"accessKeySecret", "xxx", "user accessKeySecret")
-	serve.PersistentFlags().StringVar(&kubeConfig,
-		"kubeconfig", "", "kubeconfig location; if empty the server will assume it's in a cluster; for local testing use ~/.kube/config")
+	_ = serve.PersistentFlags().MarkDeprecated("accessKeyId", "the AccessKey is read from "+common.AccessKeyIDPath)
+	_ = serve.PersistentFlags().MarkDeprecated("accessKeySecret", "the AccessKey is read from "+common.AccessKeySecretPath)
+	serve.PersistentFlags().BoolVar(&leaderElect,
+		"leaderElect", true, "if true, only the replica holding the Lease writes ServiceEntries, the others keep their watchers warm to take over; "+
+			"requires get, create and update on coordination.k8s.io leases in the lease namespace")
+	serve.PersistentFlags().StringVar(&leaderElectNamespace,
+		"leaderElectNamespace", "", "the namespace of the Lease; if empty the POD_NAMESPACE environment variable or istio-system")
+	serve.PersistentFlags().StringVar(&monitoringAddress,
+		"monitoringAddress", ":15014", "the address serving /metrics, /healthz and /readyz; disabled if empty")
+	serve.PersistentFlags().StringVar(&mcpAddress,
+		"mcpAddress", "", "if set, the ServiceEntries are served to istiod over MCP on this address, e.g. :15010, rather than written to the API server")
+	serve.PersistentFlags().BoolVar(&dryRun,
+		"dry-run", false, "if true, the ServiceEntries which would be created, updated and deleted are printed rather than written")
+	serve.PersistentFlags().StringVarP(&output,
+		"output", "o", plan.FormatYAML, "the format of the printed changes: yaml or json")
+	serve.PersistentFlags().Float32Var(&writeQPS,
+		"writeQPS", writer.DefaultQPS, "the writes per second to the API server, across all registries")
+	serve.PersistentFlags().IntVar(&writeBurst,
+		"writeBurst", writer.DefaultBurst, "the writes to the API server allowed at once above --writeQPS")
+	serve.PersistentFlags().StringVar(&fieldManager,
+		"fieldManager", "asm-se-syncer", "the field manager of the server-side applied writes; if empty the objects are created and updated instead")
+	addSnapshotFlags(serve.PersistentFlags())
 	return serve
 }
 
-func getWatcher(serviceRegistryConfigList []map[string]interface{}, cfg *restclient.Config) ([]provider.Watcher, error) {
-	if serviceRegistryConfigList == nil || len(serviceRegistryConfigList) == 0 {
-		return nil, errors.New("failed to initialize watchers as serviceRegistryConfigList is empty")
+// serveMCP serves the ServiceEntries over MCP on address until the context is cancelled
+func serveMCP(ctx context.Context, address string) (*mcp.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for MCP connections")
 	}
-	log.Info("Initializing Watchers")
-	var watchers []provider.Watcher
-	for _, serviceRegistryInfo := range serviceRegistryConfigList {
-		var watcher provider.Watcher
-		serviceRegistryType := cast.ToString(serviceRegistryInfo["type"])
-		if serviceRegistryType == string(common.Consul) {
-			store := provider.NewCache()
-			consulEndpoint := cast.ToString(serviceRegistryInfo["endpoint"])
-			consulNamespace := cast.ToString(serviceRegistryInfo["consulNamespace"])
-			prefix := cast.ToString(serviceRegistryInfo["prefix"])
-			toNamespace := cast.ToString(serviceRegistryInfo["toNamespace"])
-			consulWatcher, consulErr := consul.NewWatcher(store, consulEndpoint, consulNamespace, prefix, toNamespace)
-			if consulErr != nil {
-				log.Errorf("error setting up consul: %v", consulErr)
-				continue
-			} else {
-				log.Infof("Consul Watcher initialized at %s", consulEndpoint)
-				watcher = consulWatcher
-			}
-			watchers = append(watchers, watcher)
-		} else if serviceRegistryType == string(common.Nacos) {
-			nacosEndpoint := cast.ToString(serviceRegistryInfo["endpoint"])
-			//nacosNamespace := cast.ToString(serviceRegistryInfo["nacosNamespace"])
-			toNamespace := cast.ToString(serviceRegistryInfo["toNamespace"])
-			store := memory.Make(collections.Pilot)
-			configController := memory.NewController(store)
-			log.Info("create configController success")
-			nacosWatcher, nacosErr := nacos.NewWatcher(nacosEndpoint, nil, cfg, "", toNamespace, configController)
-			if nacosErr != nil {
-				log.Errorf("error setting up nacos: %v", nacosErr)
-				return nil, errors.Wrapf(nacosErr, "failed to initialize nacos watchers")
-			} else {
-				log.Infof("nacos Watcher initialized at %s", consulEndpoint)
-				watcher = nacosWatcher
-			}
-			watchers = append(watchers, watcher)
-		} else {
-			log.Errorf("the service registry type is not supported: %s", serviceRegistryType)
-			return nil, errors.Errorf("the service registry type is not supported: %s", serviceRegistryType)
+	server := mcp.NewServer()
+	go func() {
+		log.Infof("Serving ServiceEntries over MCP on %s", address)
+		if err := server.Serve(ctx, listener); err != nil {
+			log.Fatalf("failed to serve MCP: %v", err)
 		}
-	}
-	log.Infof("watchers nums %d", len(watchers))
+	}()
+	return server, nil
+}
 
-	return watchers, nil
+// addClusterFlags adds the flags selecting the cluster to connect to
+func addClusterFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&meshId,
+		"meshId", "", "the id of asm instance")
+	flags.StringVar(&regionId,
+		"regionId", "cn-hangzhou", "the id of the region where the asm instance is running")
+	flags.StringVar(&credentials,
+		"credentials", "", fmt.Sprintf("how to connect to the cluster: %s, %s or %s; if empty %s is used if --kubeconfig is set, %s if --meshId is set and %s otherwise",
+			common.CredentialsInCluster, common.CredentialsKubeconfig, common.CredentialsASM,
+			common.CredentialsKubeconfig, common.CredentialsASM, common.CredentialsInCluster))
+	flags.StringVar(&kubeConfig,
+		"kubeconfig", "", "kubeconfig location; if empty the server will assume it's in a cluster; for local testing use ~/.kube/config")
+	flags.StringVar(&kubeContext,
+		"context", "", "the kubeconfig context to use; the current context if empty")
+}
 
+// restConfig returns the config of the cluster selected with the cluster flags
+func restConfig() (*restclient.Config, error) {
+	cfg, err := common.GetRestConfig(common.RestConfigOptions{
+		Mode:       credentials,
+		Kubeconfig: kubeConfig,
+		Context:    kubeContext,
+		MeshID:     meshId,
+		RegionID:   regionId,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the rest config")
+	}
+	return cfg, nil
 }
 
 func main() {
@@ -242,17 +280,78 @@ func main() {
 		Example: "",
 	}
 	root.AddCommand(serve())
+	root.AddCommand(diff())
+	root.AddCommand(export())
+	root.AddCommand(inspectSnapshot())
 	if err := root.Execute(); err != nil {
 		log.Error(err.Error())
 		os.Exit(1)
 	}
 }
 
+// runLeaderElection takes part in the leader election until the context is cancelled, the returned channel is
+// closed once the election stopped and the lease, if held, was released
+func runLeaderElection(ctx context.Context, cfg *restclient.Config) (*leader.Elector, <-chan struct{}, error) {
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaseNamespace := leaderElectNamespace
+	if leaseNamespace == "" {
+		leaseNamespace = os.Getenv("POD_NAMESPACE")
+	}
+	if leaseNamespace == "" {
+		leaseNamespace = defaultLeaseNamespace
+	}
+	if err := populateNamespace(cfg, leaseNamespace); err != nil {
+		return nil, nil, err
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get the identity for leader election")
+	}
+
+	elector := leader.New()
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		err := elector.Run(ctx, clientset, leaseNamespace, leaseName, identity, func() {
+			if ctx.Err() != nil {
+				log.Infof("%s released the lease %s/%s", identity, leaseNamespace, leaseName)
+				return
+			}
+			log.Fatalf("%s lost the lease %s/%s, exiting", identity, leaseNamespace, leaseName)
+		})
+		if err != nil {
+			log.Fatalf("error running leader election: %v", err)
+		}
+	}()
+	log.Infof("%s is waiting to become the leader of %s/%s", identity, leaseNamespace, leaseName)
+	return elector, released, nil
+}
+
+// signalContext returns a context which is cancelled on SIGTERM or SIGINT, a second signal exits at once
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		log.Infof("received %s, shutting down", <-signals)
+		cancel()
+		log.Fatalf("received %s again, exiting", <-signals)
+	}()
+	return ctx
+}
+
 func findNamespace(namespace string) string {
 	if len(namespace) > 0 {
 		log.Infof("using namespace flag to publish service entries into %q", namespace)
 		return namespace
 	}
+	if ns, ok := os.LookupEnv("PUBLISH_NAMESPACE"); ok && ns != "" {
+		log.Infof("using PUBLISH_NAMESPACE environment variable to publish service entries into %q", ns)
+		return ns
+	}
 	// This way assumes you've set the POD_NAMESPACE environment variable using the downward API.
 	// This check has to be done first for backwards compatibility with the way InClusterConfig was originally set up
 	if ns, ok := os.LookupEnv("POD_NAMESPACE"); ok {
@@ -272,7 +371,7 @@ func populateNamespace(cfg *restclient.Config, namespace string) error {
 	}
 	ns, err := clientset.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
 	if err != nil && !k8serrors.IsNotFound(err) {
-		log.Info(fmt.Sprintf("checking if namespace %s exists with error - requeue", namespace), "error", err)
+		log.Infof("checking if namespace %s exists with error - requeue: %v", namespace, err)
 		return err
 	}
 
@@ -284,54 +383,14 @@ func populateNamespace(cfg *restclient.Config, namespace string) error {
 		}
 		ns, err = clientset.CoreV1().Namespaces().Create(context.TODO(), ns, metav1.CreateOptions{})
 		if err != nil {
-			log.Info(fmt.Sprintf("namespace %s cannot be created with error - requeue", namespace), "error", err)
+			log.Infof("namespace %s cannot be created with error - requeue: %v", namespace, err)
 			return err
 		}
-		log.Info(fmt.Sprintf("namespace %s has been created", namespace))
+		log.Infof("namespace %s has been created", namespace)
 		return nil
 	} else {
-		log.Info(fmt.Sprintf("namespace %s already exists", namespace))
+		log.Infof("namespace %s already exists", namespace)
 	}
 
 	return nil
 }
-func getASMServiceRegistry(cfg *restclient.Config) (types.UID, error) {
-	crdConfig := cfg
-	crdConfig.GroupVersion = &schema.GroupVersion{Group: "istio.alibabacloud.com", Version: "v1beta1"}
-	crdConfig.APIPath = "/apis"
-	crdConfig.ContentType = k8sruntime.ContentTypeJSON
-	crdConfig.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
-	if crdConfig.UserAgent == "" {
-		crdConfig.UserAgent = restclient.DefaultKubernetesUserAgent()
-	}
-	restClient, err := restclient.RESTClientFor(crdConfig)
-	if err != nil {
-		return "", err
-	}
-	var defaultSR unstructured.Unstructured
-	err = restClient.Get().Resource("asmserviceregistrys").Name("default").Do(context.TODO()).Into(&defaultSR)
-	if err != nil {
-		return "", err
-	}
-	log.Infof(fmt.Sprintf("asmserviceregistrys:%+v", defaultSR))
-
-	return defaultSR.GetUID(), nil
-}
-
-func hasMultiKindServiceRegistry(watchers []provider.Watcher) bool {
-	previousType := ""
-	if watchers == nil || len(watchers) <= 1 {
-		return false
-	}
-	for i, watcher := range watchers {
-		if i == 0 {
-			previousType = watcher.WatcherType()
-		} else {
-			if previousType != watcher.WatcherType() {
-				return true
-			}
-			previousType = watcher.WatcherType()
-		}
-	}
-	return false
-}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/plan"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/snapshot"
+)
+
+var (
+	snapshotDir       string
+	snapshotConfigMap string
+)
+
+func inspectSnapshot() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot [registry...]",
+		Short: "Prints the snapshots of the registries the syncer starts from",
+		Long: "Prints a summary of the last-good snapshots saved by the syncer, of all registries or of those given, or " +
+			"the snapshots themselves with --output.",
+		Example: "asm-se-syncer snapshot --snapshotDir /var/lib/asm-se-syncer consul-prod -o yaml",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if snapshotDir == "" && snapshotConfigMap == "" {
+				return errors.New("either --snapshotDir or --snapshotConfigMap must be set")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := snapshotStore()
+			if err != nil {
+				return err
+			}
+			ctx := context.Background()
+			var snapshots []*snapshot.Snapshot
+			if len(args) == 0 {
+				if snapshots, err = store.List(ctx); err != nil {
+					return err
+				}
+			}
+			for _, registry := range args {
+				s, err := store.Load(ctx, registry)
+				if err != nil {
+					return err
+				}
+				if s == nil {
+					return errors.Errorf("there is no snapshot of registry %q", registry)
+				}
+				snapshots = append(snapshots, s)
+			}
+			return writeSnapshots(os.Stdout, snapshots, output)
+		},
+	}
+	addClusterFlags(cmd.Flags())
+	addSnapshotFlags(cmd.Flags())
+	cmd.Flags().StringVarP(&output,
+		"output", "o", "", "the format of the printed snapshots: yaml or json; a summary if empty")
+	return cmd
+}
+
+// addSnapshotFlags adds the flags selecting where the snapshots are kept
+func addSnapshotFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&snapshotDir,
+		"snapshotDir", "", "the directory keeping the snapshot of every registry, e.g. on a persistent volume")
+	flags.StringVar(&snapshotConfigMap,
+		"snapshotConfigMap", "", "the <namespace>/<name> of the ConfigMap keeping the snapshot of every registry, instead of --snapshotDir")
+}
+
+// snapshotStore returns the store selected with the snapshot flags, nil if none is
+func snapshotStore() (snapshot.Store, error) {
+	switch {
+	case snapshotDir != "" && snapshotConfigMap != "":
+		return nil, errors.New("--snapshotDir can't be combined with --snapshotConfigMap")
+	case snapshotDir != "":
+		return snapshot.NewFileStore(snapshotDir), nil
+	case snapshotConfigMap != "":
+		parts := strings.Split(snapshotConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("--snapshotConfigMap must be <namespace>/<name>, got %q", snapshotConfigMap)
+		}
+		cfg, err := restConfig()
+		if err != nil {
+			return nil, err
+		}
+		clientset, err := kubernetes.NewForConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return snapshot.NewConfigMapStore(clientset.CoreV1(), parts[0], parts[1]), nil
+	}
+	return nil, nil
+}
+
+// writeSnapshots prints the snapshots as YAML or JSON, or a line summing up each of them if format is empty
+func writeSnapshots(w io.Writer, snapshots []*snapshot.Snapshot, format string) error {
+	var out []byte
+	var err error
+	switch format {
+	case "":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "REGISTRY\tTYPE\tREVISION\tSAVED\tHOSTS\tENDPOINTS")
+		for _, s := range snapshots {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%d\n", s.Registry, s.Type, s.Revision, s.Time.Format(time.RFC3339),
+				len(s.Hosts), s.Endpoints())
+		}
+		return tw.Flush()
+	case plan.FormatJSON:
+		out, err = json.MarshalIndent(snapshots, "", "  ")
+		out = append(out, '\n')
+	case plan.FormatYAML:
+		out, err = yaml.Marshal(snapshots)
+	default:
+		return errors.Errorf("unknown output format %q, must be %s or %s", format, plan.FormatYAML, plan.FormatJSON)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
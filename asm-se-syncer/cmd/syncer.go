@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/clientset/versioned"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	icinformer "istio.io/client-go/pkg/informers/externalversions/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/config/memory"
+	"istio.io/istio/pkg/config/schema/collections"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/consul"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/control"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/eureka"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/mcp"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/nacos"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/plan"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/snapshot"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/writer"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/zookeeper"
+)
+
+// interval of saving the snapshots of the registries which changed
+const snapshotInterval = 30 * time.Second
+
+// syncer holds what the watchers and synchronizers of all registries share
+type syncer struct {
+	cfg         *restclient.Config
+	istioClient ic.Interface
+	// istio is the view of the ServiceEntries across all namespaces
+	istio          serviceentry.ServiceEntryModel
+	informerSynced cache.InformerSynced
+	// hosts published by each registry, shared by all of them so that a host found in several registries
+	// is published only once and the conflict is reported
+	claims  *serviceentry.HostClaims
+	elector *leader.Elector
+	owner   metav1.OwnerReference
+	// recorder records the ServiceEntry writes instead of doing them in dry runs, nil otherwise
+	recorder *plan.Recorder
+	// mcp serves the ServiceEntries to istiod instead of writing them to the API server, if set
+	mcp *mcp.Server
+	// snapshots keeps the last-good state of the registries to start from, if set
+	snapshots snapshot.Store
+	// snapshotElector elects the replica saving the snapshots, they are loaded by all replicas
+	snapshotElector *leader.Elector
+	// writes does the writes to the API server if set, applied server-side as fieldManager if it is set
+	writes       *writer.Queue
+	fieldManager string
+
+	m sync.Mutex
+	// started are the registries started since the process started, only their first start is warmed up
+	started map[string]bool
+}
+
+// synchronizer publishes the hosts found by a watcher
+type synchronizer interface {
+	Run(ctx context.Context)
+	SyncOnce()
+}
+
+// newSyncer starts watching the ServiceEntries across all namespaces until the context is cancelled.
+// If server is set, the ServiceEntries are served by it rather than written to the API server, and only those
+// served are watched.
+func newSyncer(ctx context.Context, cfg *restclient.Config, elector *leader.Elector, owner metav1.OwnerReference,
+	recorder *plan.Recorder, server *mcp.Server) (*syncer, error) {
+	istioClient, err := ic.NewForConfig(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create an istio client from the k8s rest config")
+	}
+	istio := serviceentry.New(owner)
+	if debug {
+		istio = serviceentry.NewLoggingStore(istio, log.Infof)
+	}
+	s := &syncer{
+		cfg:         cfg,
+		istioClient: istioClient,
+		istio:       istio,
+		claims:      serviceentry.NewHostClaims(),
+		elector:     elector,
+		owner:       owner,
+		recorder:    recorder,
+		mcp:         server,
+	}
+	if server != nil {
+		serviceentry.AttachHandler(istio, server)
+		s.informerSynced = func() bool { return true }
+		return s, nil
+	}
+
+	informer := icinformer.NewServiceEntryInformer(istioClient, allNamespaces, 5*time.Second,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	serviceentry.AttachHandler(istio, informer)
+	log.Infof("Watching %s.%s across all namespaces with resync period %d", apiType, kind, resyncPeriod)
+	go informer.Run(ctx.Done())
+	s.informerSynced = informer.HasSynced
+	return s, nil
+}
+
+// start runs the watcher of a registry, and its synchronizer, until the context is cancelled
+func (s *syncer) start(ctx context.Context, registryConfig common.RegistryConfig) error {
+	if s.mcp != nil {
+		if !registryConfig.Synchronized() {
+			return errors.Errorf("registry %q can't be served over MCP, it publishes its ServiceEntries to the API server", registryConfig.Name)
+		}
+		if registryConfig.EndpointMode == common.EndpointModeWorkloadEntry || registryConfig.DestinationRule != nil {
+			return errors.Errorf("registry %q can't be served over MCP, only ServiceEntries are served", registryConfig.Name)
+		}
+	}
+	watcher, toNamespace, err := s.startWatcher(ctx, registryConfig)
+	if err != nil {
+		return err
+	}
+	if watcher.Cache() == nil {
+		// the watcher publishes its ServiceEntries on its own
+		return nil
+	}
+	log.Infof("Starting Synchronizer control loop, registry %q", watcher.Name())
+	go s.newSynchronizer(watcher, toNamespace, registryConfig).Run(ctx)
+	return nil
+}
+
+// startWatcher runs the watcher of a registry until the context is cancelled, and returns it with the namespace
+// its ServiceEntries are published into
+func (s *syncer) startWatcher(ctx context.Context, registryConfig common.RegistryConfig) (provider.Watcher, string, error) {
+	live := provider.NewCache()
+	cache, last := s.warmUp(ctx, registryConfig, live)
+	watcher, err := s.newWatcher(registryConfig, cache)
+	if err != nil {
+		return nil, "", err
+	}
+	// we get the service entry for namespace `namespace` for the synchronizer to publish service entries in to
+	// (if we use an `allNamespaces` client here we can't publish). Listening for ServiceEntries is done with
+	// the informer, which uses allNamespace.
+	toNamespace := watcher.ToNamespace()
+	if toNamespace == "" {
+		toNamespace = namespace
+	}
+	toNamespace = findNamespace(toNamespace)
+	if s.recorder == nil && s.mcp == nil {
+		if err := populateNamespace(s.cfg, toNamespace); err != nil {
+			return nil, "", err
+		}
+		for _, rule := range registryConfig.Namespaces {
+			if err := populateNamespace(s.cfg, rule.Namespace); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	log.Infof("Starting %s watcher %q, prefix %q, namespace %q", watcher.WatcherType(), watcher.Name(), watcher.Prefix(), toNamespace)
+	go watcher.Run(ctx)
+	if s.snapshots != nil && s.recorder == nil && watcher.Cache() != nil {
+		go snapshot.Persist(ctx, s.snapshots, last, s.snapshotElector, watcher.Name(), string(registryConfig.Type), live, snapshotInterval)
+	} else if s.snapshots != nil && s.recorder == nil {
+		log.Warnf("registry %q isn't snapshotted, its %s watcher doesn't support snapshots", watcher.Name(), watcher.WatcherType())
+	}
+	return watcher, toNamespace, nil
+}
+
+// warmUp returns the cache the watcher of a registry fills: live, which also serves the snapshot of the registry if
+// this is its first start. The snapshot loaded is returned too, to be saved again only once it changed.
+func (s *syncer) warmUp(ctx context.Context, registryConfig common.RegistryConfig, live provider.Cache) (provider.Cache, *snapshot.Snapshot) {
+	if s.snapshots == nil || !registryConfig.Synchronized() {
+		return live, nil
+	}
+	name := registryConfig.Name
+	s.m.Lock()
+	restarted := s.started[name]
+	if s.started == nil {
+		s.started = make(map[string]bool)
+	}
+	s.started[name] = true
+	s.m.Unlock()
+
+	last, err := s.snapshots.Load(ctx, name)
+	if err != nil {
+		log.Warnf("registry %q starts without snapshot: %v", name, err)
+		return live, nil
+	}
+	if last == nil {
+		log.Infof("registry %q starts without snapshot, none was saved", name)
+		return live, nil
+	}
+	if last.Type != string(registryConfig.Type) {
+		log.Warnf("registry %q starts without snapshot, it was saved by a %s registry", name, last.Type)
+		return live, last
+	}
+	if restarted {
+		// the config of the registry changed, the snapshot may name the hosts differently
+		return live, last
+	}
+	return snapshot.Warm(live, name, last), last
+}
+
+// newSynchronizer returns the synchronizer publishing the hosts found by watcher into namespace, or the namespaces
+// of the namespace rules, with their ports and endpoints published as the registry config says
+func (s *syncer) newSynchronizer(watcher provider.Watcher, namespace string, registryConfig common.RegistryConfig) synchronizer {
+	registry := watcher.Name()
+	write := control.ServiceEntries(s.istioClient.NetworkingV1alpha3().ServiceEntries)
+	if s.mcp != nil {
+		write = s.mcp.ServiceEntries
+	}
+	if s.recorder != nil {
+		client := write
+		write = func(namespace string) icapi.ServiceEntryInterface {
+			return s.recorder.Wrap(client(namespace), registry)
+		}
+	}
+	location := v1alpha3.ServiceEntry_MESH_EXTERNAL
+	// changes are published as they are found, this is the interval of full resyncs
+	interval := time.Minute
+	sync := control.NewSynchronizer(namespace, s.istio, watcher, location, interval, write, s.claims, s.elector).
+		WithPortRules(registryConfig.Ports).
+		WithRouting(registryConfig.Namespaces, registryConfig.ExportTo)
+	if registryConfig.GarbageCollection != nil {
+		sync.WithGarbageCollection(*registryConfig.GarbageCollection)
+	}
+	if registryConfig.EndpointMode == common.EndpointModeWorkloadEntry {
+		workloadEntries := control.WorkloadEntries(s.istioClient.NetworkingV1alpha3().WorkloadEntries)
+		if s.recorder != nil {
+			client := workloadEntries
+			workloadEntries = func(namespace string) icapi.WorkloadEntryInterface {
+				return s.recorder.WrapWorkloadEntries(client(namespace), registry)
+			}
+		}
+		sync.WithWorkloadEntries(workloadEntries)
+	}
+	if registryConfig.DestinationRule != nil {
+		destinationRules := control.DestinationRules(s.istioClient.NetworkingV1alpha3().DestinationRules)
+		if s.recorder != nil {
+			client := destinationRules
+			destinationRules = func(namespace string) icapi.DestinationRuleInterface {
+				return s.recorder.WrapDestinationRules(client(namespace), registry)
+			}
+		}
+		sync.WithDestinationRules(destinationRules, *registryConfig.DestinationRule)
+	}
+	if s.writes != nil {
+		sync.WithWriteQueue(s.writes).WithServerSideApply(s.fieldManager)
+	}
+	return sync
+}
+
+// newWatcher returns the watcher of a registry filling cache
+func (s *syncer) newWatcher(registryConfig common.RegistryConfig, cache provider.Cache) (provider.Watcher, error) {
+	name := registryConfig.Name
+	endpoint := registryConfig.Endpoint
+	prefix := registryConfig.Prefix
+	toNamespace := registryConfig.ToNamespace
+	switch {
+	case registryConfig.Consul != nil:
+		c := registryConfig.Consul
+		consulOptions := consul.Options{
+			IncludeWarning: c.IncludeWarning,
+			Tags:           c.Tags,
+			LabelKeys:      c.LabelKeys,
+			LocalityKey:    c.LocalityKey,
+			Token:          c.Token,
+			TokenFile:      c.TokenFile,
+			CAFile:         c.CAFile,
+			CertFile:       c.CertFile,
+			KeyFile:        c.KeyFile,
+			Datacenters:    c.Datacenter,
+			Partition:      c.Partition,
+			HostTemplate:   registryConfig.HostTemplate,
+			Filter:         registryConfig.Filter,
+		}
+		watcher, err := consul.NewWatcher(cache, name, endpoint, c.ConsulNamespace, prefix, toNamespace, consulOptions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error setting up consul %q", name)
+		}
+		log.Infof("Consul Watcher %q initialized at %s", name, endpoint)
+		return watcher, nil
+	case registryConfig.Zookeeper != nil:
+		watcher, err := zookeeper.NewWatcher(cache, name, endpoint, registryConfig.Zookeeper.RootPath, prefix, registryConfig.HostTemplate,
+			registryConfig.Filter, toNamespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error setting up zookeeper %q", name)
+		}
+		log.Infof("ZooKeeper Watcher %q initialized at %s", name, endpoint)
+		return watcher, nil
+	case registryConfig.Eureka != nil:
+		pollInterval := time.Duration(registryConfig.Eureka.PollInterval)
+		watcher, err := eureka.NewWatcher(cache, name, endpoint, pollInterval, prefix, registryConfig.HostTemplate,
+			registryConfig.Filter, toNamespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error setting up eureka %q", name)
+		}
+		log.Infof("Eureka Watcher %q initialized at %s", name, endpoint)
+		return watcher, nil
+	case registryConfig.Nacos != nil && registryConfig.Nacos.Mode == common.NacosOpenAPIMode:
+		n := registryConfig.Nacos
+		namingConfig := nacos.NamingConfig{
+			Endpoint:     endpoint,
+			Namespaces:   n.NacosNamespace,
+			Groups:       n.Groups,
+			Clusters:     n.Clusters,
+			Username:     n.Username,
+			Password:     n.Password,
+			PollInterval: time.Duration(n.PollInterval),
+			HostTemplate: registryConfig.HostTemplate,
+			Filter:       registryConfig.Filter,
+		}
+		watcher, err := nacos.NewNamingWatcher(cache, name, namingConfig, prefix, toNamespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error setting up nacos %q", name)
+		}
+		log.Infof("nacos Open API Watcher %q initialized at %s", name, endpoint)
+		return watcher, nil
+	case registryConfig.Nacos != nil:
+		store := memory.Make(collections.Pilot)
+		configController := memory.NewController(store)
+		log.Info("create configController success")
+		watcher, err := nacos.NewWatcher(name, endpoint, &nacos.Config{Recorder: s.recorder, Queue: s.writes, FieldManager: s.fieldManager}, s.cfg, "", prefix, toNamespace, configController,
+			s.claims, s.elector, s.owner)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error setting up nacos %q", name)
+		}
+		log.Infof("nacos Watcher %q initialized at %s", name, endpoint)
+		return watcher, nil
+	}
+	return nil, errors.Errorf("the service registry type is not supported: %s", registryConfig.Type)
+}
@@ -6,13 +6,16 @@ require (
 	github.com/aliyun/alibaba-cloud-sdk-go v1.61.870
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/envoyproxy/go-control-plane v0.9.9-0.20210115003313-31f9241a16e6
+	github.com/go-zookeeper/zk v1.0.2
 	github.com/gogo/protobuf v1.3.2
 	github.com/golang/protobuf v1.4.3
-	github.com/hashicorp/consul/api v1.6.0
+	github.com/hashicorp/consul/api v1.12.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.9.0
 	github.com/sirupsen/logrus v1.7.0
-	github.com/spf13/cast v1.3.1
 	github.com/spf13/cobra v1.1.1
+	github.com/spf13/pflag v1.0.5
+	google.golang.org/genproto v0.0.0-20210126160654-44e461bb6506
 	google.golang.org/grpc v1.35.0
 	istio.io/api v0.0.0-20210219010445-724943e9da20
 	istio.io/client-go v0.0.0-20200908160912-f99162621a1a
@@ -21,6 +24,7 @@ require (
 	k8s.io/apimachinery v0.20.2
 	k8s.io/client-go v0.20.1
 	sigs.k8s.io/controller-runtime v0.7.0
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace github.com/hashicorp/consul => github.com/hashicorp/consul v1.6.0
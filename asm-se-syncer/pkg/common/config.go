@@ -1,17 +1,18 @@
 package common
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
 	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
 	"github.com/aliyun/alibaba-cloud-sdk-go/services/servicemesh"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/cast"
 	"io/ioutil"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"os"
 	"strconv"
+	"time"
 )
 
 const (
@@ -46,38 +47,65 @@ func GetRegistryConfig() ([]byte, error) {
 	return loadFileContent(RegistryConfigPath)
 }
 
-func GetServiceRegistryConfig() ([]map[string]interface{}, error) {
+func GetServiceRegistryConfig() ([]RegistryConfig, error) {
 	serviceRegistryConfigBytes, err := GetRegistryConfig()
 	if err != nil {
 		return nil, err
 	}
-	var serviceRegistryConfig []map[string]interface{}
-	err = json.Unmarshal(serviceRegistryConfigBytes, &serviceRegistryConfig)
+	configs, err := ParseRegistryConfig(serviceRegistryConfigBytes)
 	if err != nil {
-		log.Infof("error Unmarshal config file %q\n", RegistryConfigPath)
-		return nil, errors.Wrapf(err, "error Unmarshal config file %q\n", RegistryConfigPath)
-	}
-	if serviceRegistryConfig == nil || len(serviceRegistryConfig) == 0 {
-		log.Infof("error no service registry info within config file %q\n", RegistryConfigPath)
-		return nil, errors.Wrapf(err, "error no service registry info within config file %q\n", RegistryConfigPath)
+		return nil, errors.Wrapf(err, "invalid config file %q", RegistryConfigPath)
 	}
+	return configs, nil
+}
 
-	var serviceRegistryInfoList []map[string]interface{}
-	for _, serviceRegistryInfo := range serviceRegistryConfig {
-		serviceRegistryType := cast.ToString(serviceRegistryInfo["type"])
-		if serviceRegistryType == string(Consul) || serviceRegistryType == string(Nacos) {
-			serviceRegistryInfoList = append(serviceRegistryInfoList, serviceRegistryInfo)
+// WatchRegistryConfig checks the registry config file for changes every interval until the context is cancelled.
+// The file is polled rather than watched, since mounted ConfigMaps and Secrets are updated by swapping symlinks.
+// Invalid configs are logged and skipped, onChange is only called with valid configs.
+func WatchRegistryConfig(ctx context.Context, interval time.Duration, onChange func([]RegistryConfig)) {
+	last, _ := GetRegistryConfig()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
 		}
+		data, err := GetRegistryConfig()
+		if err != nil || bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+		log.Infof("config file %q changed", RegistryConfigPath)
+		configs, err := ParseRegistryConfig(data)
+		if err != nil {
+			log.Errorf("ignoring invalid config file %q: %v", RegistryConfigPath, err)
+			continue
+		}
+		onChange(configs)
 	}
-
-	if len(serviceRegistryConfig) > 0 {
-		return serviceRegistryInfoList, nil
-	}
-	return nil, errors.New("no available service registry config")
 }
 
 func GetASMRestConfig(meshId, regionId, accessKeyId, accessKeySecret string) (*restclient.Config, error) {
-	kubeconfigString, err := getASMKubeConfig(meshId, regionId, accessKeyId, accessKeySecret)
+	return getASMRestConfig(meshId, func() (*servicemesh.Client, error) {
+		return servicemesh.NewClientWithAccessKey(regionId, accessKeyId, accessKeySecret)
+	})
+}
+
+// GetASMRestConfigWithRAMRole gets the kubeconfig of the ASM instance with the RAM role of the ECS instance
+func GetASMRestConfigWithRAMRole(meshId, regionId string) (*restclient.Config, error) {
+	return getASMRestConfig(meshId, func() (*servicemesh.Client, error) {
+		token, err := ramRole.Get()
+		if err != nil {
+			return nil, err
+		}
+		return servicemesh.NewClientWithStsToken(regionId, token.AccessKeyId, token.AccessKeySecret, token.SecurityToken)
+	})
+}
+
+func getASMRestConfig(meshId string, newClient func() (*servicemesh.Client, error)) (*restclient.Config, error) {
+	kubeconfigString, err := getASMKubeConfig(meshId, newClient)
 	if err != nil {
 		return nil, errors.Wrapf(err, "getASMKubeConfig failed to get the kubeconfig of asm %s", meshId)
 	}
@@ -93,8 +121,8 @@ func GetASMRestConfig(meshId, regionId, accessKeyId, accessKeySecret string) (*r
 	return cfg, nil
 }
 
-func getASMKubeConfig(meshId, regionId, accessKeyId, accessKeySecret string) (string, error) {
-	client, err := servicemesh.NewClientWithAccessKey(regionId, accessKeyId, accessKeySecret)
+func getASMKubeConfig(meshId string, newClient func() (*servicemesh.Client, error)) (string, error) {
+	client, err := newClient()
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Credentials modes select how the syncer connects to the cluster it publishes ServiceEntries into
+const (
+	// CredentialsInCluster uses the service account of the pod
+	CredentialsInCluster = "inCluster"
+	// CredentialsKubeconfig uses a kubeconfig file, e.g. for self-managed Istio or local kind clusters
+	CredentialsKubeconfig = "kubeconfig"
+	// CredentialsASM gets the kubeconfig of the ASM instance from the ASM OpenAPI, authenticating with the
+	// AccessKey files if they exist and with the RAM role of the ECS instance otherwise
+	CredentialsASM = "asm"
+)
+
+var ramRole = newRAMRoleCredentials()
+
+// RestConfigOptions are the settings of the credentials modes
+type RestConfigOptions struct {
+	// Mode is one of the credentials modes, it is inferred from the other settings if empty:
+	// kubeconfig if Kubeconfig is set, asm if MeshID is set, in-cluster otherwise
+	Mode string
+	// Kubeconfig is the kubeconfig file, Context the context within it, the current context if empty
+	Kubeconfig string
+	Context    string
+	// MeshID and RegionID identify the ASM instance
+	MeshID   string
+	RegionID string
+}
+
+// CredentialsMode returns the credentials mode selected by opts
+func (opts RestConfigOptions) CredentialsMode() string {
+	switch {
+	case opts.Mode != "":
+		return opts.Mode
+	case opts.Kubeconfig != "":
+		return CredentialsKubeconfig
+	case opts.MeshID != "":
+		return CredentialsASM
+	default:
+		return CredentialsInCluster
+	}
+}
+
+// GetRestConfig returns the config of the cluster ServiceEntries are published into
+func GetRestConfig(opts RestConfigOptions) (*restclient.Config, error) {
+	mode := opts.CredentialsMode()
+	log.Infof("using %s credentials", mode)
+	switch mode {
+	case CredentialsInCluster:
+		cfg, err := restclient.InClusterConfig()
+		return cfg, errors.Wrap(err, "failed to get the in-cluster config")
+	case CredentialsKubeconfig:
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = opts.Kubeconfig
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: opts.Context}
+		cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+		return cfg, errors.Wrapf(err, "failed to load kubeconfig %q, context %q", opts.Kubeconfig, opts.Context)
+	case CredentialsASM:
+		if opts.MeshID == "" {
+			return nil, errors.New("meshId is required")
+		}
+		if _, err := os.Stat(AccessKeyIDPath); err != nil {
+			log.Infof("no AccessKey found at %s, using the RAM role of the ECS instance", AccessKeyIDPath)
+			return GetASMRestConfigWithRAMRole(opts.MeshID, opts.RegionID)
+		}
+		akId, err := GetAccessKeyID()
+		if err != nil {
+			return nil, err
+		}
+		akSecret, err := GetAccessKeySecret()
+		if err != nil {
+			return nil, err
+		}
+		return GetASMRestConfig(opts.MeshID, opts.RegionID, string(akId), string(akSecret))
+	default:
+		return nil, errors.Errorf("unknown credentials mode %q, must be one of %s, %s or %s",
+			mode, CredentialsInCluster, CredentialsKubeconfig, CredentialsASM)
+	}
+}
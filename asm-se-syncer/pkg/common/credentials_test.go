@@ -0,0 +1,110 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+- name: staging
+  cluster:
+    server: https://staging.example.com:6443
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: kind-kind
+  context: {cluster: kind, user: admin}
+- name: staging
+  context: {cluster: staging, user: admin}
+current-context: kind-kind
+`
+
+func TestCredentialsMode(t *testing.T) {
+	tests := []struct {
+		opts RestConfigOptions
+		want string
+	}{
+		{opts: RestConfigOptions{}, want: CredentialsInCluster},
+		{opts: RestConfigOptions{MeshID: "c123"}, want: CredentialsASM},
+		{opts: RestConfigOptions{MeshID: "c123", Kubeconfig: "/root/.kube/config"}, want: CredentialsKubeconfig},
+		{opts: RestConfigOptions{Mode: CredentialsInCluster, Kubeconfig: "/root/.kube/config"}, want: CredentialsInCluster},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.CredentialsMode(); got != tt.want {
+			t.Errorf("CredentialsMode() of %+v = %s, want %s", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestGetRestConfigFromKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := GetRestConfig(RestConfigOptions{Kubeconfig: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "https://127.0.0.1:6443" || cfg.BearerToken != "secret" {
+		t.Errorf("the current context must be used but got host %s", cfg.Host)
+	}
+
+	cfg, err = GetRestConfig(RestConfigOptions{Kubeconfig: path, Context: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "https://staging.example.com:6443" {
+		t.Errorf("the staging context must be used but got host %s", cfg.Host)
+	}
+
+	if _, err := GetRestConfig(RestConfigOptions{Kubeconfig: path, Context: "missing"}); err == nil {
+		t.Error("an unknown context must be an error")
+	}
+	if _, err := GetRestConfig(RestConfigOptions{Mode: CredentialsASM}); err == nil {
+		t.Error("the asm mode must require the mesh id")
+	}
+}
+
+func TestRAMRoleCredentialsRefresh(t *testing.T) {
+	now := time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC)
+	fetched := 0
+	c := &ramRoleCredentials{
+		now: func() time.Time { return now },
+		fetch: func() (*SecurityTokenResult, error) {
+			fetched++
+			return &SecurityTokenResult{AccessKeyId: "STS.id", Expiration: "2021-03-01T09:00:00Z", Code: "Success"}, nil
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("the token must be cached until it is about to expire but was fetched %d times", fetched)
+	}
+
+	now = now.Add(55 * time.Minute)
+	if _, err := c.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if fetched != 2 {
+		t.Errorf("the token must be refreshed before it expires but was fetched %d times", fetched)
+	}
+}
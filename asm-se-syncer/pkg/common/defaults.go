@@ -8,16 +8,37 @@ const (
 
 	IsSameVpc      = "IS_SAME_VPC"
 	AsmSyncerLabel = "ASM_Syncer"
+	// AsmSyncerRegistryLabel carries the name of the registry that published a ServiceEntry,
+	// so that several registries of the same type can be synced side by side.
+	AsmSyncerRegistryLabel = "ASM_Syncer_Registry"
+	// AsmSyncerServiceLabel is set on the WorkloadEntries of a service, its ServiceEntry selects them by it
+	AsmSyncerServiceLabel = "ASM_Syncer_Service"
+	// AsmSyncerOwnerAnnotation carries the type and name of the registry that published a resource, e.g. consul/consul-prod.
+	// Resources without it, or with the one of another registry, are never updated or deleted by the registry.
+	AsmSyncerOwnerAnnotation = "asm-syncer.istio.alibabacloud.com/owner"
 )
 
 type ServiceRegistryType string
 
 const (
-	Consul ServiceRegistryType = "consul"
-	Nacos  ServiceRegistryType = "nacos"
+	Consul    ServiceRegistryType = "consul"
+	Nacos     ServiceRegistryType = "nacos"
+	Zookeeper ServiceRegistryType = "zookeeper"
+	Eureka    ServiceRegistryType = "eureka"
 )
 
 func FormatedName(hostName string) string {
 	cleanHostName := strings.Replace(hostName, "_", "-", -1)
 	return cleanHostName
 }
+
+// OwnerLabels returns the labels stamped on every ServiceEntry published for the given registry.
+func OwnerLabels(registryType, registryName string) map[string]string {
+	labels := map[string]string{
+		AsmSyncerLabel: registryType,
+	}
+	if registryName != "" {
+		labels[AsmSyncerRegistryLabel] = registryName
+	}
+	return labels
+}
@@ -7,13 +7,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	aliyunECSMetaBaseURL = "http://100.100.100.200/latest/meta-data/"
 	aliyunECSMetaRamURL  = aliyunECSMetaBaseURL + "ram/security-credentials/"
-	expirationTimeFormat = "2006-01-01T01:01:01Z"
+	expirationTimeFormat = "2006-01-02T15:04:05Z"
+	// the security token is refreshed this long before it expires
+	securityTokenRefreshMargin = 10 * time.Minute
 )
 
 type SecurityTokenResult struct {
@@ -100,3 +103,39 @@ func getSecurityTokenResult() (*SecurityTokenResult, error) {
 	}
 	return nil, errors.New("failed to get security token")
 }
+
+// ramRoleCredentials caches the security token of the RAM role of the ECS instance,
+// a new token is fetched from the ECS metadata service before the cached one expires.
+type ramRoleCredentials struct {
+	m          sync.Mutex
+	token      *SecurityTokenResult
+	expiration time.Time
+	fetch      func() (*SecurityTokenResult, error)
+	now        func() time.Time
+}
+
+func newRAMRoleCredentials() *ramRoleCredentials {
+	return &ramRoleCredentials{fetch: getSecurityTokenResult, now: time.Now}
+}
+
+// Get returns a security token which is valid for at least securityTokenRefreshMargin
+func (c *ramRoleCredentials) Get() (*SecurityTokenResult, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.token != nil && c.now().Add(securityTokenRefreshMargin).Before(c.expiration) {
+		return c.token, nil
+	}
+	token, err := c.fetch()
+	if err != nil {
+		return nil, err
+	}
+	expiration, err := time.Parse(expirationTimeFormat, token.Expiration)
+	if err != nil {
+		// use the token this once, a new one is fetched next time
+		log.Errorf("failed to parse the expiration %q of the security token: %v", token.Expiration, err)
+		expiration = time.Time{}
+	}
+	log.Infof("got the security token of the ECS RAM role, expiring at %s", token.Expiration)
+	c.token, c.expiration = token, expiration
+	return token, nil
+}
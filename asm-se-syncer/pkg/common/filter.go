@@ -0,0 +1,183 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// IncludeRule is the rule reported for the services a FilterConfig drops for matching none of its Include rules
+const IncludeRule = "include"
+
+type (
+	// FilterConfig selects the services of a registry which are synced: a service is synced if it matches one of
+	// the Include rules, or there is none, and none of the Exclude rules
+	FilterConfig struct {
+		Include []ServiceMatch `json:"include"`
+		Exclude []ServiceMatch `json:"exclude"`
+	}
+
+	// ServiceMatch matches the services meeting all of its criteria, the criteria which aren't set match every
+	// service. Tags, Metadata and Clusters are met if one of the instances of a service meets them all.
+	ServiceMatch struct {
+		// Name is a glob matching the service name, as named by the registry rather than by the host template
+		Name string `json:"name"`
+		// NameRegex is a regular expression the whole service name must match
+		NameRegex *Regexp `json:"nameRegex"`
+		// Tags must all be carried by the instance (Consul)
+		Tags StringList `json:"tags"`
+		// Metadata must all be carried by the instance, the Consul service meta, the Nacos and Eureka instance
+		// metadata or the parameters of the Dubbo provider URL
+		Metadata map[string]string `json:"metadata"`
+		// Groups are the Nacos groups one of which the service must be in
+		Groups StringList `json:"groups"`
+		// Clusters are the Nacos clusters one of which the instance must be in
+		Clusters StringList `json:"clusters"`
+	}
+
+	// ServiceInfo is what the filters are evaluated against, the fields a registry doesn't know are empty
+	ServiceInfo struct {
+		Name      string
+		Group     string
+		Instances []InstanceInfo
+	}
+
+	// InstanceInfo describes an instance of a service for the filters
+	InstanceInfo struct {
+		Tags     []string
+		Metadata map[string]string
+		Cluster  string
+	}
+
+	// Regexp is a regular expression given as a string, which must match whole strings
+	Regexp struct {
+		text   string
+		regexp *regexp.Regexp
+	}
+)
+
+// Drop returns the rule dropping svc, IncludeRule or exclude[<index>], or "" if svc is synced. A nil config
+// drops nothing.
+func (c *FilterConfig) Drop(svc ServiceInfo) string {
+	if c == nil {
+		return ""
+	}
+	if len(c.Include) > 0 {
+		included := false
+		for _, match := range c.Include {
+			if match.Matches(svc) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return IncludeRule
+		}
+	}
+	for i, match := range c.Exclude {
+		if match.Matches(svc) {
+			return ExcludeRule(i)
+		}
+	}
+	return ""
+}
+
+// Rules returns the rules which can drop services, to report them even when they drop none
+func (c *FilterConfig) Rules() []string {
+	if c == nil {
+		return nil
+	}
+	var rules []string
+	if len(c.Include) > 0 {
+		rules = append(rules, IncludeRule)
+	}
+	for i := range c.Exclude {
+		rules = append(rules, ExcludeRule(i))
+	}
+	return rules
+}
+
+// ExcludeRule names the Exclude rule at index i
+func ExcludeRule(i int) string {
+	return fmt.Sprintf("exclude[%d]", i)
+}
+
+// Matches reports whether svc meets all criteria of m
+func (m ServiceMatch) Matches(svc ServiceInfo) bool {
+	// the globs are validated with the config
+	if matched, _ := path.Match(m.Name, svc.Name); m.Name != "" && !matched {
+		return false
+	}
+	if m.NameRegex != nil && !m.NameRegex.MatchString(svc.Name) {
+		return false
+	}
+	if len(m.Groups) > 0 && !contains(m.Groups, svc.Group) {
+		return false
+	}
+	if len(m.Tags) == 0 && len(m.Metadata) == 0 && len(m.Clusters) == 0 {
+		return true
+	}
+	for _, instance := range svc.Instances {
+		if m.matchesInstance(instance) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m ServiceMatch) matchesInstance(instance InstanceInfo) bool {
+	for _, tag := range m.Tags {
+		if !contains(instance.Tags, tag) {
+			return false
+		}
+	}
+	for key, value := range m.Metadata {
+		if v, ok := instance.Metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+	return len(m.Clusters) == 0 || contains(m.Clusters, instance.Cluster)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRegexp parses a regular expression matching whole strings
+func ParseRegexp(text string) (*Regexp, error) {
+	re, err := regexp.Compile("^(?:" + text + ")$")
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid regular expression %q", text)
+	}
+	return &Regexp{text: text, regexp: re}, nil
+}
+
+// MatchString reports whether s matches the whole regular expression
+func (r *Regexp) MatchString(s string) bool {
+	return r.regexp.MatchString(s)
+}
+
+func (r *Regexp) String() string {
+	return r.text
+}
+
+func (r *Regexp) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Errorf("must be a regular expression string, got %s", data)
+	}
+	parsed, err := ParseRegexp(s)
+	if err != nil {
+		return err
+	}
+	*r = *parsed
+	return nil
+}
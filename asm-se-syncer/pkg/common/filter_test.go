@@ -0,0 +1,67 @@
+package common
+
+import "testing"
+
+func TestFilterConfig(t *testing.T) {
+	filter := &FilterConfig{
+		Include: []ServiceMatch{{NameRegex: mustParseRegexp(t, "(orders|payments)(-v[0-9]+)?")}, {Groups: StringList{"mesh"}}},
+		Exclude: []ServiceMatch{
+			{Name: "*-v1"},
+			{Tags: StringList{"internal", "mesh"}},
+			{Metadata: map[string]string{"env": "test"}, Clusters: StringList{"canary"}},
+		},
+	}
+	tests := []struct {
+		name string
+		svc  ServiceInfo
+		want string
+	}{
+		{name: "included by name", svc: ServiceInfo{Name: "orders"}},
+		{name: "included by group", svc: ServiceInfo{Name: "reviews", Group: "mesh"}},
+		{name: "the whole name must match", svc: ServiceInfo{Name: "orders-db"}, want: IncludeRule},
+		{name: "excluded by name", svc: ServiceInfo{Name: "payments-v1"}, want: "exclude[0]"},
+		{
+			name: "excluded by tags",
+			svc:  ServiceInfo{Name: "orders", Instances: []InstanceInfo{{Tags: []string{"mesh"}}, {Tags: []string{"mesh", "internal"}}}},
+			want: "exclude[1]",
+		},
+		{
+			name: "tags of different instances",
+			svc:  ServiceInfo{Name: "orders", Instances: []InstanceInfo{{Tags: []string{"mesh"}}, {Tags: []string{"internal"}}}},
+		},
+		{
+			name: "excluded by metadata and cluster",
+			svc: ServiceInfo{Name: "payments", Instances: []InstanceInfo{
+				{Metadata: map[string]string{"env": "test"}, Cluster: "canary"},
+			}},
+			want: "exclude[2]",
+		},
+		{
+			name: "metadata in another cluster",
+			svc: ServiceInfo{Name: "payments", Instances: []InstanceInfo{
+				{Metadata: map[string]string{"env": "test"}, Cluster: "DEFAULT"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filter.Drop(tt.svc); got != tt.want {
+				t.Errorf("Drop() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	var none *FilterConfig
+	if got := none.Drop(ServiceInfo{Name: "consul"}); got != "" {
+		t.Errorf("a nil filter must drop nothing, got %q", got)
+	}
+}
+
+func mustParseRegexp(t *testing.T, text string) *Regexp {
+	t.Helper()
+	re, err := ParseRegexp(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return re
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultHostTemplate names the services of a registry after the registry prefix and the service name
+const DefaultHostTemplate = "{{.Prefix}}{{.Service}}"
+
+type (
+	// HostData is what a host template refers to, the fields a registry doesn't know are empty
+	HostData struct {
+		// Registry is the name of the registry
+		Registry string
+		// Prefix is the prefix configured for the registry
+		Prefix string
+		// Service is the service name, the application name in Eureka and the interface in ZooKeeper
+		Service string
+		// Namespace is the Consul or Nacos namespace of the service
+		Namespace string
+		// Group is the Nacos group of the service
+		Group string
+		// Datacenter is the Consul datacenter of the service, empty for the datacenter of the agent
+		Datacenter string
+	}
+
+	// HostTemplate renders the host a service is published under, e.g. {{.Service}}.{{.Datacenter}}.consul.
+	// It is given as a text/template string.
+	HostTemplate struct {
+		text     string
+		template *template.Template
+	}
+)
+
+// ParseHostTemplate parses a host template, it fails if the template can't be rendered
+func ParseHostTemplate(text string) (*HostTemplate, error) {
+	tmpl, err := template.New("host").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid host template %q", text)
+	}
+	t := &HostTemplate{text: text, template: tmpl}
+	// fields which don't exist are only reported when rendering
+	if _, err := t.render(HostData{Service: "service"}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// MustParseHostTemplate parses a host template known to be valid
+func MustParseHostTemplate(text string) *HostTemplate {
+	t, err := ParseHostTemplate(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Host renders the host of a service, sanitised by SanitizeHost
+func (t *HostTemplate) Host(data HostData) (string, error) {
+	host, err := t.render(data)
+	if err != nil {
+		return "", err
+	}
+	return SanitizeHost(host)
+}
+
+func (t *HostTemplate) render(data HostData) (string, error) {
+	var out bytes.Buffer
+	if err := t.template.Execute(&out, data); err != nil {
+		return "", errors.Wrapf(err, "failed to render host template %q", t.text)
+	}
+	return out.String(), nil
+}
+
+func (t *HostTemplate) String() string {
+	return t.text
+}
+
+func (t *HostTemplate) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Errorf("must be a template string such as \"{{.Service}}.consul\", got %s", data)
+	}
+	parsed, err := ParseHostTemplate(s)
+	if err != nil {
+		return err
+	}
+	*t = *parsed
+	return nil
+}
+
+// SanitizeHost turns a host into an RFC 1123 DNS subdomain, which it must be to name a ServiceEntry: it is lower
+// cased, the characters which aren't allowed are replaced with '-' and empty labels are dropped. Labels longer than
+// 63 characters are shortened and suffixed with a hash of the label, so that they stay unique.
+// Hosts which are already valid are returned as they are.
+func SanitizeHost(host string) (string, error) {
+	sanitised := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(host))
+
+	var labels []string
+	for _, label := range strings.Split(sanitised, ".") {
+		label = strings.Trim(label, "-")
+		if len(label) > validation.DNS1123LabelMaxLength {
+			sum := sha256.Sum256([]byte(label))
+			suffix := hex.EncodeToString(sum[:])[:8]
+			label = strings.TrimRight(label[:validation.DNS1123LabelMaxLength-len(suffix)-1], "-") + "-" + suffix
+		}
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	sanitised = strings.Join(labels, ".")
+	if errs := validation.IsDNS1123Subdomain(sanitised); len(errs) > 0 {
+		return "", errors.Errorf("host %q can't be made a valid DNS name: %s", host, strings.Join(errs, ", "))
+	}
+	return sanitised, nil
+}
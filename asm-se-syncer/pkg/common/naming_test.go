@@ -0,0 +1,59 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHost(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	tests := []struct {
+		host, want string
+	}{
+		{host: "web.service.consul", want: "web.service.consul"},
+		{host: "payments.v2", want: "payments.v2"},
+		{host: "Payments_V2", want: "payments-v2"},
+		{host: "orders@DEFAULT_GROUP..public", want: "orders-default-group.public"},
+		{host: "-web-.", want: "web"},
+		{host: long + ".consul", want: long[:54] + "-6bd5e503.consul"},
+		{host: "___"},
+		{host: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, err := SanitizeHost(tt.host)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("SanitizeHost() = %q, an error must be returned", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("SanitizeHost() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostTemplate(t *testing.T) {
+	tmpl, err := ParseHostTemplate("{{.Service}}.{{.Datacenter}}.consul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host, err := tmpl.Host(HostData{Service: "Reviews", Datacenter: "dc1"}); err != nil || host != "reviews.dc1.consul" {
+		t.Errorf("Host() = %q, %v, want reviews.dc1.consul", host, err)
+	}
+	// the datacenter of the agent is empty
+	if host, err := tmpl.Host(HostData{Service: "reviews"}); err != nil || host != "reviews.consul" {
+		t.Errorf("Host() = %q, %v, want reviews.consul", host, err)
+	}
+
+	for _, text := range []string{"{{.Service", "{{.Cluster}}.consul"} {
+		if _, err := ParseHostTemplate(text); err == nil {
+			t.Errorf("template %q must be rejected", text)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// NacosOpenAPIMode selects the Nacos watcher polling the naming Open API instead of subscribing over MCP
+const NacosOpenAPIMode = "openapi"
+
+const (
+	// DefaultGracePeriod is how long a host must be gone from its registry before its ServiceEntry is deleted
+	DefaultGracePeriod = 5 * time.Minute
+	// DefaultMaxDeletionPercent is the share of the ServiceEntries of a registry a single pass may delete
+	DefaultMaxDeletionPercent = 50
+)
+
+const (
+	// EndpointModeInline publishes the instances of a service as the endpoints of its ServiceEntry
+	EndpointModeInline = "inline"
+	// EndpointModeWorkloadEntry publishes every instance as a WorkloadEntry selected by the ServiceEntry
+	EndpointModeWorkloadEntry = "workloadEntry"
+)
+
+// Protocols are the port protocols which can be declared for the services of a registry. DUBBO is published as
+// TCP, with a port name telling Dubbo aware proxies about it.
+var Protocols = []string{"HTTP", "HTTPS", "HTTP2", "GRPC", "GRPC-WEB", "TLS", "TCP", "MONGO", "MYSQL", "REDIS", "DUBBO"}
+
+// IsProtocol reports whether protocol, in any case, is one of Protocols
+func IsProtocol(protocol string) bool {
+	for _, p := range Protocols {
+		if strings.EqualFold(p, protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+type (
+	// RegistryConfig is an entry of the registry config file. The fields common to all registries are
+	// decoded into RegistryConfig itself, the fields of its type into exactly one of the typed configs.
+	RegistryConfig struct {
+		// Name identifies the registry, it defaults to <type>-<hash of the endpoint> so that it doesn't change when
+		// the registries are reordered. It owns the resources published for the registry, see the serviceentry package.
+		Name        string              `json:"name"`
+		Type        ServiceRegistryType `json:"type"`
+		Endpoint    string              `json:"endpoint"`
+		Prefix      string              `json:"prefix"`
+		ToNamespace string              `json:"toNamespace"`
+		// EndpointMode is EndpointModeInline, the default, or EndpointModeWorkloadEntry
+		EndpointMode string `json:"endpointMode"`
+		// Ports declare the protocol, name and target port of service ports, the first matching rule applies.
+		// They take precedence over the protocol found in the registry metadata.
+		Ports []PortRule `json:"ports"`
+		// DestinationRule, if set, generates a DestinationRule for every ServiceEntry
+		DestinationRule *DestinationRuleConfig `json:"destinationRule"`
+		// HostTemplate names the hosts the services are published under, by default the prefix followed by the
+		// service name. The hosts are sanitised into valid DNS names, see SanitizeHost.
+		HostTemplate *HostTemplate `json:"hostTemplate"`
+		// Namespaces place services into other namespaces than ToNamespace, the first matching rule applies
+		Namespaces []NamespaceRule `json:"namespaces"`
+		// ExportTo is the exportTo of the ServiceEntries, they are exported to all namespaces if empty
+		ExportTo StringList `json:"exportTo"`
+		// Filter selects the services which are synced, all services if nil
+		Filter *FilterConfig `json:"filter"`
+		// GarbageCollection guards the deletion of the ServiceEntries of hosts gone from the registry, it defaults
+		// to DefaultGracePeriod and DefaultMaxDeletionPercent. Null deletes them at once, without any limit.
+		GarbageCollection *GarbageCollectionConfig `json:"garbageCollection"`
+
+		Consul    *ConsulConfig    `json:"-"`
+		Nacos     *NacosConfig     `json:"-"`
+		Zookeeper *ZookeeperConfig `json:"-"`
+		Eureka    *EurekaConfig    `json:"-"`
+	}
+
+	// PortRule declares how a port of the services of a registry is published
+	PortRule struct {
+		// Service is a glob matching the hosts of the services, all services if empty
+		Service string `json:"service"`
+		// Port is the port number registered by the instances
+		Port uint32 `json:"port"`
+		// Protocol is one of Protocols, the protocol inferred from the port number is kept if empty
+		Protocol string `json:"protocol"`
+		// Name is the port name, it defaults to the protocol followed by the port number
+		Name string `json:"name"`
+		// TargetPort is the port the instances listen on, if it differs from Port
+		TargetPort uint32 `json:"targetPort"`
+	}
+
+	// NamespaceRule places the services matching it into a namespace
+	NamespaceRule struct {
+		// Namespace the matching services are published into
+		Namespace string `json:"namespace"`
+		// Service is a glob matching the hosts of the services, all services if empty
+		Service string `json:"service"`
+		// Labels must all be carried by one of the endpoints of a service for it to match, e.g. the metadata
+		// copied from the registry or the key=value Consul tags
+		Labels map[string]string `json:"labels"`
+		// ExportTo, if set, replaces the exportTo of the registry for the matching services
+		ExportTo StringList `json:"exportTo"`
+	}
+
+	// DestinationRuleConfig configures the DestinationRules generated for the ServiceEntries of a registry
+	DestinationRuleConfig struct {
+		// SubsetKeys are the endpoint labels the subsets are derived from, there is a subset for every combination
+		// of their values found
+		SubsetKeys StringList `json:"subsetKeys"`
+		// TrafficPolicy, e.g. connection pool and outlier detection defaults, is set on every DestinationRule
+		TrafficPolicy *v1alpha3.TrafficPolicy `json:"trafficPolicy"`
+	}
+
+	// GarbageCollectionConfig guards the deletion of the ServiceEntries of hosts gone from a registry, so that a
+	// registry briefly returning an empty catalog doesn't remove the services from the mesh
+	GarbageCollectionConfig struct {
+		// GracePeriod is how long a host must be gone before its ServiceEntry is deleted
+		GracePeriod Duration `json:"gracePeriod"`
+		// MaxDeletionPercent is the share of the ServiceEntries of the registry a single pass may delete, a pass
+		// deleting more is refused until the hosts are back or the deletion is confirmed. 100 disables the guard.
+		MaxDeletionPercent int `json:"maxDeletionPercent"`
+		// ConfirmMassDeletion confirms a refused deletion with the token logged when it was refused. The token
+		// names the hosts of that deletion only, any other mass deletion is refused again.
+		ConfirmMassDeletion string `json:"confirmMassDeletion"`
+	}
+
+	ConsulConfig struct {
+		ConsulNamespace string     `json:"consulNamespace"`
+		IncludeWarning  bool       `json:"includeWarning"`
+		Tags            StringList `json:"tags"`
+		LabelKeys       StringList `json:"labelKeys"`
+		LocalityKey     string     `json:"localityKey"`
+		Token           string     `json:"token"`
+		TokenFile       string     `json:"tokenFile"`
+		CAFile          string     `json:"caFile"`
+		CertFile        string     `json:"certFile"`
+		KeyFile         string     `json:"keyFile"`
+		Datacenter      StringList `json:"datacenter"`
+		Partition       string     `json:"partition"`
+	}
+
+	NacosConfig struct {
+		// Mode is NacosOpenAPIMode, or empty for MCP
+		Mode           string     `json:"mode"`
+		NacosNamespace StringList `json:"nacosNamespace"`
+		Groups         StringList `json:"groups"`
+		Clusters       StringList `json:"clusters"`
+		Username       string     `json:"username"`
+		Password       string     `json:"password"`
+		PollInterval   Duration   `json:"pollInterval"`
+	}
+
+	ZookeeperConfig struct {
+		RootPath string `json:"rootPath"`
+	}
+
+	EurekaConfig struct {
+		PollInterval Duration `json:"pollInterval"`
+	}
+
+	// StringList is given either as a list or as a comma separated string
+	StringList []string
+
+	// Duration is given as a string such as "30s"
+	Duration time.Duration
+)
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = nil
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*l = append(*l, item)
+			}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.Errorf("must be a list of strings or a comma separated string, got %s", data)
+	}
+	*l = list
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Errorf("must be a duration such as \"30s\", got %s", data)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrapf(err, "invalid duration %q", s)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (c *RegistryConfig) UnmarshalJSON(data []byte) error {
+	var head struct {
+		Type ServiceRegistryType `json:"type"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return err
+	}
+	// plain has no UnmarshalJSON, the typed config is decoded alongside so that unknown fields are rejected
+	type plain RegistryConfig
+	*c = RegistryConfig{
+		// the fields which are given are decoded into the defaults
+		GarbageCollection: &GarbageCollectionConfig{
+			GracePeriod:        Duration(DefaultGracePeriod),
+			MaxDeletionPercent: DefaultMaxDeletionPercent,
+		},
+	}
+	switch head.Type {
+	case Consul:
+		c.Consul = &ConsulConfig{}
+		return decodeStrict(data, &struct {
+			*plain
+			*ConsulConfig
+		}{(*plain)(c), c.Consul})
+	case Nacos:
+		c.Nacos = &NacosConfig{}
+		return decodeStrict(data, &struct {
+			*plain
+			*NacosConfig
+		}{(*plain)(c), c.Nacos})
+	case Zookeeper:
+		c.Zookeeper = &ZookeeperConfig{}
+		return decodeStrict(data, &struct {
+			*plain
+			*ZookeeperConfig
+		}{(*plain)(c), c.Zookeeper})
+	case Eureka:
+		c.Eureka = &EurekaConfig{}
+		return decodeStrict(data, &struct {
+			*plain
+			*EurekaConfig
+		}{(*plain)(c), c.Eureka})
+	case "":
+		return errors.New("type is required")
+	default:
+		return errors.Errorf("the service registry type is not supported: %s", head.Type)
+	}
+}
+
+func decodeStrict(data []byte, out interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+// Validate reports the settings which are missing or inconsistent
+func (c *RegistryConfig) Validate() error {
+	var errs []error
+	// the name is stamped as the ASM_Syncer_Registry label and used in label selectors
+	if msgs := validation.IsValidLabelValue(c.Name); len(msgs) > 0 {
+		errs = append(errs, errors.Errorf("name %q isn't a valid label value: %s", c.Name, strings.Join(msgs, ", ")))
+	}
+	if c.Endpoint == "" {
+		errs = append(errs, errors.New("endpoint is required"))
+	}
+	if c.DestinationRule != nil && !c.Synchronized() {
+		errs = append(errs, errors.New("destinationRule isn't supported by nacos over MCP"))
+	}
+	if (c.HostTemplate != nil || len(c.Namespaces) > 0 || len(c.ExportTo) > 0) && !c.Synchronized() {
+		errs = append(errs, errors.Errorf("hostTemplate, namespaces and exportTo aren't supported by nacos over MCP, only in mode %q", NacosOpenAPIMode))
+	}
+	if c.Filter != nil && !c.Synchronized() {
+		errs = append(errs, errors.Errorf("filter isn't supported by nacos over MCP, only in mode %q", NacosOpenAPIMode))
+	}
+	errs = append(errs, validateExportTo("exportTo", c.ExportTo)...)
+	if c.Filter != nil {
+		for i, match := range c.Filter.Include {
+			errs = append(errs, validateServiceMatch(fmt.Sprintf("filter.include[%d]", i), match)...)
+		}
+		for i, match := range c.Filter.Exclude {
+			errs = append(errs, validateServiceMatch(fmt.Sprintf("filter.exclude[%d]", i), match)...)
+		}
+	}
+	for i, rule := range c.Namespaces {
+		if msgs := validation.IsDNS1123Label(rule.Namespace); len(msgs) > 0 {
+			errs = append(errs, errors.Errorf("namespaces[%d]: namespace %q is invalid: %s", i, rule.Namespace, strings.Join(msgs, ", ")))
+		}
+		if _, err := path.Match(rule.Service, ""); err != nil {
+			errs = append(errs, errors.Errorf("namespaces[%d]: service %q isn't a valid glob", i, rule.Service))
+		}
+		errs = append(errs, validateExportTo(fmt.Sprintf("namespaces[%d].exportTo", i), rule.ExportTo)...)
+	}
+	switch c.EndpointMode {
+	case "", EndpointModeInline:
+	case EndpointModeWorkloadEntry:
+		if !c.Synchronized() {
+			errs = append(errs, errors.Errorf("endpointMode %q isn't supported by nacos over MCP", c.EndpointMode))
+		}
+	default:
+		errs = append(errs, errors.Errorf("endpointMode must be %q or %q, got %q", EndpointModeInline, EndpointModeWorkloadEntry, c.EndpointMode))
+	}
+	if gc := c.GarbageCollection; gc != nil {
+		if gc.GracePeriod < 0 {
+			errs = append(errs, errors.New("garbageCollection.gracePeriod must not be negative"))
+		}
+		if gc.MaxDeletionPercent < 1 || gc.MaxDeletionPercent > 100 {
+			errs = append(errs, errors.Errorf("garbageCollection.maxDeletionPercent must be between 1 and 100, got %d", gc.MaxDeletionPercent))
+		}
+	}
+	for i, rule := range c.Ports {
+		if rule.Port == 0 {
+			errs = append(errs, errors.Errorf("ports[%d]: port is required", i))
+		}
+		if rule.Protocol != "" && !IsProtocol(rule.Protocol) {
+			errs = append(errs, errors.Errorf("ports[%d]: protocol must be one of %v, got %q", i, Protocols, rule.Protocol))
+		}
+		if _, err := path.Match(rule.Service, ""); err != nil {
+			errs = append(errs, errors.Errorf("ports[%d]: service %q isn't a valid glob", i, rule.Service))
+		}
+	}
+	switch {
+	case c.Consul != nil:
+		if c.Consul.Token != "" && c.Consul.TokenFile != "" {
+			errs = append(errs, errors.New("token and tokenFile are mutually exclusive"))
+		}
+		if (c.Consul.CertFile == "") != (c.Consul.KeyFile == "") {
+			errs = append(errs, errors.New("certFile and keyFile must be set together"))
+		}
+	case c.Nacos != nil:
+		if c.Nacos.Mode != "" && c.Nacos.Mode != NacosOpenAPIMode {
+			errs = append(errs, errors.Errorf("mode must be empty or %q, got %q", NacosOpenAPIMode, c.Nacos.Mode))
+		}
+		if c.Nacos.PollInterval < 0 {
+			errs = append(errs, errors.New("pollInterval must not be negative"))
+		}
+	case c.Eureka != nil:
+		if c.Eureka.PollInterval < 0 {
+			errs = append(errs, errors.New("pollInterval must not be negative"))
+		}
+	case c.Zookeeper != nil:
+		if c.Zookeeper.RootPath != "" && !strings.HasPrefix(c.Zookeeper.RootPath, "/") {
+			errs = append(errs, errors.Errorf("rootPath must be absolute, got %q", c.Zookeeper.RootPath))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// validateExportTo reports the exportTo entries which are neither ".", "*" nor a namespace
+func validateExportTo(field string, exportTo []string) []error {
+	var errs []error
+	for _, ns := range exportTo {
+		if ns != "." && ns != "*" && len(validation.IsDNS1123Label(ns)) > 0 {
+			errs = append(errs, errors.Errorf("%s: %q must be \".\", \"*\" or a namespace", field, ns))
+		}
+	}
+	return errs
+}
+
+// validateServiceMatch reports the invalid criteria of a filter rule
+func validateServiceMatch(field string, match ServiceMatch) []error {
+	var errs []error
+	if _, err := path.Match(match.Name, ""); err != nil {
+		errs = append(errs, errors.Errorf("%s: name %q isn't a valid glob", field, match.Name))
+	}
+	if match.Name == "" && match.NameRegex == nil && len(match.Tags) == 0 && len(match.Metadata) == 0 &&
+		len(match.Groups) == 0 && len(match.Clusters) == 0 {
+		errs = append(errs, errors.Errorf("%s: the rule matches every service", field))
+	}
+	return errs
+}
+
+// Synchronized reports whether the ServiceEntries of the registry are published by a synchronizer. The Nacos MCP
+// watcher publishes the ServiceEntries it receives on its own, without the features of the synchronizer.
+func (c *RegistryConfig) Synchronized() bool {
+	return c.Nacos == nil || c.Nacos.Mode == NacosOpenAPIMode
+}
+
+// defaultName names a registry after its type and endpoint, never after its place in the config file: the name owns
+// the resources published for the registry, they would be left behind by a registry renamed by a reordering.
+func defaultName(registryType ServiceRegistryType, endpoint string) string {
+	sum := sha256.Sum256([]byte(endpoint))
+	return fmt.Sprintf("%s-%s", registryType, hex.EncodeToString(sum[:4]))
+}
+
+// ParseRegistryConfig decodes and validates the registry config file, all errors are reported at once
+func ParseRegistryConfig(data []byte) ([]RegistryConfig, error) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrap(err, "the registry config must be a list of registries")
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no service registry within the registry config")
+	}
+
+	var errs []error
+	configs := make([]RegistryConfig, 0, len(entries))
+	names := make(map[string]struct{}, len(entries))
+	for i, entry := range entries {
+		var c RegistryConfig
+		if err := json.Unmarshal(entry, &c); err != nil {
+			errs = append(errs, errors.Wrapf(err, "registry %d", i))
+			continue
+		}
+		if c.Name == "" {
+			c.Name = defaultName(c.Type, c.Endpoint)
+		}
+		if _, found := names[c.Name]; found {
+			errs = append(errs, errors.Errorf("registry %d: the service registry name is not unique: %s, registries of the "+
+				"same type and endpoint must be named", i, c.Name))
+		}
+		names[c.Name] = struct{}{}
+		if err := c.Validate(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "registry %d (%s)", i, c.Name))
+		}
+		configs = append(configs, c)
+	}
+	if err := utilerrors.NewAggregate(errs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
@@ -0,0 +1,178 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRegistryConfig(t *testing.T) {
+	data := `[
+  {"name": "consul-prod", "type": "consul", "endpoint": "http://consul:8500", "tags": "mesh, !canary",
+   "datacenter": ["dc1", "dc2"], "includeWarning": true, "hostTemplate": "{{.Service}}.{{.Datacenter}}.consul",
+   "filter": {"exclude": [{"name": "consul"}, {"tags": "internal"}]}},
+  {"type": "eureka", "endpoint": "http://eureka:8761/eureka", "pollInterval": "15s",
+   "garbageCollection": {"gracePeriod": "0s"}, "exportTo": ".",
+   "namespaces": [{"namespace": "payments", "labels": {"team": "payments"}, "exportTo": ["*"]}]},
+  {"type": "nacos", "mode": "openapi", "endpoint": "http://nacos:8848", "nacosNamespace": "public,dev"}
+]`
+	configs, err := ParseRegistryConfig([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl := configs[0].HostTemplate; tmpl == nil || tmpl.String() != "{{.Service}}.{{.Datacenter}}.consul" {
+		t.Fatalf("hostTemplate = %v, want the template given", tmpl)
+	}
+	defaultGC := &GarbageCollectionConfig{GracePeriod: Duration(DefaultGracePeriod), MaxDeletionPercent: DefaultMaxDeletionPercent}
+	want := []RegistryConfig{
+		{
+			Name: "consul-prod", Type: Consul, Endpoint: "http://consul:8500", GarbageCollection: defaultGC,
+			HostTemplate: configs[0].HostTemplate,
+			Filter:       &FilterConfig{Exclude: []ServiceMatch{{Name: "consul"}, {Tags: StringList{"internal"}}}},
+			Consul: &ConsulConfig{
+				IncludeWarning: true,
+				Tags:           StringList{"mesh", "!canary"},
+				Datacenter:     StringList{"dc1", "dc2"},
+			},
+		},
+		{
+			Name: defaultName(Eureka, "http://eureka:8761/eureka"), Type: Eureka, Endpoint: "http://eureka:8761/eureka",
+			GarbageCollection: &GarbageCollectionConfig{MaxDeletionPercent: DefaultMaxDeletionPercent},
+			ExportTo:          StringList{"."},
+			Namespaces: []NamespaceRule{
+				{Namespace: "payments", Labels: map[string]string{"team": "payments"}, ExportTo: StringList{"*"}},
+			},
+			Eureka: &EurekaConfig{PollInterval: Duration(15 * time.Second)},
+		},
+		{
+			Name: defaultName(Nacos, "http://nacos:8848"), Type: Nacos, Endpoint: "http://nacos:8848", GarbageCollection: defaultGC,
+			Nacos: &NacosConfig{Mode: NacosOpenAPIMode, NacosNamespace: StringList{"public", "dev"}},
+		},
+	}
+	if !reflect.DeepEqual(configs, want) {
+		t.Errorf("configs = %+v, want %+v", configs, want)
+	}
+
+	// the names of the registries don't change with their order
+	reordered, err := ParseRegistryConfig([]byte(`[
+  {"type": "nacos", "mode": "openapi", "endpoint": "http://nacos:8848", "nacosNamespace": "public,dev"},
+  {"type": "eureka", "endpoint": "http://eureka:8761/eureka", "pollInterval": "15s"}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reordered[0].Name != want[2].Name || reordered[1].Name != want[1].Name {
+		t.Errorf("the reordered registries are named %s and %s, want %s and %s", reordered[0].Name, reordered[1].Name,
+			want[2].Name, want[1].Name)
+	}
+}
+
+func TestParseRegistryConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{name: "not a list", data: `{"type": "consul"}`, want: []string{"must be a list"}},
+		{name: "empty", data: `[]`, want: []string{"no service registry"}},
+		{
+			name: "typo",
+			data: `[{"type": "consul", "endpoint": "http://consul:8500", "datacentre": "dc1"}]`,
+			want: []string{`registry 0`, `unknown field "datacentre"`},
+		},
+		{
+			name: "field of another type",
+			data: `[{"type": "eureka", "endpoint": "http://eureka:8761", "rootPath": "/dubbo"}]`,
+			want: []string{`unknown field "rootPath"`},
+		},
+		{name: "unsupported type", data: `[{"type": "etcd", "endpoint": "etcd:2379"}]`, want: []string{"not supported: etcd"}},
+		{
+			name: "all errors are reported",
+			data: `[{"type": "zookeeper", "rootPath": "dubbo"}, {"type": "nacos", "endpoint": "nacos:8848", "mode": "grpc"},
+  {"name": "nacos-1", "type": "eureka", "endpoint": "http://eureka:8761", "pollInterval": 30}]`,
+			want: []string{"endpoint is required", "rootPath must be absolute", `mode must be empty or "openapi"`,
+				"must be a duration"},
+		},
+		{
+			name: "name isn't a label value",
+			data: `[{"name": "consul/prod", "type": "consul", "endpoint": "http://consul:8500"}]`,
+			want: []string{`name "consul/prod" isn't a valid label value`},
+		},
+		{
+			name: "unknown endpoint mode",
+			data: `[{"type": "zookeeper", "endpoint": "zk:2181", "endpointMode": "pods"}]`,
+			want: []string{`endpointMode must be`},
+		},
+		{
+			name: "workload entries of nacos mcp",
+			data: `[{"type": "nacos", "endpoint": "nacos:18848", "endpointMode": "workloadEntry"}]`,
+			want: []string{"endpointMode"},
+		},
+		{
+			name: "invalid garbage collection",
+			data: `[{"type": "zookeeper", "endpoint": "zk:2181", "garbageCollection": {"gracePeriod": "-1m", "maxDeletionPercent": 0}}]`,
+			want: []string{"gracePeriod must not be negative", "maxDeletionPercent must be between 1 and 100"},
+		},
+		{
+			name: "destination rules of nacos mcp",
+			data: `[{"type": "nacos", "endpoint": "nacos:18848", "destinationRule": {"subsetKeys": "version"}}]`,
+			want: []string{"destinationRule"},
+		},
+		{
+			name: "invalid port rules",
+			data: `[{"type": "zookeeper", "endpoint": "zk:2181", "ports": [{"service": "[", "protocol": "thrift"}]}]`,
+			want: []string{"port is required", "protocol must be one of", "isn't a valid glob"},
+		},
+		{
+			name: "invalid host template",
+			data: `[{"type": "consul", "endpoint": "http://consul:8500", "hostTemplate": "{{.Cluster}}.consul"}]`,
+			want: []string{"can't evaluate field Cluster"},
+		},
+		{
+			name: "invalid namespace rules",
+			data: `[{"type": "zookeeper", "endpoint": "zk:2181", "exportTo": "Team A",
+  "namespaces": [{"namespace": "Payments", "service": "[", "exportTo": "~"}]}]`,
+			want: []string{`exportTo: "Team A"`, `namespace "Payments" is invalid`, "isn't a valid glob", `namespaces[0].exportTo: "~"`},
+		},
+		{
+			name: "naming of nacos mcp",
+			data: `[{"type": "nacos", "endpoint": "nacos:18848", "exportTo": "."}]`,
+			want: []string{"aren't supported by nacos over MCP"},
+		},
+		{
+			name: "invalid filter",
+			data: `[{"type": "eureka", "endpoint": "http://eureka:8761",
+  "filter": {"include": [{"name": "["}], "exclude": [{}]}}]`,
+			want: []string{`filter.include[0]: name "[" isn't a valid glob`, "filter.exclude[0]: the rule matches every service"},
+		},
+		{
+			name: "invalid filter regex",
+			data: `[{"type": "eureka", "endpoint": "http://eureka:8761", "filter": {"exclude": [{"nameRegex": "(web"}]}}]`,
+			want: []string{`invalid regular expression "(web"`},
+		},
+		{
+			name: "filter of nacos mcp",
+			data: `[{"type": "nacos", "endpoint": "nacos:18848", "filter": {"exclude": [{"groups": "internal"}]}}]`,
+			want: []string{"filter isn't supported by nacos over MCP"},
+		},
+		{
+			name: "duplicate names",
+			data: `[{"name": "a", "type": "zookeeper", "endpoint": "zk:2181"}, {"name": "a", "type": "zookeeper", "endpoint": "zk:2181"}]`,
+			want: []string{"not unique: a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRegistryConfig([]byte(tt.data))
+			if err == nil {
+				t.Fatal("an error must be returned")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q must contain %q", err, want)
+				}
+			}
+		})
+	}
+}
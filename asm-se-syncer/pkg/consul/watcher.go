@@ -2,10 +2,14 @@ package consul
 
 import (
 	"context"
+	"github.com/cenkalti/backoff"
 	log "github.com/sirupsen/logrus"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
@@ -17,26 +21,74 @@ import (
 
 var errIndexChangeTimeout = errors.New("blocking request timeout while waiting for index to change")
 
+// Options tune which Consul instances become endpoints and what is copied onto them.
+type Options struct {
+	// IncludeWarning also publishes instances whose checks are warning, by default only passing instances are published
+	IncludeWarning bool
+	// Tags are tag expressions a service must match to be synced: a service must carry every tag
+	// and none of the tags prefixed with "!". All services are synced if empty.
+	Tags []string
+	// LabelKeys are the service meta keys, or node meta keys, copied into the endpoint labels.
+	// Tags of the form key=value are copied as well.
+	LabelKeys []string
+	// LocalityKey is the service meta key, or node meta key, holding the region/zone/subzone locality of an instance
+	LocalityKey string
+	// MaxConcurrentFetches bounds the number of services fetched at once without waiting for a change,
+	// e.g. when all services are fetched at startup. Defaults to 32.
+	MaxConcurrentFetches int
+
+	// Token is the ACL token sent with every request, TokenFile is read for the token instead if set
+	Token     string
+	TokenFile string
+	// CAFile, CertFile and KeyFile are the PEM encoded CA bundle used to verify the Consul servers,
+	// and the client certificate and key presented to them for mTLS
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// Datacenters are the datacenters services are aggregated from, the datacenter of the agent if empty.
+	// Endpoints are given their datacenter as locality, unless LocalityKey is found on the instance.
+	Datacenters []string
+	// Partition is the admin partition services are read from (Consul Enterprise)
+	Partition string
+	// HostTemplate names the host of a service in a datacenter, common.DefaultHostTemplate if nil. The endpoints of
+	// the datacenters a service has the same host in are published together.
+	HostTemplate *common.HostTemplate
+	// Filter selects the services which are synced, by name, tags and service meta. Services are dropped per
+	// datacenter.
+	Filter *common.FilterConfig
+}
+
 type watcher struct {
 	client          *api.Client
 	store           provider.Cache
-	tickInterval    time.Duration
-	lastIndex       uint64 // lastly synced index of Catalog
+	opts            Options
 	consulNamespace string
+	name            string
 	prefix          string
 	toNamespace     string
 	watcherType     string
+
+	fetches chan struct{} // bounds concurrent fetches
+	m       sync.Mutex    // serializes cache updates with stopping service watches
+	// endpoints of every service per datacenter
+	endpoints map[string]map[string][]*v1alpha3.WorkloadEntry
+	// published are the hosts of every service
+	published map[string][]string
+	hosts     *provider.HostTable
+	filter    *provider.Filter
 }
 
 const (
 	// TODO: allow users to specify these
-	defaultBlockingRequestWaitTimeDuration = 5 * time.Second
-	defaultTickIntervalDuration            = 10 * time.Second
+	defaultBlockingRequestWaitTimeDuration = 5 * time.Minute
+	defaultMaxConcurrentFetches            = 32
+	// minimal time between two queries of the same service, so that flapping services don't cause a busy loop
+	minQueryInterval = time.Second
 )
 
 var _ provider.Watcher = &watcher{}
 
-func NewWatcher(store provider.Cache, endpoint string, consulNamespace, prefix, toNamespace string) (provider.Watcher, error) {
+func NewWatcher(store provider.Cache, name, endpoint string, consulNamespace, prefix, toNamespace string, opts Options) (provider.Watcher, error) {
 	if len(endpoint) == 0 {
 		return nil, errors.New("Consul endpoint not specified")
 	}
@@ -47,20 +99,37 @@ func NewWatcher(store provider.Cache, endpoint string, consulNamespace, prefix,
 		return nil, errors.Wrapf(err, "error parsing endpoint: %s", endpoint)
 	}
 
-	// TODO: allow users to specify TOKEN
 	config.Scheme = u.Scheme
 	config.Address = u.Host
 	config.WaitTime = defaultBlockingRequestWaitTimeDuration
+	config.Token = opts.Token
+	config.TokenFile = opts.TokenFile
+	config.Partition = opts.Partition
+	config.TLSConfig.CAFile = opts.CAFile
+	config.TLSConfig.CertFile = opts.CertFile
+	config.TLSConfig.KeyFile = opts.KeyFile
 
-	log.Infof("watching config: %+v", config)
+	log.Infof("watching Consul %s://%s, datacenters %v, partition %q", config.Scheme, config.Address, opts.Datacenters, opts.Partition)
 	client, err := api.NewClient(config)
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating client")
 	}
+	if opts.MaxConcurrentFetches <= 0 {
+		opts.MaxConcurrentFetches = defaultMaxConcurrentFetches
+	}
+	if opts.HostTemplate == nil {
+		opts.HostTemplate = common.MustParseHostTemplate(common.DefaultHostTemplate)
+	}
 	return &watcher{client: client,
 		store:           store,
-		tickInterval:    defaultTickIntervalDuration,
+		opts:            opts,
+		fetches:         make(chan struct{}, opts.MaxConcurrentFetches),
+		endpoints:       make(map[string]map[string][]*v1alpha3.WorkloadEntry),
+		published:       make(map[string][]string),
+		hosts:           provider.NewHostTable(store, name),
+		filter:          provider.NewFilter(opts.Filter, name),
 		consulNamespace: consulNamespace,
+		name:            name,
 		prefix:          prefix,
 		watcherType:     string(common.Consul),
 		toNamespace:     toNamespace,
@@ -71,6 +140,10 @@ func (w *watcher) Cache() provider.Cache {
 	return w.store
 }
 
+func (w *watcher) Name() string {
+	return w.name
+}
+
 func (w *watcher) Prefix() string {
 	return w.prefix
 }
@@ -82,110 +155,417 @@ func (w *watcher) WatcherType() string {
 	return w.watcherType
 }
 
-// Run the watcher until the context is cancelled
+// Run the watcher until the context is cancelled.
+// The list of services of every datacenter is watched with a blocking query, and every service matching
+// the tag expressions is watched with its own blocking query, so that only the services which changed are
+// fetched again.
 func (w *watcher) Run(ctx context.Context) {
-	ticker := time.NewTicker(w.tickInterval)
-	defer ticker.Stop()
+	datacenters := w.opts.Datacenters
+	if len(datacenters) == 0 {
+		datacenters = []string{""} // the datacenter of the agent
+	}
+	// initial waits for the first listing of every datacenter and the first fetch of every service listed
+	var initial sync.WaitGroup
+	initial.Add(len(datacenters))
+	var wg sync.WaitGroup
+	for _, dc := range datacenters {
+		wg.Add(1)
+		go func(dc string) {
+			defer wg.Done()
+			w.watchDatacenter(ctx, dc, &initial)
+		}(dc)
+	}
+	go func() {
+		initial.Wait()
+		if ctx.Err() == nil {
+			monitoring.Synced(w.name)
+		}
+	}()
+	wg.Wait()
+}
+
+// watchDatacenter keeps the services of a datacenter up to date until the context is cancelled
+func (w *watcher) watchDatacenter(ctx context.Context, dc string, initial *sync.WaitGroup) {
+	listed := false
+	defer func() {
+		if !listed {
+			initial.Done()
+		}
+	}()
+	watches := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, stop := range watches {
+			stop()
+		}
+	}()
 
-	w.refreshStore(w.Prefix()) // init
+	var index uint64
+	retry := backoff.NewExponentialBackOff()
+	retry.MaxElapsedTime = 0
 	for {
-		select {
-		case <-ticker.C:
-			w.refreshStore(w.Prefix())
-		case <-ctx.Done():
+		names, lastIndex, err := w.listServices(ctx, dc, index)
+		if ctx.Err() != nil {
 			return
 		}
+		if err == errIndexChangeTimeout {
+			log.Debugf("waiting for index to change: datacenter: %q, current index: %d", dc, index)
+			monitoring.WatchSucceeded(w.name)
+			continue
+		} else if err != nil {
+			log.Errorf("error listing services from Consul datacenter %q: %v", dc, err)
+			monitoring.WatchFailed(w.name, err)
+			index = 0
+			if !sleep(ctx, retry.NextBackOff()) {
+				return
+			}
+			continue
+		}
+		retry.Reset()
+		index = lastIndex
+		monitoring.WatchSucceeded(w.name)
+		monitoring.SetConsulIndex(w.name, dc, lastIndex)
+
+		for name, tags := range names {
+			if _, found := watches[name]; found || !matchTags(w.opts.Tags, tags) {
+				continue
+			}
+			watchCtx, stop := context.WithCancel(ctx)
+			watches[name] = stop
+			fetched := func() {}
+			if !listed {
+				initial.Add(1)
+				fetched = once(initial.Done)
+			}
+			go w.watchService(watchCtx, dc, name, fetched)
+		}
+		if !listed {
+			listed = true
+			initial.Done()
+		}
+		for name, stop := range watches {
+			if tags, found := names[name]; found && matchTags(w.opts.Tags, tags) {
+				continue
+			}
+			w.m.Lock()
+			stop()
+			w.update(name, dc, nil)
+			w.m.Unlock()
+			w.filter.Forget(serviceID(name, dc))
+			delete(watches, name)
+		}
 	}
 }
 
-// fetch services and endpoints from consul catalog and sync them with Store
-func (w *watcher) refreshStore(prefix string) {
-	names, err := w.listServices()
-	if err == errIndexChangeTimeout {
-		log.Infof("waiting for index to change: current index: %d", w.lastIndex)
-		return
-	} else if err != nil {
-		log.Errorf("error listing services from Consul: %v", err)
-		return
-	}
+// watchService keeps the endpoints of a service up to date until the context is cancelled
+// fetched is called once the endpoints were fetched for the first time.
+func (w *watcher) watchService(ctx context.Context, dc, name string, fetched func()) {
+	defer fetched()
+	// a service which isn't watched anymore doesn't fail
+	defer monitoring.ServiceWatched(w.name, serviceID(name, dc), nil)
+	var index uint64
+	retry := backoff.NewExponentialBackOff()
+	retry.MaxElapsedTime = 0
+	for {
+		svcs, lastIndex, err := w.describeService(ctx, dc, name, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// the catalog is reached by watchDatacenter, so one service failing doesn't disconnect the registry
+			log.Errorf("error describing service health from Consul: %v ", err)
+			monitoring.ServiceWatched(w.name, serviceID(name, dc), err)
+			index = 0
+			if !sleep(ctx, retry.NextBackOff()) {
+				return
+			}
+			continue
+		}
+		retry.Reset()
+		monitoring.ServiceWatched(w.name, serviceID(name, dc), nil)
 
-	css := w.describeServices(names)
-	data := make(map[string][]*v1alpha3.WorkloadEntry, len(css))
-	for name, cs := range css {
-		name = common.FormatedName(name)
-		eps := make([]*v1alpha3.WorkloadEntry, 0, len(cs))
-		for _, c := range cs {
-			if ep := catalogServiceToEndpoints(c); ep != nil {
-				eps = append(eps, ep)
+		if lastIndex != index {
+			eps := make([]*v1alpha3.WorkloadEntry, 0, len(svcs))
+			for _, c := range svcs {
+				if ep := healthServiceToEndpoint(c, w.opts); ep != nil {
+					eps = append(eps, ep)
+				}
+			}
+			if len(eps) == 0 {
+				w.filter.Forget(serviceID(name, dc))
+			} else if !w.filter.Keep(serviceID(name, dc), serviceInfo(name, svcs)) {
+				eps = nil
 			}
+			w.m.Lock()
+			if ctx.Err() == nil {
+				w.update(name, dc, eps)
+			}
+			w.m.Unlock()
 		}
-		if len(eps) > 0 {
-			data[prefix+name] = eps
+		fetched()
+		// indexes going backwards must be reset, see https://www.consul.io/api-docs/features/blocking
+		if lastIndex < index {
+			index = 0
+		} else {
+			index = lastIndex
+		}
+		if !sleep(ctx, minQueryInterval) {
+			return
 		}
 	}
-	w.store.Set(data)
 }
 
-// listServices lists services
-func (w *watcher) listServices() (map[string][]string, error) {
+// update replaces the endpoints of a service in a datacenter and publishes the endpoints of the service under
+// its hosts, callers must hold w.m
+func (w *watcher) update(name, dc string, eps []*v1alpha3.WorkloadEntry) {
+	byDC := w.endpoints[name]
+	if byDC == nil {
+		byDC = make(map[string][]*v1alpha3.WorkloadEntry)
+		w.endpoints[name] = byDC
+	}
+	if len(eps) == 0 {
+		delete(byDC, dc)
+	} else {
+		byDC[dc] = eps
+	}
+	if len(byDC) == 0 {
+		delete(w.endpoints, name)
+	}
+
+	// keep the order of the configured datacenters so that the endpoints are stable
+	byHost := make(map[string][]*v1alpha3.WorkloadEntry)
+	var hosts []string
+	for _, d := range w.datacenters() {
+		if _, found := byDC[d]; !found {
+			continue
+		}
+		host, err := w.host(name, d)
+		if err != nil {
+			log.Errorf("service %s of Consul datacenter %q isn't published: %v", name, d, err)
+			continue
+		}
+		if _, found := byHost[host]; !found {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], byDC[d]...)
+	}
+	for _, host := range w.published[name] {
+		if _, found := byHost[host]; !found {
+			w.hosts.Update(name, host, nil)
+		}
+	}
+	for _, host := range hosts {
+		w.hosts.Update(name, host, byHost[host])
+	}
+	if len(hosts) == 0 {
+		delete(w.published, name)
+	} else {
+		w.published[name] = hosts
+	}
+}
+
+func (w *watcher) datacenters() []string {
+	if len(w.opts.Datacenters) == 0 {
+		return []string{""}
+	}
+	return w.opts.Datacenters
+}
+
+// host is the name a Consul service is published under in a datacenter
+func (w *watcher) host(name, dc string) (string, error) {
+	return w.opts.HostTemplate.Host(common.HostData{
+		Registry:   w.name,
+		Prefix:     w.prefix,
+		Service:    name,
+		Namespace:  w.consulNamespace,
+		Datacenter: dc,
+	})
+}
+
+// serviceID identifies a service of a datacenter for the filter, e.g. dc1/web
+func serviceID(name, dc string) string {
+	if dc == "" {
+		return name
+	}
+	return dc + "/" + name
+}
+
+// serviceInfo describes the instances of a service for the filter
+func serviceInfo(name string, svcs []*api.ServiceEntry) common.ServiceInfo {
+	info := common.ServiceInfo{Name: name, Instances: make([]common.InstanceInfo, 0, len(svcs))}
+	for _, e := range svcs {
+		if e.Service != nil {
+			info.Instances = append(info.Instances, common.InstanceInfo{Tags: e.Service.Tags, Metadata: e.Service.Meta})
+		}
+	}
+	return info
+}
+
+// listServices lists the services of a datacenter once its index differs from waitIndex
+func (w *watcher) listServices(ctx context.Context, dc string, waitIndex uint64) (map[string][]string, uint64, error) {
 	data, metadata, err := w.client.Catalog().Services(
-		&api.QueryOptions{WaitIndex: w.lastIndex, Namespace: w.consulNamespace},
+		(&api.QueryOptions{Datacenter: dc, WaitIndex: waitIndex, Namespace: w.consulNamespace}).WithContext(ctx),
 	)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to list services")
+		return nil, 0, errors.Wrap(err, "failed to list services")
 	}
 
-	if w.lastIndex == metadata.LastIndex {
+	if waitIndex == metadata.LastIndex {
 		// this case indicates the request reaches timeout of blocking request
-		return nil, errIndexChangeTimeout
+		return nil, waitIndex, errIndexChangeTimeout
 	}
-
-	w.lastIndex = metadata.LastIndex
-	return data, nil
+	return data, metadata.LastIndex, nil
 }
 
-// describeServices gets catalog services for given service names
-func (w *watcher) describeServices(names map[string][]string) map[string][]*api.CatalogService {
-	ss := make(map[string][]*api.CatalogService, len(names))
-	for name := range names { // ignore tags in value
-		svcs, err := w.describeService(name)
-		if err != nil {
-			log.Errorf("error describing service catalog from Consul: %v ", err)
-			continue
+// describeService gets the instances of a service once its index differs from waitIndex.
+// Fetches without waiting for a change are bounded by Options.MaxConcurrentFetches.
+func (w *watcher) describeService(ctx context.Context, dc, name string, waitIndex uint64) ([]*api.ServiceEntry, uint64, error) {
+	if waitIndex == 0 {
+		select {
+		case w.fetches <- struct{}{}:
+			defer func() { <-w.fetches }()
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
 		}
-		ss[name] = svcs
 	}
-	return ss
+	// warning instances can't be selected by the API, they are filtered by healthServiceToEndpoint
+	svcs, metadata, err := w.client.Health().Service(name, "", !w.opts.IncludeWarning, (&api.QueryOptions{
+		Datacenter: dc,
+		Namespace:  w.consulNamespace,
+		WaitIndex:  waitIndex,
+	}).WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to describe svc: %s, datacenter: %q", name, dc)
+	}
+	return svcs, metadata.LastIndex, nil
 }
 
-func (w *watcher) describeService(name string) ([]*api.CatalogService, error) {
-	svcs, _, err := w.client.Catalog().Service(name, "", &api.QueryOptions{
-		Namespace: w.consulNamespace,
-	})
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to describe svc: %s", name)
+// sleep waits for d, it returns false if the context was cancelled in the meantime
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-	return svcs, nil
 }
 
-// catalogServiceToEndpoints converts catalog service to service entry endpoint
-func catalogServiceToEndpoints(c *api.CatalogService) *v1alpha3.WorkloadEntry {
-	address := c.ServiceAddress
+// once returns a function which calls f the first time it is called only
+func once(f func()) func() {
+	var o sync.Once
+	return func() { o.Do(f) }
+}
+
+// matchTags reports whether a service carrying tags matches all tag expressions
+func matchTags(expressions, tags []string) bool {
+	for _, expr := range expressions {
+		excluded := strings.HasPrefix(expr, "!")
+		expr = strings.TrimPrefix(expr, "!")
+		found := false
+		for _, tag := range tags {
+			if tag == expr {
+				found = true
+				break
+			}
+		}
+		if found == excluded {
+			return false
+		}
+	}
+	return true
+}
+
+// healthServiceToEndpoint converts a service instance to service entry endpoint,
+// it returns nil for instances which are not healthy.
+func healthServiceToEndpoint(e *api.ServiceEntry, opts Options) *v1alpha3.WorkloadEntry {
+	if e.Service == nil {
+		return nil
+	}
+	var weight int
+	switch e.Checks.AggregatedStatus() {
+	case api.HealthPassing:
+		weight = e.Service.Weights.Passing
+	case api.HealthWarning:
+		if !opts.IncludeWarning {
+			return nil
+		}
+		weight = e.Service.Weights.Warning
+	default:
+		return nil
+	}
+
+	var node api.Node
+	if e.Node != nil {
+		node = *e.Node
+	}
+	address := e.Service.Address
 	if address == "" {
-		address = c.Address
+		address = node.Address
 	}
 
 	if address == "" {
 		log.Infof("instance %s of %s.%v is of a type that is not currently supported",
-			c.ServiceID, c.ServiceName, c.Namespace)
+			e.Service.ID, e.Service.Service, e.Service.Namespace)
 		return nil
 	}
 
-	port := c.ServicePort
+	var ep *v1alpha3.WorkloadEntry
+	port := e.Service.Port
 	if port > 0 { // port is optional and defaults to zero
-		return serviceentry.Endpoint(address, uint32(port))
+		ep = serviceentry.EndpointWithProtocol(address, uint32(port), instanceProtocol(e.Service))
+	} else {
+		log.Infof("no port found for address %v, assuming http (80) and https (443)", address)
+		ep = &v1alpha3.WorkloadEntry{Address: address, Ports: map[string]uint32{"http": 80, "https": 443}}
+	}
+	ep.Labels = serviceentry.Labels(instanceLabels(e.Service, node, opts.LabelKeys))
+	if opts.LocalityKey != "" {
+		ep.Locality = metaValue(e.Service, node, opts.LocalityKey)
 	}
+	if ep.Locality == "" && len(opts.Datacenters) > 0 {
+		ep.Locality = node.Datacenter
+	}
+	if weight > 0 {
+		ep.Weight = uint32(weight)
+	}
+	return ep
+}
 
-	log.Infof("no port found for address %v, assuming http (80) and https (443)", address)
-	return &v1alpha3.WorkloadEntry{Address: address, Ports: map[string]uint32{"http": 80, "https": 443}}
+// instanceLabels collects the values of keys from the service meta, the node meta and the key=value tags
+func instanceLabels(svc *api.AgentService, node api.Node, keys []string) map[string]string {
+	labels := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if value := metaValue(svc, node, key); value != "" {
+			labels[key] = value
+			continue
+		}
+		for _, tag := range svc.Tags {
+			if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 && kv[0] == key {
+				labels[key] = kv[1]
+				break
+			}
+		}
+	}
+	return labels
+}
+
+// metaValue looks key up in the service meta first and the node meta second
+func metaValue(svc *api.AgentService, node api.Node, key string) string {
+	if value, ok := svc.Meta[key]; ok {
+		return value
+	}
+	return node.Meta[key]
+}
+
+// instanceProtocol returns the protocol declared by the protocol service meta, or else by a protocol=<protocol> tag
+func instanceProtocol(svc *api.AgentService) string {
+	if protocol, ok := svc.Meta[serviceentry.ProtocolKey]; ok {
+		return protocol
+	}
+	for _, tag := range svc.Tags {
+		if strings.HasPrefix(tag, serviceentry.ProtocolKey+"=") {
+			return strings.TrimPrefix(tag, serviceentry.ProtocolKey+"=")
+		}
+	}
+	return ""
 }
@@ -1,11 +1,16 @@
 package consul
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/consul/api"
+	"istio.io/api/networking/v1alpha3"
 
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
 )
 
@@ -32,23 +37,36 @@ func TestWatcher(t *testing.T) {
 		checkConsulEmpty(t)
 	})
 
-	t.Run("refreshStore", func(t *testing.T) {
-		testRefreshStore(t)
+	t.Run("Run", func(t *testing.T) {
+		testRun(t)
 		checkConsulEmpty(t)
 	})
 }
 
 func checkConsulEmpty(t *testing.T) {
-	w := &watcher{client: testClient, store: provider.NewCache(), tickInterval: time.Second * 10}
+	w := newTestWatcher()
 
-	if n, err := w.listServices(); err != nil {
+	if n, _, err := w.listServices(context.Background(), "", 0); err != nil {
 		t.Fatalf("listServices failed: %v", err)
 	} else if len(n) != 1 {
 		t.Fatalf("service must be empty")
 	}
 }
 
-func testRefreshStore(t *testing.T) {
+func newTestWatcher() *watcher {
+	store := provider.NewCache()
+	return &watcher{
+		client:    testClient,
+		store:     store,
+		opts:      Options{HostTemplate: common.MustParseHostTemplate(common.DefaultHostTemplate)},
+		fetches:   make(chan struct{}, defaultMaxConcurrentFetches),
+		endpoints: make(map[string]map[string][]*v1alpha3.WorkloadEntry),
+		published: make(map[string][]string),
+		hosts:     provider.NewHostTable(store, "consul"),
+	}
+}
+
+func testRun(t *testing.T) {
 	tests := []struct {
 		name     string
 		services map[string][]*api.CatalogRegistration
@@ -135,10 +153,17 @@ func testRefreshStore(t *testing.T) {
 				}
 			}()
 
-			w := &watcher{client: testClient, store: provider.NewCache(), tickInterval: time.Second * 10}
-			w.refreshStore(w.Prefix())
+			w := newTestWatcher()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go w.Run(ctx)
 
-			actual := w.store.Hosts()
+			var actual map[string][]*v1alpha3.WorkloadEntry
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+				if actual = w.store.Hosts(); len(actual) == len(tt.services)+1 {
+					break
+				}
+			}
 			if len(actual) != len(tt.services)+1 {
 				t.Fatalf("number of hosts must be %d but got %d: %v", len(tt.services)+1, len(actual), actual)
 			}
@@ -164,10 +189,8 @@ func testRefreshStore(t *testing.T) {
 				}
 			}
 
-			prevIndex := w.lastIndex
-			w.refreshStore(w.Prefix()) // supposed to immediately return since the index not change
-			if prevIndex != w.lastIndex {
-				t.Fatalf("indexes must not change but have %d != %d", prevIndex, w.lastIndex)
+			if dirty := w.store.Dirty(); len(dirty) != len(tt.services)+1 {
+				t.Fatalf("all hosts must be dirty but got %v", dirty)
 			}
 		})
 	}
@@ -213,8 +236,8 @@ func testDescribeService(t *testing.T) {
 				}()
 			}
 
-			w := &watcher{client: testClient, store: provider.NewCache(), tickInterval: time.Second * 10}
-			ret, err := w.describeService(tt.sc.Service.Service)
+			w := newTestWatcher()
+			ret, _, err := w.describeService(context.Background(), "", tt.sc.Service.Service, 0)
 			if tt.sc.Service.Service != "" {
 				if err != nil {
 					t.Fatal(err)
@@ -224,8 +247,8 @@ func testDescribeService(t *testing.T) {
 				}
 
 				actual := ret[0]
-				if actual.Address != tt.sc.Address {
-					t.Fatalf("the returned address must be %s but got %s", tt.sc.Address, actual.Address)
+				if actual.Node.Address != tt.sc.Address {
+					t.Fatalf("the returned address must be %s but got %s", tt.sc.Address, actual.Node.Address)
 				}
 			} else if err == nil {
 				t.Fatalf("err must be returned: %v", err)
@@ -265,8 +288,8 @@ func testListServices(t *testing.T) {
 				}
 			}()
 
-			w := &watcher{client: testClient, store: provider.NewCache(), tickInterval: time.Second * 10}
-			actual, err := w.listServices()
+			w := newTestWatcher()
+			actual, _, err := w.listServices(context.Background(), "", 0)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -295,13 +318,13 @@ func testListServices(t *testing.T) {
 			}
 		}()
 
-		w := &watcher{client: testClient, store: provider.NewCache(), tickInterval: time.Second * 10}
-		_, err = w.listServices()
+		w := newTestWatcher()
+		_, index, err := w.listServices(context.Background(), "", 0)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		_, err = w.listServices()
+		_, _, err = w.listServices(context.Background(), "", index)
 		if err != errIndexChangeTimeout {
 			t.Fatalf(
 				"`%v` must be returned but got `%v`",
@@ -311,18 +334,18 @@ func testListServices(t *testing.T) {
 	})
 }
 
-func TestCatalogServiceToEndpoints(t *testing.T) {
+func TestHealthServiceToEndpoint(t *testing.T) {
 	// empty address
-	res := catalogServiceToEndpoints(&api.CatalogService{})
+	res := healthServiceToEndpoint(&api.ServiceEntry{Service: &api.AgentService{}}, Options{})
 	if res != nil {
 		t.Errorf("result must be nil but got %v", res)
 	}
 
 	// empty port
-	in := &api.CatalogService{Address: "192.0.2.4"}
-	res = catalogServiceToEndpoints(in)
-	if res.Address != in.Address {
-		t.Errorf("address must be %s but got %s", in.Address, res.Address)
+	in := &api.ServiceEntry{Node: &api.Node{Address: "192.0.2.4"}, Service: &api.AgentService{}}
+	res = healthServiceToEndpoint(in, Options{})
+	if res.Address != in.Node.Address {
+		t.Errorf("address must be %s but got %s", in.Node.Address, res.Address)
 	}
 	if res.Ports["http"] != 80 {
 		t.Error("port 80 must be configured")
@@ -332,12 +355,143 @@ func TestCatalogServiceToEndpoints(t *testing.T) {
 	}
 
 	// address and ports are provided
-	in = &api.CatalogService{Address: "192.0.2.10", ServicePort: 8080}
-	res = catalogServiceToEndpoints(in)
-	if res.Address != in.Address {
-		t.Errorf("address must be %s but got %s", in.Address, res.Address)
+	in = &api.ServiceEntry{Node: &api.Node{Address: "192.0.2.10"}, Service: &api.AgentService{Port: 8080}}
+	res = healthServiceToEndpoint(in, Options{})
+	if res.Address != in.Node.Address {
+		t.Errorf("address must be %s but got %s", in.Node.Address, res.Address)
+	}
+	if res.Ports["tcp"] != uint32(in.Service.Port) {
+		t.Errorf("port %d must be of name tcp", in.Service.Port)
+	}
+
+	// protocol declared by a tag
+	in.Service.Tags = []string{"protocol=grpc"}
+	if res = healthServiceToEndpoint(in, Options{}); res.Ports["grpc-8080"] != 8080 {
+		t.Errorf("port 8080 must be of name grpc-8080 but got %v", res.Ports)
+	}
+	in.Service.Tags = nil
+
+	// labels, locality and weight
+	in = &api.ServiceEntry{
+		Node: &api.Node{Address: "192.0.2.11", Meta: map[string]string{"zone": "cn-hangzhou/cn-hangzhou-h"}},
+		Service: &api.AgentService{
+			Port:    8080,
+			Tags:    []string{"primary", "version=v2"},
+			Meta:    map[string]string{"app": "reviews", "team": "bookinfo"},
+			Weights: api.AgentWeights{Passing: 10, Warning: 1},
+		},
+	}
+	opts := Options{LabelKeys: []string{"app", "version", "missing"}, LocalityKey: "zone"}
+	res = healthServiceToEndpoint(in, opts)
+	want := map[string]string{"app": "reviews", "version": "v2"}
+	if !reflect.DeepEqual(res.Labels, want) {
+		t.Errorf("labels must be %v but got %v", want, res.Labels)
+	}
+	if res.Locality != "cn-hangzhou/cn-hangzhou-h" {
+		t.Errorf("locality must be taken from the node meta but got %q", res.Locality)
+	}
+	if res.Weight != 10 {
+		t.Errorf("weight must be the passing weight but got %d", res.Weight)
+	}
+
+	// warning instances are only published if requested
+	in.Checks = api.HealthChecks{{CheckID: "service:reviews", Status: api.HealthWarning}}
+	if res = healthServiceToEndpoint(in, opts); res != nil {
+		t.Errorf("warning instance must be dropped but got %v", res)
+	}
+	opts.IncludeWarning = true
+	if res = healthServiceToEndpoint(in, opts); res == nil || res.Weight != 1 {
+		t.Errorf("warning instance must be published with the warning weight but got %v", res)
+	}
+
+	// critical instances are never published
+	in.Checks = api.HealthChecks{{CheckID: "service:reviews", Status: api.HealthCritical}}
+	if res = healthServiceToEndpoint(in, opts); res != nil {
+		t.Errorf("critical instance must be dropped but got %v", res)
+	}
+
+	// the datacenter is the locality of instances without the locality key when several datacenters are synced
+	in = &api.ServiceEntry{Node: &api.Node{Address: "192.0.2.12", Datacenter: "dc2"}, Service: &api.AgentService{Port: 8080}}
+	if res = healthServiceToEndpoint(in, Options{LocalityKey: "zone"}); res.Locality != "" {
+		t.Errorf("locality must be empty without datacenters but got %q", res.Locality)
+	}
+	if res = healthServiceToEndpoint(in, Options{LocalityKey: "zone", Datacenters: []string{"dc1", "dc2"}}); res.Locality != "dc2" {
+		t.Errorf("locality must be the datacenter but got %q", res.Locality)
 	}
-	if res.Ports["tcp"] != uint32(in.ServicePort) {
-		t.Errorf("port %d must be of name tcp", in.ServicePort)
+}
+
+func TestUpdateAggregatesDatacenters(t *testing.T) {
+	w := newTestWatcher()
+	w.opts.Datacenters = []string{"dc1", "dc2"}
+	dc1 := []*v1alpha3.WorkloadEntry{{Address: "192.0.2.1", Locality: "dc1"}}
+	dc2 := []*v1alpha3.WorkloadEntry{{Address: "192.0.2.2", Locality: "dc2"}}
+
+	w.update("reviews", "dc2", dc2)
+	w.update("reviews", "dc1", dc1)
+	want := append(append([]*v1alpha3.WorkloadEntry{}, dc1...), dc2...)
+	if actual := w.store.Hosts()["reviews"]; !reflect.DeepEqual(actual, want) {
+		t.Fatalf("endpoints must be those of all datacenters in order %v but got %v", want, actual)
+	}
+
+	w.update("reviews", "dc1", nil)
+	if actual := w.store.Hosts()["reviews"]; !reflect.DeepEqual(actual, dc2) {
+		t.Fatalf("endpoints must be those of dc2 %v but got %v", dc2, actual)
+	}
+	w.update("reviews", "dc2", nil)
+	if actual, found := w.store.Hosts()["reviews"]; found {
+		t.Fatalf("host must be removed with its last datacenter but got %v", actual)
+	}
+}
+
+func TestUpdateHostTemplate(t *testing.T) {
+	w := newTestWatcher()
+	w.opts.Datacenters = []string{"dc1", "dc2"}
+	w.opts.HostTemplate = common.MustParseHostTemplate("{{.Service}}.{{.Datacenter}}.consul")
+	dc1 := []*v1alpha3.WorkloadEntry{{Address: "192.0.2.1", Locality: "dc1"}}
+	dc2 := []*v1alpha3.WorkloadEntry{{Address: "192.0.2.2", Locality: "dc2"}}
+
+	// every datacenter has its own host, the names are sanitised
+	w.update("Payments_V2", "dc1", dc1)
+	w.update("Payments_V2", "dc2", dc2)
+	want := map[string][]*v1alpha3.WorkloadEntry{"payments-v2.dc1.consul": dc1, "payments-v2.dc2.consul": dc2}
+	if actual := w.store.Hosts(); !reflect.DeepEqual(actual, want) {
+		t.Fatalf("hosts must be %v but got %v", want, actual)
+	}
+
+	// a service named the same host once sanitised isn't published while the first one has endpoints
+	other := []*v1alpha3.WorkloadEntry{{Address: "192.0.2.3", Locality: "dc1"}}
+	w.update("payments-v2", "dc1", other)
+	if actual := w.store.Hosts()["payments-v2.dc1.consul"]; !reflect.DeepEqual(actual, dc1) {
+		t.Fatalf("the colliding service must not replace the endpoints %v but got %v", dc1, actual)
+	}
+	w.update("Payments_V2", "dc1", nil)
+	if actual := w.store.Hosts()["payments-v2.dc1.consul"]; !reflect.DeepEqual(actual, other) {
+		t.Fatalf("the colliding service must be published once the host is free %v but got %v", other, actual)
+	}
+	w.update("payments-v2", "dc1", nil)
+	w.update("Payments_V2", "dc2", nil)
+	if actual := w.store.Hosts(); len(actual) != 0 {
+		t.Fatalf("hosts must be removed with their services but got %v", actual)
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+	tests := []struct {
+		expressions, tags []string
+		want              bool
+	}{
+		{expressions: nil, tags: []string{"a"}, want: true},
+		{expressions: []string{"mesh"}, tags: []string{"mesh", "v1"}, want: true},
+		{expressions: []string{"mesh"}, tags: []string{"v1"}, want: false},
+		{expressions: []string{"!canary"}, tags: []string{"v1"}, want: true},
+		{expressions: []string{"!canary"}, tags: []string{"canary"}, want: false},
+		{expressions: []string{"mesh", "!canary"}, tags: []string{"mesh", "canary"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v matches %v", tt.expressions, tt.tags), func(t *testing.T) {
+			if got := matchTags(tt.expressions, tt.tags); got != tt.want {
+				t.Errorf("matchTags() = %v, want %v", got, tt.want)
+			}
+		})
 	}
 }
@@ -0,0 +1,104 @@
+package control
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/writer"
+)
+
+// WithDestinationRules makes the synchronizer publish a DestinationRule, written with clients, for every ServiceEntry
+// with subsets or a traffic policy as config says. DestinationRules of the registry whose host is gone are deleted,
+// DestinationRules not published by the registry are left as they are.
+func (s *synchronizer) WithDestinationRules(clients DestinationRules, config common.DestinationRuleConfig) *synchronizer {
+	s.destinationRules = clients
+	s.destinationRule = config
+	return s
+}
+
+// syncDestinationRule creates, updates or deletes the named DestinationRule of namespace so that it is the desired
+// one, nil if there must be none
+func (s *synchronizer) syncDestinationRule(namespace, name string, desired *ic.DestinationRule) {
+	client := s.destinationRules(namespace)
+	existing, err := client.Get(context.TODO(), name, v1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		if desired == nil {
+			return
+		}
+		s.applyDestinationRule(namespace, desired, monitoring.OperationCreate)
+	case err != nil:
+		log.Errorf("error getting DestinationRule %q: %v", name, err)
+	case !s.ownsOrAdopts(existing):
+		log.Warnf("DestinationRule %s/%s isn't published by registry %s, it is left as is", namespace, name, s.registryName)
+	case desired == nil:
+		s.deleteDestinationRule(namespace, name)
+	case proto.Equal(&existing.Spec, &desired.Spec) && reflect.DeepEqual(existing.Labels, desired.Labels) &&
+		s.identity.Stamped(existing):
+	default:
+		s.applyDestinationRule(namespace, desired, monitoring.OperationUpdate)
+	}
+}
+
+// applyDestinationRule creates or updates dr as operation says
+func (s *synchronizer) applyDestinationRule(namespace string, dr *ic.DestinationRule, operation string) {
+	client := s.destinationRules(namespace)
+	s.write(writer.Key(destinationRuleKind, namespace, dr.Name), func(ctx context.Context) error {
+		err := writer.ApplyDestinationRule(ctx, client, dr, s.ownsOrAdopts, s.fieldManager)
+		if _, notOwned := err.(*serviceentry.NotOwnedError); !notOwned {
+			monitoring.DestinationRuleWritten(s.registryName, operation, err)
+		}
+		return err
+	}, func(err error) {
+		if notOwned, ok := err.(*serviceentry.NotOwnedError); ok {
+			log.Warnf("DestinationRule %s/%s is published by %s now, it is left as is", namespace, dr.Name, notOwned.Publisher)
+			return
+		}
+		if err != nil {
+			log.Errorf("error writing DestinationRule %q: %v", dr.Name, err)
+		}
+	})
+}
+
+// garbageCollectDestinationRules deletes the DestinationRules of the registry, and those left by registries removed
+// from the registry config, which belong to none of the ServiceEntries, they are named alike
+func (s *synchronizer) garbageCollectDestinationRules(serviceEntries map[types.NamespacedName]struct{}) {
+	list, err := s.destinationRules(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{LabelSelector: common.AsmSyncerRegistryLabel})
+	if err != nil {
+		log.Errorf("error listing the DestinationRules of registry %s: %v", s.registryName, err)
+		return
+	}
+	for i, dr := range list.Items {
+		key := types.NamespacedName{Namespace: dr.Namespace, Name: dr.Name}
+		if _, ok := serviceEntries[key]; !ok && (s.identity.Owns(&list.Items[i]) || s.abandoned(&list.Items[i])) {
+			s.deleteDestinationRule(dr.Namespace, dr.Name)
+		}
+	}
+}
+
+func (s *synchronizer) deleteDestinationRule(namespace, name string) {
+	client := s.destinationRules(namespace)
+	s.write(writer.Key(destinationRuleKind, namespace, name), func(ctx context.Context) error {
+		err := writer.DeleteDestinationRule(ctx, client, name, s.ownsOrAdopts)
+		if _, notOwned := err.(*serviceentry.NotOwnedError); !notOwned {
+			monitoring.DestinationRuleWritten(s.registryName, monitoring.OperationDelete, err)
+		}
+		return err
+	}, func(err error) {
+		if err != nil {
+			log.Errorf("error deleting DestinationRule %q: %v", name, err)
+			return
+		}
+		log.Infof("deleted DestinationRule %q, registry: %s", name, s.registryName)
+	})
+}
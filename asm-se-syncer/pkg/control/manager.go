@@ -0,0 +1,129 @@
+package control
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+// StartFunc starts the watcher, and its synchronizer, of a registry. They must stop when the context is cancelled.
+type StartFunc func(ctx context.Context, cfg common.RegistryConfig) error
+
+// Manager runs a watcher per registry and applies registry config changes to the running watchers:
+// registries which were added are started, registries which were removed are stopped and registries
+// which changed are restarted. Registries which didn't change keep running untouched. The registries
+// which are configured and which run are recorded in the host claims.
+type Manager struct {
+	start  StartFunc
+	claims *serviceentry.HostClaims
+	m      sync.Mutex
+	// configs are the registries applied last
+	configs []common.RegistryConfig
+	running map[string]*registry
+}
+
+type registry struct {
+	cfg  common.RegistryConfig
+	stop context.CancelFunc
+}
+
+func NewManager(start StartFunc, claims *serviceentry.HostClaims) *Manager {
+	return &Manager{
+		start:   start,
+		claims:  claims,
+		running: make(map[string]*registry),
+	}
+}
+
+// Apply starts, stops and restarts registries so that those of configs are running.
+// Registries which fail to start are reported, and tried again by Retry or on the next Apply.
+func (m *Manager) Apply(ctx context.Context, configs []common.RegistryConfig) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.configs = configs
+	return m.apply(ctx)
+}
+
+// Retry starts the registries which failed to start again every interval, until the context is cancelled
+func (m *Manager) Retry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		m.m.Lock()
+		if len(m.running) < len(m.configs) {
+			if err := m.apply(ctx); err != nil {
+				log.Errorf("error starting the service registries again: %v", err)
+			}
+		}
+		m.m.Unlock()
+	}
+}
+
+// apply makes the registries of m.configs run; callers must hold the lock
+func (m *Manager) apply(ctx context.Context) error {
+	wanted := make(map[string]common.RegistryConfig, len(m.configs))
+	names := make([]string, 0, len(m.configs))
+	for _, cfg := range m.configs {
+		wanted[cfg.Name] = cfg
+		names = append(names, cfg.Name)
+	}
+	m.claims.Configure(names)
+	for name, r := range m.running {
+		cfg, found := wanted[name]
+		if found && reflect.DeepEqual(cfg, r.cfg) {
+			continue
+		}
+		log.Infof("stopping %s registry %q", r.cfg.Type, name)
+		r.stop()
+		delete(m.running, name)
+		monitoring.Forget(name)
+		if !found {
+			// restarted registries keep their hosts
+			m.claims.Stop(name)
+		}
+	}
+
+	var errs []error
+	for _, cfg := range m.configs {
+		if _, found := m.running[cfg.Name]; found {
+			continue
+		}
+		log.Infof("starting %s registry %q", cfg.Type, cfg.Name)
+		m.claims.Start(cfg.Name)
+		monitoring.Register(cfg.Name, string(cfg.Type))
+		registryCtx, stop := context.WithCancel(ctx)
+		if err := m.start(registryCtx, cfg); err != nil {
+			stop()
+			m.claims.Stop(cfg.Name)
+			monitoring.WatchFailed(cfg.Name, err)
+			errs = append(errs, err)
+			continue
+		}
+		m.running[cfg.Name] = &registry{cfg: cfg, stop: stop}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// Running returns the names of the running registries
+func (m *Manager) Running() []string {
+	m.m.Lock()
+	defer m.m.Unlock()
+	names := make([]string, 0, len(m.running))
+	for name := range m.running {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,99 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+func TestManagerApply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the synchronizer tests of registries of the same names must not find them registered
+	defer func() {
+		for _, name := range []string{"consul", "eureka", "nacos", "broken"} {
+			monitoring.Forget(name)
+		}
+	}()
+
+	var started []string
+	contexts := map[string]context.Context{}
+	// broken fails to start until it is fixed
+	fixed := false
+	claims := serviceentry.NewHostClaims()
+	m := NewManager(func(ctx context.Context, cfg common.RegistryConfig) error {
+		if cfg.Name == "broken" && !fixed {
+			return errors.New("no endpoint")
+		}
+		started = append(started, cfg.Name)
+		contexts[cfg.Name] = ctx
+		return nil
+	}, claims)
+
+	consul := common.RegistryConfig{Name: "consul", Type: common.Consul, Endpoint: "http://consul:8500", Consul: &common.ConsulConfig{}}
+	eureka := common.RegistryConfig{Name: "eureka", Type: common.Eureka, Endpoint: "http://eureka:8761", Eureka: &common.EurekaConfig{}}
+	nacos := common.RegistryConfig{Name: "nacos", Type: common.Nacos, Endpoint: "nacos:18848", Nacos: &common.NacosConfig{}}
+	if err := m.Apply(ctx, []common.RegistryConfig{consul, eureka, nacos}); err != nil {
+		t.Fatal(err)
+	}
+	assertRunning(t, m, "consul", "eureka", "nacos")
+
+	// eureka is removed, consul and nacos are changed
+	consul.Prefix = "consul-"
+	nacos.Prefix = "nacos-"
+	started = nil
+	if err := m.Apply(ctx, []common.RegistryConfig{consul, nacos}); err != nil {
+		t.Fatal(err)
+	}
+	assertRunning(t, m, "consul", "nacos")
+	if !reflect.DeepEqual(started, []string{"consul", "nacos"}) {
+		t.Errorf("consul and nacos must be restarted but started %v", started)
+	}
+	if contexts["eureka"].Err() == nil {
+		t.Error("the removed registry must be stopped")
+	}
+	if contexts["consul"].Err() != nil || contexts["nacos"].Err() != nil {
+		t.Error("the restarted registries must be running")
+	}
+	if claims.Running("eureka") || claims.Configured("eureka") || !claims.Running("consul") || !claims.Running("nacos") {
+		t.Error("only the hosts of the running registries may be claimed")
+	}
+
+	// registries failing to start are reported and not running
+	broken := common.RegistryConfig{Name: "broken", Type: common.Zookeeper, Zookeeper: &common.ZookeeperConfig{}}
+	if err := m.Apply(ctx, []common.RegistryConfig{consul, nacos, broken}); err == nil {
+		t.Error("the start error must be returned")
+	}
+	assertRunning(t, m, "consul", "nacos")
+	if claims.Running("broken") || !claims.Configured("broken") {
+		t.Error("the registry failing to start must be configured, but not running")
+	}
+
+	// until they are tried again
+	m.m.Lock()
+	fixed = true
+	m.m.Unlock()
+	go m.Retry(ctx, 10*time.Millisecond)
+	for deadline := time.Now().Add(5 * time.Second); !claims.Running("broken"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the registry failing to start must be tried again")
+		}
+	}
+	assertRunning(t, m, "broken", "consul", "nacos")
+}
+
+func assertRunning(t *testing.T, m *Manager, want ...string) {
+	t.Helper()
+	running := m.Running()
+	sort.Strings(running)
+	if !reflect.DeepEqual(running, want) {
+		t.Errorf("running registries must be %v but got %v", want, running)
+	}
+}
@@ -2,124 +2,640 @@ package control
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	log "github.com/sirupsen/logrus"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/writer"
+)
+
+// the kinds written, serviceEntryKind also names the ServiceEntries in the conflict report
+const (
+	serviceEntryKind    = "ServiceEntry"
+	workloadEntryKind   = "WorkloadEntry"
+	destinationRuleKind = "DestinationRule"
+)
+
+type (
+	// ServiceEntries returns the client writing the ServiceEntries of a namespace
+	ServiceEntries func(namespace string) icapi.ServiceEntryInterface
+	// WorkloadEntries returns the client writing the WorkloadEntries of a namespace, v1.NamespaceAll lists them all
+	WorkloadEntries func(namespace string) icapi.WorkloadEntryInterface
+	// DestinationRules returns the client writing the DestinationRules of a namespace, v1.NamespaceAll lists them all
+	DestinationRules func(namespace string) icapi.DestinationRuleInterface
 )
 
 type synchronizer struct {
 	namespace          string
+	registryType       string
+	registryName       string
 	serviceEntry       serviceentry.ServiceEntryModel
 	store              provider.Cache
 	serviceEntryPrefix string
 	location           v1alpha3.ServiceEntry_Location
-	client             icapi.ServiceEntryInterface
+	serviceEntries     ServiceEntries
 	interval           time.Duration
+	claims             *serviceentry.HostClaims
+	claimed            map[string]struct{} // hosts claimed by this synchronizer
+	refused            map[string]struct{} // hosts refused as someone else than the syncer publishes them
+	leader             *leader.Elector
+	// identity is stamped on everything published, nothing without it is updated or deleted
+	identity serviceentry.Identity
+	// workloadEntries, if set, publishes every endpoint as a WorkloadEntry rather than inline
+	workloadEntries WorkloadEntries
+	portRules       []common.PortRule
+	// destinationRules, if set, publishes a DestinationRule for every ServiceEntry as destinationRule configures
+	destinationRules DestinationRules
+	destinationRule  common.DestinationRuleConfig
+	// namespaceRules place hosts into other namespaces than namespace, exportTo is the default exportTo
+	namespaceRules []common.NamespaceRule
+	exportTo       []string
+	// gc guards the deletions, tombstones are when the hosts whose deletion is pending were found gone
+	gc         common.GarbageCollectionConfig
+	tombstones map[string]time.Time
+	now        func() time.Time
+	// queue, if set, does the writes rather than the synchronizer, fieldManager applies them server-side if set
+	queue        *writer.Queue
+	fieldManager string
+	// pass tracks the writes of the sync running, nil between syncs
+	pass *monitoring.Pass
+	// m guards the state above against the results of the queued writes
+	m sync.Mutex
 }
 
+// NewSynchronizer returns a synchronizer publishing the endpoints found by watcher as ServiceEntries in namespace,
+// written with the client serviceEntries returns for it. Hosts are claimed in claims before they are published,
+// so that a host found in several registries is only published by one of them. Nothing is published until this
+// replica is the leader.
 func NewSynchronizer(namespace string,
-	serviceEntry serviceentry.ServiceEntryModel, store provider.Cache, serviceEntryPrefix string, location v1alpha3.ServiceEntry_Location, interval time.Duration, client icapi.ServiceEntryInterface) *synchronizer {
+	serviceEntry serviceentry.ServiceEntryModel, watcher provider.Watcher, location v1alpha3.ServiceEntry_Location, interval time.Duration, serviceEntries ServiceEntries, claims *serviceentry.HostClaims,
+	elector *leader.Elector) *synchronizer {
 	return &synchronizer{
 		namespace:          namespace,
+		registryType:       watcher.WatcherType(),
+		registryName:       watcher.Name(),
 		serviceEntry:       serviceEntry,
-		store:              store,
-		serviceEntryPrefix: serviceEntryPrefix,
+		store:              watcher.Cache(),
+		serviceEntryPrefix: watcher.Prefix(),
 		location:           location,
-		client:             client,
+		serviceEntries:     serviceEntries,
 		interval:           interval,
+		claims:             claims,
+		claimed:            make(map[string]struct{}),
+		refused:            make(map[string]struct{}),
+		leader:             elector,
+		tombstones:         make(map[string]time.Time),
+		now:                time.Now,
+		identity: serviceentry.Identity{
+			Type:     watcher.WatcherType(),
+			Registry: watcher.Name(),
+			Ref:      serviceEntry.OwnerReference(),
+		},
 	}
 }
 
-// Run the synchronizer until the context is cancelled
+// WithWorkloadEntries makes the synchronizer publish every endpoint as a WorkloadEntry written with clients, selected
+// by the ServiceEntry of its host, rather than as an endpoint of the ServiceEntry. WorkloadEntries of the registry
+// which aren't selected by any of its ServiceEntries anymore are deleted.
+func (s *synchronizer) WithWorkloadEntries(clients WorkloadEntries) *synchronizer {
+	s.workloadEntries = clients
+	return s
+}
+
+// WithRouting makes the synchronizer publish the hosts matching rules into the namespaces they name, and export
+// the ServiceEntries to exportTo unless the rule says otherwise. A host whose namespace changes is published into
+// its new namespace before it is deleted from the old one.
+func (s *synchronizer) WithRouting(rules []common.NamespaceRule, exportTo []string) *synchronizer {
+	s.namespaceRules = rules
+	s.exportTo = exportTo
+	return s
+}
+
+// WithPortRules makes the synchronizer publish the ports matching rules as they declare
+func (s *synchronizer) WithPortRules(rules []common.PortRule) *synchronizer {
+	s.portRules = rules
+	return s
+}
+
+// WithGarbageCollection makes the synchronizer keep the ServiceEntries of hosts gone from the registry for the grace
+// period, and refuse passes deleting more of them than allowed. Without it they are deleted at once.
+func (s *synchronizer) WithGarbageCollection(config common.GarbageCollectionConfig) *synchronizer {
+	s.gc = config
+	return s
+}
+
+// WithWriteQueue makes the synchronizer queue its writes to queue rather than doing them, so that they are rate
+// limited and retried, and handle their results as they are done. SyncOnce mustn't be used then.
+func (s *synchronizer) WithWriteQueue(queue *writer.Queue) *synchronizer {
+	s.queue = queue
+	return s
+}
+
+// WithServerSideApply makes the synchronizer write the ServiceEntries, WorkloadEntries and DestinationRules with
+// server-side apply as fieldManager, rather than create and update them
+func (s *synchronizer) WithServerSideApply(fieldManager string) *synchronizer {
+	s.fieldManager = fieldManager
+	return s
+}
+
+// Run the synchronizer until the context is cancelled.
+// Hosts are published as soon as the watcher changes them, all hosts are synced again every interval
+// to repair ServiceEntries changed by someone else.
 func (s *synchronizer) Run(ctx context.Context) {
+	for !s.leader.IsLeader() {
+		select {
+		case <-s.leader.Leading():
+		case <-s.store.Changed():
+			s.observeSize(s.store.Hosts())
+		case <-ctx.Done():
+			return
+		}
+	}
+	// the watcher kept its cache warm in the meantime, everything is synced at once
+	s.sync()
+
 	ticker := time.NewTicker(s.interval)
 	defer ticker.Stop()
 
 	for {
 		select {
+		case <-s.store.Changed():
+			s.syncDirty()
 		case <-ticker.C:
 			s.sync()
 		case <-ctx.Done():
+			// the published ServiceEntries are kept, but other registries may claim their hosts from now on
+			s.m.Lock()
+			defer s.m.Unlock()
+			for host := range s.claimed {
+				s.claims.Release(host, s.registryName)
+			}
+			for host := range s.refused {
+				s.claims.Release(host, s.registryName)
+			}
 			return
 		}
 	}
 }
 
+// SyncOnce publishes all hosts of the watcher once whether this replica is the leader or not, for one-shot runs
+func (s *synchronizer) SyncOnce() {
+	s.sync()
+}
+
+// syncDirty only publishes the hosts changed since the last sync
+func (s *synchronizer) syncDirty() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.startPass()
+	defer s.endPass()
+	hosts := s.store.Hosts()
+	s.observeSize(hosts)
+	removed := false
+	for _, host := range s.store.Dirty() {
+		if endpoints, ok := hosts[host]; ok {
+			s.createOrUpdate(host, endpoints)
+		} else {
+			removed = true
+		}
+	}
+	if removed {
+		s.garbageCollect(hosts)
+	}
+}
+
 func (s *synchronizer) sync() {
 	// Entries are generated per host; entirely from information in the slice of endpoints;
 	// so we only actually need to compare the current endpoints with the new endpoints.
-	for host, endpoints := range s.store.Hosts() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.startPass()
+	defer s.endPass()
+	s.store.Dirty() // all hosts are synced below
+	hosts := s.store.Hosts()
+	s.observeSize(hosts)
+	for host, endpoints := range hosts {
 		s.createOrUpdate(host, endpoints)
 	}
-	s.garbageCollect()
+	s.garbageCollect(hosts)
 }
 
 func (s *synchronizer) createOrUpdate(host string, endpoints []*v1alpha3.WorkloadEntry) {
-	newServiceEntry := serviceentry.Builder(s.namespace, s.serviceEntryPrefix, host, s.location, endpoints)
+	if theirs, found := s.serviceEntry.Theirs()[host]; found {
+		// written by hand or by another tool, it is never overwritten
+		s.refuse(host, serviceentry.Publisher(serviceEntryKind, theirs))
+		return
+	}
+	existing, found := s.serviceEntry.Ours()[host]
+	if found && !s.owns(host, existing) && !s.adopts(existing) {
+		registry := existing.Labels[common.AsmSyncerRegistryLabel]
+		if registry == "" || !s.claims.Running(registry) {
+			// published by a registry of another type before they were labelled with their names, or by another
+			// deployment of the syncer
+			s.refuse(host, serviceentry.Publisher(serviceEntryKind, existing))
+			return
+		}
+		// the host was published by another registry before we started, it keeps the host
+		s.claims.Claim(host, registry)
+	}
+	if _, ok := s.claims.Claim(host, s.registryName); !ok {
+		return
+	}
+	s.claimed[host] = struct{}{}
+	delete(s.refused, host)
+	delete(s.tombstones, host)
+
+	namespace, exportTo := serviceentry.Route(s.namespaceRules, s.namespace, s.exportTo, host, endpoints)
+	labels := s.identity.Labels()
+	newServiceEntry := serviceentry.Builder(namespace, s.serviceEntryPrefix, host, s.location, endpoints, labels)
+	newServiceEntry.Spec.ExportTo = exportTo
+	s.identity.Stamp(newServiceEntry)
+	serviceentry.ApplyPortRules(newServiceEntry, host, s.portRules)
 	name := common.FormatedName(host)
-	if _, ok := s.serviceEntry.Ours()[host]; ok {
-		// If we have already created an identical service entry, return.
-		if reflect.DeepEqual(s.serviceEntry.Ours()[host].Spec.Endpoints, endpoints) {
+	if s.destinationRules != nil {
+		s.syncDestinationRule(namespace, name, serviceentry.BuildDestinationRule(newServiceEntry,
+			s.destinationRule.SubsetKeys, s.destinationRule.TrafficPolicy))
+	}
+	// the ports and exportTo are compared too, as the rules may have changed
+	unchanged := found && reflect.DeepEqual(existing.Spec.Endpoints, newServiceEntry.Spec.Endpoints) &&
+		proto.Equal(&v1alpha3.ServiceEntry{Ports: existing.Spec.Ports, ExportTo: existing.Spec.ExportTo},
+			&v1alpha3.ServiceEntry{Ports: newServiceEntry.Spec.Ports, ExportTo: newServiceEntry.Spec.ExportTo})
+	if s.workloadEntries != nil {
+		workloadEntries := serviceentry.SelectWorkloadEntries(newServiceEntry, labels)
+		for _, we := range workloadEntries {
+			s.identity.Stamp(we)
+		}
+		// the endpoints are published before the ServiceEntry selecting them
+		s.syncWorkloadEntries(namespace, name, workloadEntries)
+		unchanged = found && proto.Equal(&existing.Spec, &newServiceEntry.Spec)
+	}
+	client := s.serviceEntries(namespace)
+	// a host routed into another namespace is created there, and deleted from its old namespace afterwards
+	moved := found && existing.Namespace != namespace
+	// If we have already created an identical service entry, return.
+	// Entries created before they had owner references are updated to get them.
+	if found && !moved && unchanged && reflect.DeepEqual(existing.Labels, labels) && s.identity.Stamped(existing) {
+		return
+	}
+	operation, written := monitoring.OperationCreate, "created"
+	if found && !moved {
+		operation, written = monitoring.OperationUpdate, "updated"
+	}
+	if found && s.adopts(existing) {
+		log.Infof("registry %s takes over Service Entry %q of registry %s, which doesn't run", s.registryName, existing.Name,
+			existing.Labels[common.AsmSyncerRegistryLabel])
+	}
+	owns := func(current v1.Object) bool { return s.owns(host, current) || s.adopts(current) }
+	s.write(writer.Key(serviceEntryKind, namespace, name), func(ctx context.Context) error {
+		err := writer.ApplyServiceEntry(ctx, client, newServiceEntry, nil, owns, s.fieldManager)
+		if _, notOwned := err.(*serviceentry.NotOwnedError); !notOwned {
+			monitoring.ServiceEntryWritten(s.registryName, operation, err)
+		}
+		return err
+	}, func(err error) {
+		if notOwned, ok := err.(*serviceentry.NotOwnedError); ok {
+			// replaced since it was cached
+			s.refuse(host, notOwned.Publisher)
 			return
 		}
-		// Otherwise, endpoints have changed so update existing Service Entry
-		oldServiceEntry, err := s.client.Get(context.TODO(), name, v1.GetOptions{})
 		if err != nil {
-			log.Errorf("failed to get existing service entry %q for host %q, errMsg %v", name, host, err)
+			log.Errorf("error writing Service Entry %q: %v", name, err)
+			return
+		}
+		log.Infof("%s Service Entry %q, host: %s, registry: %s", written, name, host, s.registryName)
+		if moved {
+			log.Infof("host %s moved from namespace %s to %s, registry: %s", host, existing.Namespace, namespace, s.registryName)
+			s.deleteServiceEntry(host, existing)
+		}
+	})
+}
+
+// startPass starts tracking the writes of a sync, it is recorded as successful once they all succeeded
+func (s *synchronizer) startPass() {
+	s.pass = monitoring.StartPass(s.registryName)
+}
+
+// endPass ends the sync, the writes done after it ended were started by the results of its writes and aren't tracked
+func (s *synchronizer) endPass() {
+	s.pass.End()
+	s.pass = nil
+}
+
+// write does a write at once, or queues it with the write queue if there is one. done is called with the final
+// result of the write, holding s.m if it was queued; it isn't called if the write is replaced by a later one.
+func (s *synchronizer) write(key string, write writer.Write, done func(error)) {
+	pass := s.pass
+	pass.Add()
+	finish := func(err error) {
+		done(err)
+		if _, notOwned := err.(*serviceentry.NotOwnedError); notOwned {
+			// refused, the conflict is reported instead
+			err = nil
+		}
+		pass.Done(err)
+	}
+	if s.queue == nil {
+		finish(writer.Do(context.TODO(), write))
+		return
+	}
+	s.queue.Add(key, write, func(err error) {
+		if err == writer.ErrReplaced {
+			// called by Add, which may hold s.m already
+			pass.Done(err)
+			return
+		}
+		s.m.Lock()
+		defer s.m.Unlock()
+		finish(err)
+	})
+}
+
+// garbageCollect deletes the ServiceEntries, and their WorkloadEntries and DestinationRules, of the hosts gone from
+// the registry for longer than the grace period. Nothing is deleted while the registry can't be reached, the last
+// known endpoints are kept instead.
+func (s *synchronizer) garbageCollect(hosts map[string][]*v1alpha3.WorkloadEntry) {
+	if !monitoring.Connected(s.registryName) {
+		log.Warnf("registry %s can't be reached, the ServiceEntries of its last known services are kept", s.registryName)
+		return
+	}
+	now := s.now()
+	ours := s.serviceEntry.Ours()
+	owned := 0
+	var expired []string
+	for host, se := range ours {
+		// skip entries published by other registries, and those published before they were labelled with their
+		// registry into other namespaces, they may have been published by other deployments of the syncer; those
+		// left by registries removed from the registry config are collected too
+		if !s.owns(host, se) && !s.abandoned(se) || serviceentry.Legacy(se) && se.Namespace != s.namespace {
+			continue
+		}
+		owned++
+		if _, ok := hosts[host]; ok {
+			continue
+		}
+		since, found := s.tombstones[host]
+		if !found {
+			since = now
+			s.tombstones[host] = now
+			if s.gc.GracePeriod > 0 {
+				log.Infof("host %s is gone from registry %s, its Service Entry %q is deleted in %s", host, s.registryName,
+					se.Name, time.Duration(s.gc.GracePeriod))
+			}
+		}
+		if now.Sub(since) >= time.Duration(s.gc.GracePeriod) {
+			expired = append(expired, host)
+		}
+	}
+	for host := range s.tombstones {
+		// back, or deleted by someone else
+		if _, ok := hosts[host]; ok {
+			delete(s.tombstones, host)
+		} else if se, found := ours[host]; !found || !s.owns(host, se) && !s.abandoned(se) {
+			delete(s.tombstones, host)
+		}
+	}
+
+	blocked := 0
+	if token := deletionToken(expired); s.massDeletion(len(expired), owned) && s.gc.ConfirmMassDeletion != token {
+		blocked = len(expired)
+		log.Errorf("refusing to delete %d of the %d Service Entries of registry %s at once, more than %d%%; they are "+
+			"deleted once confirmed with garbageCollection.confirmMassDeletion %q", blocked, owned, s.registryName,
+			s.gc.MaxDeletionPercent, token)
+		// the registry isn't in sync until the deletions are confirmed
+		s.pass.Fail()
+	} else {
+		for _, host := range expired {
+			s.deleteServiceEntry(host, ours[host])
+		}
+	}
+	monitoring.SetDeletions(s.registryName, len(s.tombstones), blocked)
+
+	// the hosts whose deletion is pending keep everything they published
+	retained := make(map[string]struct{}, len(hosts)+len(s.tombstones))
+	for host := range hosts {
+		retained[host] = struct{}{}
+	}
+	for host := range s.tombstones {
+		retained[host] = struct{}{}
+	}
+	// the WorkloadEntries and DestinationRules of a host are kept in the namespace it is routed into, and in the
+	// namespace of its ServiceEntry while it is moved
+	placed := make(map[types.NamespacedName]struct{}, len(retained))
+	for host := range retained {
+		if endpoints, ok := hosts[host]; ok {
+			namespace, _ := serviceentry.Route(s.namespaceRules, s.namespace, s.exportTo, host, endpoints)
+			placed[types.NamespacedName{Namespace: namespace, Name: common.FormatedName(host)}] = struct{}{}
+		}
+		if se, ok := ours[host]; ok {
+			placed[types.NamespacedName{Namespace: se.Namespace, Name: common.FormatedName(host)}] = struct{}{}
+		}
+	}
+	for host := range s.claimed {
+		if _, ok := retained[host]; !ok {
+			s.claims.Release(host, s.registryName)
+			delete(s.claimed, host)
+		}
+	}
+	for host := range s.refused {
+		if _, ok := hosts[host]; !ok {
+			s.claims.Release(host, s.registryName)
+			delete(s.refused, host)
+		}
+	}
+	if s.workloadEntries != nil {
+		s.garbageCollectWorkloadEntries(placed)
+	}
+	if s.destinationRules != nil {
+		s.garbageCollectDestinationRules(placed)
+	}
+}
+
+// massDeletion reports whether deleting count of the owned ServiceEntries at once is more than allowed. A
+// single ServiceEntry may always be deleted.
+func (s *synchronizer) massDeletion(count, owned int) bool {
+	if s.gc.MaxDeletionPercent <= 0 || count <= 1 {
+		return false
+	}
+	return count*100 > s.gc.MaxDeletionPercent*owned
+}
+
+// deletionToken names the deletion of hosts, so that confirming it doesn't confirm the deletion of other hosts
+func deletionToken(hosts []string) string {
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(sum[:4])
+}
+
+// deleteServiceEntry deletes the ServiceEntry of host, unless it was replaced by someone else since it was
+// cached. The tombstone of the host is removed once the ServiceEntry is gone.
+func (s *synchronizer) deleteServiceEntry(host string, se *ic.ServiceEntry) {
+	name := se.Name
+	client := s.serviceEntries(se.Namespace)
+	owns := func(current v1.Object) bool { return s.owns(host, current) || s.adopts(current) }
+	s.write(writer.Key(serviceEntryKind, se.Namespace, name), func(ctx context.Context) error {
+		err := writer.DeleteServiceEntry(ctx, client, name, owns)
+		if _, notOwned := err.(*serviceentry.NotOwnedError); !notOwned {
+			monitoring.ServiceEntryWritten(s.registryName, monitoring.OperationDelete, err)
+		}
+		return err
+	}, func(err error) {
+		if notOwned, ok := err.(*serviceentry.NotOwnedError); ok {
+			log.Warnf("Service Entry %q is published by %s now, it isn't deleted", name, notOwned.Publisher)
+			delete(s.tombstones, host)
 			return
 		}
-		newServiceEntry.ResourceVersion = oldServiceEntry.ResourceVersion
-		rv, err := s.client.Update(context.TODO(), newServiceEntry, v1.UpdateOptions{})
 		if err != nil {
-			log.Errorf("error updating Service Entry %q: %v", name, err)
+			log.Errorf("error deleting Service Entry %q: %v", name, err)
 			return
 		}
-		log.Infof("updated Service Entry %q, ResourceVersion is now %q, host: %s, prefix: %s", name, rv.ResourceVersion, host, s.serviceEntryPrefix)
+		log.Infof("successfully deleted Service Entry %q, registry: %s", name, s.registryName)
+		delete(s.tombstones, host)
+	})
+}
+
+// refuse gives up host, as it is published by owner which isn't the syncer, and reports the conflict
+func (s *synchronizer) refuse(host, owner string) {
+	s.claims.Refuse(host, s.registryName, owner)
+	s.refused[host] = struct{}{}
+	delete(s.claimed, host)
+}
+
+// syncWorkloadEntries creates, updates and deletes the WorkloadEntries selected by the named ServiceEntry of
+// namespace so that they are the desired ones
+func (s *synchronizer) syncWorkloadEntries(namespace, serviceEntryName string, desired []*ic.WorkloadEntry) {
+	// those of registries which don't run are taken over
+	selector := k8slabels.Set{common.AsmSyncerServiceLabel: serviceentry.SelectorValue(serviceEntryName)}
+	client := s.workloadEntries(namespace)
+	list, err := client.List(context.TODO(), v1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		log.Errorf("error listing the WorkloadEntries of Service Entry %q: %v", serviceEntryName, err)
 		return
 	}
-	// Otherwise, create a new Service Entry
-	rv, err := s.client.Create(context.TODO(), newServiceEntry, v1.CreateOptions{})
+	current := make(map[string]*ic.WorkloadEntry, len(list.Items))
+	for i := range list.Items {
+		if s.ownsOrAdopts(&list.Items[i]) {
+			current[list.Items[i].Name] = &list.Items[i]
+		}
+	}
+
+	for _, we := range desired {
+		existing, found := current[we.Name]
+		delete(current, we.Name)
+		if found && proto.Equal(&existing.Spec, &we.Spec) && reflect.DeepEqual(existing.Labels, we.Labels) && s.identity.Stamped(existing) {
+			continue
+		}
+		s.applyWorkloadEntry(client, we, found)
+	}
+	for name := range current {
+		s.deleteWorkloadEntry(namespace, name)
+	}
+}
+
+// garbageCollectWorkloadEntries deletes the WorkloadEntries of the registry, and those left by registries removed
+// from the registry config, which are selected by none of the ServiceEntries
+func (s *synchronizer) garbageCollectWorkloadEntries(serviceEntries map[types.NamespacedName]struct{}) {
+	list, err := s.workloadEntries(v1.NamespaceAll).List(context.TODO(), v1.ListOptions{LabelSelector: common.AsmSyncerRegistryLabel})
 	if err != nil {
-		log.Errorf("error creating Service Entry %q: %v\n%v", name, err, newServiceEntry)
+		log.Errorf("error listing the WorkloadEntries of registry %s: %v", s.registryName, err)
+		return
+	}
+	wanted := make(map[types.NamespacedName]struct{}, len(serviceEntries))
+	for se := range serviceEntries {
+		wanted[types.NamespacedName{Namespace: se.Namespace, Name: serviceentry.SelectorValue(se.Name)}] = struct{}{}
+	}
+	for i, we := range list.Items {
+		selected := types.NamespacedName{Namespace: we.Namespace, Name: we.Labels[common.AsmSyncerServiceLabel]}
+		if _, ok := wanted[selected]; !ok && (s.identity.Owns(&list.Items[i]) || s.abandoned(&list.Items[i])) {
+			s.deleteWorkloadEntry(we.Namespace, we.Name)
+		}
 	}
-	log.Infof("created Service Entry %q, ResourceVersion is %q, host: %s, prefix: %s", name, rv.ResourceVersion, host, s.serviceEntryPrefix)
 }
 
-func (s *synchronizer) garbageCollect() {
-	for host := range s.serviceEntry.Ours() {
-		//skip host not belong to synchronizer prefix
-		if !strings.HasPrefix(host, s.serviceEntryPrefix) {
-			continue
+// applyWorkloadEntry creates we, or updates it if it was found
+func (s *synchronizer) applyWorkloadEntry(client icapi.WorkloadEntryInterface, we *ic.WorkloadEntry, found bool) {
+	operation := monitoring.OperationCreate
+	if found {
+		operation = monitoring.OperationUpdate
+	}
+	s.write(writer.Key(workloadEntryKind, we.Namespace, we.Name), func(ctx context.Context) error {
+		err := writer.ApplyWorkloadEntry(ctx, client, we, s.ownsOrAdopts, s.fieldManager)
+		if _, notOwned := err.(*serviceentry.NotOwnedError); !notOwned {
+			monitoring.WorkloadEntryWritten(s.registryName, operation, err)
 		}
-		// If host no longer exists, delete service entry
-		allHost := []string{}
-		for k := range s.store.Hosts() {
-			allHost = append(allHost, k)
-		}
-		if _, ok := s.store.Hosts()[host]; !ok {
-			name := host
-			//name := serviceentry.ServiceEntryName(s.serviceEntryPrefix, host)
-			oldServiceEntry, err := s.client.Get(context.TODO(), name, v1.GetOptions{})
-			// check the ASM label
-			if err != nil {
-				log.Error(err, "get oldServiceEntry get failed")
-			}
-			if oldServiceEntry.Labels[common.AsmSyncerLabel] != string(common.Consul) {
-				continue
-			}
-			if err := s.client.Delete(context.TODO(), name, v1.DeleteOptions{}); err != nil {
-				log.Errorf("error deleting Service Entry %q: %v", name, err)
-			}
-			log.Infof("successfully deleted Service Entry %q", name)
+		return err
+	}, func(err error) {
+		if err != nil {
+			log.Errorf("error writing WorkloadEntry %q: %v", we.Name, err)
 		}
+	})
+}
+
+func (s *synchronizer) deleteWorkloadEntry(namespace, name string) {
+	client := s.workloadEntries(namespace)
+	s.write(writer.Key(workloadEntryKind, namespace, name), func(ctx context.Context) error {
+		err := writer.DeleteWorkloadEntry(ctx, client, name, s.ownsOrAdopts)
+		if _, notOwned := err.(*serviceentry.NotOwnedError); !notOwned {
+			monitoring.WorkloadEntryWritten(s.registryName, monitoring.OperationDelete, err)
+		}
+		return err
+	}, func(err error) {
+		if err != nil {
+			log.Errorf("error deleting WorkloadEntry %q: %v", name, err)
+			return
+		}
+		log.Infof("deleted WorkloadEntry %q, registry: %s", name, s.registryName)
+	})
+}
+
+// observeSize records the number of services and endpoints found by the watcher
+func (s *synchronizer) observeSize(hosts map[string][]*v1alpha3.WorkloadEntry) {
+	endpoints := 0
+	for _, eps := range hosts {
+		endpoints += len(eps)
 	}
+	monitoring.SetRegistrySize(s.registryName, len(hosts), endpoints)
+}
+
+// owns reports whether se was published for the registry of this synchronizer.
+// Entries published before they were labelled with the registry name are matched by type and prefix.
+func (s *synchronizer) owns(host string, se v1.Object) bool {
+	if !s.identity.Owns(se) {
+		return false
+	}
+	return !serviceentry.Legacy(se) || strings.HasPrefix(host, s.serviceEntryPrefix)
+}
+
+// adopts reports whether obj was published for another registry which doesn't run, the registry takes it over
+func (s *synchronizer) adopts(obj v1.Object) bool {
+	return s.identity.Orphaned(obj, s.claims.Running)
+}
+
+// abandoned reports whether obj was published for a registry removed from the registry config, the registry
+// deletes it once it isn't published anymore
+func (s *synchronizer) abandoned(obj v1.Object) bool {
+	return s.identity.Orphaned(obj, s.claims.Configured)
+}
+
+// ownsOrAdopts reports whether the registry may write obj
+func (s *synchronizer) ownsOrAdopts(obj v1.Object) bool {
+	return s.identity.Owns(obj) || s.adopts(obj)
 }
@@ -0,0 +1,400 @@
+package control
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+type fakeWatcher struct {
+	provider.Watcher
+	cache provider.Cache
+}
+
+func (w fakeWatcher) Cache() provider.Cache { return w.cache }
+func (w fakeWatcher) Name() string          { return "consul" }
+func (w fakeWatcher) Prefix() string        { return "" }
+func (w fakeWatcher) WatcherType() string   { return "consul" }
+
+func TestSyncWorkloadEntries(t *testing.T) {
+	cache := provider.NewCache()
+	client := fake.NewSimpleClientset().NetworkingV1alpha3()
+	s := NewSynchronizer("external", serviceentry.New(v1.OwnerReference{}), fakeWatcher{cache: cache},
+		v1alpha3.ServiceEntry_MESH_EXTERNAL, 0, client.ServiceEntries, serviceentry.NewHostClaims(),
+		leader.Always()).WithWorkloadEntries(client.WorkloadEntries)
+
+	cache.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"web.service.consul": {serviceentry.Endpoint("10.0.0.1", 80), serviceentry.Endpoint("10.0.0.2", 80)},
+		"db.service.consul":  {serviceentry.Endpoint("10.0.1.1", 3306)},
+	})
+	s.SyncOnce()
+	se, err := client.ServiceEntries("external").Get(context.Background(), "web.service.consul", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(se.Spec.Endpoints) != 0 || se.Spec.WorkloadSelector == nil {
+		t.Errorf("the ServiceEntry must select its endpoints, got %v", se.Spec)
+	}
+	assertWorkloadEntries(t, client, "10.0.0.1", "10.0.0.2", "10.0.1.1")
+
+	// an instance and a service are gone
+	cache.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"web.service.consul": {serviceentry.Endpoint("10.0.0.2", 80)},
+	})
+	s.SyncOnce()
+	assertWorkloadEntries(t, client, "10.0.0.2")
+}
+
+func TestSyncDestinationRules(t *testing.T) {
+	cache := provider.NewCache()
+	client := fake.NewSimpleClientset().NetworkingV1alpha3()
+	s := NewSynchronizer("external", serviceentry.New(v1.OwnerReference{}), fakeWatcher{cache: cache},
+		v1alpha3.ServiceEntry_MESH_EXTERNAL, 0, client.ServiceEntries, serviceentry.NewHostClaims(),
+		leader.Always()).WithDestinationRules(client.DestinationRules,
+		common.DestinationRuleConfig{SubsetKeys: common.StringList{"version"}})
+	endpoint := func(address, version string) *v1alpha3.WorkloadEntry {
+		ep := serviceentry.Endpoint(address, 80)
+		ep.Labels = map[string]string{"version": version}
+		return ep
+	}
+
+	cache.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"web.service.consul": {endpoint("10.0.0.1", "v1"), endpoint("10.0.0.2", "v2")},
+		"db.service.consul":  {serviceentry.Endpoint("10.0.1.1", 3306)},
+	})
+	s.SyncOnce()
+	dr, err := client.DestinationRules("external").Get(context.Background(), "web.service.consul", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dr.Spec.Host != "web.service.consul" || len(dr.Spec.Subsets) != 2 || dr.Labels[common.AsmSyncerRegistryLabel] != "consul" {
+		t.Errorf("unexpected DestinationRule %v", dr)
+	}
+	if _, err := client.DestinationRules("external").Get(context.Background(), "db.service.consul", v1.GetOptions{}); err == nil {
+		t.Error("a service without subsets must have no DestinationRule")
+	}
+
+	// the v2 instances are gone, then the whole service
+	cache.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"web.service.consul": {endpoint("10.0.0.1", "v1")},
+	})
+	s.SyncOnce()
+	dr, err = client.DestinationRules("external").Get(context.Background(), "web.service.consul", v1.GetOptions{})
+	if err != nil || len(dr.Spec.Subsets) != 1 {
+		t.Errorf("the DestinationRule must be updated, got %v, %v", dr, err)
+	}
+	cache.Set(map[string][]*v1alpha3.WorkloadEntry{})
+	s.SyncOnce()
+	if list, _ := client.DestinationRules("external").List(context.Background(), v1.ListOptions{}); len(list.Items) != 0 {
+		t.Errorf("the DestinationRules of the registry must be deleted, got %v", list.Items)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	ctx := context.Background()
+	cache := provider.NewCache()
+	// written by hand for a host of the registry
+	foreign := &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{Name: "web.service.consul", Namespace: "external"},
+		Spec:       v1alpha3.ServiceEntry{Hosts: []string{"web.service.consul"}},
+	}
+	client := fake.NewSimpleClientset(foreign).NetworkingV1alpha3()
+	model := serviceentry.New(v1.OwnerReference{})
+	claims := serviceentry.NewHostClaims()
+	s := NewSynchronizer("external", model, fakeWatcher{cache: cache}, v1alpha3.ServiceEntry_MESH_EXTERNAL, 0,
+		client.ServiceEntries, claims, leader.Always())
+
+	cache.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"web.service.consul": {serviceentry.Endpoint("10.0.0.1", 80)},
+		"db.service.consul":  {serviceentry.Endpoint("10.0.1.1", 3306)},
+	})
+	s.SyncOnce()
+	// once before the informer cached it, once after
+	if err := model.Insert(foreign); err != nil {
+		t.Fatal(err)
+	}
+	s.SyncOnce()
+	web, err := client.ServiceEntries("external").Get(ctx, "web.service.consul", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(web.Spec.Endpoints) != 0 || len(web.Labels) != 0 {
+		t.Errorf("the ServiceEntry written by hand must not be overwritten, got %v", web)
+	}
+	want := []serviceentry.Conflict{{Host: "web.service.consul", Owner: "ServiceEntry external/web.service.consul", Rejected: []string{"consul"}}}
+	if got := claims.Conflicts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("conflicts = %v, want %v", got, want)
+	}
+	db, err := client.ServiceEntries("external").Get(ctx, "db.service.consul", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Annotations[common.AsmSyncerOwnerAnnotation] != "consul/consul" {
+		t.Errorf("the ServiceEntry must be annotated with its owner, got %v", db.Annotations)
+	}
+
+	// the cached ServiceEntry was taken over by someone else since
+	if err := model.Insert(db.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	db.Labels, db.Annotations = nil, nil
+	if _, err := client.ServiceEntries("external").Update(ctx, db, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	cache.Set(map[string][]*v1alpha3.WorkloadEntry{})
+	s.SyncOnce()
+	if _, err := client.ServiceEntries("external").Get(ctx, "db.service.consul", v1.GetOptions{}); err != nil {
+		t.Errorf("the ServiceEntry taken over must not be deleted: %v", err)
+	}
+	if got := claims.Conflicts(); len(got) != 0 {
+		t.Errorf("the conflicts of hosts gone must be withdrawn, got %v", got)
+	}
+}
+
+func TestAdoption(t *testing.T) {
+	ctx := context.Background()
+	// published stamps a ServiceEntry of host as published for registry
+	published := func(host, registry string) *ic.ServiceEntry {
+		se := serviceentry.Builder("external", "", host, v1alpha3.ServiceEntry_MESH_EXTERNAL,
+			[]*v1alpha3.WorkloadEntry{serviceentry.Endpoint("10.0.0.9", 80)}, nil)
+		serviceentry.Identity{Type: "consul", Registry: registry}.Stamp(se)
+		return se
+	}
+	existing := []*ic.ServiceEntry{
+		// consul-0 was renamed to consul, consul-dev runs and consul-broken failed to start
+		published("web.service.consul", "consul-0"),
+		published("gone.service.consul", "consul-0"),
+		published("db.service.consul", "consul-dev"),
+		published("cache.service.consul", "consul-broken"),
+	}
+	clientset := fake.NewSimpleClientset()
+	client := clientset.NetworkingV1alpha3()
+	model := serviceentry.New(v1.OwnerReference{})
+	for _, se := range existing {
+		if _, err := client.ServiceEntries("external").Create(ctx, se, v1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		_ = model.Insert(se)
+	}
+	claims := serviceentry.NewHostClaims()
+	claims.Configure([]string{"consul", "consul-dev", "consul-broken"})
+	claims.Start("consul")
+	claims.Start("consul-dev")
+	cache := provider.NewCache()
+	s := NewSynchronizer("external", model, fakeWatcher{cache: cache}, v1alpha3.ServiceEntry_MESH_EXTERNAL, 0,
+		client.ServiceEntries, claims, leader.Always())
+
+	cache.Set(map[string][]*v1alpha3.WorkloadEntry{
+		"web.service.consul": {serviceentry.Endpoint("10.0.0.1", 80)},
+		"db.service.consul":  {serviceentry.Endpoint("10.0.1.1", 3306)},
+	})
+	s.SyncOnce()
+	// the ServiceEntry of the renamed registry is taken over, the one of the host gone from it is deleted
+	assertServiceEntries(t, client, "cache.service.consul", "db.service.consul", "web.service.consul")
+	web, err := client.ServiceEntries("external").Get(ctx, "web.service.consul", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web.Labels[common.AsmSyncerRegistryLabel] != "consul" || web.Spec.Endpoints[0].Address != "10.0.0.1" {
+		t.Errorf("the ServiceEntry left by the renamed registry must be taken over, got %v", web)
+	}
+	// the hosts of the running registries are kept by them
+	db, err := client.ServiceEntries("external").Get(ctx, "db.service.consul", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Labels[common.AsmSyncerRegistryLabel] != "consul-dev" {
+		t.Errorf("the ServiceEntry of the running registry must be left as is, got %v", db)
+	}
+	want := []serviceentry.Conflict{{Host: "db.service.consul", Owner: "consul-dev", Rejected: []string{"consul"}}}
+	if got := claims.Conflicts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("conflicts = %v, want %v", got, want)
+	}
+}
+
+func TestGarbageCollection(t *testing.T) {
+	cache := provider.NewCache()
+	client := fake.NewSimpleClientset().NetworkingV1alpha3()
+	model := serviceentry.New(v1.OwnerReference{})
+	s := NewSynchronizer("external", model, fakeWatcher{cache: cache}, v1alpha3.ServiceEntry_MESH_EXTERNAL, 0,
+		client.ServiceEntries, serviceentry.NewHostClaims(), leader.Always()).
+		WithGarbageCollection(common.GarbageCollectionConfig{GracePeriod: common.Duration(time.Minute), MaxDeletionPercent: 50})
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	// sync publishes the hosts once, and lets the model catch up like the informer would
+	sync := func(hosts ...string) {
+		t.Helper()
+		endpoints := make(map[string][]*v1alpha3.WorkloadEntry, len(hosts))
+		for _, host := range hosts {
+			endpoints[host] = []*v1alpha3.WorkloadEntry{serviceentry.Endpoint("10.0.0.1", 80)}
+		}
+		cache.Set(endpoints)
+		s.SyncOnce()
+		list, err := client.ServiceEntries("external").List(context.Background(), v1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, se := range model.Ours() {
+			_ = model.Delete(se)
+		}
+		for i := range list.Items {
+			_ = model.Insert(&list.Items[i])
+		}
+	}
+
+	sync("a.service.consul", "b.service.consul", "c.service.consul", "d.service.consul")
+	// nothing is deleted while the registry can't be reached
+	monitoring.Register("consul", "consul")
+	sync()
+	monitoring.Forget("consul")
+	assertServiceEntries(t, client, "a.service.consul", "b.service.consul", "c.service.consul", "d.service.consul")
+
+	// a host is deleted once it is gone for the grace period
+	sync("a.service.consul", "b.service.consul", "c.service.consul")
+	assertServiceEntries(t, client, "a.service.consul", "b.service.consul", "c.service.consul", "d.service.consul")
+	now = now.Add(time.Minute)
+	sync("a.service.consul", "b.service.consul", "c.service.consul")
+	assertServiceEntries(t, client, "a.service.consul", "b.service.consul", "c.service.consul")
+
+	// an empty catalog deletes more than half of the hosts at once, until it is confirmed
+	sync()
+	now = now.Add(time.Minute)
+	sync()
+	assertServiceEntries(t, client, "a.service.consul", "b.service.consul", "c.service.consul")
+	s.gc.ConfirmMassDeletion = deletionToken([]string{"c.service.consul", "b.service.consul", "a.service.consul"})
+	sync()
+	assertServiceEntries(t, client)
+
+	// the confirmation was for these hosts only, the next mass deletion is refused again
+	sync("e.service.consul", "f.service.consul")
+	sync()
+	now = now.Add(time.Minute)
+	sync()
+	assertServiceEntries(t, client, "e.service.consul", "f.service.consul")
+}
+
+func TestRouting(t *testing.T) {
+	ctx := context.Background()
+	cache := provider.NewCache()
+	client := fake.NewSimpleClientset().NetworkingV1alpha3()
+	model := serviceentry.New(v1.OwnerReference{})
+	rules := []common.NamespaceRule{
+		{Namespace: "payments", Labels: map[string]string{"team": "payments"}, ExportTo: common.StringList{"."}},
+	}
+	s := NewSynchronizer("external", model, fakeWatcher{cache: cache}, v1alpha3.ServiceEntry_MESH_EXTERNAL, 0,
+		client.ServiceEntries, serviceentry.NewHostClaims(), leader.Always()).
+		WithWorkloadEntries(client.WorkloadEntries).
+		WithDestinationRules(client.DestinationRules, common.DestinationRuleConfig{SubsetKeys: common.StringList{"version"}}).
+		WithRouting(rules, []string{"*"})
+	// sync publishes the host of the team once, and lets the model catch up like the informer would
+	sync := func(team string) {
+		t.Helper()
+		ep := serviceentry.Endpoint("10.0.0.1", 80)
+		ep.Labels = map[string]string{"team": team, "version": "v1"}
+		cache.Set(map[string][]*v1alpha3.WorkloadEntry{"web.service.consul": {ep}})
+		s.SyncOnce()
+		list, err := client.ServiceEntries(v1.NamespaceAll).List(ctx, v1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, se := range model.Ours() {
+			_ = model.Delete(se)
+		}
+		for i := range list.Items {
+			_ = model.Insert(&list.Items[i])
+		}
+	}
+	// assertPlaced checks the namespaces the ServiceEntry, WorkloadEntries and DestinationRule are found in
+	assertPlaced := func(exportTo []string, namespaces ...string) {
+		t.Helper()
+		ses, _ := client.ServiceEntries(v1.NamespaceAll).List(ctx, v1.ListOptions{})
+		wes, _ := client.WorkloadEntries(v1.NamespaceAll).List(ctx, v1.ListOptions{})
+		drs, _ := client.DestinationRules(v1.NamespaceAll).List(ctx, v1.ListOptions{})
+		var got []string
+		for _, se := range ses.Items {
+			got = append(got, "ServiceEntry "+se.Namespace)
+			if !reflect.DeepEqual(se.Spec.ExportTo, exportTo) {
+				t.Errorf("ServiceEntry %s/%s is exported to %v, want %v", se.Namespace, se.Name, se.Spec.ExportTo, exportTo)
+			}
+		}
+		for _, we := range wes.Items {
+			got = append(got, "WorkloadEntry "+we.Namespace)
+		}
+		for _, dr := range drs.Items {
+			got = append(got, "DestinationRule "+dr.Namespace)
+			if !reflect.DeepEqual(dr.Spec.ExportTo, exportTo) {
+				t.Errorf("DestinationRule %s/%s is exported to %v, want %v", dr.Namespace, dr.Name, dr.Spec.ExportTo, exportTo)
+			}
+		}
+		want := []string{"ServiceEntry " + namespaces[0], "WorkloadEntry " + namespaces[1], "DestinationRule " + namespaces[2]}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("published %v, want %v", got, want)
+		}
+	}
+
+	sync("payments")
+	assertPlaced([]string{"."}, "payments", "payments", "payments")
+
+	// the ServiceEntry moves at once, the WorkloadEntries it selected are kept until the move was observed
+	sync("web")
+	ses, _ := client.ServiceEntries(v1.NamespaceAll).List(ctx, v1.ListOptions{})
+	if len(ses.Items) != 1 || ses.Items[0].Namespace != "external" {
+		t.Fatalf("the ServiceEntry must be moved into the default namespace, got %v", ses.Items)
+	}
+	sync("web")
+	assertPlaced([]string{"*"}, "external", "external", "external")
+}
+
+func assertServiceEntries(t *testing.T, client icapi.NetworkingV1alpha3Interface, hosts ...string) {
+	t.Helper()
+	list, err := client.ServiceEntries("external").List(context.Background(), v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(list.Items))
+	for _, se := range list.Items {
+		got = append(got, se.Spec.Hosts[0])
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, append([]string{}, hosts...)) {
+		t.Errorf("ServiceEntries of %v, want %v", got, hosts)
+	}
+}
+
+func assertWorkloadEntries(t *testing.T, client icapi.NetworkingV1alpha3Interface, addresses ...string) {
+	t.Helper()
+	list, err := client.WorkloadEntries("external").List(context.Background(), v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, we := range list.Items {
+		if we.Labels[common.AsmSyncerRegistryLabel] != "consul" {
+			t.Errorf("WorkloadEntry %s must be labelled with its registry, got %v", we.Name, we.Labels)
+		}
+		got = append(got, we.Spec.Address)
+	}
+	sort.Strings(got)
+	if len(got) != len(addresses) {
+		t.Fatalf("WorkloadEntries of %v, want %v", got, addresses)
+	}
+	for i := range got {
+		if got[i] != addresses[i] {
+			t.Errorf("WorkloadEntries of %v, want %v", got, addresses)
+		}
+	}
+}
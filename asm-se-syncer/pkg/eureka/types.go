@@ -0,0 +1,126 @@
+package eureka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+type (
+	// applicationsResult is the JSON document returned by /apps and /apps/delta
+	applicationsResult struct {
+		Applications struct {
+			VersionsDelta string       `json:"versions__delta"`
+			AppsHashCode  string       `json:"apps__hashcode"`
+			Application   applications `json:"application"`
+		} `json:"applications"`
+	}
+
+	application struct {
+		Name     string    `json:"name"`
+		Instance instances `json:"instance"`
+	}
+
+	instance struct {
+		InstanceID string            `json:"instanceId"`
+		HostName   string            `json:"hostName"`
+		App        string            `json:"app"`
+		IPAddr     string            `json:"ipAddr"`
+		Status     string            `json:"status"`
+		Port       port              `json:"port"`
+		SecurePort port              `json:"securePort"`
+		Metadata   map[string]string `json:"metadata"`
+		ActionType string            `json:"actionType"`
+	}
+
+	// port is encoded by Eureka as {"$": 8080, "@enabled": "true"}
+	port struct {
+		Number  uint32
+		Enabled bool
+	}
+
+	// Eureka encodes lists holding a single element as that element
+	applications []application
+	instances    []instance
+)
+
+// id identifies the instance within its application
+func (i instance) id() string {
+	if i.InstanceID != "" {
+		return i.InstanceID
+	}
+	return fmt.Sprintf("%s:%s:%d", i.HostName, i.App, i.Port.Number)
+}
+
+func (a *applications) UnmarshalJSON(data []byte) error {
+	var list []application
+	if err := json.Unmarshal(data, &list); err == nil {
+		*a = list
+		return nil
+	}
+	var single application
+	if err := json.Unmarshal(data, &single); err != nil {
+		return err
+	}
+	*a = applications{single}
+	return nil
+}
+
+func (i *instances) UnmarshalJSON(data []byte) error {
+	var list []instance
+	if err := json.Unmarshal(data, &list); err == nil {
+		*i = list
+		return nil
+	}
+	var single instance
+	if err := json.Unmarshal(data, &single); err != nil {
+		return err
+	}
+	*i = instances{single}
+	return nil
+}
+
+func (p *port) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Number  json.Number `json:"$"`
+		Enabled interface{} `json:"@enabled"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	number, err := strconv.ParseUint(raw.Number.String(), 10, 32)
+	if err != nil && raw.Number != "" {
+		return fmt.Errorf("invalid port %q", raw.Number)
+	}
+	p.Number = uint32(number)
+	switch enabled := raw.Enabled.(type) {
+	case bool:
+		p.Enabled = enabled
+	case string:
+		p.Enabled, _ = strconv.ParseBool(enabled)
+	}
+	return nil
+}
+
+func (i *instance) UnmarshalJSON(data []byte) error {
+	// metadata holds arbitrary JSON values, e.g. {"@class": "java.util.Collections$EmptyMap"}
+	type plain instance
+	var raw struct {
+		plain
+		Metadata map[string]interface{} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*i = instance(raw.plain)
+	i.Metadata = nil
+	for key, value := range raw.Metadata {
+		if s, ok := value.(string); ok {
+			if i.Metadata == nil {
+				i.Metadata = make(map[string]string, len(raw.Metadata))
+			}
+			i.Metadata[key] = s
+		}
+	}
+	return nil
+}
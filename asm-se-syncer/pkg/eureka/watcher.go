@@ -0,0 +1,327 @@
+package eureka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+const (
+	// Instance statuses, only instances which are UP become endpoints
+	StatusUp           = "UP"
+	StatusDown         = "DOWN"
+	StatusOutOfService = "OUT_OF_SERVICE"
+
+	// Delta action types
+	actionAdded    = "ADDED"
+	actionModified = "MODIFIED"
+	actionDeleted  = "DELETED"
+
+	defaultContextPath    = "/eureka"
+	defaultPollInterval   = 30 * time.Second
+	defaultRequestTimeout = 5 * time.Second
+)
+
+type watcher struct {
+	client       *http.Client
+	baseURL      string
+	store        provider.Cache
+	pollInterval time.Duration
+	name         string
+	prefix       string
+	hostTemplate *common.HostTemplate
+	toNamespace  string
+	watcherType  string
+	hosts        *provider.HostTable
+	filter       *provider.Filter
+
+	// apps is the local copy of the Eureka registry, maps app->instance id->instance
+	apps map[string]map[string]*instance
+	// synced is true once the full registry has been fetched, deltas are applied on top of it
+	synced bool
+}
+
+var _ provider.Watcher = &watcher{}
+
+// NewWatcher returns a watcher of the applications registered in the Eureka server at endpoint,
+// e.g. http://eureka:8761/eureka. The context path defaults to /eureka if the endpoint has no path.
+// The applications are named by hostTemplate, common.DefaultHostTemplate if nil, and selected by filter by name and
+// instance metadata.
+func NewWatcher(store provider.Cache, name, endpoint string, pollInterval time.Duration, prefix string, hostTemplate *common.HostTemplate,
+	filter *common.FilterConfig, toNamespace string) (provider.Watcher, error) {
+	if len(endpoint) == 0 {
+		return nil, errors.New("Eureka endpoint not specified")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing endpoint: %s", endpoint)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.Errorf("endpoint %s must be an http(s) URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = defaultContextPath
+	}
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	if hostTemplate == nil {
+		hostTemplate = common.MustParseHostTemplate(common.DefaultHostTemplate)
+	}
+	return &watcher{
+		client:       &http.Client{Timeout: defaultRequestTimeout},
+		baseURL:      strings.TrimSuffix(u.String(), "/"),
+		store:        store,
+		pollInterval: pollInterval,
+		name:         name,
+		prefix:       prefix,
+		hostTemplate: hostTemplate,
+		toNamespace:  toNamespace,
+		watcherType:  string(common.Eureka),
+		hosts:        provider.NewHostTable(store, name),
+		filter:       provider.NewFilter(filter, name),
+		apps:         make(map[string]map[string]*instance),
+	}, nil
+}
+
+func (w *watcher) Cache() provider.Cache {
+	return w.store
+}
+
+func (w *watcher) Name() string {
+	return w.name
+}
+
+func (w *watcher) Prefix() string {
+	return w.prefix
+}
+
+func (w *watcher) ToNamespace() string {
+	return w.toNamespace
+}
+
+func (w *watcher) WatcherType() string {
+	return w.watcherType
+}
+
+// Run the watcher until the context is cancelled
+func (w *watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	w.refreshStore() // init
+	for {
+		select {
+		case <-ticker.C:
+			w.refreshStore()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetch the registry, or the changes since the last fetch, and sync the UP instances with Store
+func (w *watcher) refreshStore() {
+	var err error
+	if w.synced {
+		err = w.fetchDelta()
+	} else {
+		err = w.fetchAll()
+	}
+	if err != nil {
+		// keep the last known endpoints, the full registry is fetched again next time
+		log.Errorf("error fetching applications from Eureka %s: %v", w.name, err)
+		monitoring.WatchFailed(w.name, err)
+		w.synced = false
+		return
+	}
+
+	data := make(map[string]map[string][]*v1alpha3.WorkloadEntry, len(w.apps)) // host->app->endpoints
+	for app, instances := range w.apps {
+		ids := make([]string, 0, len(instances))
+		for id := range instances {
+			ids = append(ids, id)
+		}
+		// keep a stable order so that unchanged applications don't cause updates
+		sort.Strings(ids)
+		eps := make([]*v1alpha3.WorkloadEntry, 0, len(instances))
+		for _, id := range ids {
+			if ep := instanceToEndpoint(instances[id]); ep != nil {
+				eps = append(eps, ep)
+			}
+		}
+		if len(eps) == 0 || !w.filter.Keep(app, appInfo(app, instances)) {
+			continue
+		}
+		host, err := w.hostTemplate.Host(common.HostData{Registry: w.name, Prefix: w.prefix, Service: app})
+		if err != nil {
+			log.Errorf("application %s of Eureka %s isn't published: %v", app, w.name, err)
+			continue
+		}
+		if data[host] == nil {
+			data[host] = make(map[string][]*v1alpha3.WorkloadEntry)
+		}
+		data[host][app] = eps
+	}
+	w.filter.Sweep()
+	w.hosts.Set(data)
+	monitoring.Synced(w.name)
+}
+
+// appInfo describes the instances of an application for the filter
+func appInfo(app string, instances map[string]*instance) common.ServiceInfo {
+	info := common.ServiceInfo{Name: app, Instances: make([]common.InstanceInfo, 0, len(instances))}
+	for _, i := range instances {
+		info.Instances = append(info.Instances, common.InstanceInfo{Metadata: i.Metadata})
+	}
+	return info
+}
+
+// fetchAll replaces the local registry with the full registry
+func (w *watcher) fetchAll() error {
+	var result applicationsResult
+	if err := w.get("/apps/", &result); err != nil {
+		return errors.Wrap(err, "failed to fetch applications")
+	}
+	apps := make(map[string]map[string]*instance, len(result.Applications.Application))
+	for _, a := range result.Applications.Application {
+		for _, i := range a.Instance {
+			i := i
+			if apps[a.Name] == nil {
+				apps[a.Name] = make(map[string]*instance, len(a.Instance))
+			}
+			apps[a.Name][i.id()] = &i
+		}
+	}
+	w.apps = apps
+	w.synced = true
+	return nil
+}
+
+// fetchDelta applies the recent changes to the local registry, falling back to fetching the full registry
+// if the local registry doesn't match the server afterwards.
+func (w *watcher) fetchDelta() error {
+	var result applicationsResult
+	if err := w.get("/apps/delta", &result); err != nil {
+		return errors.Wrap(err, "failed to fetch delta")
+	}
+	for _, a := range result.Applications.Application {
+		for _, i := range a.Instance {
+			i := i
+			switch i.ActionType {
+			case actionDeleted:
+				delete(w.apps[a.Name], i.id())
+				if len(w.apps[a.Name]) == 0 {
+					delete(w.apps, a.Name)
+				}
+			case actionAdded, actionModified:
+				if w.apps[a.Name] == nil {
+					w.apps[a.Name] = make(map[string]*instance)
+				}
+				w.apps[a.Name][i.id()] = &i
+			}
+		}
+	}
+	if hash := w.hashCode(); hash != result.Applications.AppsHashCode {
+		log.Infof("Eureka %s registry hash %q doesn't match %q after applying delta, fetching all applications",
+			w.name, hash, result.Applications.AppsHashCode)
+		return w.fetchAll()
+	}
+	return nil
+}
+
+// hashCode computes the reconcile hash code of the local registry the same way Eureka does,
+// the count of instances per status ordered by status, e.g. DOWN_1_UP_3_
+func (w *watcher) hashCode() string {
+	counts := map[string]int{}
+	for _, instances := range w.apps {
+		for _, i := range instances {
+			counts[i.Status]++
+		}
+	}
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	var b strings.Builder
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "%s_%d_", status, counts[status])
+	}
+	return b.String()
+}
+
+// get issues a GET request against the Eureka REST API and decodes the JSON response into out
+func (w *watcher) get(path string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, w.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("GET %s returned %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// instanceToEndpoint converts a Eureka instance to a service entry endpoint, it returns nil for instances
+// which are not UP or have no enabled port.
+func instanceToEndpoint(i *instance) *v1alpha3.WorkloadEntry {
+	if i.Status != StatusUp {
+		return nil
+	}
+	address := i.IPAddr
+	if address == "" {
+		address = i.HostName
+	}
+	if address == "" {
+		return nil
+	}
+
+	ports := map[string]uint32{}
+	if i.Port.Enabled && i.Port.Number > 0 {
+		// the protocol metadata declares the protocol of the non-secure port
+		for name, number := range serviceentry.EndpointWithProtocol("", i.Port.Number, i.Metadata[serviceentry.ProtocolKey]).Ports {
+			ports[name] = number
+		}
+	}
+	if i.SecurePort.Enabled && i.SecurePort.Number > 0 {
+		// port names are inferred from the port number, the secure port is dropped if it gets the same name
+		if _, found := ports[serviceentry.Proto(i.SecurePort.Number)]; !found {
+			ports[serviceentry.Proto(i.SecurePort.Number)] = i.SecurePort.Number
+		}
+	}
+	if len(ports) == 0 {
+		log.Infof("instance %s of %s has no enabled port", i.id(), i.App)
+		return nil
+	}
+	return &v1alpha3.WorkloadEntry{
+		Address: address,
+		Ports:   ports,
+		Labels:  serviceentry.Labels(i.Metadata),
+	}
+}
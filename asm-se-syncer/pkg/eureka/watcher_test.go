@@ -0,0 +1,118 @@
+package eureka
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+)
+
+const (
+	fullRegistry = `{"applications": {"versions__delta": "1", "apps__hashcode": "DOWN_1_UP_2_", "application": [
+  {"name": "DEMO-SERVICE", "instance": [
+    {"instanceId": "demo-1", "hostName": "demo-1", "app": "DEMO-SERVICE", "ipAddr": "192.0.2.1", "status": "UP",
+     "port": {"$": 8080, "@enabled": "true"}, "securePort": {"$": 443, "@enabled": "false"},
+     "metadata": {"version": "v1", "management.port": "8081"}},
+    {"instanceId": "demo-2", "hostName": "demo-2", "app": "DEMO-SERVICE", "ipAddr": "192.0.2.2", "status": "DOWN",
+     "port": {"$": 8080, "@enabled": "true"}, "securePort": {"$": 443, "@enabled": "false"},
+     "metadata": {"@class": "java.util.Collections$EmptyMap"}}
+  ]},
+  {"name": "GATEWAY", "instance":
+    {"instanceId": "gateway-1", "hostName": "gateway-1", "app": "GATEWAY", "ipAddr": "192.0.2.3", "status": "UP",
+     "port": {"$": 80, "@enabled": "false"}, "securePort": {"$": 443, "@enabled": "true"}}
+  }
+]}}`
+
+	delta = `{"applications": {"versions__delta": "2", "apps__hashcode": "OUT_OF_SERVICE_1_UP_2_", "application": [
+  {"name": "DEMO-SERVICE", "instance": [
+    {"instanceId": "demo-1", "hostName": "demo-1", "app": "DEMO-SERVICE", "ipAddr": "192.0.2.1", "status": "OUT_OF_SERVICE",
+     "port": {"$": 8080, "@enabled": "true"}, "actionType": "MODIFIED"},
+    {"instanceId": "demo-2", "hostName": "demo-2", "app": "DEMO-SERVICE", "ipAddr": "192.0.2.2", "status": "UP",
+     "port": {"$": 8080, "@enabled": "true"}, "actionType": "MODIFIED"}
+  ]}
+]}}`
+)
+
+func TestRefreshStore(t *testing.T) {
+	var fetched []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		switch r.URL.Path {
+		case "/eureka/apps/":
+			_, _ = w.Write([]byte(fullRegistry))
+		case "/eureka/apps/delta":
+			_, _ = w.Write([]byte(delta))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	pw, err := NewWatcher(provider.NewCache(), "eureka-test", server.URL, 0, "eureka-", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pw.(*watcher)
+
+	w.refreshStore()
+	want := map[string][]*v1alpha3.WorkloadEntry{
+		"eureka-demo-service": {{
+			Address: "192.0.2.1",
+			Ports:   map[string]uint32{"tcp": 8080},
+			Labels:  map[string]string{"version": "v1", "management.port": "8081"},
+		}},
+		"eureka-gateway": {{Address: "192.0.2.3", Ports: map[string]uint32{"https": 443}}},
+	}
+	if actual := w.Cache().Hosts(); !reflect.DeepEqual(actual, want) {
+		t.Fatalf("hosts must be %v but got %v", want, actual)
+	}
+
+	w.refreshStore()
+	if actual := w.Cache().Hosts()["eureka-demo-service"]; len(actual) != 1 || actual[0].Address != "192.0.2.2" {
+		t.Fatalf("only the instance brought UP by the delta must be an endpoint but got %v", actual)
+	}
+	if !reflect.DeepEqual(fetched, []string{"/eureka/apps/", "/eureka/apps/delta"}) {
+		t.Fatalf("the delta must be applied without fetching the full registry, but fetched %v", fetched)
+	}
+}
+
+func TestHashCodeMismatchFetchesAll(t *testing.T) {
+	var fetched []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		if r.URL.Path == "/eureka/apps/delta" {
+			_, _ = w.Write([]byte(`{"applications": {"apps__hashcode": "UP_5_", "application": []}}`))
+			return
+		}
+		_, _ = w.Write([]byte(fullRegistry))
+	}))
+	defer server.Close()
+
+	pw, err := NewWatcher(provider.NewCache(), "eureka-test", server.URL+"/eureka/", 0, "", nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pw.(*watcher)
+	w.refreshStore()
+	w.refreshStore()
+	if !reflect.DeepEqual(fetched, []string{"/eureka/apps/", "/eureka/apps/delta", "/eureka/apps/"}) {
+		t.Fatalf("the full registry must be fetched again on hash code mismatch, but fetched %v", fetched)
+	}
+}
+
+func TestUnmarshalInstance(t *testing.T) {
+	var i instance
+	data := `{"instanceId": "a", "status": "UP", "port": {"$": "8080", "@enabled": true}, "metadata": {"k": "v", "n": 1}}`
+	if err := json.Unmarshal([]byte(data), &i); err != nil {
+		t.Fatal(err)
+	}
+	want := instance{InstanceID: "a", Status: StatusUp, Port: port{Number: 8080, Enabled: true}, Metadata: map[string]string{"k": "v"}}
+	if !reflect.DeepEqual(i, want) {
+		t.Errorf("instance = %+v, want %+v", i, want)
+	}
+}
@@ -0,0 +1,96 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// Elector tells whether this replica is the leader. Only the leader writes ServiceEntries, the other replicas
+// keep their watchers running so that they can take over as soon as the lease of the leader expires.
+type Elector struct {
+	once    sync.Once
+	leading chan struct{}
+}
+
+// New returns an elector which becomes the leader once Run wins the election
+func New() *Elector {
+	return &Elector{leading: make(chan struct{})}
+}
+
+// Always returns an elector which is the leader from the start, for running a single replica
+func Always() *Elector {
+	e := New()
+	e.lead()
+	return e
+}
+
+// Leading returns a channel which is closed once this replica is the leader
+func (e *Elector) Leading() <-chan struct{} {
+	return e.leading
+}
+
+func (e *Elector) IsLeader() bool {
+	select {
+	case <-e.leading:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *Elector) lead() {
+	e.once.Do(func() { close(e.leading) })
+}
+
+// Run takes part in the election of the Lease namespace/name until the context is cancelled.
+// A replica never becomes a follower again, onStoppedLeading is called if the lease is lost, and is expected
+// to exit the process so that writes of the new leader aren't raced.
+func (e *Elector) Run(ctx context.Context, client kubernetes.Interface, namespace, name, identity string, onStoppedLeading func()) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				log.Infof("%s is the leader of %s/%s", identity, namespace, name)
+				e.lead()
+			},
+			OnStoppedLeading: func() {
+				if e.IsLeader() {
+					onStoppedLeading()
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Infof("%s is the leader of %s/%s, waiting for its lease to expire", leader, namespace, name)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	elector.Run(ctx)
+	return nil
+}
@@ -0,0 +1,26 @@
+package leader
+
+import "testing"
+
+func TestElector(t *testing.T) {
+	e := New()
+	if e.IsLeader() {
+		t.Fatal("a new elector must not be the leader before winning the election")
+	}
+	select {
+	case <-e.Leading():
+		t.Fatal("leading must not be closed before winning the election")
+	default:
+	}
+
+	e.lead()
+	e.lead() // winning again must not panic
+	if !e.IsLeader() {
+		t.Fatal("the elector must be the leader after winning the election")
+	}
+	<-e.Leading()
+
+	if !Always().IsLeader() {
+		t.Fatal("an elector without election must always be the leader")
+	}
+}
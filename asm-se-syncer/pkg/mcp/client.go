@@ -0,0 +1,102 @@
+package mcp
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	k8swatch "k8s.io/apimachinery/pkg/watch"
+)
+
+var serviceEntries = ic.Resource("serviceentries")
+
+// ServiceEntries returns a client writing the ServiceEntries of namespace to the server rather than to the API server
+func (s *Server) ServiceEntries(namespace string) icapi.ServiceEntryInterface {
+	return &client{server: s, namespace: namespace}
+}
+
+type client struct {
+	server    *Server
+	namespace string
+}
+
+func (c *client) key(name string) string {
+	return c.namespace + "/" + name
+}
+
+func (c *client) Create(ctx context.Context, se *ic.ServiceEntry, _ v1.CreateOptions) (*ic.ServiceEntry, error) {
+	if _, err := c.Get(ctx, se.Name, v1.GetOptions{}); err == nil {
+		return nil, k8serrors.NewAlreadyExists(serviceEntries, se.Name)
+	}
+	return c.set(se)
+}
+
+func (c *client) Update(ctx context.Context, se *ic.ServiceEntry, _ v1.UpdateOptions) (*ic.ServiceEntry, error) {
+	if _, err := c.Get(ctx, se.Name, v1.GetOptions{}); err != nil {
+		return nil, err
+	}
+	return c.set(se)
+}
+
+func (c *client) set(se *ic.ServiceEntry) (*ic.ServiceEntry, error) {
+	se = se.DeepCopy()
+	se.Namespace = c.namespace
+	if err := c.server.set(c.key(se.Name), se); err != nil {
+		return nil, errors.Wrapf(err, "failed to serve ServiceEntry %s", c.key(se.Name))
+	}
+	return se.DeepCopy(), nil
+}
+
+func (c *client) UpdateStatus(ctx context.Context, se *ic.ServiceEntry, opts v1.UpdateOptions) (*ic.ServiceEntry, error) {
+	return c.Update(ctx, se, opts)
+}
+
+func (c *client) Delete(ctx context.Context, name string, _ v1.DeleteOptions) error {
+	if _, err := c.Get(ctx, name, v1.GetOptions{}); err != nil {
+		return err
+	}
+	return c.server.set(c.key(name), nil)
+}
+
+func (c *client) DeleteCollection(context.Context, v1.DeleteOptions, v1.ListOptions) error {
+	return errors.New("deleting collections isn't supported by the MCP server")
+}
+
+func (c *client) Get(_ context.Context, name string, _ v1.GetOptions) (*ic.ServiceEntry, error) {
+	c.server.m.RLock()
+	defer c.server.m.RUnlock()
+	e, found := c.server.entries[c.key(name)]
+	if !found {
+		return nil, k8serrors.NewNotFound(serviceEntries, name)
+	}
+	return e.se.DeepCopy(), nil
+}
+
+func (c *client) List(_ context.Context, opts v1.ListOptions) (*ic.ServiceEntryList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	c.server.m.RLock()
+	defer c.server.m.RUnlock()
+	list := &ic.ServiceEntryList{}
+	for _, e := range c.server.entries {
+		if (c.namespace == v1.NamespaceAll || e.se.Namespace == c.namespace) && selector.Matches(labels.Set(e.se.Labels)) {
+			list.Items = append(list.Items, *e.se.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (c *client) Watch(context.Context, v1.ListOptions) (k8swatch.Interface, error) {
+	return nil, errors.New("watching isn't supported by the MCP server, use AddEventHandler")
+}
+
+func (c *client) Patch(context.Context, string, types.PatchType, []byte, v1.PatchOptions, ...string) (*ic.ServiceEntry, error) {
+	return nil, errors.New("patching isn't supported by the MCP server")
+}
@@ -0,0 +1,296 @@
+package mcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/ptypes/any"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mcp "istio.io/api/mcp/v1alpha1"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+)
+
+const (
+	// ServiceEntryType is the type URL istiod requests the ServiceEntries with
+	ServiceEntryType = "networking.istio.io/v1alpha3/ServiceEntry"
+	// resourceType is the type of every resource sent, the ServiceEntry is its body
+	resourceType = "type.googleapis.com/istio.mcp.v1alpha1.Resource"
+)
+
+// Server serves the ServiceEntries written to it to istiod over MCP-over-xDS, so that they are never stored in the
+// API server. istiod connects to it as one of its configSources, e.g. xds://asm-se-syncer:15010.
+//
+// Every connection is pushed the whole collection whenever it changed and the previous push was acknowledged.
+// Other collections istiod requests are served empty, so that it considers them synced.
+type Server struct {
+	m       sync.RWMutex
+	entries map[string]*entry // namespace/name->entry
+	// version of the collection, incremented by every change
+	version uint64
+	// versionPrefix tells the versions of different processes apart
+	versionPrefix string
+	// changed is closed and replaced whenever the collection changed
+	changed  chan struct{}
+	handlers []cache.ResourceEventHandler
+	now      func() time.Time
+}
+
+type entry struct {
+	se       *ic.ServiceEntry
+	resource *any.Any
+}
+
+// NewServer returns a server serving no ServiceEntries
+func NewServer() *Server {
+	return &Server{
+		entries:       make(map[string]*entry),
+		versionPrefix: strconv.FormatInt(time.Now().Unix(), 36),
+		changed:       make(chan struct{}),
+		now:           time.Now,
+	}
+}
+
+// AddEventHandler calls handler for every ServiceEntry written to the server, like an informer of the API server would
+func (s *Server) AddEventHandler(handler cache.ResourceEventHandler) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.handlers = append(s.handlers, handler)
+}
+
+// Serve serves the ADS API on listener until the context is cancelled
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	server := grpc.NewServer()
+	discovery.RegisterAggregatedDiscoveryServiceServer(server, s)
+	go func() {
+		<-ctx.Done()
+		// the streams never end on their own, so a graceful stop would block forever
+		server.Stop()
+	}()
+	return server.Serve(listener)
+}
+
+// StreamAggregatedResources serves a connection of istiod
+func (s *Server) StreamAggregatedResources(stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	ctx := stream.Context()
+	monitoring.MCPConnected()
+	defer monitoring.MCPDisconnected()
+
+	requests := make(chan *discovery.DiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case requests <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	c := &connection{stream: stream, watches: make(map[string]*watch)}
+	for {
+		s.m.RLock()
+		changed := s.changed
+		s.m.RUnlock()
+
+		select {
+		case req := <-requests:
+			if err := c.handle(s, req); err != nil {
+				return err
+			}
+		case <-changed:
+			if err := c.push(s); err != nil {
+				return err
+			}
+		case err := <-errs:
+			if status.Code(err) == codes.Canceled || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// DeltaAggregatedResources isn't supported, istiod doesn't use it for configSources
+func (s *Server) DeltaAggregatedResources(discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return status.Error(codes.Unimplemented, "incremental xDS isn't supported")
+}
+
+// connection is the state of a stream
+type connection struct {
+	stream  discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer
+	nonce   int
+	watches map[string]*watch // type URL->watch
+}
+
+// watch is a collection requested on a connection
+type watch struct {
+	// nonce and version of the last response
+	nonce, version string
+	// acked is whether the last response was acknowledged, the next is only sent then
+	acked bool
+}
+
+func (c *connection) handle(s *Server, req *discovery.DiscoveryRequest) error {
+	w, found := c.watches[req.TypeUrl]
+	if !found {
+		w = &watch{}
+		c.watches[req.TypeUrl] = w
+		return c.send(s, req.TypeUrl, w)
+	}
+	if req.ResponseNonce != w.nonce {
+		// the response to an older push, the last one is still to be answered
+		return nil
+	}
+	if req.ErrorDetail != nil {
+		// the rejected version isn't pushed again, only the next change is
+		log.Warnf("MCP push %s of %s was rejected: %s", w.version, req.TypeUrl, req.ErrorDetail.Message)
+		monitoring.MCPNacked(req.TypeUrl)
+	}
+	w.acked = true
+	if req.TypeUrl == ServiceEntryType && w.version != s.currentVersion() {
+		// changed while the push was on its way
+		return c.send(s, req.TypeUrl, w)
+	}
+	return nil
+}
+
+// push sends the ServiceEntries if they changed since the last acknowledged push
+func (c *connection) push(s *Server) error {
+	w, found := c.watches[ServiceEntryType]
+	if !found || !w.acked || w.version == s.currentVersion() {
+		return nil
+	}
+	return c.send(s, ServiceEntryType, w)
+}
+
+func (c *connection) send(s *Server, typeURL string, w *watch) error {
+	resp := &discovery.DiscoveryResponse{TypeUrl: typeURL, VersionInfo: s.versionPrefix}
+	if typeURL == ServiceEntryType {
+		resp.VersionInfo, resp.Resources = s.snapshot()
+	}
+	c.nonce++
+	resp.Nonce = strconv.Itoa(c.nonce)
+	if err := c.stream.Send(resp); err != nil {
+		return err
+	}
+	w.nonce, w.version, w.acked = resp.Nonce, resp.VersionInfo, false
+	monitoring.MCPPushed(typeURL)
+	return nil
+}
+
+func (s *Server) currentVersion() string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.formatVersion(s.version)
+}
+
+func (s *Server) formatVersion(version uint64) string {
+	return fmt.Sprintf("%s-%d", s.versionPrefix, version)
+}
+
+// snapshot returns the version of the collection with its resources, sorted by namespace and name
+func (s *Server) snapshot() (string, []*any.Any) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	resources := make([]*any.Any, 0, len(keys))
+	for _, key := range keys {
+		resources = append(resources, s.entries[key].resource)
+	}
+	return s.formatVersion(s.version), resources
+}
+
+// set stores se, or deletes the ServiceEntry if se is nil, and notifies the connections and handlers
+func (s *Server) set(key string, se *ic.ServiceEntry) error {
+	s.m.Lock()
+	old := s.entries[key]
+	if se == nil && old == nil {
+		s.m.Unlock()
+		return nil
+	}
+	if se == nil {
+		delete(s.entries, key)
+	} else {
+		se.ResourceVersion = s.formatVersion(s.version + 1)
+		se.CreationTimestamp = metav1.NewTime(s.now())
+		if old != nil {
+			se.CreationTimestamp = old.se.CreationTimestamp
+		}
+		resource, err := s.resource(se)
+		if err != nil {
+			s.m.Unlock()
+			return err
+		}
+		s.entries[key] = &entry{se: se, resource: resource}
+	}
+	s.version++
+	close(s.changed)
+	s.changed = make(chan struct{})
+	handlers := s.handlers
+	s.m.Unlock()
+
+	for _, h := range handlers {
+		switch {
+		case se == nil:
+			h.OnDelete(old.se)
+		case old == nil:
+			h.OnAdd(se)
+		default:
+			h.OnUpdate(old.se, se)
+		}
+	}
+	return nil
+}
+
+// resource converts a ServiceEntry to an MCP resource
+func (s *Server) resource(se *ic.ServiceEntry) (*any.Any, error) {
+	body, err := types.MarshalAny(&se.Spec)
+	if err != nil {
+		return nil, err
+	}
+	createTime, err := types.TimestampProto(se.CreationTimestamp.Time)
+	if err != nil {
+		return nil, err
+	}
+	value, err := proto.Marshal(&mcp.Resource{
+		Metadata: &mcp.Metadata{
+			Name:        se.Namespace + "/" + se.Name,
+			CreateTime:  createTime,
+			Version:     se.ResourceVersion,
+			Labels:      se.Labels,
+			Annotations: se.Annotations,
+		},
+		Body: body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &any.Any{TypeUrl: resourceType, Value: value}, nil
+}
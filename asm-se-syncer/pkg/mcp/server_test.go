@@ -0,0 +1,124 @@
+package mcp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/gogo/protobuf/types"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	mcp "istio.io/api/mcp/v1alpha1"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+func serviceEntry(name string) *ic.ServiceEntry {
+	return &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{Name: name, Labels: common.OwnerLabels("consul", "consul")},
+		Spec:       v1alpha3.ServiceEntry{Hosts: []string{name}},
+	}
+}
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	server := NewServer()
+	model := serviceentry.New(v1.OwnerReference{})
+	serviceentry.AttachHandler(model, server)
+	write := server.ServiceEntries("external")
+	if _, err := write.Create(ctx, serviceEntry("web.service.consul"), v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := write.Create(ctx, serviceEntry("web.service.consul"), v1.CreateOptions{}); err == nil {
+		t.Error("creating an existing ServiceEntry must fail")
+	}
+	if model.Classify("web.service.consul") != serviceentry.Us {
+		t.Error("the ServiceEntries served must be passed to the handlers")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ctx, listener)
+	conn, err := grpc.DialContext(ctx, listener.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(typeURL string, last *discovery.DiscoveryResponse, nack bool) {
+		t.Helper()
+		req := &discovery.DiscoveryRequest{TypeUrl: typeURL}
+		if last != nil {
+			req.VersionInfo, req.ResponseNonce = last.VersionInfo, last.Nonce
+		}
+		if nack {
+			req.ErrorDetail = &status.Status{Message: "invalid"}
+		}
+		if err := stream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(typeURL string, hosts ...string) *discovery.DiscoveryResponse {
+		t.Helper()
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TypeUrl != typeURL || len(resp.Resources) != len(hosts) {
+			t.Fatalf("got %d resources of %s, want %v of %s", len(resp.Resources), resp.TypeUrl, hosts, typeURL)
+		}
+		for i, resource := range resp.Resources {
+			var r mcp.Resource
+			if err := types.UnmarshalAny(&types.Any{TypeUrl: resource.TypeUrl, Value: resource.Value}, &r); err != nil {
+				t.Fatal(err)
+			}
+			var se v1alpha3.ServiceEntry
+			if err := types.UnmarshalAny(r.Body, &se); err != nil {
+				t.Fatal(err)
+			}
+			if r.Metadata.Name != "external/"+hosts[i] || r.Metadata.CreateTime == nil || se.Hosts[0] != hosts[i] {
+				t.Errorf("unexpected resource %v with body %v, want %s", r.Metadata, se, hosts[i])
+			}
+		}
+		return resp
+	}
+
+	request(ServiceEntryType, nil, false)
+	first := receive(ServiceEntryType, "web.service.consul")
+	// collections without ServiceEntries are served empty
+	request("networking.istio.io/v1alpha3/VirtualService", nil, false)
+	receive("networking.istio.io/v1alpha3/VirtualService")
+
+	// a change is only pushed once the last push was acknowledged
+	if _, err := write.Create(ctx, serviceEntry("db.service.consul"), v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	request(ServiceEntryType, first, false)
+	second := receive(ServiceEntryType, "db.service.consul", "web.service.consul")
+	if second.VersionInfo == first.VersionInfo {
+		t.Errorf("every change must have a new version, got %s twice", first.VersionInfo)
+	}
+
+	// a rejected push isn't repeated, the next change is pushed
+	request(ServiceEntryType, second, true)
+	if err := write.Delete(ctx, "web.service.consul", v1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	receive(ServiceEntryType, "db.service.consul")
+	if model.Classify("web.service.consul") != serviceentry.None {
+		t.Error("the deleted ServiceEntry must be removed from the handlers")
+	}
+}
@@ -0,0 +1,299 @@
+package monitoring
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unreachableAfter is how long a watcher may fail to reach its registry before /readyz fails
+const unreachableAfter = 5 * time.Minute
+
+type registryHealth struct {
+	registryType string
+	synced       bool
+	// failingSince is when the watcher started failing to reach the registry, zero while it is connected
+	failingSince time.Time
+	lastError    string
+	// failing are the last errors of the services which can't be watched, they don't disconnect the registry
+	failing   map[string]string
+	lastSync  time.Time
+	services  int
+	endpoints int
+}
+
+// State is the health of the watcher of a registry and the size of what it published
+type State struct {
+	Name      string
+	Type      string
+	Synced    bool
+	Connected bool
+	LastSync  time.Time
+	Services  int
+	Endpoints int
+	LastError string
+}
+
+type registryHealths struct {
+	m          sync.Mutex
+	registries map[string]*registryHealth
+	now        func() time.Time
+}
+
+var registries = &registryHealths{registries: make(map[string]*registryHealth), now: time.Now}
+
+// Register adds a registry which is reported unready until its watcher completed its initial sync.
+// The health of registries which aren't registered isn't tracked.
+func Register(registry, registryType string) {
+	registries.m.Lock()
+	defer registries.m.Unlock()
+	registries.registries[registry] = &registryHealth{registryType: registryType}
+	connected.WithLabelValues(registry).Set(0)
+	failingServices.WithLabelValues(registry).Set(0)
+}
+
+// States returns the state of all registries, sorted by name
+func States() []State {
+	registries.m.Lock()
+	defer registries.m.Unlock()
+	out := make([]State, 0, len(registries.registries))
+	for name, h := range registries.registries {
+		out = append(out, State{
+			Name:      name,
+			Type:      h.registryType,
+			Synced:    h.synced,
+			Connected: h.connected(),
+			LastSync:  h.lastSync,
+			Services:  h.services,
+			Endpoints: h.endpoints,
+			LastError: h.reportedError(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// WatchSucceeded records that the watcher of a registry reached it
+func WatchSucceeded(registry string) {
+	registries.update(registry, func(h *registryHealth) {
+		h.failingSince = time.Time{}
+		h.lastError = ""
+	})
+}
+
+// WatchFailed records that the watcher of a registry failed to reach it
+func WatchFailed(registry string, err error) {
+	watchErrors.WithLabelValues(registry).Inc()
+	registries.update(registry, func(h *registryHealth) {
+		if h.failingSince.IsZero() {
+			h.failingSince = registries.now()
+		}
+		h.lastError = err.Error()
+	})
+}
+
+// ServiceWatched records the result of watching a service of a registry which is reached otherwise, e.g. a failure
+// to fetch the instances of one service. A nil error clears the failure of the service, also once it isn't watched.
+func ServiceWatched(registry, service string, err error) {
+	if err != nil {
+		watchErrors.WithLabelValues(registry).Inc()
+	}
+	registries.update(registry, func(h *registryHealth) {
+		if err == nil {
+			delete(h.failing, service)
+			return
+		}
+		if h.failing == nil {
+			h.failing = make(map[string]string)
+		}
+		h.failing[service] = err.Error()
+	})
+}
+
+// Synced records that the watcher of a registry completed its initial sync, i.e. its cache holds all services
+func Synced(registry string) {
+	registries.update(registry, func(h *registryHealth) {
+		h.synced = true
+		h.failingSince = time.Time{}
+		h.lastError = ""
+	})
+}
+
+// Connected reports whether the watcher of a registry completed its initial sync and reaches the registry, so that
+// what it found can be trusted to be complete. Registries which aren't registered are always connected.
+func Connected(registry string) bool {
+	registries.m.Lock()
+	defer registries.m.Unlock()
+	h, found := registries.registries[registry]
+	return !found || h.connected()
+}
+
+func (h *registryHealth) connected() bool {
+	return h.synced && h.failingSince.IsZero()
+}
+
+// reportedError is the last error reaching the registry, or else the error of the first failing service
+func (h *registryHealth) reportedError() string {
+	if h.lastError != "" || len(h.failing) == 0 {
+		return h.lastError
+	}
+	services := make([]string, 0, len(h.failing))
+	for service := range h.failing {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return fmt.Sprintf("%d services can't be watched, %s: %s", len(services), services[0], h.failing[services[0]])
+}
+
+// Pass tracks a sync of a registry and the writes it started, which may be done after it ended by a write queue.
+// The sync is recorded as the last successful one once it ended and all its writes succeeded, if the watcher of the
+// registry was connected when it ended. The methods of a nil Pass do nothing.
+type Pass struct {
+	registry string
+	start    time.Time
+	m        sync.Mutex
+	pending  int
+	failed   bool
+	ended    bool
+	// settled is set once the sync was recorded
+	settled bool
+}
+
+// StartPass starts tracking a sync of registry
+func StartPass(registry string) *Pass {
+	return &Pass{registry: registry, start: time.Now()}
+}
+
+// Add records a write started by the sync, Done must be called with its result
+func (p *Pass) Add() {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.pending++
+}
+
+// Done records the result of a write started by the sync
+func (p *Pass) Done(err error) {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.pending--
+	p.failed = p.failed || err != nil
+	p.settle()
+}
+
+// Fail records that the sync left out some of what it found
+func (p *Pass) Fail() {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.failed = true
+}
+
+// End records the duration of the sync, once it started all its writes
+func (p *Pass) End() {
+	if p == nil {
+		return
+	}
+	ObserveSync(p.registry, p.start)
+	connected := Connected(p.registry)
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.ended = true
+	p.failed = p.failed || !connected
+	p.settle()
+}
+
+// settle records the sync as successful once it ended and its writes are done; callers must hold the lock
+func (p *Pass) settle() {
+	if !p.ended || p.pending > 0 || p.failed || p.settled {
+		return
+	}
+	p.settled = true
+	syncSucceeded(p.registry)
+}
+
+// update changes the health of a registry, unless the registry isn't registered (anymore)
+func (r *registryHealths) update(registry string, f func(h *registryHealth)) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if h, found := r.registries[registry]; found {
+		f(h)
+		failingServices.WithLabelValues(registry).Set(float64(len(h.failing)))
+		if h.connected() {
+			connected.WithLabelValues(registry).Set(1)
+		} else {
+			connected.WithLabelValues(registry).Set(0)
+		}
+	}
+}
+
+func (r *registryHealths) remove(registry string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	delete(r.registries, registry)
+}
+
+// unreachable returns the registries which have failed for longer than unreachableAfter
+func (r *registryHealths) unreachable() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	var out []string
+	for name, h := range r.registries {
+		if !h.failingSince.IsZero() && r.now().Sub(h.failingSince) > unreachableAfter {
+			out = append(out, fmt.Sprintf("%s: failing since %s: %s", name, h.failingSince.Format(time.RFC3339), h.lastError))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// unready returns the registries which haven't completed their initial sync
+func (r *registryHealths) unready() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	var out []string
+	for name, h := range r.registries {
+		if !h.synced {
+			out = append(out, fmt.Sprintf("%s: initial sync not complete", name))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Handler serves /metrics, /healthz and /readyz. /healthz only checks that the process serves requests: the
+// registries being unreachable is reported by /readyz, the metrics and the status, restarting the syncer wouldn't
+// help and would drop the services it keeps publishing meanwhile.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeStatus(w, nil)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		writeStatus(w, append(registries.unready(), registries.unreachable()...))
+	})
+	return mux
+}
+
+func writeStatus(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,122 @@
+package monitoring
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	now := time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC)
+	registries = &registryHealths{registries: make(map[string]*registryHealth), now: func() time.Time { return now }}
+	handler := Handler()
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	Register("consul", "consul")
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "consul") {
+		t.Errorf("/readyz must fail until the initial sync completed, got %d %q", code, body)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz must not wait for the initial sync, got %d", code)
+	}
+
+	Synced("consul")
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz must succeed once synced, got %d", code)
+	}
+
+	WatchFailed("consul", errors.New("connection refused"))
+	now = now.Add(time.Minute)
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz must tolerate short failures, got %d", code)
+	}
+	now = now.Add(unreachableAfter)
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "connection refused") {
+		t.Errorf("/readyz must fail after %s of failures, got %d %q", unreachableAfter, code, body)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz must not fail as the registry can't be reached, got %d", code)
+	}
+
+	WatchSucceeded("consul")
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz must recover once the registry is reached, got %d", code)
+	}
+
+	ServiceWatched("consul", "dc1/db", errors.New("permission denied"))
+	now = now.Add(2 * unreachableAfter)
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz must not fail as a service can't be watched, got %d", code)
+	}
+	if state := States()[0]; !state.Connected || !strings.Contains(state.LastError, "dc1/db: permission denied") {
+		t.Errorf("a failing service must be reported without disconnecting the registry, got %+v", state)
+	}
+	ServiceWatched("consul", "dc1/db", nil)
+	if state := States()[0]; state.LastError != "" {
+		t.Errorf("the failure of a service must be cleared once it is watched, got %q", state.LastError)
+	}
+
+	Register("eureka", "eureka")
+	Forget("eureka")
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("a forgotten registry must not be reported, got %d", code)
+	}
+}
+
+func TestPass(t *testing.T) {
+	registries = &registryHealths{registries: make(map[string]*registryHealth), now: time.Now}
+	failed := errors.New("etcd is down")
+	tests := []struct {
+		name string
+		// sync starts and ends a pass, whose writes may be done after it ended
+		sync      func(p *Pass)
+		connected bool
+		want      bool
+	}{
+		{
+			name:      "all writes succeeded",
+			sync:      func(p *Pass) { p.Add(); p.Add(); p.Done(nil); p.End(); p.Done(nil) },
+			connected: true,
+			want:      true,
+		},
+		{
+			name:      "a write is still queued",
+			sync:      func(p *Pass) { p.Add(); p.End() },
+			connected: true,
+		},
+		{
+			name:      "a queued write failed after the sync ended",
+			sync:      func(p *Pass) { p.Add(); p.End(); p.Done(failed) },
+			connected: true,
+		},
+		{
+			name: "the registry isn't connected",
+			sync: func(p *Pass) { p.End() },
+		},
+		{
+			name:      "something found was left out",
+			sync:      func(p *Pass) { p.Fail(); p.End() },
+			connected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Register("consul", "consul")
+			defer Forget("consul")
+			if tt.connected {
+				Synced("consul")
+			}
+			tt.sync(StartPass("consul"))
+			if got := !States()[0].LastSync.IsZero(); got != tt.want {
+				t.Errorf("sync recorded as successful: %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package monitoring
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "asm_se_syncer"
+
+	// ServiceEntry write operations
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+
+	resultSuccess = "success"
+	resultFailure = "failure"
+
+	// reasons of trying a write again
+	RetryConflict = "conflict"
+	RetryBackoff  = "backoff"
+)
+
+var (
+	services = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registry_services",
+		Help:      "Number of services seen in the registry.",
+	}, []string{"registry"})
+
+	endpoints = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registry_endpoints",
+		Help:      "Number of endpoints seen in the registry.",
+	}, []string{"registry"})
+
+	serviceEntryWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "serviceentry_writes_total",
+		Help:      "ServiceEntry creates, updates and deletes by result.",
+	}, []string{"registry", "operation", "result"})
+
+	workloadEntryWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "workloadentry_writes_total",
+		Help:      "WorkloadEntry creates, updates and deletes by result.",
+	}, []string{"registry", "operation", "result"})
+
+	destinationRuleWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "destinationrule_writes_total",
+		Help:      "DestinationRule creates, updates and deletes by result.",
+	}, []string{"registry", "operation", "result"})
+
+	pendingWrites = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pending_writes",
+		Help:      "Writes to the API server waiting in the write queue, for the rate limit or after a failure.",
+	})
+
+	writeRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "write_retries_total",
+		Help:      "Writes to the API server tried again, at once after a conflict or with backoff after a failure.",
+	}, []string{"reason"})
+
+	pendingDeletions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pending_deletions",
+		Help:      "ServiceEntries of hosts gone from the registry which are kept until the grace period passed.",
+	}, []string{"registry"})
+
+	blockedDeletions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "blocked_deletions",
+		Help:      "ServiceEntries the last garbage collection refused to delete, as they were more than allowed at once.",
+	}, []string{"registry"})
+
+	hostCollisions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "host_collisions",
+		Help:      "Services which aren't published as another service of the registry is published under the same host.",
+	}, []string{"registry"})
+
+	filteredServices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "filtered_services",
+		Help:      "Services which aren't synced as a filter rule of the registry drops them.",
+	}, []string{"registry", "rule"})
+
+	watchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "watch_errors_total",
+		Help:      "Errors watching the registry.",
+	}, []string{"registry"})
+
+	consulLastIndex = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consul_last_index",
+		Help:      "Last index of the Consul catalog services seen per datacenter.",
+	}, []string{"registry", "datacenter"})
+
+	adsReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ads_reconnects_total",
+		Help:      "Reconnects of the ADS stream.",
+	}, []string{"registry"})
+
+	mcpConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mcp_connections",
+		Help:      "Connections to the MCP server.",
+	})
+
+	mcpPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mcp_pushes_total",
+		Help:      "Responses sent by the MCP server per type.",
+	}, []string{"type_url"})
+
+	mcpNacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mcp_nacks_total",
+		Help:      "Responses of the MCP server rejected by the client per type.",
+	}, []string{"type_url"})
+
+	adsAckedVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ads_acked_version_info",
+		Help:      "Last version ACKed on the ADS stream per type, the value is always 1.",
+	}, []string{"registry", "type_url", "version"})
+
+	syncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of publishing the changed hosts of a registry as ServiceEntries.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"registry"})
+
+	connected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registry_connected",
+		Help:      "Whether the watcher of a registry completed its initial sync and reaches the registry.",
+	}, []string{"registry"})
+
+	failingServices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "failing_services",
+		Help:      "Services of a reachable registry which the watcher fails to watch.",
+	}, []string{"registry"})
+
+	lastSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "Unix time of the last sync of a registry which was connected and wrote everything it found.",
+	}, []string{"registry"})
+)
+
+// labels remembers the label values which can't be derived from the registry name, so that Forget can delete them
+var labels = struct {
+	sync.Mutex
+	datacenters  map[string]map[string]struct{} // registry->datacenters
+	ackedVersion map[string]map[string]string   // registry->type URL->version
+	filterRules  map[string]map[string]struct{} // registry->filter rules
+}{
+	datacenters:  make(map[string]map[string]struct{}),
+	ackedVersion: make(map[string]map[string]string),
+	filterRules:  make(map[string]map[string]struct{}),
+}
+
+func init() {
+	prometheus.MustRegister(services, endpoints, serviceEntryWrites, workloadEntryWrites, destinationRuleWrites, pendingWrites, writeRetries,
+		pendingDeletions, blockedDeletions,
+		hostCollisions, filteredServices, watchErrors, consulLastIndex,
+		adsReconnects, adsAckedVersion, syncDuration, connected, failingServices, lastSync, mcpConnections, mcpPushes, mcpNacks)
+}
+
+// SetRegistrySize records the number of services and endpoints seen in a registry
+func SetRegistrySize(registry string, serviceCount, endpointCount int) {
+	services.WithLabelValues(registry).Set(float64(serviceCount))
+	endpoints.WithLabelValues(registry).Set(float64(endpointCount))
+	registries.update(registry, func(h *registryHealth) {
+		h.services, h.endpoints = serviceCount, endpointCount
+	})
+}
+
+// ServiceEntryWritten records a ServiceEntry create, update or delete
+func ServiceEntryWritten(registry, operation string, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	serviceEntryWrites.WithLabelValues(registry, operation, result).Inc()
+}
+
+// WorkloadEntryWritten records a WorkloadEntry create, update or delete
+func WorkloadEntryWritten(registry, operation string, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	workloadEntryWrites.WithLabelValues(registry, operation, result).Inc()
+}
+
+// DestinationRuleWritten records a DestinationRule create, update or delete
+func DestinationRuleWritten(registry, operation string, err error) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailure
+	}
+	destinationRuleWrites.WithLabelValues(registry, operation, result).Inc()
+}
+
+// SetPendingWrites records the number of writes waiting in the write queue
+func SetPendingWrites(count int) {
+	pendingWrites.Set(float64(count))
+}
+
+// WriteRetried records a write tried again for reason, RetryConflict or RetryBackoff
+func WriteRetried(reason string) {
+	writeRetries.WithLabelValues(reason).Inc()
+}
+
+// SetDeletions records the ServiceEntries of a registry whose deletion is pending for the grace period, and those
+// whose deletion was blocked as too many would have been deleted at once
+func SetDeletions(registry string, pending, blocked int) {
+	pendingDeletions.WithLabelValues(registry).Set(float64(pending))
+	blockedDeletions.WithLabelValues(registry).Set(float64(blocked))
+}
+
+// SetHostCollisions records the number of services left out as their host collides with another service
+func SetHostCollisions(registry string, count int) {
+	hostCollisions.WithLabelValues(registry).Set(float64(count))
+}
+
+// SetFilteredServices records the number of services dropped by every filter rule of a registry, the rules which
+// aren't given any more are removed
+func SetFilteredServices(registry string, counts map[string]int) {
+	labels.Lock()
+	defer labels.Unlock()
+	for rule := range labels.filterRules[registry] {
+		if _, found := counts[rule]; !found {
+			filteredServices.DeleteLabelValues(registry, rule)
+		}
+	}
+	rules := make(map[string]struct{}, len(counts))
+	for rule, count := range counts {
+		rules[rule] = struct{}{}
+		filteredServices.WithLabelValues(registry, rule).Set(float64(count))
+	}
+	labels.filterRules[registry] = rules
+}
+
+// SetConsulIndex records the last index of the catalog services of a Consul datacenter
+func SetConsulIndex(registry, datacenter string, index uint64) {
+	labels.Lock()
+	if labels.datacenters[registry] == nil {
+		labels.datacenters[registry] = make(map[string]struct{})
+	}
+	labels.datacenters[registry][datacenter] = struct{}{}
+	labels.Unlock()
+	consulLastIndex.WithLabelValues(registry, datacenter).Set(float64(index))
+}
+
+// ADSReconnected records a reconnect of the ADS stream
+func ADSReconnected(registry string) {
+	adsReconnects.WithLabelValues(registry).Inc()
+}
+
+// MCPConnected records a connection to the MCP server
+func MCPConnected() {
+	mcpConnections.Inc()
+}
+
+// MCPDisconnected records a connection to the MCP server was closed
+func MCPDisconnected() {
+	mcpConnections.Dec()
+}
+
+// MCPPushed records a response of the MCP server
+func MCPPushed(typeURL string) {
+	mcpPushes.WithLabelValues(typeURL).Inc()
+}
+
+// MCPNacked records a response of the MCP server was rejected
+func MCPNacked(typeURL string) {
+	mcpNacks.WithLabelValues(typeURL).Inc()
+}
+
+// ADSAcked records the version ACKed for a type on the ADS stream
+func ADSAcked(registry, typeURL, version string) {
+	labels.Lock()
+	defer labels.Unlock()
+	if labels.ackedVersion[registry] == nil {
+		labels.ackedVersion[registry] = make(map[string]string)
+	}
+	if last, found := labels.ackedVersion[registry][typeURL]; found {
+		adsAckedVersion.DeleteLabelValues(registry, typeURL, last)
+	}
+	labels.ackedVersion[registry][typeURL] = version
+	adsAckedVersion.WithLabelValues(registry, typeURL, version).Set(1)
+}
+
+// ObserveSync records the duration of a sync which started at start
+func ObserveSync(registry string, start time.Time) {
+	syncDuration.WithLabelValues(registry).Observe(time.Since(start).Seconds())
+}
+
+// syncSucceeded records the time of the last successful sync of a registry, see Pass
+func syncSucceeded(registry string) {
+	now := time.Now()
+	lastSync.WithLabelValues(registry).Set(float64(now.Unix()))
+	registries.update(registry, func(h *registryHealth) {
+		h.lastSync = now
+	})
+}
+
+// Forget drops the metrics and the health of a registry which was removed
+func Forget(registry string) {
+	for _, vec := range []*prometheus.MetricVec{services.MetricVec, endpoints.MetricVec, pendingDeletions.MetricVec,
+		blockedDeletions.MetricVec, hostCollisions.MetricVec, watchErrors.MetricVec,
+		adsReconnects.MetricVec, syncDuration.MetricVec, connected.MetricVec, failingServices.MetricVec, lastSync.MetricVec} {
+		vec.DeleteLabelValues(registry)
+	}
+	for _, operation := range []string{OperationCreate, OperationUpdate, OperationDelete} {
+		for _, result := range []string{resultSuccess, resultFailure} {
+			serviceEntryWrites.DeleteLabelValues(registry, operation, result)
+			workloadEntryWrites.DeleteLabelValues(registry, operation, result)
+			destinationRuleWrites.DeleteLabelValues(registry, operation, result)
+		}
+	}
+
+	labels.Lock()
+	for datacenter := range labels.datacenters[registry] {
+		consulLastIndex.DeleteLabelValues(registry, datacenter)
+	}
+	for typeURL, version := range labels.ackedVersion[registry] {
+		adsAckedVersion.DeleteLabelValues(registry, typeURL, version)
+	}
+	for rule := range labels.filterRules[registry] {
+		filteredServices.DeleteLabelValues(registry, rule)
+	}
+	delete(labels.datacenters, registry)
+	delete(labels.ackedVersion, registry)
+	delete(labels.filterRules, registry)
+	labels.Unlock()
+
+	registries.remove(registry)
+}
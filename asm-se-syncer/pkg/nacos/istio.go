@@ -3,10 +3,17 @@ package nacos
 import (
 	"context"
 	log "github.com/sirupsen/logrus"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/plan"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/writer"
 	metaV3 "istio.io/api/networking/v1alpha3"
 	"istio.io/client-go/pkg/apis/networking/v1alpha3"
 	versionedclient "istio.io/client-go/pkg/clientset/versioned"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
 	metaV1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -18,6 +25,16 @@ type IstioClient struct {
 	Config         *rest.Config
 	Client         *versionedclient.Clientset
 	IstioK8sClient *kubernetes.Clientset
+	// registry is the name of the registry whose ServiceEntries are written, for the metrics
+	registry string
+	// recorder records the writes instead of doing them if set
+	recorder *plan.Recorder
+	// identity is stamped on the ServiceEntries written, ServiceEntries without it are never updated or deleted
+	identity serviceentry.Identity
+	// running reports whether a registry runs, the ServiceEntries left by those which don't are taken over
+	running func(registry string) bool
+	// fieldManager applies the ServiceEntries server-side if set, they are updated otherwise
+	fieldManager string
 }
 
 func NewClient(config *rest.Config) (*IstioClient, error) {
@@ -37,7 +54,19 @@ func NewClient(config *rest.Config) (*IstioClient, error) {
 	}, nil
 }
 
+// serviceEntries returns the client of the ServiceEntries of a namespace
+func (k *IstioClient) serviceEntries(namespace string) icapi.ServiceEntryInterface {
+	client := k.Client.NetworkingV1alpha3().ServiceEntries(namespace)
+	if k.recorder != nil {
+		return k.recorder.Wrap(client, k.registry)
+	}
+	return client
+}
+
 func (k *IstioClient) CreateNamespace(namespace string) error {
+	if k.recorder != nil {
+		return nil
+	}
 	_, err := k.IstioK8sClient.CoreV1().Namespaces().Get(context.Background(), namespace, v1.GetOptions{})
 	if err != nil {
 		if client.IgnoreNotFound(err) != nil {
@@ -54,30 +83,22 @@ func (k *IstioClient) CreateNamespace(namespace string) error {
 	return nil
 }
 
-func (k *IstioClient) CreateOrUpdateServiceEntry(serviceEntry *v1alpha3.ServiceEntry) error {
+// CreateOrUpdateServiceEntry writes serviceEntry, applied server-side if the client has a field manager. A ServiceEntry
+// found which isn't published by the registry is never overwritten, a serviceentry.NotOwnedError is returned instead.
+func (k *IstioClient) CreateOrUpdateServiceEntry(ctx context.Context, serviceEntry *v1alpha3.ServiceEntry) error {
 	err := k.CreateNamespace(serviceEntry.Namespace)
 	if err != nil {
 		log.Error(err, "create namespace error")
 		return err
 	}
-	existServiceEntry, err := k.Client.NetworkingV1alpha3().ServiceEntries(serviceEntry.Namespace).Get(context.Background(), serviceEntry.Name, v1.GetOptions{})
-	if err != nil {
-		if client.IgnoreNotFound(err) != nil {
-			log.Error("get service entry err %v", err.Error())
-			return err
-		}
-		_, err = k.Client.NetworkingV1alpha3().ServiceEntries(serviceEntry.Namespace).Create(context.Background(), serviceEntry, v1.CreateOptions{})
-		if err != nil {
-			log.Error("create service entry err %v", err.Error())
-			return err
-		}
-
-		return nil
-	}
-	if existServiceEntry.Annotations != nil {
-		_, ok := existServiceEntry.Annotations["update"]
-		if ok {
-			existServiceEntry.Annotations["update"] = "nacos-mesh"
+	operation, written := monitoring.OperationCreate, true
+	err = writer.ApplyServiceEntry(ctx, k.serviceEntries(serviceEntry.Namespace), serviceEntry, func(existServiceEntry, serviceEntry *v1alpha3.ServiceEntry) bool {
+		operation = monitoring.OperationUpdate
+		if _, ok := existServiceEntry.Annotations["update"]; ok {
+			if serviceEntry.Annotations == nil {
+				serviceEntry.Annotations = make(map[string]string, 1)
+			}
+			serviceEntry.Annotations["update"] = "nacos-mesh"
 			var endpoints []*metaV3.WorkloadEntry
 			for _, newEndpoint := range serviceEntry.Spec.Endpoints {
 				isHave := false
@@ -92,35 +113,63 @@ func (k *IstioClient) CreateOrUpdateServiceEntry(serviceEntry *v1alpha3.ServiceE
 			}
 			serviceEntry.Spec.Endpoints = endpoints
 		}
+		if reflect.DeepEqual(existServiceEntry.Spec, serviceEntry.Spec) && hasLabels(existServiceEntry.Labels, serviceEntry.Labels) &&
+			hasOwnerReferences(existServiceEntry.OwnerReferences, serviceEntry.OwnerReferences) &&
+			existServiceEntry.Annotations[common.AsmSyncerOwnerAnnotation] == k.identity.Annotation() {
+			log.Info("service entry is not change")
+			written = false
+			return false
+		}
+		log.Info("service entry is ", serviceEntry)
+		return true
+	}, k.owns, k.fieldManager)
+	if _, notOwned := err.(*serviceentry.NotOwnedError); written && !notOwned {
+		monitoring.ServiceEntryWritten(k.registry, operation, err)
 	}
-	if reflect.DeepEqual(existServiceEntry.Spec, serviceEntry.Spec) {
-		log.Info("service entry is not change")
-		return nil
+	if err != nil && !k8serrors.IsConflict(err) {
+		log.Errorf("%s service entry err %v", operation, err.Error())
 	}
-	existServiceEntry.Spec = serviceEntry.Spec
-	log.Info("service entry is ", serviceEntry)
-	_, err = k.Client.NetworkingV1alpha3().ServiceEntries(serviceEntry.Namespace).Update(context.Background(), existServiceEntry, v1.UpdateOptions{})
-	if err != nil {
-		log.Error("update service entry err %v", err.Error())
-		return err
+	return err
+}
+
+// DeleteServiceEntry deletes serviceEntry unless the ServiceEntry found isn't published by the registry, a
+// serviceentry.NotOwnedError is returned then
+func (k *IstioClient) DeleteServiceEntry(ctx context.Context, serviceEntry *v1alpha3.ServiceEntry) error {
+	err := writer.DeleteServiceEntry(ctx, k.serviceEntries(serviceEntry.Namespace), serviceEntry.Name, k.owns)
+	if _, notOwned := err.(*serviceentry.NotOwnedError); !notOwned {
+		monitoring.ServiceEntryWritten(k.registry, monitoring.OperationDelete, err)
 	}
-	return nil
+	return err
 }
 
-func (k *IstioClient) DeleteServiceEntry(serviceEntry *v1alpha3.ServiceEntry) error {
-	existServiceEntry, err := k.Client.NetworkingV1alpha3().ServiceEntries(serviceEntry.Namespace).Get(context.Background(), serviceEntry.Name, v1.GetOptions{})
-	if err != nil {
-		if client.IgnoreNotFound(err) != nil {
-			return err
+// hasOwnerReferences reports whether all wanted owner references are set in refs
+func hasOwnerReferences(refs, wanted []v1.OwnerReference) bool {
+	for _, w := range wanted {
+		found := false
+		for _, ref := range refs {
+			if ref.UID == w.UID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
 		}
-
-		return nil
 	}
+	return true
+}
 
-	err = k.Client.NetworkingV1alpha3().ServiceEntries(existServiceEntry.Namespace).Delete(context.Background(), existServiceEntry.Name, v1.DeleteOptions{})
-	if err != nil {
-		return err
+// hasLabels reports whether all wanted labels are set in labels
+func hasLabels(labels, wanted map[string]string) bool {
+	for key, value := range wanted {
+		if labels[key] != value {
+			return false
+		}
 	}
+	return true
+}
 
-	return nil
+// owns reports whether obj may be written: it was published for the registry, or for a registry which doesn't run
+func (k *IstioClient) owns(obj v1.Object) bool {
+	return k.identity.Owns(obj) || k.running != nil && k.identity.Orphaned(obj, k.running)
 }
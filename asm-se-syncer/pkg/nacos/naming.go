@@ -0,0 +1,409 @@
+package nacos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+const (
+	// DefaultGroup is the group Nacos registers services in when none is given
+	DefaultGroup = "DEFAULT_GROUP"
+	// AllNamespaces selects every namespace of the Nacos server
+	AllNamespaces = "*"
+
+	defaultContextPath        = "/nacos"
+	defaultPollInterval       = 10 * time.Second
+	defaultRequestTimeout     = 5 * time.Second
+	servicePageSize           = 500
+	tokenRefreshBeforeExpires = 30 * time.Second
+
+	// DefaultHostTemplate qualifies the services outside the default group and the public namespace by them,
+	// so that they don't collide with each other
+	DefaultHostTemplate = `{{.Prefix}}{{.Service}}{{if ne .Group "` + DefaultGroup + `"}}.{{.Group}}{{end}}{{with .Namespace}}.{{.}}{{end}}`
+)
+
+// NamingConfig describes how to read a Nacos server through its naming Open API.
+type NamingConfig struct {
+	// Endpoint is the address of the Nacos server, e.g. http://nacos:8848
+	// The context path defaults to /nacos if the endpoint has no path.
+	Endpoint string
+	// Namespaces are the ids of the Nacos namespaces to sync, the public namespace if empty.
+	// AllNamespaces syncs every namespace of the server.
+	Namespaces []string
+	// Groups are the groups to sync, all groups if empty
+	Groups []string
+	// Clusters are the clusters to sync, all clusters if empty
+	Clusters []string
+	// Username and Password are used to log in to servers with authentication enabled
+	Username string
+	Password string
+	// PollInterval defaults to 10s
+	PollInterval time.Duration
+	// HostTemplate names the services, DefaultHostTemplate if nil
+	HostTemplate *common.HostTemplate
+	// Filter selects the services which are synced, by name, group, instance metadata and cluster
+	Filter *common.FilterConfig
+}
+
+type namingWatcher struct {
+	client       *http.Client
+	baseURL      string
+	cfg          NamingConfig
+	store        provider.Cache
+	name         string
+	prefix       string
+	toNamespace  string
+	watcherType  string
+	accessToken  string
+	tokenExpires time.Time
+	hosts        *provider.HostTable
+	filter       *provider.Filter
+}
+
+type (
+	namespaceList struct {
+		Data []struct {
+			Namespace         string `json:"namespace"`
+			NamespaceShowName string `json:"namespaceShowName"`
+		} `json:"data"`
+	}
+
+	catalogServiceList struct {
+		Count       int `json:"count"`
+		ServiceList []struct {
+			Name      string `json:"name"`
+			GroupName string `json:"groupName"`
+		} `json:"serviceList"`
+	}
+
+	instanceList struct {
+		Hosts []instance `json:"hosts"`
+	}
+
+	instance struct {
+		InstanceID  string            `json:"instanceId"`
+		IP          string            `json:"ip"`
+		Port        int               `json:"port"`
+		Weight      float64           `json:"weight"`
+		Healthy     bool              `json:"healthy"`
+		Enabled     bool              `json:"enabled"`
+		ClusterName string            `json:"clusterName"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+
+	loginResult struct {
+		AccessToken string `json:"accessToken"`
+		TokenTTL    int64  `json:"tokenTtl"`
+	}
+
+	// service identifies a Nacos service
+	service struct {
+		namespace, group, name string
+	}
+)
+
+var _ provider.Watcher = &namingWatcher{}
+
+// NewNamingWatcher returns a watcher polling the Nacos naming Open API, for Nacos servers which don't expose
+// the MCP over xDS endpoint. Unlike ADSC it fills a provider.Cache, published by a synchronizer.
+func NewNamingWatcher(store provider.Cache, name string, cfg NamingConfig, prefix, toNamespace string) (provider.Watcher, error) {
+	if len(cfg.Endpoint) == 0 {
+		return nil, errors.New("Nacos endpoint not specified")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing endpoint: %s", cfg.Endpoint)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.Errorf("endpoint %s must be an http(s) URL", cfg.Endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = defaultContextPath
+	}
+	if len(cfg.Namespaces) == 0 {
+		cfg.Namespaces = []string{""}
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.HostTemplate == nil {
+		cfg.HostTemplate = common.MustParseHostTemplate(DefaultHostTemplate)
+	}
+	return &namingWatcher{
+		client:      &http.Client{Timeout: defaultRequestTimeout},
+		baseURL:     strings.TrimSuffix(u.String(), "/"),
+		cfg:         cfg,
+		store:       store,
+		name:        name,
+		prefix:      prefix,
+		toNamespace: toNamespace,
+		watcherType: string(common.Nacos),
+		hosts:       provider.NewHostTable(store, name),
+		filter:      provider.NewFilter(cfg.Filter, name),
+	}, nil
+}
+
+func (w *namingWatcher) Cache() provider.Cache {
+	return w.store
+}
+
+func (w *namingWatcher) Name() string {
+	return w.name
+}
+
+func (w *namingWatcher) Prefix() string {
+	return w.prefix
+}
+
+func (w *namingWatcher) ToNamespace() string {
+	return w.toNamespace
+}
+
+func (w *namingWatcher) WatcherType() string {
+	return w.watcherType
+}
+
+// Run the watcher until the context is cancelled
+func (w *namingWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+
+	w.refreshStore() // init
+	for {
+		select {
+		case <-ticker.C:
+			w.refreshStore()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetch services and instances from the Nacos naming API and sync them with Store
+func (w *namingWatcher) refreshStore() {
+	services, err := w.listServices()
+	if err != nil {
+		// keep the last known endpoints rather than publishing a partial view
+		log.Errorf("error listing services from Nacos %s: %v", w.name, err)
+		monitoring.WatchFailed(w.name, err)
+		return
+	}
+
+	data := make(map[string]map[string][]*v1alpha3.WorkloadEntry, len(services)) // host->service->endpoints
+	for _, svc := range services {
+		instances, err := w.listInstances(svc)
+		if err != nil {
+			log.Errorf("error listing instances of %s from Nacos %s: %v", svc.name, w.name, err)
+			monitoring.WatchFailed(w.name, err)
+			return
+		}
+		eps := make([]*v1alpha3.WorkloadEntry, 0, len(instances))
+		for _, i := range instances {
+			if ep := instanceToEndpoint(i); ep != nil {
+				eps = append(eps, ep)
+			}
+		}
+		if len(eps) == 0 || !w.filter.Keep(svc.String(), serviceInfo(svc, instances)) {
+			continue
+		}
+		host, err := w.cfg.HostTemplate.Host(common.HostData{
+			Registry:  w.name,
+			Prefix:    w.prefix,
+			Service:   svc.name,
+			Namespace: svc.namespace,
+			Group:     svc.group,
+		})
+		if err != nil {
+			log.Errorf("service %s of Nacos %s isn't published: %v", svc, w.name, err)
+			continue
+		}
+		if data[host] == nil {
+			data[host] = make(map[string][]*v1alpha3.WorkloadEntry)
+		}
+		data[host][svc.String()] = eps
+	}
+	w.filter.Sweep()
+	w.hosts.Set(data)
+	monitoring.Synced(w.name)
+}
+
+// serviceInfo describes the instances of a service for the filter
+func serviceInfo(svc service, instances []instance) common.ServiceInfo {
+	info := common.ServiceInfo{Name: svc.name, Group: svc.group, Instances: make([]common.InstanceInfo, 0, len(instances))}
+	for _, i := range instances {
+		info.Instances = append(info.Instances, common.InstanceInfo{Metadata: i.Metadata, Cluster: i.ClusterName})
+	}
+	return info
+}
+
+// listServices lists the services of the configured namespaces and groups
+func (w *namingWatcher) listServices() ([]service, error) {
+	namespaces, err := w.listNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	var services []service
+	for _, namespace := range namespaces {
+		for pageNo := 1; ; pageNo++ {
+			query := url.Values{}
+			query.Set("namespaceId", namespace)
+			query.Set("pageNo", strconv.Itoa(pageNo))
+			query.Set("pageSize", strconv.Itoa(servicePageSize))
+			query.Set("withInstances", "false")
+			var page catalogServiceList
+			if err := w.get("/v1/ns/catalog/services", query, &page); err != nil {
+				return nil, errors.Wrapf(err, "failed to list services of namespace %q", namespace)
+			}
+			for _, s := range page.ServiceList {
+				if s.GroupName == "" {
+					s.GroupName = DefaultGroup
+				}
+				if !selected(w.cfg.Groups, s.GroupName) {
+					continue
+				}
+				services = append(services, service{namespace: namespace, group: s.GroupName, name: s.Name})
+			}
+			if len(page.ServiceList) < servicePageSize || pageNo*servicePageSize >= page.Count {
+				break
+			}
+		}
+	}
+	return services, nil
+}
+
+// listNamespaces resolves the configured namespaces, listing all of them from the server if requested
+func (w *namingWatcher) listNamespaces() ([]string, error) {
+	if !selected(w.cfg.Namespaces, AllNamespaces) {
+		return w.cfg.Namespaces, nil
+	}
+	var list namespaceList
+	if err := w.get("/v1/console/namespaces", nil, &list); err != nil {
+		return nil, errors.Wrap(err, "failed to list namespaces")
+	}
+	namespaces := make([]string, 0, len(list.Data))
+	for _, ns := range list.Data {
+		namespaces = append(namespaces, ns.Namespace)
+	}
+	return namespaces, nil
+}
+
+// listInstances lists the healthy and enabled instances of svc in the configured clusters
+func (w *namingWatcher) listInstances(svc service) ([]instance, error) {
+	query := url.Values{}
+	query.Set("namespaceId", svc.namespace)
+	query.Set("groupName", svc.group)
+	query.Set("serviceName", svc.name)
+	query.Set("healthyOnly", "true")
+	if len(w.cfg.Clusters) > 0 {
+		query.Set("clusters", strings.Join(w.cfg.Clusters, ","))
+	}
+	var list instanceList
+	if err := w.get("/v1/ns/instance/list", query, &list); err != nil {
+		return nil, err
+	}
+	return list.Hosts, nil
+}
+
+// get issues a GET request against the Nacos API and decodes the JSON response into out
+func (w *namingWatcher) get(path string, query url.Values, out interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if w.cfg.Username != "" {
+		token, err := w.token()
+		if err != nil {
+			return err
+		}
+		query.Set("accessToken", token)
+	}
+	resp, err := w.client.Get(w.baseURL + path + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+			// log in again on the next request
+			w.accessToken = ""
+		}
+		return errors.Errorf("GET %s returned %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// token logs in to Nacos if there is no valid access token
+func (w *namingWatcher) token() (string, error) {
+	if w.accessToken != "" && time.Now().Before(w.tokenExpires) {
+		return w.accessToken, nil
+	}
+	form := url.Values{}
+	form.Set("username", w.cfg.Username)
+	form.Set("password", w.cfg.Password)
+	resp, err := w.client.PostForm(w.baseURL+"/v1/auth/login", form)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to log in to Nacos")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to log in to Nacos as %s: status %d", w.cfg.Username, resp.StatusCode)
+	}
+	var result loginResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrap(err, "failed to decode Nacos login result")
+	}
+	w.accessToken = result.AccessToken
+	w.tokenExpires = time.Now().Add(time.Duration(result.TokenTTL)*time.Second - tokenRefreshBeforeExpires)
+	return w.accessToken, nil
+}
+
+// String identifies a service across namespaces and groups, e.g. dev/DEFAULT_GROUP/orders
+func (s service) String() string {
+	return fmt.Sprintf("%s/%s/%s", s.namespace, s.group, s.name)
+}
+
+// instanceToEndpoint converts a Nacos instance to a service entry endpoint, it returns nil for instances
+// which must not receive traffic.
+func instanceToEndpoint(i instance) *v1alpha3.WorkloadEntry {
+	if !i.Healthy || !i.Enabled || i.Weight <= 0 || i.IP == "" || i.Port <= 0 {
+		return nil
+	}
+	ep := serviceentry.EndpointWithProtocol(i.IP, uint32(i.Port), i.Metadata[serviceentry.ProtocolKey])
+	ep.Labels = serviceentry.Labels(i.Metadata)
+	// Nacos weights are decimals defaulting to 1
+	ep.Weight = uint32(math.Max(1, math.Round(i.Weight*100)))
+	return ep
+}
+
+// selected reports whether value is selected by filter; an empty filter selects everything
+func selected(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package nacos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+)
+
+// fakeNaming serves the Nacos naming API from a map of namespace->group->service->instances
+func fakeNaming(t *testing.T, services map[string]map[string]map[string][]instance) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var out interface{}
+		switch r.URL.Path {
+		case "/nacos/v1/console/namespaces":
+			var list namespaceList
+			for ns := range services {
+				list.Data = append(list.Data, struct {
+					Namespace         string `json:"namespace"`
+					NamespaceShowName string `json:"namespaceShowName"`
+				}{Namespace: ns})
+			}
+			out = list
+		case "/nacos/v1/ns/catalog/services":
+			var list catalogServiceList
+			for group, svcs := range services[q.Get("namespaceId")] {
+				for name := range svcs {
+					list.ServiceList = append(list.ServiceList, struct {
+						Name      string `json:"name"`
+						GroupName string `json:"groupName"`
+					}{Name: name, GroupName: group})
+				}
+			}
+			list.Count = len(list.ServiceList)
+			out = list
+		case "/nacos/v1/ns/instance/list":
+			var list instanceList
+			for _, i := range services[q.Get("namespaceId")][q.Get("groupName")][q.Get("serviceName")] {
+				if q.Get("healthyOnly") == "true" && !i.Healthy {
+					continue
+				}
+				list.Hosts = append(list.Hosts, i)
+			}
+			out = list
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	}))
+}
+
+func TestNamingRefreshStore(t *testing.T) {
+	healthy := instance{IP: "192.0.2.1", Port: 8080, Weight: 1, Healthy: true, Enabled: true}
+	unhealthy := instance{IP: "192.0.2.2", Port: 8080, Weight: 1, Healthy: false, Enabled: true}
+	services := map[string]map[string]map[string][]instance{
+		"": {
+			DefaultGroup: {"service1": {healthy, unhealthy}},
+			"orders":     {"service2": {healthy}},
+		},
+		"dev": {
+			DefaultGroup: {"service1": {healthy}},
+		},
+	}
+	server := fakeNaming(t, services)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		cfg    NamingConfig
+		prefix string
+		want   []string
+	}{
+		{
+			name: "public namespace",
+			cfg:  NamingConfig{},
+			want: []string{"service1", "service2.orders"},
+		},
+		{
+			name: "group filter",
+			cfg:  NamingConfig{Groups: []string{DefaultGroup}},
+			want: []string{"service1"},
+		},
+		{
+			name: "namespace filter",
+			cfg:  NamingConfig{Namespaces: []string{"dev"}},
+			want: []string{"service1.dev"},
+		},
+		{
+			name:   "all namespaces",
+			cfg:    NamingConfig{Namespaces: []string{AllNamespaces}},
+			prefix: "nacos-",
+			want:   []string{"nacos-service1", "nacos-service2.orders", "nacos-service1.dev"},
+		},
+		{
+			name: "host template",
+			cfg:  NamingConfig{HostTemplate: common.MustParseHostTemplate("{{.Service}}.{{.Group}}.nacos")},
+			want: []string{"service1.default-group.nacos", "service2.orders.nacos"},
+		},
+		{
+			name: "service filter",
+			cfg: NamingConfig{
+				Namespaces: []string{AllNamespaces},
+				Filter:     &common.FilterConfig{Exclude: []common.ServiceMatch{{Name: "service1", Groups: []string{DefaultGroup}}}},
+			},
+			want: []string{"service2.orders"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Endpoint = server.URL
+			w, err := NewNamingWatcher(provider.NewCache(), "nacos-test", tt.cfg, tt.prefix, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.(*namingWatcher).refreshStore()
+
+			actual := w.Cache().Hosts()
+			if len(actual) != len(tt.want) {
+				t.Fatalf("hosts must be %v but got %v", tt.want, actual)
+			}
+			for _, host := range tt.want {
+				eps, ok := actual[host]
+				if !ok {
+					t.Fatalf("host %s must exist in %v", host, actual)
+				}
+				if len(eps) != 1 || eps[0].Address != healthy.IP {
+					t.Fatalf("host %s must only have the healthy endpoint but got %v", host, eps)
+				}
+			}
+		})
+	}
+}
+
+func TestInstanceToEndpoint(t *testing.T) {
+	tests := []struct {
+		name string
+		in   instance
+		want *v1alpha3.WorkloadEntry
+	}{
+		{
+			name: "healthy instance",
+			in: instance{IP: "192.0.2.1", Port: 80, Weight: 0.5, Healthy: true, Enabled: true,
+				Metadata: map[string]string{"version": "v1", "preserved.register.source": "SPRING_CLOUD", "bad key": "x"}},
+			want: &v1alpha3.WorkloadEntry{
+				Address: "192.0.2.1",
+				Ports:   map[string]uint32{"http": 80},
+				Labels:  map[string]string{"version": "v1", "preserved.register.source": "SPRING_CLOUD"},
+				Weight:  50,
+			},
+		},
+		{
+			name: "instance declaring its protocol",
+			in: instance{IP: "192.0.2.1", Port: 20880, Weight: 1, Healthy: true, Enabled: true,
+				Metadata: map[string]string{"protocol": "dubbo"}},
+			want: &v1alpha3.WorkloadEntry{
+				Address: "192.0.2.1",
+				Ports:   map[string]uint32{"tcp-dubbo-20880": 20880},
+				Labels:  map[string]string{"protocol": "dubbo"},
+				Weight:  100,
+			},
+		},
+		{
+			name: "disabled instance",
+			in:   instance{IP: "192.0.2.1", Port: 80, Weight: 1, Healthy: true, Enabled: false},
+		},
+		{
+			name: "zero weight instance",
+			in:   instance{IP: "192.0.2.1", Port: 80, Weight: 0, Healthy: true, Enabled: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := instanceToEndpoint(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("instanceToEndpoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
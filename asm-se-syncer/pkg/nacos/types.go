@@ -5,6 +5,8 @@ import (
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	pstruct "github.com/golang/protobuf/ptypes/struct"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/plan"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/writer"
 	"google.golang.org/grpc"
 	"istio.io/istio/pkg/security"
 )
@@ -67,6 +69,15 @@ type Config struct {
 	ResponseHandler ResponseHandler
 
 	GrpcOpts []grpc.DialOption
+
+	// Recorder, if set, records the ServiceEntry writes instead of doing them, for dry runs.
+	Recorder *plan.Recorder
+
+	// Queue, if set, does the ServiceEntry writes rate limited and retried, instead of the watcher.
+	Queue *writer.Queue
+
+	// FieldManager, if set, applies the ServiceEntries server-side as this field manager.
+	FieldManager string
 }
 
 type ResponseHandler interface {
@@ -15,9 +15,15 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/any"
 	pstruct "github.com/golang/protobuf/ptypes/struct"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/plan"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/writer"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/keepalive"
 	"io/ioutil"
@@ -30,10 +36,12 @@ import (
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pkg/config"
 	"istio.io/istio/pkg/config/schema/collections"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -42,24 +50,31 @@ const (
 	grpcInitialConnWindowSize = 1 << 30
 )
 
+// serviceEntryType is the type URL the ServiceEntries are subscribed to
+var serviceEntryType = collections.IstioNetworkingV1Alpha3Serviceentries.Resource().GroupVersionKind().String()
+
 // ADSC implements a basic client for ADS, for use in stress tests and tools
 // or libraries that need to connect to Istio pilot or other ADS servers.
 type ADSC struct {
 	// Stream is the GRPC connection stream, allowing direct GRPC send operations.
-	// Set after Dial is called.
+	// Set whenever the server is dialed, it is only used by the goroutine receiving from it.
 	stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient
-	// xds client used to create a stream
-	client discovery.AggregatedDiscoveryServiceClient
-	conn   *grpc.ClientConn
 
 	// Indicates if the ADSC client is closed
 	closed bool
+	// cancel stops Run
+	cancel context.CancelFunc
 
 	// NodeID is the node identity sent to Pilot.
 	nodeID string
 
 	url string
 
+	// name is the name of the registry, used to label and claim the published ServiceEntries
+	name string
+
+	prefix string
+
 	toNamespace string
 
 	watcherType string
@@ -91,8 +106,6 @@ type ADSC struct {
 	// If nil, the defaults will be used.
 	Metadata *pstruct.Struct
 
-	// Updates includes the type of the last update received from the server.
-	Updates     chan string
 	XDSUpdates  chan *discovery.DiscoveryResponse
 	VersionInfo map[string]string
 
@@ -114,59 +127,95 @@ type ADSC struct {
 	// LocalCacheDir is set to a base name used to save fetched resources.
 	// If set, each update will be saved.
 	// TODO: also load at startup - so we can support warm up in init-container, and survive
-	// restarts.
+	// restarts. Unlike the other registries, the ADS state isn't kept by the snapshot package yet.
 	LocalCacheDir string
 
-	// RecvWg is for letting goroutines know when the goroutine handling the ADS stream finishes.
-	RecvWg sync.WaitGroup
-
 	cfg *Config
 
-	ServiceEntry map[string]string
+	// entries are the ServiceEntries received and published, by MCP resource name
+	entries map[string]receivedEntry
+	// resync is set on every new stream, the first ServiceEntry response received on it is the full state of the
+	// server, the ServiceEntries missing from it were removed while the stream was down
+	resync bool
 
 	// sendNodeMeta is set to true if the connection is new - and we need to send node meta.,
-	sendNodeMeta                   bool
-	sync                           map[string]time.Time
-	syncCh                         chan string
-	Locality                       *core.Locality
-	IstioClient                    *IstioClient
-	CreateOrUpdateServiceEntryChan chan *v1alpha3.ServiceEntry
+	sendNodeMeta bool
+	sync         map[string]time.Time
+	syncCh       chan string
+	Locality     *core.Locality
+	IstioClient  *IstioClient
+	claims       *serviceentry.HostClaims
+	leader       *leader.Elector
+	// identity is stamped on the published ServiceEntries, with the owner reference unless it is zero
+	identity serviceentry.Identity
+	// queued counts the received ServiceEntries which haven't been handled yet
+	queued int32
+	// pending are the latest ServiceEntries received before this replica became the leader, by name
+	pending                        map[string]*v1alpha3.ServiceEntry
+	pendingMutex                   sync.Mutex
+	CreateOrUpdateServiceEntryChan chan queuedEntry
 	//UpdateServiceEntryChan chan *v1alpha3.ServiceEntry
-	DeleteServiceEntryChan chan *v1alpha3.ServiceEntry
+	DeleteServiceEntryChan chan queuedEntry
+}
+
+// receivedEntry is a ServiceEntry published as received, with the MCP version it was received at
+type receivedEntry struct {
+	version      string
+	serviceEntry *v1alpha3.ServiceEntry
+}
+
+// queuedEntry is a received ServiceEntry to be written, with the sync of the response it was received in
+type queuedEntry struct {
+	serviceEntry *v1alpha3.ServiceEntry
+	pass         *monitoring.Pass
 }
 
-func NewWatcher(endpoint string, opts *Config, istioConfig *rest.Config, nacosNamespace, toNamespace string, store model.ConfigStoreCache) (*ADSC, error) {
+func NewWatcher(name, endpoint string, opts *Config, istioConfig *rest.Config, nacosNamespace, prefix, toNamespace string,
+	store model.ConfigStoreCache, claims *serviceentry.HostClaims, elector *leader.Elector, owner metav1.OwnerReference) (*ADSC, error) {
 	if opts == nil {
 		opts = &Config{}
 	}
 	// We want to recreate stream
 	if opts.BackoffPolicy == nil {
-		opts.BackoffPolicy = backoff.NewExponentialBackOff()
+		policy := backoff.NewExponentialBackOff()
+		// the stream is opened again for as long as the watcher runs
+		policy.MaxElapsedTime = 0
+		opts.BackoffPolicy = policy
 	}
 	istioClient, err := NewClient(istioConfig)
 	if err != nil {
 		return nil, err
 	}
 	log.Info("create nacos istio client success")
+	identity := serviceentry.Identity{Type: string(common.Nacos), Registry: name, Ref: owner}
+	istioClient.registry = name
+	istioClient.recorder = opts.Recorder
+	istioClient.identity = identity
+	istioClient.running = claims.Running
+	istioClient.fieldManager = opts.FieldManager
 	adsc := &ADSC{
-		Updates:                        make(chan string, 100),
 		XDSUpdates:                     make(chan *discovery.DiscoveryResponse, 100),
 		VersionInfo:                    map[string]string{},
+		name:                           name,
+		prefix:                         prefix,
 		toNamespace:                    toNamespace,
 		nacosNamespace:                 nacosNamespace,
 		watcherType:                    string(common.Nacos),
 		url:                            endpoint,
 		Received:                       map[string]*discovery.DiscoveryResponse{},
-		RecvWg:                         sync.WaitGroup{},
 		cfg:                            opts,
 		syncCh:                         make(chan string, len(collections.Pilot.All())),
 		sync:                           map[string]time.Time{},
 		IstioClient:                    istioClient,
-		CreateOrUpdateServiceEntryChan: make(chan *v1alpha3.ServiceEntry, 50),
+		claims:                         claims,
+		leader:                         elector,
+		identity:                       identity,
+		pending:                        make(map[string]*v1alpha3.ServiceEntry),
+		CreateOrUpdateServiceEntryChan: make(chan queuedEntry, 50),
 		Store:                          model.MakeIstioStore(store),
-		ServiceEntry:                   make(map[string]string),
+		entries:                        make(map[string]receivedEntry),
 		//UpdateServiceEntryChan: make(chan *v1alpha3.ServiceEntry, 10),
-		DeleteServiceEntryChan: make(chan *v1alpha3.ServiceEntry, 50),
+		DeleteServiceEntryChan: make(chan queuedEntry, 50),
 	}
 
 	if opts.Namespace == "" {
@@ -186,25 +235,6 @@ func NewWatcher(endpoint string, opts *Config, istioConfig *rest.Config, nacosNa
 
 	adsc.nodeID = fmt.Sprintf("%s~%s~%s.%s~%s.svc.cluster.local", opts.NodeType, opts.IP,
 		opts.Workload, opts.Namespace, opts.Namespace)
-
-	if err := adsc.Dial(); err != nil {
-		return nil, err
-	}
-
-	adsc.client = discovery.NewAggregatedDiscoveryServiceClient(adsc.conn)
-	adsc.stream, err = adsc.client.StreamAggregatedResources(context.Background())
-	if err != nil {
-		log.Error("can not get stream err is %s", err.Error())
-		return nil, err
-	}
-	log.Info("new stream success")
-	adsc.sendNodeMeta = true
-	adsc.InitialLoad = 0
-	if err := adsc.Send(&discovery.DiscoveryRequest{
-		TypeUrl: collections.IstioNetworkingV1Alpha3Serviceentries.Resource().GroupVersionKind().String(),
-	}); err != nil {
-		return adsc, err
-	}
 	return adsc, nil
 }
 
@@ -228,30 +258,80 @@ func (a *ADSC) Cache() provider.Cache {
 	return nil
 }
 
+func (a *ADSC) Name() string {
+	return a.name
+}
+
 func (a *ADSC) Prefix() string {
-	return ""
+	return a.prefix
 }
 
+// Run the watcher until the context is cancelled or Close is called. The server is dialed again, with backoff,
+// whenever the stream fails, and the ServiceEntries are subscribed to again from the last version received.
+// The ServiceEntries received are written by a single goroutine.
 func (a *ADSC) Run(ctx context.Context) {
-	// Send the initial requests
-	/*for _, r := range a.cfg.InitialDiscoveryRequests {
-		if r.TypeUrl == v3.ClusterType {
-			a.watchTime = time.Now()
-		}
-		_ = a.Send(r)
-	}*/
-	// by default, we assume 1 goroutine decrements the waitgroup (go a.handleRecv()).
-	// for synchronizing when the goroutine finishes reading from the gRPC stream.
-	a.RecvWg.Add(1)
-	go a.handleRecv()
-	a.RecvWg.Add(1)
-	go a.handleServiceEntry()
-}
-
-func (a *ADSC) Dial() error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return
+	}
+	a.cancel = cancel
+	a.mutex.Unlock()
+
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		a.handleServiceEntry(ctx)
+	}()
+	defer writer.Wait()
+
+	for {
+		err := a.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Errorf("ADS stream of nacos %q failed for node %v: %v", a.name, a.nodeID, err)
+		monitoring.WatchFailed(a.name, err)
+		delay := a.cfg.BackoffPolicy.NextBackOff()
+		if delay == backoff.Stop {
+			log.Errorf("giving up reconnecting to nacos %q", a.name)
+			return
+		}
+		if !sleep(ctx, delay) {
+			return
+		}
+		monitoring.ADSReconnected(a.name)
+	}
+}
+
+// watch dials the server, subscribes to the ServiceEntries and handles the responses until the stream fails
+func (a *ADSC) watch(ctx context.Context) error {
+	conn, err := a.dial()
+	if err != nil {
+		return errors.Wrapf(err, "failed to dial %s", a.url)
+	}
+	// the connection of a failed stream is never reused
+	defer conn.Close()
+	a.stream, err = discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to open the stream")
+	}
+	a.sendNodeMeta = true
+	a.resync = true
+	version := a.VersionInfo[serviceEntryType]
+	if err := a.Send(&discovery.DiscoveryRequest{TypeUrl: serviceEntryType, VersionInfo: version}); err != nil {
+		return errors.Wrap(err, "failed to subscribe to ServiceEntries")
+	}
+	log.Infof("subscribed to the ServiceEntries of nacos %q at %s, version %q", a.name, a.url, version)
+	return a.handleRecv(ctx)
+}
+
+func (a *ADSC) dial() (*grpc.ClientConn, error) {
 	opts := a.cfg
 
-	var err error
 	grpcDialOptions := opts.GrpcOpts
 	if len(grpcDialOptions) == 0 {
 		// Only disable transport security if the user didn't supply custom dial options
@@ -268,31 +348,19 @@ func (a *ADSC) Dial() error {
 			}))
 	}
 
-	a.conn, err = grpc.Dial(a.url, grpcDialOptions...)
-	if err != nil {
-		return err
-	}
-	return nil
+	return grpc.Dial(a.url, grpcDialOptions...)
 }
 
-func (a *ADSC) handleRecv() {
+// handleRecv handles the responses received on the stream until it fails
+func (a *ADSC) handleRecv(ctx context.Context) error {
 	for {
 		var err error
 		msg, err := a.stream.Recv()
 		if err != nil {
-			a.RecvWg.Done()
-			log.Info("Connection closed for node %v with err: %v", a.nodeID, err)
-			// if 'reconnect' enabled - schedule a new Run
-			if a.cfg.BackoffPolicy != nil {
-				time.AfterFunc(a.cfg.BackoffPolicy.NextBackOff(), a.reconnect)
-			} else {
-				a.Close()
-				a.WaitClear()
-				a.Updates <- ""
-				a.XDSUpdates <- nil
-			}
-			return
+			return err
 		}
+		// the stream works, the next failure is retried without delay
+		a.cfg.BackoffPolicy.Reset()
 
 		// Group-value-kind - used for high level api generator.
 		gvk := strings.SplitN(msg.TypeUrl, "/", 3)
@@ -328,9 +396,17 @@ func (a *ADSC) handleRecv() {
 
 		// Process the resources.
 		a.VersionInfo[msg.TypeUrl] = msg.VersionInfo
+		var pass *monitoring.Pass
+		if msg.TypeUrl == serviceEntryType {
+			pass = monitoring.StartPass(a.name)
+		}
 		switch msg.TypeUrl {
 		default:
-			a.handleMCP(gvk, msg.Resources)
+			seen := a.handleMCP(ctx, gvk, msg.Resources, pass)
+			if msg.TypeUrl == serviceEntryType && a.resync && seen != nil {
+				a.resync = false
+				a.deleteMissing(ctx, seen, pass)
+			}
 		}
 
 		// If we got no resource - still save to the store with empty name/namespace, to notify sync
@@ -349,20 +425,15 @@ func (a *ADSC) handleRecv() {
 		a.Received[msg.TypeUrl] = msg
 		a.ack(msg)
 		a.mutex.Unlock()
-
-		select {
-		case a.XDSUpdates <- msg:
-		default:
+		if msg.TypeUrl == serviceEntryType {
+			monitoring.Synced(a.name)
+			a.observeSize()
+			pass.End()
 		}
-	}
-}
 
-func (a *ADSC) WaitClear() {
-	for {
 		select {
-		case <-a.Updates:
+		case a.XDSUpdates <- msg:
 		default:
-			return
 		}
 	}
 }
@@ -380,44 +451,49 @@ func (a *ADSC) ack(msg *discovery.DiscoveryResponse) {
 		}
 	}
 
-	_ = a.stream.Send(&discovery.DiscoveryRequest{
+	err := a.stream.Send(&discovery.DiscoveryRequest{
 		ResponseNonce: msg.Nonce,
 		TypeUrl:       msg.TypeUrl,
 		Node:          a.node(),
 		VersionInfo:   msg.VersionInfo,
 		ResourceNames: resources,
 	})
+	if err == nil {
+		monitoring.ADSAcked(a.name, msg.TypeUrl, msg.VersionInfo)
+	}
 }
 
-func (a *ADSC) handleMCP(gvk []string, resources []*any.Any) {
+// handleMCP passes the ServiceEntries which changed to the writer, their writes are tracked by pass. It returns the
+// names of all resources received, or nil if some of them couldn't be read.
+func (a *ADSC) handleMCP(ctx context.Context, gvk []string, resources []*any.Any, pass *monitoring.Pass) map[string]struct{} {
 	if len(gvk) != 3 || a.Store == nil {
-		return // Not MCP Generic - fill up the store
+		return nil // Not MCP Generic - fill up the store
 	}
 
 	groupVersionKind := config.GroupVersionKind{Group: gvk[0], Version: gvk[1], Kind: gvk[2]}
+	seen := make(map[string]struct{}, len(resources))
+	complete := true
 	for _, rsc := range resources {
 		m := &mcp.Resource{}
 		err := types.UnmarshalAny(&types.Any{
 			TypeUrl: rsc.TypeUrl,
 			Value:   rsc.Value,
 		}, m)
-		if err != nil {
-			log.Error("Error unmarshalling received MCP config %v", err.Error())
+		if err != nil || m.Metadata == nil {
+			log.Errorf("Error unmarshalling received MCP config %v", err)
+			complete = false
+			pass.Fail()
 			continue
 		}
-		xVersion, ok := a.ServiceEntry[m.Metadata.Name]
-		if ok {
-			if xVersion == m.Metadata.Version {
-				log.Info("service entry xVersion is not change")
-				continue
-			}
-			a.ServiceEntry[m.Metadata.Name] = m.Metadata.Version
-		} else {
-			a.ServiceEntry[m.Metadata.Name] = m.Metadata.Version
+		seen[m.Metadata.Name] = struct{}{}
+		if entry, ok := a.entries[m.Metadata.Name]; ok && entry.version == m.Metadata.Version {
+			log.Info("service entry xVersion is not change")
+			continue
 		}
 		val, err := mcpToPilot(m)
 		if err != nil {
 			log.Error("Invalid data ", err.Error(), " ", string(rsc.Value))
+			pass.Fail()
 			continue
 		}
 		//received[val.Namespace+"/"+val.Name] = val
@@ -425,36 +501,221 @@ func (a *ADSC) handleMCP(gvk []string, resources []*any.Any) {
 		val.GroupVersionKind = groupVersionKind
 		serviceEntry, err := getServiceEntry(val)
 		if err != nil {
+			pass.Fail()
 			continue
 		}
+		a.publishAs(serviceEntry)
 		if len(serviceEntry.Spec.Endpoints) == 0 {
-			a.DeleteServiceEntryChan <- serviceEntry
-			delete(a.ServiceEntry, m.Metadata.Name)
+			delete(a.entries, m.Metadata.Name)
+			a.enqueue(ctx, a.DeleteServiceEntryChan, serviceEntry, pass)
 		} else {
-			a.CreateOrUpdateServiceEntryChan <- serviceEntry
+			a.entries[m.Metadata.Name] = receivedEntry{version: m.Metadata.Version, serviceEntry: serviceEntry.DeepCopy()}
+			a.enqueue(ctx, a.CreateOrUpdateServiceEntryChan, serviceEntry, pass)
 		}
+	}
+	if !complete {
+		return nil
+	}
+	return seen
+}
 
+// deleteMissing deletes the ServiceEntries published before which the server didn't send on the new stream,
+// seen are the names of those it sent
+func (a *ADSC) deleteMissing(ctx context.Context, seen map[string]struct{}, pass *monitoring.Pass) {
+	for name, entry := range a.entries {
+		if _, found := seen[name]; found {
+			continue
+		}
+		log.Infof("ServiceEntry %s was removed from nacos %q while the stream was down", name, a.name)
+		delete(a.entries, name)
+		serviceEntry := entry.serviceEntry.DeepCopy()
+		serviceEntry.Spec.Endpoints = nil
+		a.enqueue(ctx, a.DeleteServiceEntryChan, serviceEntry, pass)
 	}
 }
 
-func (a *ADSC) handleServiceEntry() {
+// observeSize records the number of ServiceEntries received and of their endpoints
+func (a *ADSC) observeSize() {
+	endpoints := 0
+	for _, entry := range a.entries {
+		endpoints += len(entry.serviceEntry.Spec.Endpoints)
+	}
+	monitoring.SetRegistrySize(a.name, len(a.entries), endpoints)
+}
+
+// enqueue passes a ServiceEntry to the writer, unless the watcher stops in the meantime. Its write is tracked by pass.
+func (a *ADSC) enqueue(ctx context.Context, ch chan<- queuedEntry, serviceEntry *v1alpha3.ServiceEntry, pass *monitoring.Pass) {
+	atomic.AddInt32(&a.queued, 1)
+	pass.Add()
+	select {
+	case ch <- queuedEntry{serviceEntry: serviceEntry, pass: pass}:
+	case <-ctx.Done():
+		atomic.AddInt32(&a.queued, -1)
+		pass.Done(ctx.Err())
+	}
+}
+
+// handleServiceEntry writes the received ServiceEntries once this replica is the leader, until the context is
+// cancelled. Only the latest ServiceEntry of every name is kept until then.
+func (a *ADSC) handleServiceEntry(ctx context.Context) {
+	leading := a.leader.Leading()
+	isLeader := false
 	for {
 		select {
-		case serviceEntry := <-a.CreateOrUpdateServiceEntryChan:
-			err := a.IstioClient.CreateOrUpdateServiceEntry(serviceEntry)
-			if err != nil {
-				log.Error("create service entry err %v", err.Error())
+		case <-ctx.Done():
+			return
+		case <-leading:
+			leading = nil
+			isLeader = true
+			a.publishPending()
+		case entry := <-a.CreateOrUpdateServiceEntryChan:
+			if !isLeader {
+				a.keepPending(entry)
+			} else {
+				a.createOrUpdate(entry.serviceEntry, entry.pass)
 			}
-		case serviceEntry := <-a.DeleteServiceEntryChan:
-			err := a.IstioClient.DeleteServiceEntry(serviceEntry)
-			if err != nil {
-				log.Error("delete service entry err %v", err.Error())
+			atomic.AddInt32(&a.queued, -1)
+		case entry := <-a.DeleteServiceEntryChan:
+			if !isLeader {
+				a.keepPending(entry)
+			} else {
+				a.delete(entry.serviceEntry, entry.pass)
 			}
+			atomic.AddInt32(&a.queued, -1)
 		}
 
 	}
 }
 
+// Settled reports whether all received ServiceEntries were handled
+func (a *ADSC) Settled() bool {
+	return atomic.LoadInt32(&a.queued) == 0
+}
+
+// keepPending keeps a ServiceEntry received before this replica became the leader, its sync isn't successful as it
+// isn't written
+func (a *ADSC) keepPending(entry queuedEntry) {
+	entry.pass.Fail()
+	entry.pass.Done(nil)
+	a.pendingMutex.Lock()
+	defer a.pendingMutex.Unlock()
+	a.pending[entry.serviceEntry.Name] = entry.serviceEntry
+}
+
+func (a *ADSC) publishPending() {
+	a.pendingMutex.Lock()
+	pending := a.pending
+	a.pending = make(map[string]*v1alpha3.ServiceEntry)
+	a.pendingMutex.Unlock()
+	log.Infof("publishing %d ServiceEntries received from nacos %q before becoming the leader", len(pending), a.name)
+	for _, serviceEntry := range pending {
+		if len(serviceEntry.Spec.Endpoints) == 0 {
+			a.delete(serviceEntry, nil)
+		} else {
+			a.createOrUpdate(serviceEntry, nil)
+		}
+	}
+}
+
+func (a *ADSC) createOrUpdate(serviceEntry *v1alpha3.ServiceEntry, pass *monitoring.Pass) {
+	if !a.claim(serviceEntry) {
+		// the conflict is reported instead
+		pass.Done(nil)
+		return
+	}
+	a.write(serviceEntry, pass, func(ctx context.Context) error {
+		return a.IstioClient.CreateOrUpdateServiceEntry(ctx, serviceEntry)
+	}, func(err error) {
+		if notOwned, ok := err.(*serviceentry.NotOwnedError); ok {
+			// written by hand or by another tool, it is never overwritten
+			for _, host := range serviceEntry.Spec.Hosts {
+				a.claims.Refuse(host, a.name, notOwned.Publisher)
+			}
+			return
+		}
+		if err != nil {
+			log.Errorf("create service entry err %v", err.Error())
+		}
+	})
+}
+
+func (a *ADSC) delete(serviceEntry *v1alpha3.ServiceEntry, pass *monitoring.Pass) {
+	if !a.claim(serviceEntry) {
+		// published by another registry, not ours to delete
+		pass.Done(nil)
+		return
+	}
+	a.write(serviceEntry, pass, func(ctx context.Context) error {
+		return a.IstioClient.DeleteServiceEntry(ctx, serviceEntry)
+	}, func(err error) {
+		if _, ok := err.(*serviceentry.NotOwnedError); ok {
+			log.Warnf("service entry isn't deleted: %v", err)
+		} else if err != nil {
+			log.Errorf("delete service entry err %v", err.Error())
+			return
+		}
+		for _, host := range serviceEntry.Spec.Hosts {
+			a.claims.Release(host, a.name)
+		}
+	})
+}
+
+// write does a write of serviceEntry at once, or queues it with the write queue if there is one. done is called
+// with the final result of the write, unless it is replaced by a later one; pass is told the result in any case.
+func (a *ADSC) write(serviceEntry *v1alpha3.ServiceEntry, pass *monitoring.Pass, write writer.Write, done func(error)) {
+	finish := func(err error) {
+		done(err)
+		if _, notOwned := err.(*serviceentry.NotOwnedError); notOwned {
+			// refused, the conflict is reported instead
+			err = nil
+		}
+		pass.Done(err)
+	}
+	if a.cfg.Queue == nil {
+		finish(writer.Do(context.TODO(), write))
+		return
+	}
+	a.cfg.Queue.Add(writer.Key(plan.KindServiceEntry, serviceEntry.Namespace, serviceEntry.Name), write, func(err error) {
+		if err == writer.ErrReplaced {
+			pass.Done(err)
+			return
+		}
+		finish(err)
+	})
+}
+
+// publishAs rewrites the ServiceEntry received from Nacos so that it is published with the prefix,
+// into the namespace and with the owner labels, annotation and reference of this registry.
+func (a *ADSC) publishAs(serviceEntry *v1alpha3.ServiceEntry) {
+	if a.prefix != "" {
+		serviceEntry.Name = a.prefix + serviceEntry.Name
+		for i, host := range serviceEntry.Spec.Hosts {
+			serviceEntry.Spec.Hosts[i] = a.prefix + host
+		}
+	}
+	if a.toNamespace != "" {
+		serviceEntry.Namespace = a.toNamespace
+	}
+	serviceEntry.Labels = nil
+	a.identity.Stamp(serviceEntry)
+}
+
+// claim claims all hosts of the ServiceEntry for this registry. It claims none of them and returns false
+// if any of the hosts is already published by another registry.
+func (a *ADSC) claim(serviceEntry *v1alpha3.ServiceEntry) bool {
+	for _, host := range serviceEntry.Spec.Hosts {
+		if owner, found := a.claims.Owner(host); found && owner != a.name {
+			// records the conflict
+			a.claims.Claim(host, a.name)
+			return false
+		}
+	}
+	for _, host := range serviceEntry.Spec.Hosts {
+		a.claims.Claim(host, a.name)
+	}
+	return true
+}
+
 func (a *ADSC) node() *core.Node {
 	n := &core.Node{
 		Id:       a.nodeID,
@@ -474,35 +735,26 @@ func (a *ADSC) node() *core.Node {
 	return n
 }
 
-func (a *ADSC) reconnect() {
-	a.mutex.RLock()
-	if a.closed {
-		a.mutex.RUnlock()
-		return
-	}
-	a.mutex.RUnlock()
-	var err error
-	a.client = discovery.NewAggregatedDiscoveryServiceClient(a.conn)
-	a.stream, err = a.client.StreamAggregatedResources(context.Background())
-	if err != nil {
-		log.Error("can not get stream err is %s", err.Error())
-		a.cfg.BackoffPolicy.Reset()
-		time.AfterFunc(a.cfg.BackoffPolicy.NextBackOff(), a.reconnect)
-	} else {
-		a.Run(context.Background())
-	}
-	log.Info("new stream success")
-}
-
-// Close the stream.
+// Close stops the watcher like cancelling the context of Run, the stream and its connection are closed
 func (a *ADSC) Close() {
 	a.mutex.Lock()
-	_ = a.conn.Close()
+	defer a.mutex.Unlock()
 	a.closed = true
-	close(a.CreateOrUpdateServiceEntryChan)
-	//close(a.UpdateServiceEntryChan)
-	//close(a.CreateServiceEntryChan)
-	a.mutex.Unlock()
+	if a.cancel != nil {
+		a.cancel()
+	}
+}
+
+// sleep waits for d, it returns false if the context was cancelled in the meantime
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 func mcpToPilot(m *mcp.Resource) (*config.Config, error) {
@@ -550,13 +802,13 @@ func getServiceEntry(val *config.Config) (*v1alpha3.ServiceEntry, error) {
 	//serviceEntry.ResourceVersion = val.ResourceVersion
 	r, err := config.ToJSON(val.Spec)
 	if err != nil {
-		log.Error("Error config to json %v", err.Error())
+		log.Errorf("Error config to json %v", err.Error())
 		return nil, err
 	}
 	spec := networkingv1alpha3.ServiceEntry{}
 	err = json.Unmarshal(r, &spec)
 	if err != nil {
-		log.Error("Unmarshal config to json %v", err.Error())
+		log.Errorf("Unmarshal config to json %v", err.Error())
 		return nil, err
 	}
 	serviceEntry.Spec = spec
@@ -0,0 +1,114 @@
+package nacos
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/config/memory"
+	"istio.io/istio/pkg/config/schema/collections"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/mcp"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+// serveNacos serves the ServiceEntries of hosts over MCP on address until the returned function is called
+func serveNacos(t *testing.T, address string, hosts ...string) (string, func()) {
+	t.Helper()
+	server := mcp.NewServer()
+	for _, host := range hosts {
+		se := &ic.ServiceEntry{
+			ObjectMeta: metav1.ObjectMeta{Name: host},
+			Spec: v1alpha3.ServiceEntry{
+				Hosts:     []string{host},
+				Endpoints: []*v1alpha3.WorkloadEntry{{Address: "192.0.2.1", Ports: map[string]uint32{"http": 8080}}},
+			},
+		}
+		if _, err := server.ServiceEntries("nacos").Create(context.Background(), se, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		_ = server.Serve(ctx, listener)
+	}()
+	return listener.Addr().String(), func() {
+		cancel()
+		<-stopped
+	}
+}
+
+func TestRunReconnect(t *testing.T) {
+	address, stop := serveNacos(t, "127.0.0.1:0", "web.nacos", "db.nacos")
+	store := memory.NewController(memory.Make(collections.Pilot))
+	// this replica never leads, the ServiceEntries received are kept pending instead of written
+	a, err := NewWatcher("nacos", address, &Config{BackoffPolicy: backoff.NewConstantBackOff(10 * time.Millisecond)},
+		&rest.Config{Host: "http://127.0.0.1:1"}, "", "", "external", store, serviceentry.NewHostClaims(), leader.New(),
+		metav1.OwnerReference{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx)
+	}()
+
+	endpoints := func() map[string]int {
+		a.pendingMutex.Lock()
+		defer a.pendingMutex.Unlock()
+		out := make(map[string]int, len(a.pending))
+		for name, se := range a.pending {
+			out[name] = len(se.Spec.Endpoints)
+		}
+		return out
+	}
+	eventually(t, "both ServiceEntries must be received", func() bool {
+		eps := endpoints()
+		return eps["web.nacos"] == 1 && eps["db.nacos"] == 1
+	})
+
+	// db is removed while the stream is down
+	stop()
+	_, stop = serveNacos(t, address, "web.nacos")
+	defer stop()
+	eventually(t, "the ServiceEntry removed while disconnected must be deleted", func() bool {
+		eps := endpoints()
+		return eps["web.nacos"] == 1 && eps["db.nacos"] == 0
+	})
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run must return once the context is cancelled")
+	}
+	if _, found := a.entries["db.nacos"]; found {
+		t.Error("the deleted ServiceEntry must be forgotten")
+	}
+}
+
+func eventually(t *testing.T, msg string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
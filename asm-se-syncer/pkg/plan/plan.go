@@ -0,0 +1,303 @@
+package plan
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+// Action is what would be done to a ServiceEntry, WorkloadEntry or DestinationRule
+type Action string
+
+const (
+	Create Action = "create"
+	Update Action = "update"
+	Delete Action = "delete"
+
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+
+	KindServiceEntry    = "ServiceEntry"
+	KindWorkloadEntry   = "WorkloadEntry"
+	KindDestinationRule = "DestinationRule"
+)
+
+// Change is a write of a ServiceEntry, WorkloadEntry or DestinationRule which was planned rather than done
+type Change struct {
+	Action    Action `json:"action"`
+	Kind      string `json:"kind"`
+	Registry  string `json:"registry"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Current is the object in the cluster, nil when it is created
+	Current runtime.Object `json:"current,omitempty"`
+	// Desired is the object which would be written, nil when it is deleted
+	Desired runtime.Object `json:"desired,omitempty"`
+}
+
+func (c Change) key() string {
+	return c.Namespace + "/" + c.Name + "/" + c.Kind
+}
+
+// Recorder records the writes of ServiceEntries, WorkloadEntries and DestinationRules instead of doing them.
+// Only the last change of every object is kept, a change which was already recorded isn't reported again.
+type Recorder struct {
+	m        sync.Mutex
+	changes  map[string]Change // namespace/name/kind->change
+	onChange func(Change)
+	// empty, if set, is read instead of the wrapped clients
+	empty icapi.NetworkingV1alpha3Interface
+}
+
+// NewRecorder returns a recorder calling onChange, if not nil, for every new change
+func NewRecorder(onChange func(Change)) *Recorder {
+	return &Recorder{changes: make(map[string]Change), onChange: onChange}
+}
+
+// NewOfflineRecorder returns a recorder planning against an empty cluster, the clients it wraps are never used
+func NewOfflineRecorder(onChange func(Change)) *Recorder {
+	r := NewRecorder(onChange)
+	r.empty = fake.NewSimpleClientset().NetworkingV1alpha3()
+	return r
+}
+
+// Wrap returns a client which reads with client and records the writes of the registry
+func (r *Recorder) Wrap(client icapi.ServiceEntryInterface, registry string) icapi.ServiceEntryInterface {
+	if r.empty != nil {
+		client = r.empty.ServiceEntries(v1.NamespaceAll)
+	}
+	return &recordingClient{ServiceEntryInterface: client, recorder: r, registry: registry}
+}
+
+// WrapWorkloadEntries returns a client which reads with client and records the writes of the registry
+func (r *Recorder) WrapWorkloadEntries(client icapi.WorkloadEntryInterface, registry string) icapi.WorkloadEntryInterface {
+	if r.empty != nil {
+		client = r.empty.WorkloadEntries(v1.NamespaceAll)
+	}
+	return &recordingWorkloadEntryClient{WorkloadEntryInterface: client, recorder: r, registry: registry}
+}
+
+// WrapDestinationRules returns a client which reads with client and records the writes of the registry
+func (r *Recorder) WrapDestinationRules(client icapi.DestinationRuleInterface, registry string) icapi.DestinationRuleInterface {
+	if r.empty != nil {
+		client = r.empty.DestinationRules(v1.NamespaceAll)
+	}
+	return &recordingDestinationRuleClient{DestinationRuleInterface: client, recorder: r, registry: registry}
+}
+
+// Plan returns the recorded changes, sorted by namespace, name and kind
+func (r *Recorder) Plan() []Change {
+	r.m.Lock()
+	defer r.m.Unlock()
+	out := make([]Change, 0, len(r.changes))
+	for _, c := range r.changes {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].key() < out[j].key() })
+	return out
+}
+
+func (r *Recorder) record(c Change) {
+	r.m.Lock()
+	last, found := r.changes[c.key()]
+	r.changes[c.key()] = c
+	r.m.Unlock()
+	if found && last.Action == c.Action && reflect.DeepEqual(last.Desired, c.Desired) {
+		return
+	}
+	if r.onChange != nil {
+		r.onChange(c)
+	}
+}
+
+// Write prints the changes as YAML or JSON
+func Write(w io.Writer, changes []Change, format string) error {
+	var out []byte
+	var err error
+	switch format {
+	case FormatJSON:
+		out, err = json.MarshalIndent(changes, "", "  ")
+		out = append(out, '\n')
+	case FormatYAML:
+		out, err = yaml.Marshal(changes)
+	default:
+		return errors.Errorf("unknown output format %q, must be %s or %s", format, FormatYAML, FormatJSON)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+type recordingClient struct {
+	icapi.ServiceEntryInterface
+	recorder *Recorder
+	registry string
+}
+
+func (c *recordingClient) change(action Action, namespace, name string) Change {
+	return Change{Action: action, Kind: KindServiceEntry, Registry: c.registry, Namespace: namespace, Name: name}
+}
+
+func (c *recordingClient) Create(ctx context.Context, se *ic.ServiceEntry, _ v1.CreateOptions) (*ic.ServiceEntry, error) {
+	change := c.change(Create, se.Namespace, se.Name)
+	change.Desired = se.DeepCopy()
+	c.recorder.record(change)
+	return se.DeepCopy(), nil
+}
+
+func (c *recordingClient) Update(ctx context.Context, se *ic.ServiceEntry, _ v1.UpdateOptions) (*ic.ServiceEntry, error) {
+	current, err := c.Get(ctx, se.Name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	change := c.change(Update, se.Namespace, se.Name)
+	change.Current, change.Desired = current, se.DeepCopy()
+	c.recorder.record(change)
+	return se.DeepCopy(), nil
+}
+
+func (c *recordingClient) UpdateStatus(ctx context.Context, se *ic.ServiceEntry, _ v1.UpdateOptions) (*ic.ServiceEntry, error) {
+	return se.DeepCopy(), nil
+}
+
+func (c *recordingClient) Delete(ctx context.Context, name string, _ v1.DeleteOptions) error {
+	current, err := c.Get(ctx, name, v1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	change := c.change(Delete, current.Namespace, name)
+	change.Current = current
+	c.recorder.record(change)
+	return nil
+}
+
+func (c *recordingClient) DeleteCollection(context.Context, v1.DeleteOptions, v1.ListOptions) error {
+	return errors.New("deleting collections isn't supported in dry runs")
+}
+
+func (c *recordingClient) Patch(context.Context, string, types.PatchType, []byte, v1.PatchOptions, ...string) (*ic.ServiceEntry, error) {
+	return nil, errors.New("patching isn't supported in dry runs")
+}
+
+type recordingWorkloadEntryClient struct {
+	icapi.WorkloadEntryInterface
+	recorder *Recorder
+	registry string
+}
+
+func (c *recordingWorkloadEntryClient) change(action Action, namespace, name string) Change {
+	return Change{Action: action, Kind: KindWorkloadEntry, Registry: c.registry, Namespace: namespace, Name: name}
+}
+
+func (c *recordingWorkloadEntryClient) Create(ctx context.Context, we *ic.WorkloadEntry, _ v1.CreateOptions) (*ic.WorkloadEntry, error) {
+	change := c.change(Create, we.Namespace, we.Name)
+	change.Desired = we.DeepCopy()
+	c.recorder.record(change)
+	return we.DeepCopy(), nil
+}
+
+func (c *recordingWorkloadEntryClient) Update(ctx context.Context, we *ic.WorkloadEntry, _ v1.UpdateOptions) (*ic.WorkloadEntry, error) {
+	current, err := c.Get(ctx, we.Name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	change := c.change(Update, we.Namespace, we.Name)
+	change.Current, change.Desired = current, we.DeepCopy()
+	c.recorder.record(change)
+	return we.DeepCopy(), nil
+}
+
+func (c *recordingWorkloadEntryClient) UpdateStatus(ctx context.Context, we *ic.WorkloadEntry, _ v1.UpdateOptions) (*ic.WorkloadEntry, error) {
+	return we.DeepCopy(), nil
+}
+
+func (c *recordingWorkloadEntryClient) Delete(ctx context.Context, name string, _ v1.DeleteOptions) error {
+	current, err := c.Get(ctx, name, v1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	change := c.change(Delete, current.Namespace, name)
+	change.Current = current
+	c.recorder.record(change)
+	return nil
+}
+
+func (c *recordingWorkloadEntryClient) DeleteCollection(context.Context, v1.DeleteOptions, v1.ListOptions) error {
+	return errors.New("deleting collections isn't supported in dry runs")
+}
+
+func (c *recordingWorkloadEntryClient) Patch(context.Context, string, types.PatchType, []byte, v1.PatchOptions, ...string) (*ic.WorkloadEntry, error) {
+	return nil, errors.New("patching isn't supported in dry runs")
+}
+
+type recordingDestinationRuleClient struct {
+	icapi.DestinationRuleInterface
+	recorder *Recorder
+	registry string
+}
+
+func (c *recordingDestinationRuleClient) change(action Action, namespace, name string) Change {
+	return Change{Action: action, Kind: KindDestinationRule, Registry: c.registry, Namespace: namespace, Name: name}
+}
+
+func (c *recordingDestinationRuleClient) Create(ctx context.Context, dr *ic.DestinationRule, _ v1.CreateOptions) (*ic.DestinationRule, error) {
+	change := c.change(Create, dr.Namespace, dr.Name)
+	change.Desired = dr.DeepCopy()
+	c.recorder.record(change)
+	return dr.DeepCopy(), nil
+}
+
+func (c *recordingDestinationRuleClient) Update(ctx context.Context, dr *ic.DestinationRule, _ v1.UpdateOptions) (*ic.DestinationRule, error) {
+	current, err := c.Get(ctx, dr.Name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	change := c.change(Update, dr.Namespace, dr.Name)
+	change.Current, change.Desired = current, dr.DeepCopy()
+	c.recorder.record(change)
+	return dr.DeepCopy(), nil
+}
+
+func (c *recordingDestinationRuleClient) UpdateStatus(ctx context.Context, dr *ic.DestinationRule, _ v1.UpdateOptions) (*ic.DestinationRule, error) {
+	return dr.DeepCopy(), nil
+}
+
+func (c *recordingDestinationRuleClient) Delete(ctx context.Context, name string, _ v1.DeleteOptions) error {
+	current, err := c.Get(ctx, name, v1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	change := c.change(Delete, current.Namespace, name)
+	change.Current = current
+	c.recorder.record(change)
+	return nil
+}
+
+func (c *recordingDestinationRuleClient) DeleteCollection(context.Context, v1.DeleteOptions, v1.ListOptions) error {
+	return errors.New("deleting collections isn't supported in dry runs")
+}
+
+func (c *recordingDestinationRuleClient) Patch(context.Context, string, types.PatchType, []byte, v1.PatchOptions, ...string) (*ic.DestinationRule, error) {
+	return nil, errors.New("patching isn't supported in dry runs")
+}
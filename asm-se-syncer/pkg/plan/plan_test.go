@@ -0,0 +1,82 @@
+package plan
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func serviceEntry(name string, addresses ...string) *ic.ServiceEntry {
+	se := &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "external"},
+		Spec:       v1alpha3.ServiceEntry{Hosts: []string{name}},
+	}
+	for _, address := range addresses {
+		se.Spec.Endpoints = append(se.Spec.Endpoints, &v1alpha3.WorkloadEntry{Address: address})
+	}
+	return se
+}
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(serviceEntry("changed", "10.0.0.1"), serviceEntry("removed", "10.0.0.2"))
+	var reported []Change
+	recorder := NewRecorder(func(c Change) { reported = append(reported, c) })
+	write := recorder.Wrap(client.NetworkingV1alpha3().ServiceEntries("external"), "consul")
+
+	for i := 0; i < 2; i++ {
+		// a sync planning the same changes again doesn't report them again
+		if _, err := write.Create(ctx, serviceEntry("added", "10.0.0.3"), v1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := write.Update(ctx, serviceEntry("changed", "10.0.0.4"), v1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := write.Delete(ctx, "removed", v1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := write.Delete(ctx, "missing", v1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reported) != 3 {
+		t.Errorf("every change must be reported once but got %d reports", len(reported))
+	}
+
+	changes := recorder.Plan()
+	var got []string
+	for _, c := range changes {
+		got = append(got, string(c.Action)+" "+c.Name)
+	}
+	if want := "create added,update changed,delete removed"; strings.Join(got, ",") != want {
+		t.Errorf("Plan() = %v, want %s", got, want)
+	}
+	if current, ok := changes[1].Current.(*ic.ServiceEntry); !ok || current.Spec.Endpoints[0].Address != "10.0.0.1" {
+		t.Errorf("the update must show the current ServiceEntry, got %v", changes[1].Current)
+	}
+
+	list, err := client.NetworkingV1alpha3().ServiceEntries("external").List(ctx, v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 2 || list.Items[0].Spec.Endpoints[0].Address != "10.0.0.1" {
+		t.Errorf("nothing must be written but the cluster has %v", list.Items)
+	}
+
+	var out bytes.Buffer
+	if err := Write(&out, changes[:1], FormatYAML); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "action: create") || !strings.Contains(out.String(), "- address: 10.0.0.3") {
+		t.Errorf("unexpected YAML plan:\n%s", out.String())
+	}
+	if err := Write(&out, changes, "xml"); err == nil {
+		t.Error("an unknown format must be an error")
+	}
+}
@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"reflect"
 	"sync"
 
 	"istio.io/api/networking/v1alpha3"
@@ -13,19 +14,29 @@ type (
 		// Hosts are all hosts
 		Hosts() map[string][]*v1alpha3.WorkloadEntry
 		Set(hosts map[string][]*v1alpha3.WorkloadEntry)
+		// Update replaces the endpoints of a single host, removing the host if there are none
+		Update(host string, endpoints []*v1alpha3.WorkloadEntry)
+		// Changed is signalled when hosts changed since Dirty was last called
+		Changed() <-chan struct{}
+		// Dirty returns the hosts changed since it was last called
+		Dirty() []string
 	}
 
 	store struct {
-		m     *sync.RWMutex
-		hosts map[string][]*v1alpha3.WorkloadEntry // maps host->Endpoints
+		m       *sync.RWMutex
+		hosts   map[string][]*v1alpha3.WorkloadEntry // maps host->Endpoints
+		dirty   map[string]struct{}
+		changed chan struct{}
 	}
 )
 
 // NewStore returns a store
 func NewCache() Cache {
 	return &store{
-		hosts: make(map[string][]*v1alpha3.WorkloadEntry),
-		m:     &sync.RWMutex{},
+		hosts:   make(map[string][]*v1alpha3.WorkloadEntry),
+		dirty:   make(map[string]struct{}),
+		changed: make(chan struct{}, 1),
+		m:       &sync.RWMutex{},
 	}
 }
 
@@ -38,9 +49,63 @@ func (s *store) Hosts() map[string][]*v1alpha3.WorkloadEntry {
 func (s *store) Set(hosts map[string][]*v1alpha3.WorkloadEntry) {
 	s.m.Lock()
 	defer s.m.Unlock()
+	for host := range s.hosts {
+		if _, found := hosts[host]; !found {
+			s.markDirty(host)
+		}
+	}
+	for host, eps := range hosts {
+		if old, found := s.hosts[host]; !found || !reflect.DeepEqual(old, eps) {
+			s.markDirty(host)
+		}
+	}
 	s.hosts = copyMap(hosts)
 }
 
+func (s *store) Update(host string, endpoints []*v1alpha3.WorkloadEntry) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	old, found := s.hosts[host]
+	if len(endpoints) == 0 {
+		if found {
+			delete(s.hosts, host)
+			s.markDirty(host)
+		}
+		return
+	}
+	if found && reflect.DeepEqual(old, endpoints) {
+		return
+	}
+	eps := make([]*v1alpha3.WorkloadEntry, len(endpoints))
+	copy(eps, endpoints)
+	s.hosts[host] = eps
+	s.markDirty(host)
+}
+
+func (s *store) Changed() <-chan struct{} {
+	return s.changed
+}
+
+func (s *store) Dirty() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	out := make([]string, 0, len(s.dirty))
+	for host := range s.dirty {
+		out = append(out, host)
+	}
+	s.dirty = make(map[string]struct{})
+	return out
+}
+
+// markDirty records a changed host and signals it, callers must hold the write lock
+func (s *store) markDirty(host string) {
+	s.dirty[host] = struct{}{}
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
 func copyMap(m map[string][]*v1alpha3.WorkloadEntry) map[string][]*v1alpha3.WorkloadEntry {
 	out := make(map[string][]*v1alpha3.WorkloadEntry, len(m))
 	for k, v := range m {
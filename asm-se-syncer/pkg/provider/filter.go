@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+)
+
+// Filter drops the services of a registry its filter config doesn't select before they reach the cache, and
+// reports how many services every rule drops. Services are identified by an id unique within the registry.
+type Filter struct {
+	m        sync.Mutex
+	config   *common.FilterConfig
+	registry string
+	dropped  map[string]string   // service->rule dropping it
+	seen     map[string]struct{} // services passed to Keep since the last Sweep
+}
+
+// NewFilter returns a filter of the services of registry, a nil config keeps all services
+func NewFilter(config *common.FilterConfig, registry string) *Filter {
+	f := &Filter{
+		config:   config,
+		registry: registry,
+		dropped:  make(map[string]string),
+		seen:     make(map[string]struct{}),
+	}
+	f.observe()
+	return f
+}
+
+// Keep reports whether the service identified by id is synced, the service is recorded as dropped otherwise
+func (f *Filter) Keep(id string, svc common.ServiceInfo) bool {
+	rule := f.config.Drop(svc)
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.seen[id] = struct{}{}
+	if f.dropped[id] == rule {
+		return rule == ""
+	}
+	if rule == "" {
+		log.Infof("service %s of registry %s isn't dropped by filter rule %s any more", id, f.registry, f.dropped[id])
+		delete(f.dropped, id)
+	} else {
+		log.Infof("service %s of registry %s is dropped by filter rule %s", id, f.registry, rule)
+		f.dropped[id] = rule
+	}
+	f.observe()
+	return rule == ""
+}
+
+// Forget removes a service which is gone from the registry
+func (f *Filter) Forget(id string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	delete(f.seen, id)
+	if _, found := f.dropped[id]; found {
+		delete(f.dropped, id)
+		f.observe()
+	}
+}
+
+// Sweep forgets the services which weren't passed to Keep since the last Sweep, for the watchers going through
+// all services on every refresh
+func (f *Filter) Sweep() {
+	f.m.Lock()
+	defer f.m.Unlock()
+	changed := false
+	for id := range f.dropped {
+		if _, found := f.seen[id]; !found {
+			delete(f.dropped, id)
+			changed = true
+		}
+	}
+	f.seen = make(map[string]struct{}, len(f.seen))
+	if changed {
+		f.observe()
+	}
+}
+
+// observe records the number of services dropped by every rule, callers must hold f.m
+func (f *Filter) observe() {
+	counts := make(map[string]int)
+	for _, rule := range f.config.Rules() {
+		counts[rule] = 0
+	}
+	for _, rule := range f.dropped {
+		counts[rule]++
+	}
+	monitoring.SetFilteredServices(f.registry, counts)
+}
@@ -0,0 +1,131 @@
+package provider
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+)
+
+// HostTable publishes the endpoints of the services of a registry into a cache under their hosts. Services whose
+// names differ but which are named the same host, e.g. once sanitised, collide: only one of them is published and
+// the others are reported. The service keeps its host as long as it has endpoints, it is then given to the first
+// of the others by name.
+type HostTable struct {
+	m        sync.Mutex
+	store    Cache
+	registry string
+	services map[string]map[string][]*v1alpha3.WorkloadEntry // host->service->endpoints
+	owners   map[string]string                               // host->service published under it
+	reported map[string]string                               // host->services last reported as colliding
+}
+
+// NewHostTable returns a table publishing into store the services of registry
+func NewHostTable(store Cache, registry string) *HostTable {
+	return &HostTable{
+		store:    store,
+		registry: registry,
+		services: make(map[string]map[string][]*v1alpha3.WorkloadEntry),
+		owners:   make(map[string]string),
+		reported: make(map[string]string),
+	}
+}
+
+// Update replaces the endpoints service has under host, removing them if there are none
+func (t *HostTable) Update(service, host string, endpoints []*v1alpha3.WorkloadEntry) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if len(endpoints) == 0 {
+		delete(t.services[host], service)
+		if len(t.services[host]) == 0 {
+			delete(t.services, host)
+		}
+	} else {
+		if t.services[host] == nil {
+			t.services[host] = make(map[string][]*v1alpha3.WorkloadEntry)
+		}
+		t.services[host][service] = endpoints
+	}
+	t.store.Update(host, t.elect(host))
+	t.observe()
+}
+
+// Set replaces the endpoints of all services, given by host and service
+func (t *HostTable) Set(services map[string]map[string][]*v1alpha3.WorkloadEntry) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.services = make(map[string]map[string][]*v1alpha3.WorkloadEntry, len(services))
+	for host, byService := range services {
+		for service, endpoints := range byService {
+			if len(endpoints) == 0 {
+				continue
+			}
+			if t.services[host] == nil {
+				t.services[host] = make(map[string][]*v1alpha3.WorkloadEntry)
+			}
+			t.services[host][service] = endpoints
+		}
+	}
+	for host := range t.owners {
+		if _, found := t.services[host]; !found {
+			t.elect(host)
+		}
+	}
+	hosts := make(map[string][]*v1alpha3.WorkloadEntry, len(t.services))
+	for host := range t.services {
+		hosts[host] = t.elect(host)
+	}
+	t.store.Set(hosts)
+	t.observe()
+}
+
+// elect returns the endpoints published under host, those of the service which owns it. Callers must hold t.m.
+func (t *HostTable) elect(host string) []*v1alpha3.WorkloadEntry {
+	byService := t.services[host]
+	owner, found := t.owners[host]
+	if _, ok := byService[owner]; !found || !ok {
+		if len(byService) == 0 {
+			delete(t.owners, host)
+			delete(t.reported, host)
+			return nil
+		}
+		owner = ""
+		for service := range byService {
+			if owner == "" || service < owner {
+				owner = service
+			}
+		}
+		t.owners[host] = owner
+	}
+
+	if len(byService) > 1 {
+		others := make([]string, 0, len(byService)-1)
+		for service := range byService {
+			if service != owner {
+				others = append(others, service)
+			}
+		}
+		sort.Strings(others)
+		if report := owner + "," + strings.Join(others, ","); t.reported[host] != report {
+			t.reported[host] = report
+			log.Errorf("services %v of registry %s are named %s like service %s, only %s is published", others,
+				t.registry, host, owner, owner)
+		}
+	} else {
+		delete(t.reported, host)
+	}
+	return byService[owner]
+}
+
+// observe records the number of services left out, callers must hold t.m
+func (t *HostTable) observe() {
+	collisions := 0
+	for _, byService := range t.services {
+		collisions += len(byService) - 1
+	}
+	monitoring.SetHostCollisions(t.registry, collisions)
+}
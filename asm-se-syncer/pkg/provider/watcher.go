@@ -7,7 +7,11 @@ import (
 // Watcher is the interface of each provider
 type Watcher interface {
 	Run(ctx context.Context)
+	// Cache returns the endpoints discovered by the watcher, or nil if the watcher publishes
+	// ServiceEntries on its own instead of handing them to a synchronizer.
 	Cache() Cache
+	// Name is the unique name of the registry the watcher reads from
+	Name() string
 	Prefix() string
 	ToNamespace() string
 	WatcherType() string
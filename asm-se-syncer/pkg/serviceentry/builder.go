@@ -1,17 +1,23 @@
 package serviceentry
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
 	"net"
+	"sort"
 	"strings"
 
 	"istio.io/api/networking/v1alpha3"
 	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // ServiceEntry infers an Istio service entry based on provided information
-func Builder(namespace string, prefix, host string, location v1alpha3.ServiceEntry_Location, endpoints []*v1alpha3.WorkloadEntry) *ic.ServiceEntry {
+// The labels identify the registry publishing the entry, see common.OwnerLabels.
+func Builder(namespace string, prefix, host string, location v1alpha3.ServiceEntry_Location, endpoints []*v1alpha3.WorkloadEntry, labels map[string]string) *ic.ServiceEntry {
 	addresses := []string{}
 	if len(endpoints) > 0 {
 		if ip := net.ParseIP(endpoints[0].Address); ip != nil {
@@ -22,9 +28,7 @@ func Builder(namespace string, prefix, host string, location v1alpha3.ServiceEnt
 	return &ic.ServiceEntry{
 		TypeMeta: v1.TypeMeta{},
 		ObjectMeta: v1.ObjectMeta{
-			Labels: map[string]string{
-				common.AsmSyncerLabel: string(common.Consul),
-			},
+			Labels:    labels,
 			Name:      common.FormatedName(host),
 			Namespace: namespace,
 		},
@@ -39,6 +43,70 @@ func Builder(namespace string, prefix, host string, location v1alpha3.ServiceEnt
 	}
 }
 
+// SelectWorkloadEntries moves the endpoints of a ServiceEntry built by Builder into WorkloadEntries, one per
+// endpoint, and makes the ServiceEntry select them. The WorkloadEntries are labelled with labels.
+func SelectWorkloadEntries(se *ic.ServiceEntry, labels map[string]string) []*ic.WorkloadEntry {
+	selector := map[string]string{common.AsmSyncerServiceLabel: SelectorValue(se.Name)}
+	workloadEntries := make([]*ic.WorkloadEntry, 0, len(se.Spec.Endpoints))
+	for _, ep := range se.Spec.Endpoints {
+		spec := *ep
+		spec.Labels = make(map[string]string, len(ep.Labels)+1)
+		for key, value := range ep.Labels {
+			spec.Labels[key] = value
+		}
+		for key, value := range selector {
+			spec.Labels[key] = value
+		}
+		meta := make(map[string]string, len(labels)+len(selector))
+		for key, value := range labels {
+			meta[key] = value
+		}
+		for key, value := range selector {
+			meta[key] = value
+		}
+		workloadEntries = append(workloadEntries, &ic.WorkloadEntry{
+			ObjectMeta: v1.ObjectMeta{
+				Labels:    meta,
+				Name:      workloadEntryName(se.Name, ep),
+				Namespace: se.Namespace,
+			},
+			Spec: spec,
+		})
+	}
+
+	se.Spec.Endpoints = nil
+	// the addresses were taken from the first endpoint, which would change whenever the instances change
+	se.Spec.Addresses = nil
+	se.Spec.WorkloadSelector = &v1alpha3.WorkloadSelector{Labels: selector}
+	// Istio only selects workloads for services in the mesh
+	se.Spec.Location = v1alpha3.ServiceEntry_MESH_INTERNAL
+	return workloadEntries
+}
+
+// SelectorValue returns the value of the service label selecting the WorkloadEntries of the named ServiceEntry,
+// names which aren't valid label values are hashed
+func SelectorValue(name string) string {
+	if len(validation.IsValidLabelValue(name)) == 0 {
+		return name
+	}
+	return "h-" + hash(name)
+}
+
+// workloadEntryName returns a name which is unique per ServiceEntry and endpoint address and ports
+func workloadEntryName(serviceEntryName string, ep *v1alpha3.WorkloadEntry) string {
+	ports, _ := json.Marshal(ep.Ports) // map keys are sorted
+	suffix := "-" + hash(ep.Address + string(ports))[:10]
+	if max := validation.DNS1123SubdomainMaxLength - len(suffix); len(serviceEntryName) > max {
+		serviceEntryName = strings.TrimRight(serviceEntryName[:max], ".-")
+	}
+	return serviceEntryName + suffix
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
 // Endpoint creates a Service Entry endpoint from an address and port
 // It infers the port name from the port number
 func Endpoint(address string, port uint32) *v1alpha3.WorkloadEntry {
@@ -48,6 +116,22 @@ func Endpoint(address string, port uint32) *v1alpha3.WorkloadEntry {
 	}
 }
 
+// Labels keeps the registry metadata that is usable as endpoint labels, dropping keys and values
+// which are not valid Kubernetes labels. It returns nil if nothing is left.
+func Labels(metadata map[string]string) map[string]string {
+	var labels map[string]string
+	for key, value := range metadata {
+		if len(validation.IsQualifiedName(key)) > 0 || len(validation.IsValidLabelValue(value)) > 0 {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(metadata))
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
 // Proto infers the port name based on the port number
 func Proto(port uint32) string {
 	switch port {
@@ -67,15 +151,21 @@ func Proto(port uint32) string {
 }
 
 // Ports uses a slice of Service Entry endpoints to create a de-duped slice of Istio Ports
-// Infering name and protocol from the port number
+// The ports are named like the endpoint ports, their protocol is inferred from the name or else from the port number.
+// A port declared with a protocol by any endpoint is named like it, see EndpointWithProtocol.
 func Ports(endpoints []*v1alpha3.WorkloadEntry) []*v1alpha3.Port {
 	dedup := map[uint32]*v1alpha3.Port{}
 	for _, ep := range endpoints {
-		for _, port := range ep.Ports {
+		for name, port := range ep.Ports {
+			if existing, found := dedup[port]; found && existing.Name != Proto(port) &&
+				(name == Proto(port) || name >= existing.Name) {
+				// keep the declared name, the smallest if the endpoints disagree
+				continue
+			}
 			dedup[port] = &v1alpha3.Port{
-				Name:     Proto(port),
+				Name:     name,
 				Number:   uint32(port),
-				Protocol: strings.ToUpper(Proto(port)),
+				Protocol: portProtocol(name, port),
 			}
 		}
 	}
@@ -83,6 +173,8 @@ func Ports(endpoints []*v1alpha3.WorkloadEntry) []*v1alpha3.Port {
 	for _, port := range dedup {
 		res = append(res, port)
 	}
+	// keep a stable order so that unchanged services don't cause updates
+	sort.Slice(res, func(i, j int) bool { return res[i].Number < res[j].Number })
 	return res
 }
 
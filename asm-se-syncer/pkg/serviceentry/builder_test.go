@@ -3,9 +3,12 @@ package serviceentry
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
 )
 
 var ipEndpoint = &v1alpha3.WorkloadEntry{Address: "1.1.1.1"}
@@ -72,6 +75,22 @@ func TestPorts(t *testing.T) {
 			},
 			want: []*v1alpha3.Port{{Number: 80, Name: "http", Protocol: "HTTP"}},
 		},
+		{
+			name: "A port declared with a protocol by any endpoint gets its name",
+			endpoints: []*v1alpha3.WorkloadEntry{
+				{Address: "1.1.1.1", Ports: map[string]uint32{"tcp": 9090}},
+				EndpointWithProtocol("2.2.2.2", 9090, "grpc"),
+				{Address: "3.3.3.3", Ports: map[string]uint32{"tcp": 9090}},
+			},
+			want: []*v1alpha3.Port{{Number: 9090, Name: "grpc-9090", Protocol: "GRPC"}},
+		},
+		{
+			name: "Dubbo ports are TCP",
+			endpoints: []*v1alpha3.WorkloadEntry{
+				EndpointWithProtocol("1.1.1.1", 20880, "dubbo"),
+			},
+			want: []*v1alpha3.Port{{Number: 20880, Name: "tcp-dubbo-20880", Protocol: "TCP"}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -129,3 +148,185 @@ func TestProto(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectWorkloadEntries(t *testing.T) {
+	endpoints := []*v1alpha3.WorkloadEntry{
+		{Address: "10.0.0.1", Ports: map[string]uint32{"http": 80}, Labels: map[string]string{"version": "v1"}},
+		{Address: "10.0.0.2", Ports: map[string]uint32{"http": 80}},
+	}
+	labels := map[string]string{common.AsmSyncerRegistryLabel: "consul"}
+	se := Builder("external", "", "web.service.consul", v1alpha3.ServiceEntry_MESH_EXTERNAL, endpoints, labels)
+
+	workloadEntries := SelectWorkloadEntries(se, labels)
+	if len(workloadEntries) != 2 {
+		t.Fatalf("got %d WorkloadEntries, want one per endpoint", len(workloadEntries))
+	}
+	selector := map[string]string{common.AsmSyncerServiceLabel: "web.service.consul"}
+	if se.Spec.Endpoints != nil || se.Spec.Addresses != nil || !reflect.DeepEqual(se.Spec.WorkloadSelector.Labels, selector) {
+		t.Errorf("the ServiceEntry must select its endpoints, got %v", se.Spec)
+	}
+	we := workloadEntries[0]
+	if we.Namespace != "external" || we.Spec.Address != "10.0.0.1" || we.Spec.Labels["version"] != "v1" ||
+		we.Spec.Labels[common.AsmSyncerServiceLabel] != "web.service.consul" || we.Labels[common.AsmSyncerRegistryLabel] != "consul" {
+		t.Errorf("unexpected WorkloadEntry %v", we)
+	}
+	if endpoints[0].Labels[common.AsmSyncerServiceLabel] != "" {
+		t.Error("the endpoints must not be changed")
+	}
+	if we.Name == workloadEntries[1].Name || we.Name != SelectWorkloadEntries(Builder("external", "", "web.service.consul",
+		v1alpha3.ServiceEntry_MESH_EXTERNAL, endpoints, labels), labels)[0].Name {
+		t.Errorf("the names must be unique and stable, got %s and %s", we.Name, workloadEntries[1].Name)
+	}
+}
+
+func TestSelectorValue(t *testing.T) {
+	if got := SelectorValue("web.service.consul"); got != "web.service.consul" {
+		t.Errorf("SelectorValue() = %s, a valid label value must be kept", got)
+	}
+	long := strings.Repeat("a", 64)
+	if got := SelectorValue(long); got == long || len(got) > 63 {
+		t.Errorf("SelectorValue() = %s, an invalid label value must be hashed", got)
+	}
+}
+
+func TestApplyPortRules(t *testing.T) {
+	endpoints := []*v1alpha3.WorkloadEntry{Endpoint("10.0.0.1", 9090), Endpoint("10.0.0.1", 8080)}
+	rules := []common.PortRule{
+		{Service: "*.other.consul", Port: 9090, Protocol: "HTTP"},
+		{Service: "*.service.consul", Port: 9090, Protocol: "GRPC", TargetPort: 19090},
+		{Port: 8080, Name: "admin"},
+	}
+	se := Builder("external", "", "web.service.consul", v1alpha3.ServiceEntry_MESH_EXTERNAL, endpoints, nil)
+	ApplyPortRules(se, "web.service.consul", rules)
+
+	want := []*v1alpha3.Port{
+		{Number: 8080, Name: "admin", Protocol: "TCP"},
+		{Number: 9090, Name: "grpc-9090", Protocol: "GRPC", TargetPort: 19090},
+	}
+	if !reflect.DeepEqual(se.Spec.Ports, want) {
+		t.Errorf("Ports = %v, want %v", se.Spec.Ports, want)
+	}
+	if se.Spec.Endpoints[0].Ports["grpc-9090"] != 9090 || se.Spec.Endpoints[1].Ports["admin"] != 8080 {
+		t.Errorf("the endpoint ports must be renamed, got %v", se.Spec.Endpoints)
+	}
+	if endpoints[0].Ports["tcp"] != 9090 {
+		t.Error("the endpoints must not be changed")
+	}
+}
+
+func TestSubsets(t *testing.T) {
+	endpoint := func(labels map[string]string) *v1alpha3.WorkloadEntry {
+		return &v1alpha3.WorkloadEntry{Address: "10.0.0.1", Labels: labels}
+	}
+	tests := []struct {
+		name      string
+		endpoints []*v1alpha3.WorkloadEntry
+		keys      []string
+		want      []*v1alpha3.Subset
+	}{
+		{
+			name:      "no keys",
+			endpoints: []*v1alpha3.WorkloadEntry{endpoint(map[string]string{"version": "v1"})},
+			want:      []*v1alpha3.Subset{},
+		},
+		{
+			name: "one subset per value",
+			endpoints: []*v1alpha3.WorkloadEntry{
+				endpoint(map[string]string{"version": "v2"}),
+				endpoint(map[string]string{"version": "v1", "zone": "a"}),
+				endpoint(map[string]string{"version": "v1"}),
+				endpoint(nil),
+			},
+			keys: []string{"version"},
+			want: []*v1alpha3.Subset{
+				{Name: "v1", Labels: map[string]string{"version": "v1"}},
+				{Name: "v2", Labels: map[string]string{"version": "v2"}},
+			},
+		},
+		{
+			name: "combinations of values",
+			endpoints: []*v1alpha3.WorkloadEntry{
+				endpoint(map[string]string{"version": "v1", "env": "Canary"}),
+				endpoint(map[string]string{"version": "v1"}),
+			},
+			keys: []string{"version", "env"},
+			want: []*v1alpha3.Subset{
+				{Name: "v1", Labels: map[string]string{"version": "v1"}},
+				{Name: "v1-canary", Labels: map[string]string{"version": "v1", "env": "Canary"}},
+			},
+		},
+		{
+			name:      "invalid names are sanitized",
+			endpoints: []*v1alpha3.WorkloadEntry{endpoint(map[string]string{"version": "1.0_GA"})},
+			keys:      []string{"version"},
+			want:      []*v1alpha3.Subset{{Name: "1-0-ga", Labels: map[string]string{"version": "1.0_GA"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Subsets(tt.endpoints, tt.keys); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Subsets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// values only differing in invalid characters get different subsets
+	got := Subsets([]*v1alpha3.WorkloadEntry{
+		endpoint(map[string]string{"version": "1.0"}),
+		endpoint(map[string]string{"version": "1_0"}),
+	}, []string{"version"})
+	if len(got) != 2 || got[0].Name == got[1].Name {
+		t.Errorf("Subsets() = %v, want two subsets", got)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	rules := []common.NamespaceRule{
+		{Namespace: "payments", Labels: map[string]string{"team": "payments"}, ExportTo: common.StringList{"payments", "istio-system"}},
+		{Namespace: "legacy", Service: "*.legacy.consul"},
+	}
+	endpoints := func(labels ...map[string]string) []*v1alpha3.WorkloadEntry {
+		out := make([]*v1alpha3.WorkloadEntry, 0, len(labels))
+		for _, l := range labels {
+			out = append(out, &v1alpha3.WorkloadEntry{Address: "10.0.0.1", Labels: l})
+		}
+		return out
+	}
+	tests := []struct {
+		name          string
+		host          string
+		endpoints     []*v1alpha3.WorkloadEntry
+		wantNamespace string
+		wantExportTo  []string
+	}{
+		{
+			name:          "no rule matches",
+			host:          "web.service.consul",
+			endpoints:     endpoints(map[string]string{"team": "web"}),
+			wantNamespace: "external",
+			wantExportTo:  []string{"."},
+		},
+		{
+			name:          "labels of any endpoint",
+			host:          "billing.service.consul",
+			endpoints:     endpoints(nil, map[string]string{"team": "payments", "version": "v1"}),
+			wantNamespace: "payments",
+			wantExportTo:  []string{"payments", "istio-system"},
+		},
+		{
+			name:          "host pattern, exported as the registry says",
+			host:          "db.legacy.consul",
+			endpoints:     endpoints(nil),
+			wantNamespace: "legacy",
+			wantExportTo:  []string{"."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, exportTo := Route(rules, "external", []string{"."}, tt.host, tt.endpoints)
+			if namespace != tt.wantNamespace || !reflect.DeepEqual(exportTo, tt.wantExportTo) {
+				t.Errorf("Route() = %s, %v, want %s, %v", namespace, exportTo, tt.wantNamespace, tt.wantExportTo)
+			}
+		})
+	}
+}
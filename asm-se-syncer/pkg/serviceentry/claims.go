@@ -0,0 +1,191 @@
+package serviceentry
+
+import (
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// Conflict describes a host that more than one registry tried to publish.
+	Conflict struct {
+		Host string
+		// Owner is the registry the host is published for, or the resource publishing it if that wasn't
+		// published by the syncer, e.g. ServiceEntry default/web
+		Owner string
+		// Rejected are the registries whose publication of the host was refused
+		Rejected []string
+	}
+
+	// HostClaims records which registry publishes each host, so that registries synced side by side
+	// can't silently overwrite each other's ServiceEntries. The first registry to claim a host keeps it
+	// until it releases the host; later claims are refused and reported as conflicts. Hosts published by
+	// someone else than the syncer are never claimed, the registries they are refused to are reported too.
+	// The registries which are configured and which run are recorded as well, hosts are only claimed on behalf
+	// of those which run.
+	HostClaims struct {
+		m          sync.Mutex
+		owners     map[string]string              // maps host->registry
+		foreign    map[string]string              // maps host->resource publishing it outside of the syncer
+		conflicts  map[string]map[string]struct{} // maps host->set of rejected registries
+		configured map[string]struct{}            // set of registries of the registry config
+		running    map[string]struct{}            // set of registries which run
+	}
+)
+
+// NewHostClaims returns an empty set of host claims
+func NewHostClaims() *HostClaims {
+	return &HostClaims{
+		owners:     make(map[string]string),
+		foreign:    make(map[string]string),
+		conflicts:  make(map[string]map[string]struct{}),
+		configured: make(map[string]struct{}),
+		running:    make(map[string]struct{}),
+	}
+}
+
+// Configure records the registries of the registry config, they may not run yet
+func (c *HostClaims) Configure(registries []string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.configured = make(map[string]struct{}, len(registries))
+	for _, registry := range registries {
+		c.configured[registry] = struct{}{}
+	}
+}
+
+// Configured reports whether registry is in the registry config
+func (c *HostClaims) Configured(registry string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	_, found := c.configured[registry]
+	return found
+}
+
+// Start records that registry runs
+func (c *HostClaims) Start(registry string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.running[registry] = struct{}{}
+}
+
+// Stop records that registry doesn't run anymore, its hosts are released and its claims withdrawn. The
+// registries refused its hosts claim them on their next sync.
+func (c *HostClaims) Stop(registry string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.running, registry)
+	for host, owner := range c.owners {
+		if owner == registry {
+			delete(c.owners, host)
+			delete(c.conflicts, host)
+		}
+	}
+	for host := range c.conflicts {
+		c.withdraw(host, registry)
+	}
+}
+
+// Running reports whether registry runs
+func (c *HostClaims) Running(registry string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	_, found := c.running[registry]
+	return found
+}
+
+// Claim tries to claim host for registry. It returns true if the registry owns the host afterwards,
+// and false together with the current owner if another registry already claimed it.
+func (c *HostClaims) Claim(host, registry string) (string, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	owner, found := c.owners[host]
+	if !found || owner == registry {
+		c.owners[host] = registry
+		c.withdraw(host, registry)
+		return registry, true
+	}
+	c.reject(host, owner, registry)
+	return owner, false
+}
+
+// Refuse records that registry can't publish host as owner, which isn't a registry, publishes it already.
+// The conflict is reported until the registry claims the host or releases it.
+func (c *HostClaims) Refuse(host, registry, owner string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.owners[host] == registry {
+		delete(c.owners, host)
+	}
+	c.foreign[host] = owner
+	c.reject(host, owner, registry)
+}
+
+// reject records the refused claim of registry on host; callers must hold the lock
+func (c *HostClaims) reject(host, owner, registry string) {
+	rejected, found := c.conflicts[host]
+	if !found {
+		rejected = make(map[string]struct{})
+		c.conflicts[host] = rejected
+	}
+	if _, reported := rejected[registry]; !reported {
+		log.Warnf("host %q is published by %q, ignoring it from registry %q", host, owner, registry)
+		rejected[registry] = struct{}{}
+	}
+}
+
+// Release gives up the claim of registry on host. Releasing a host owned by another registry only
+// withdraws the conflicting claim.
+func (c *HostClaims) Release(host, registry string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.withdraw(host, registry)
+	if c.owners[host] == registry {
+		delete(c.owners, host)
+	}
+}
+
+// withdraw forgets a refused claim of registry on host; callers must hold the lock
+func (c *HostClaims) withdraw(host, registry string) {
+	if rejected, found := c.conflicts[host]; found {
+		delete(rejected, registry)
+		if len(rejected) == 0 {
+			delete(c.conflicts, host)
+			delete(c.foreign, host)
+		}
+	}
+}
+
+// Owner returns the registry owning host, if any
+func (c *HostClaims) Owner(host string) (string, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	owner, found := c.owners[host]
+	return owner, found
+}
+
+// Conflicts returns the hosts currently claimed by more than one registry, sorted by host
+func (c *HostClaims) Conflicts() []Conflict {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	out := make([]Conflict, 0, len(c.conflicts))
+	for host, rejected := range c.conflicts {
+		owner, found := c.owners[host]
+		if !found {
+			owner = c.foreign[host]
+		}
+		conflict := Conflict{Host: host, Owner: owner}
+		for registry := range rejected {
+			conflict.Rejected = append(conflict.Rejected, registry)
+		}
+		sort.Strings(conflict.Rejected)
+		out = append(out, conflict)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
@@ -0,0 +1,112 @@
+package serviceentry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostClaims(t *testing.T) {
+	tests := []struct {
+		name string
+		// claims are done in turn before checking the owner of web.consul and the conflicts
+		claims        func(c *HostClaims)
+		wantOwner     string
+		wantConflicts []Conflict
+	}{
+		{
+			name: "the first claim wins",
+			claims: func(c *HostClaims) {
+				c.Claim("web.consul", "consul-a")
+				c.Claim("web.consul", "consul-a")
+			},
+			wantOwner:     "consul-a",
+			wantConflicts: []Conflict{},
+		},
+		{
+			name: "a second registry is refused and reported",
+			claims: func(c *HostClaims) {
+				c.Claim("web.consul", "consul-a")
+				c.Claim("web.consul", "consul-b")
+				c.Claim("web.consul", "consul-c")
+			},
+			wantOwner: "consul-a",
+			wantConflicts: []Conflict{
+				{Host: "web.consul", Owner: "consul-a", Rejected: []string{"consul-b", "consul-c"}},
+			},
+		},
+		{
+			name: "releasing a host owned by another registry only withdraws the conflict",
+			claims: func(c *HostClaims) {
+				c.Claim("web.consul", "consul-a")
+				c.Claim("web.consul", "consul-b")
+				c.Release("web.consul", "consul-b")
+			},
+			wantOwner:     "consul-a",
+			wantConflicts: []Conflict{},
+		},
+		{
+			name: "a released host can be claimed again",
+			claims: func(c *HostClaims) {
+				c.Claim("web.consul", "consul-a")
+				c.Claim("web.consul", "consul-b")
+				c.Release("web.consul", "consul-a")
+				c.Claim("web.consul", "consul-b")
+			},
+			wantOwner:     "consul-b",
+			wantConflicts: []Conflict{},
+		},
+		{
+			name: "a host published by someone else is refused until the registry releases it",
+			claims: func(c *HostClaims) {
+				c.Claim("web.consul", "consul-a")
+				c.Refuse("web.consul", "consul-a", "ServiceEntry default/web")
+			},
+			wantConflicts: []Conflict{
+				{Host: "web.consul", Owner: "ServiceEntry default/web", Rejected: []string{"consul-a"}},
+			},
+		},
+		{
+			name: "the hosts of a registry which stopped can be claimed by others",
+			claims: func(c *HostClaims) {
+				c.Start("consul-a")
+				c.Claim("web.consul", "consul-a")
+				c.Claim("web.consul", "consul-b")
+				c.Stop("consul-a")
+				c.Claim("web.consul", "consul-c")
+			},
+			wantOwner:     "consul-c",
+			wantConflicts: []Conflict{},
+		},
+		{
+			name: "a refused host is no conflict once released",
+			claims: func(c *HostClaims) {
+				c.Refuse("web.consul", "consul-a", "ServiceEntry default/web")
+				c.Release("web.consul", "consul-a")
+			},
+			wantConflicts: []Conflict{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewHostClaims()
+			tt.claims(c)
+			owner, found := c.Owner("web.consul")
+			if owner != tt.wantOwner || found != (tt.wantOwner != "") {
+				t.Errorf("Owner() = %q, %t, want %q", owner, found, tt.wantOwner)
+			}
+			if got := c.Conflicts(); !reflect.DeepEqual(got, tt.wantConflicts) {
+				t.Errorf("Conflicts() = %+v, want %+v", got, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+func TestClaimReturnsOwner(t *testing.T) {
+	c := NewHostClaims()
+	if owner, ok := c.Claim("web.consul", "consul-a"); !ok || owner != "consul-a" {
+		t.Errorf("Claim() = %q, %t, want the host to be claimed", owner, ok)
+	}
+	if owner, ok := c.Claim("web.consul", "consul-b"); ok || owner != "consul-a" {
+		t.Errorf("Claim() = %q, %t, want it refused in favour of consul-a", owner, ok)
+	}
+}
@@ -0,0 +1,98 @@
+package serviceentry
+
+import (
+	"sort"
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// BuildDestinationRule returns the DestinationRule of a ServiceEntry built by Builder, with a subset for every
+// combination of the subsetKeys labels found on its endpoints. It returns nil if there is neither a subset nor
+// a traffic policy. The DestinationRule is named, labelled, annotated and exported like the ServiceEntry.
+func BuildDestinationRule(se *ic.ServiceEntry, subsetKeys []string, policy *v1alpha3.TrafficPolicy) *ic.DestinationRule {
+	subsets := Subsets(se.Spec.Endpoints, subsetKeys)
+	if len(subsets) == 0 && policy == nil {
+		return nil
+	}
+	var trafficPolicy *v1alpha3.TrafficPolicy
+	if policy != nil {
+		trafficPolicy = policy.DeepCopy()
+	}
+	return &ic.DestinationRule{
+		ObjectMeta: v1.ObjectMeta{
+			Labels:          se.Labels,
+			Annotations:     se.Annotations,
+			Name:            se.Name,
+			Namespace:       se.Namespace,
+			OwnerReferences: se.OwnerReferences,
+		},
+		Spec: v1alpha3.DestinationRule{
+			Host:          se.Spec.Hosts[0],
+			TrafficPolicy: trafficPolicy,
+			Subsets:       subsets,
+			ExportTo:      se.Spec.ExportTo,
+		},
+	}
+}
+
+// Subsets returns a subset for every combination of the keys labels found on the endpoints, sorted by name.
+// Endpoints without any of the labels are in no subset.
+func Subsets(endpoints []*v1alpha3.WorkloadEntry, keys []string) []*v1alpha3.Subset {
+	subsets := make(map[string]*v1alpha3.Subset)
+	for _, ep := range endpoints {
+		labels := make(map[string]string, len(keys))
+		values := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if value, ok := ep.Labels[key]; ok {
+				labels[key] = value
+				values = append(values, value)
+			}
+		}
+		if len(labels) == 0 {
+			continue
+		}
+		name := subsetName(values)
+		if existing, found := subsets[name]; found && !sameLabels(existing.Labels, labels) {
+			// values which only differ in characters invalid in subset names
+			name = subsetName(append(values, hash(strings.Join(values, "\x00"))))
+		}
+		subsets[name] = &v1alpha3.Subset{Name: name, Labels: labels}
+	}
+
+	out := make([]*v1alpha3.Subset, 0, len(subsets))
+	for _, subset := range subsets {
+		out = append(out, subset)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// subsetName joins the label values into a DNS label, e.g. v1-canary, hashing it if it is too long
+func subsetName(values []string) string {
+	name := strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(strings.Join(values, "-"))), "-")
+	if len(validation.IsDNS1123Label(name)) > 0 {
+		return "h-" + hash(name)
+	}
+	return name
+}
+
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if b[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -5,8 +5,13 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
+// EventSource is an informer, or anything else notifying ServiceEntry changes like one
+type EventSource interface {
+	AddEventHandler(handler cache.ResourceEventHandler)
+}
+
 // NewHandler returns an operator-sdk Handler which updates the store based on Kubernetes events
-func AttachHandler(model ServiceEntryModel, informer cache.SharedIndexInformer) {
+func AttachHandler(model ServiceEntryModel, informer EventSource) {
 	informer.AddEventHandler(handler{model})
 }
 
@@ -8,6 +8,8 @@ import (
 	"github.com/golang/protobuf/proto"
 	"istio.io/client-go/pkg/apis/networking/v1alpha3"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
 )
 
 type (
@@ -54,9 +56,12 @@ const (
 	None Owner = iota
 )
 
-// New returns a new store which manages resources marked by the provided ID
-func New() ServiceEntryModel {
+// New returns a new store which manages resources marked by the provided owner reference.
+// Resources without owner references are managed if they carry the labels of the syncer, e.g. when published
+// with a zero reference; all others are theirs.
+func New(ref v1.OwnerReference) ServiceEntryModel {
 	return &serviceEntryModel{
+		ref:    ref,
 		ours:   make(map[string]*v1alpha3.ServiceEntry),
 		theirs: make(map[string]*v1alpha3.ServiceEntry),
 	}
@@ -93,7 +98,7 @@ func (s *serviceEntryModel) Theirs() map[string]*v1alpha3.ServiceEntry {
 }
 
 func (s *serviceEntryModel) Insert(se *v1alpha3.ServiceEntry) error {
-	owner := owner(s.ref, se.GetOwnerReferences())
+	owner := owner(s.ref, se)
 	// as a single update, we insert all hosts owned by the ServiceEntry
 	s.m.Lock()
 	s.add(owner, se)
@@ -102,14 +107,14 @@ func (s *serviceEntryModel) Insert(se *v1alpha3.ServiceEntry) error {
 }
 
 func (s *serviceEntryModel) Update(old, se *v1alpha3.ServiceEntry) error {
-	if proto.Equal(&old.Spec, &se.Spec) {
+	oldOwner := owner(s.ref, old)
+	owner := owner(s.ref, se)
+	if oldOwner == owner && proto.Equal(&old.Spec, &se.Spec) && reflect.DeepEqual(old.Labels, se.Labels) &&
+		reflect.DeepEqual(old.Annotations, se.Annotations) {
 		log.Infof("skipping update, no change")
 		return nil
 	}
 
-	oldOwner := owner(s.ref, old.GetOwnerReferences())
-	owner := owner(s.ref, se.GetOwnerReferences())
-
 	s.m.Lock()
 	s.delete(oldOwner, old)
 	s.add(owner, se)
@@ -118,7 +123,7 @@ func (s *serviceEntryModel) Update(old, se *v1alpha3.ServiceEntry) error {
 }
 
 func (s *serviceEntryModel) Delete(se *v1alpha3.ServiceEntry) error {
-	owner := owner(s.ref, se.GetObjectMeta().GetOwnerReferences())
+	owner := owner(s.ref, se)
 	// as a single update, we delete all hosts owned by the ServiceEntry
 	s.m.Lock()
 	s.delete(owner, se)
@@ -128,7 +133,7 @@ func (s *serviceEntryModel) Delete(se *v1alpha3.ServiceEntry) error {
 
 func (s *serviceEntryModel) add(owner Owner, se *v1alpha3.ServiceEntry) {
 	switch owner {
-	case None, Us:
+	case Us:
 		for _, host := range se.Spec.Hosts {
 			s.ours[host] = se
 		}
@@ -139,30 +144,38 @@ func (s *serviceEntryModel) add(owner Owner, se *v1alpha3.ServiceEntry) {
 	}
 }
 
+// delete removes the hosts of se, unless another ServiceEntry claimed them since, e.g. when a host is moved into
+// another namespace the new ServiceEntry is created before the old one is deleted
 func (s *serviceEntryModel) delete(owner Owner, se *v1alpha3.ServiceEntry) {
 	switch owner {
 	case Us:
-		for _, host := range se.Spec.Hosts {
-			delete(s.ours, host)
-		}
+		deleteHosts(s.ours, se)
 	case Them:
-		for _, host := range se.Spec.Hosts {
-			delete(s.theirs, host)
-		}
+		deleteHosts(s.theirs, se)
 	case None:
 		// for those with no owner, make sure we remove from both maps
-		for _, host := range se.Spec.Hosts {
-			delete(s.ours, host)
-		}
-		for _, host := range se.Spec.Hosts {
-			delete(s.theirs, host)
+		deleteHosts(s.ours, se)
+		deleteHosts(s.theirs, se)
+	}
+}
+
+func deleteHosts(m map[string]*v1alpha3.ServiceEntry, se *v1alpha3.ServiceEntry) {
+	for _, host := range se.Spec.Hosts {
+		if existing, found := m[host]; found && existing.Namespace == se.Namespace && existing.Name == se.Name {
+			delete(m, host)
 		}
 	}
 }
 
-func owner(self v1.OwnerReference, refs []v1.OwnerReference) Owner {
+// owner classifies se as ours if it carries our owner reference, or no owner reference but the label of the syncer
+func owner(self v1.OwnerReference, se *v1alpha3.ServiceEntry) Owner {
+	refs := se.GetOwnerReferences()
 	if len(refs) == 0 {
-		return None
+		if _, found := se.Labels[common.AsmSyncerLabel]; found {
+			return Us
+		}
+		// written by hand or by another tool
+		return Them
 	}
 	for _, ref := range refs {
 		if reflect.DeepEqual(ref, self) {
@@ -173,6 +186,14 @@ func owner(self v1.OwnerReference, refs []v1.OwnerReference) Owner {
 	return Them
 }
 
+// OwnerReferences returns the owner references to set on new entries, none for a zero reference
+func OwnerReferences(ref v1.OwnerReference) []v1.OwnerReference {
+	if ref.UID == "" {
+		return nil
+	}
+	return []v1.OwnerReference{ref}
+}
+
 func copyMap(m map[string]*v1alpha3.ServiceEntry) map[string]*v1alpha3.ServiceEntry {
 	out := make(map[string]*v1alpha3.ServiceEntry, len(m))
 	for k, v := range m {
@@ -6,6 +6,8 @@ import (
 	"istio.io/api/networking/v1alpha3"
 	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
 )
 
 var (
@@ -25,19 +27,37 @@ var (
 		},
 	}
 
+	labelled = &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{
+			Labels: map[string]string{common.AsmSyncerLabel: "consul"},
+		},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts: []string{"labelled.us"},
+		},
+	}
+
 	us = &ic.ServiceEntry{
-		v1.TypeMeta{},
-		v1.ObjectMeta{
+		ObjectMeta: v1.ObjectMeta{
+			OwnerReferences: []v1.OwnerReference{baseOwner},
+		},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts: []string{"1.us", "2.us"},
+		},
+	}
+
+	// usBeforeMove has the hosts of us in the namespace they were moved out of
+	usBeforeMove = &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace:       "old",
 			OwnerReferences: []v1.OwnerReference{baseOwner},
 		},
-		v1alpha3.ServiceEntry{
+		Spec: v1alpha3.ServiceEntry{
 			Hosts: []string{"1.us", "2.us"},
 		},
 	}
 
 	them = &ic.ServiceEntry{
-		v1.TypeMeta{},
-		v1.ObjectMeta{
+		ObjectMeta: v1.ObjectMeta{
 			OwnerReferences: []v1.OwnerReference{
 				{
 					APIVersion: "asmcontroller.istio.io",
@@ -47,7 +67,7 @@ var (
 				},
 			},
 		},
-		v1alpha3.ServiceEntry{
+		Spec: v1alpha3.ServiceEntry{
 			Hosts: []string{"1.them", "2.them", "3.them"},
 		},
 	}
@@ -68,7 +88,13 @@ func TestInsert(t *testing.T) {
 		{
 			"no owners",
 			[]*ic.ServiceEntry{noOwners},
+			[]string{},
 			[]string{"no.owners"},
+		},
+		{
+			"no owners but our label",
+			[]*ic.ServiceEntry{labelled},
+			[]string{"labelled.us"},
 			[]string{},
 		},
 		{
@@ -86,14 +112,14 @@ func TestInsert(t *testing.T) {
 		{
 			"no owners, us",
 			[]*ic.ServiceEntry{noOwners, us},
-			[]string{"no.owners", "1.us", "2.us"},
-			[]string{},
+			[]string{"1.us", "2.us"},
+			[]string{"no.owners"},
 		},
 		{
 			"no owners, us, them",
 			[]*ic.ServiceEntry{noOwners, us, them},
-			[]string{"no.owners", "1.us", "2.us"},
-			[]string{"1.them", "2.them", "3.them"},
+			[]string{"1.us", "2.us"},
+			[]string{"no.owners", "1.them", "2.them", "3.them"},
 		},
 	}
 	for _, tt := range tests {
@@ -139,8 +165,8 @@ func TestDelete(t *testing.T) {
 		{
 			"empty",
 			[]*ic.ServiceEntry{},
-			[]string{"no.owners", "1.us", "2.us"},
-			[]string{"1.them", "2.them", "3.them"},
+			[]string{"1.us", "2.us"},
+			[]string{"no.owners", "1.them", "2.them", "3.them"},
 		},
 		{
 			"no owners",
@@ -151,14 +177,20 @@ func TestDelete(t *testing.T) {
 		{
 			"us",
 			[]*ic.ServiceEntry{us},
-			[]string{"no.owners"},
-			[]string{"1.them", "2.them", "3.them"},
+			[]string{},
+			[]string{"no.owners", "1.them", "2.them", "3.them"},
 		},
 		{
 			"them",
 			[]*ic.ServiceEntry{them},
-			[]string{"no.owners", "1.us", "2.us"},
-			[]string{},
+			[]string{"1.us", "2.us"},
+			[]string{"no.owners"},
+		},
+		{
+			"us, before it was moved",
+			[]*ic.ServiceEntry{usBeforeMove},
+			[]string{"1.us", "2.us"},
+			[]string{"no.owners", "1.them", "2.them", "3.them"},
 		},
 		{
 			"no owners, us",
@@ -225,7 +257,13 @@ func TestClassify(t *testing.T) {
 		{
 			"no owners",
 			[]*ic.ServiceEntry{noOwners},
+			[]string{},
 			[]string{"no.owners"},
+		},
+		{
+			"no owners but our label",
+			[]*ic.ServiceEntry{labelled},
+			[]string{"labelled.us"},
 			[]string{},
 		},
 		{
@@ -243,14 +281,14 @@ func TestClassify(t *testing.T) {
 		{
 			"no owners, us",
 			[]*ic.ServiceEntry{noOwners, us},
-			[]string{"no.owners", "1.us", "2.us"},
-			[]string{},
+			[]string{"1.us", "2.us"},
+			[]string{"no.owners"},
 		},
 		{
 			"no owners, us, them",
 			[]*ic.ServiceEntry{noOwners, us, them},
-			[]string{"no.owners", "1.us", "2.us"},
-			[]string{"1.them", "2.them", "3.them"},
+			[]string{"1.us", "2.us"},
+			[]string{"no.owners", "1.them", "2.them", "3.them"},
 		},
 	}
 	for _, tt := range tests {
@@ -276,3 +314,57 @@ func TestClassify(t *testing.T) {
 		})
 	}
 }
+
+func TestIdentityOwns(t *testing.T) {
+	controller := true
+	id := Identity{Type: "consul", Registry: "consul-prod", Ref: v1.OwnerReference{
+		APIVersion: common.OwnerRefAPIVersion, Kind: common.OwnerRefKind, Name: "default", UID: "1234", Controller: &controller,
+	}}
+	stamped := &ic.ServiceEntry{}
+	id.Stamp(stamped)
+	if !id.Owns(stamped) || !id.Stamped(stamped) {
+		t.Errorf("a stamped ServiceEntry must be owned, got %v", stamped.ObjectMeta)
+	}
+
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		refs        []v1.OwnerReference
+		want        bool
+	}{
+		{name: "written by hand"},
+		{
+			name:        "annotated for another registry",
+			labels:      map[string]string{common.AsmSyncerLabel: "consul", common.AsmSyncerRegistryLabel: "consul-prod"},
+			annotations: map[string]string{common.AsmSyncerOwnerAnnotation: "consul/consul-dev"},
+		},
+		{
+			name:   "labelled before it was annotated",
+			labels: map[string]string{common.AsmSyncerLabel: "consul", common.AsmSyncerRegistryLabel: "consul-prod"},
+			want:   true,
+		},
+		{
+			name:   "labelled for another registry",
+			labels: map[string]string{common.AsmSyncerLabel: "consul", common.AsmSyncerRegistryLabel: "consul-dev"},
+		},
+		{
+			name:   "labelled with the type only",
+			labels: map[string]string{common.AsmSyncerLabel: "consul"},
+			want:   true,
+		},
+		{
+			name:   "controlled by another controller",
+			labels: map[string]string{common.AsmSyncerLabel: "consul", common.AsmSyncerRegistryLabel: "consul-prod"},
+			refs:   []v1.OwnerReference{baseOwner},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			se := &ic.ServiceEntry{ObjectMeta: v1.ObjectMeta{Labels: tt.labels, Annotations: tt.annotations, OwnerReferences: tt.refs}}
+			if got := id.Owns(se); got != tt.want {
+				t.Errorf("Owns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
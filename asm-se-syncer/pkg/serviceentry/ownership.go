@@ -0,0 +1,131 @@
+package serviceentry
+
+import (
+	"fmt"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+)
+
+// NotOwnedError is returned when a resource which isn't published by the registry would be updated or deleted
+type NotOwnedError struct {
+	Kind, Namespace, Name string
+	// Publisher is who published the resource instead, see Publisher
+	Publisher string
+}
+
+// NotOwned returns the error refusing to write obj of kind
+func NotOwned(kind string, obj v1.Object) *NotOwnedError {
+	return &NotOwnedError{Kind: kind, Namespace: obj.GetNamespace(), Name: obj.GetName(), Publisher: Publisher(kind, obj)}
+}
+
+func (e *NotOwnedError) Error() string {
+	return fmt.Sprintf("%s %s/%s is published by %s", e.Kind, e.Namespace, e.Name, e.Publisher)
+}
+
+// Identity identifies the registry a resource is published for. It is stamped on every ServiceEntry, WorkloadEntry
+// and DestinationRule of the registry as the owner labels, the owner annotation and the owner reference of the
+// ASMServiceRegistry, so that resources published by anyone else can be told apart and are left alone.
+type Identity struct {
+	Type     string
+	Registry string
+	// Ref is the owner reference of the ASMServiceRegistry, resources get none if it is zero
+	Ref v1.OwnerReference
+}
+
+// Labels returns the owner labels of the registry
+func (id Identity) Labels() map[string]string {
+	return common.OwnerLabels(id.Type, id.Registry)
+}
+
+// Annotation returns the value of the owner annotation of the registry
+func (id Identity) Annotation() string {
+	return id.Type + "/" + id.Registry
+}
+
+// Stamp sets the owner labels, annotation and reference of the registry on obj, keeping its other labels
+func (id Identity) Stamp(obj v1.Object) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for key, value := range id.Labels() {
+		labels[key] = value
+	}
+	obj.SetLabels(labels)
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string, 1)
+	}
+	annotations[common.AsmSyncerOwnerAnnotation] = id.Annotation()
+	obj.SetAnnotations(annotations)
+	obj.SetOwnerReferences(OwnerReferences(id.Ref))
+}
+
+// Stamped reports whether obj carries the owner labels, annotation and reference of the registry
+func (id Identity) Stamped(obj v1.Object) bool {
+	labels := obj.GetLabels()
+	for key, value := range id.Labels() {
+		if labels[key] != value {
+			return false
+		}
+	}
+	if !id.referenced(obj) {
+		return false
+	}
+	return obj.GetAnnotations()[common.AsmSyncerOwnerAnnotation] == id.Annotation()
+}
+
+// referenced reports whether obj carries the owner reference of the registry, and no other
+func (id Identity) referenced(obj v1.Object) bool {
+	refs := OwnerReferences(id.Ref)
+	return len(obj.GetOwnerReferences()) == len(refs) && (len(refs) == 0 || obj.GetOwnerReferences()[0].UID == refs[0].UID)
+}
+
+// Owns reports whether obj was published for the registry. Resources controlled by something else than the
+// ASMServiceRegistry never are. Resources published before they were annotated are recognized by their owner
+// labels; use Legacy to tell those which only carry the registry type label, they may belong to any registry of the type.
+func (id Identity) Owns(obj v1.Object) bool {
+	if controller := v1.GetControllerOf(obj); controller != nil &&
+		(controller.APIVersion != common.OwnerRefAPIVersion || controller.Kind != common.OwnerRefKind) {
+		return false
+	}
+	if owner, found := obj.GetAnnotations()[common.AsmSyncerOwnerAnnotation]; found {
+		return owner == id.Annotation()
+	}
+	labels := obj.GetLabels()
+	if labels[common.AsmSyncerLabel] != id.Type {
+		return false
+	}
+	registry, found := labels[common.AsmSyncerRegistryLabel]
+	return !found || registry == id.Registry
+}
+
+// Orphaned reports whether obj was published by the syncer for another registry which doesn't run, as it was
+// renamed or removed from the registry config, so that the registry may adopt it. Resources with other owner
+// references than the registry's are never orphaned, they may be published by another syncer.
+func (id Identity) Orphaned(obj v1.Object, running func(registry string) bool) bool {
+	labels := obj.GetLabels()
+	registry, found := labels[common.AsmSyncerRegistryLabel]
+	if !found || labels[common.AsmSyncerLabel] == "" || registry == id.Registry || running(registry) {
+		return false
+	}
+	return id.referenced(obj)
+}
+
+// Legacy reports whether obj was published before it was labelled with the name of its registry
+func Legacy(obj v1.Object) bool {
+	_, annotated := obj.GetAnnotations()[common.AsmSyncerOwnerAnnotation]
+	_, labelled := obj.GetLabels()[common.AsmSyncerRegistryLabel]
+	return !annotated && !labelled
+}
+
+// Publisher describes who published obj for the conflict report: its registry if it was published by the syncer,
+// else the kind, namespace and name of the resource
+func Publisher(kind string, obj v1.Object) string {
+	if registry, found := obj.GetLabels()[common.AsmSyncerRegistryLabel]; found && obj.GetLabels()[common.AsmSyncerLabel] != "" {
+		return registry
+	}
+	return fmt.Sprintf("%s %s/%s", kind, obj.GetNamespace(), obj.GetName())
+}
@@ -0,0 +1,119 @@
+package serviceentry
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+)
+
+// ProtocolKey is the registry metadata key declaring the protocol of the port of an instance
+const ProtocolKey = "protocol"
+
+const dubbo = "DUBBO"
+
+// PortName returns the name of a port declared with protocol, e.g. grpc-9090.
+// Istio has no Dubbo protocol, Dubbo ports are named tcp-dubbo-<port> so that Dubbo aware proxies find them.
+func PortName(protocol string, port uint32) string {
+	if strings.EqualFold(protocol, dubbo) {
+		return fmt.Sprintf("tcp-dubbo-%d", port)
+	}
+	return fmt.Sprintf("%s-%d", strings.ToLower(protocol), port)
+}
+
+// EndpointWithProtocol creates a Service Entry endpoint from an address and port, naming the port after protocol.
+// The port name is inferred from the port number if protocol isn't one of common.Protocols.
+func EndpointWithProtocol(address string, port uint32, protocol string) *v1alpha3.WorkloadEntry {
+	if !common.IsProtocol(protocol) {
+		return Endpoint(address, port)
+	}
+	return &v1alpha3.WorkloadEntry{
+		Address: address,
+		Ports:   map[string]uint32{PortName(protocol, port): port},
+	}
+}
+
+// istioProtocol returns the Istio protocol of one of common.Protocols
+func istioProtocol(protocol string) string {
+	protocol = strings.ToUpper(protocol)
+	if protocol == dubbo {
+		return "TCP"
+	}
+	return protocol
+}
+
+// portProtocol infers the protocol of a port from its name, like Istio does, or from its number if the name
+// doesn't tell
+func portProtocol(name string, port uint32) string {
+	prefix := strings.ToUpper(name)
+	if strings.HasPrefix(prefix, "GRPC-WEB") {
+		return "GRPC-WEB"
+	}
+	if i := strings.Index(prefix, "-"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	if common.IsProtocol(prefix) {
+		return istioProtocol(prefix)
+	}
+	return strings.ToUpper(Proto(port))
+}
+
+// ApplyPortRules applies to every port of the ServiceEntry of host the first rule matching it. The endpoints whose
+// port is renamed are copied, the endpoints the ServiceEntry was built with aren't changed.
+func ApplyPortRules(se *ic.ServiceEntry, host string, rules []common.PortRule) {
+	renamed := make(map[uint32]string) // port number->new name
+	for _, port := range se.Spec.Ports {
+		rule, ok := matchPortRule(rules, host, port.Number)
+		if !ok {
+			continue
+		}
+		name := rule.Name
+		if rule.Protocol != "" {
+			port.Protocol = istioProtocol(rule.Protocol)
+			if name == "" {
+				name = PortName(rule.Protocol, port.Number)
+			}
+		}
+		if name != "" && name != port.Name {
+			port.Name = name
+			renamed[port.Number] = name
+		}
+		port.TargetPort = rule.TargetPort
+	}
+	if len(renamed) == 0 {
+		return
+	}
+
+	// the slice is shared with the caller of Builder too
+	endpoints := make([]*v1alpha3.WorkloadEntry, len(se.Spec.Endpoints))
+	for i, ep := range se.Spec.Endpoints {
+		ports := make(map[string]uint32, len(ep.Ports))
+		for name, number := range ep.Ports {
+			if newName, ok := renamed[number]; ok {
+				name = newName
+			}
+			ports[name] = number
+		}
+		renamedEndpoint := *ep
+		renamedEndpoint.Ports = ports
+		endpoints[i] = &renamedEndpoint
+	}
+	se.Spec.Endpoints = endpoints
+}
+
+func matchPortRule(rules []common.PortRule, host string, port uint32) (common.PortRule, bool) {
+	for _, rule := range rules {
+		if rule.Port != port {
+			continue
+		}
+		// the patterns are validated with the config
+		if matched, _ := path.Match(rule.Service, host); rule.Service == "" || matched {
+			return rule, true
+		}
+	}
+	return common.PortRule{}, false
+}
@@ -0,0 +1,51 @@
+package serviceentry
+
+import (
+	"path"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+)
+
+// Route returns the namespace the ServiceEntry of host is published into and the namespaces it is exported to, as
+// the first of the rules matching the host and its endpoints says. Hosts matching none are published into
+// namespace and exported to exportTo.
+func Route(rules []common.NamespaceRule, namespace string, exportTo []string, host string, endpoints []*v1alpha3.WorkloadEntry) (string, []string) {
+	for _, rule := range rules {
+		if !matchNamespaceRule(rule, host, endpoints) {
+			continue
+		}
+		if len(rule.ExportTo) > 0 {
+			return rule.Namespace, rule.ExportTo
+		}
+		return rule.Namespace, exportTo
+	}
+	return namespace, exportTo
+}
+
+func matchNamespaceRule(rule common.NamespaceRule, host string, endpoints []*v1alpha3.WorkloadEntry) bool {
+	// the patterns are validated with the config
+	if matched, _ := path.Match(rule.Service, host); rule.Service != "" && !matched {
+		return false
+	}
+	if len(rule.Labels) == 0 {
+		return true
+	}
+	for _, ep := range endpoints {
+		if hasLabels(ep.Labels, rule.Labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLabels reports whether labels has all of wanted
+func hasLabels(labels, wanted map[string]string) bool {
+	for key, value := range wanted {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package snapshot
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+)
+
+// warmCache serves the hosts of a snapshot besides those found by the watcher, until the watcher can be trusted
+type warmCache struct {
+	provider.Cache
+	registry string
+	m        sync.Mutex
+	// warm are the hosts of the snapshot the watcher didn't report yet, nil once the registry is connected
+	warm map[string][]*v1alpha3.WorkloadEntry
+}
+
+// Warm returns a cache wrapping live which also serves the hosts of snapshot, so that a restart while the registry
+// can't be reached publishes what was last found instead of nothing. A host of the snapshot is served until the
+// watcher reports it, or until the registry is connected and what the watcher found is complete. A full Set by
+// the watcher replaces the whole snapshot.
+func Warm(live provider.Cache, registry string, snapshot *Snapshot) provider.Cache {
+	warm := make(map[string][]*v1alpha3.WorkloadEntry, len(snapshot.Hosts))
+	for host, eps := range snapshot.Hosts {
+		if len(eps) > 0 {
+			warm[host] = eps
+		}
+	}
+	log.Infof("registry %q starts with %d hosts of the snapshot saved at %s, revision %d", registry, len(warm),
+		snapshot.Time.Format(time.RFC3339), snapshot.Revision)
+	return &warmCache{Cache: live, registry: registry, warm: warm}
+}
+
+func (c *warmCache) Hosts() map[string][]*v1alpha3.WorkloadEntry {
+	hosts := c.Cache.Hosts()
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.warm == nil {
+		return hosts
+	}
+	if monitoring.Connected(c.registry) {
+		c.drop("the registry is connected")
+		return hosts
+	}
+	for host, eps := range c.warm {
+		if _, found := hosts[host]; !found {
+			hosts[host] = eps
+		}
+	}
+	return hosts
+}
+
+func (c *warmCache) Set(hosts map[string][]*v1alpha3.WorkloadEntry) {
+	c.m.Lock()
+	if c.warm != nil {
+		c.drop("the watcher found all hosts")
+	}
+	c.m.Unlock()
+	c.Cache.Set(hosts)
+}
+
+func (c *warmCache) Update(host string, endpoints []*v1alpha3.WorkloadEntry) {
+	c.m.Lock()
+	delete(c.warm, host)
+	c.m.Unlock()
+	c.Cache.Update(host, endpoints)
+}
+
+// drop stops serving the snapshot, callers must hold c.m
+func (c *warmCache) drop(reason string) {
+	log.Infof("registry %q stops serving the snapshot, %s", c.registry, reason)
+	c.warm = nil
+}
+
+// Persist saves what the watcher found in live as the snapshot of registry every interval, until the context is
+// cancelled. The snapshot is saved only by the leader while the registry is connected, and only if the hosts
+// changed since last was saved, last being the snapshot loaded at startup if any. Failures are logged and retried
+// at the next interval.
+func Persist(ctx context.Context, store Store, last *Snapshot, elector *leader.Elector, registry, registryType string,
+	live provider.Cache, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !elector.IsLeader() || !monitoring.Connected(registry) {
+			continue
+		}
+		hosts := live.Hosts()
+		if last != nil && reflect.DeepEqual(last.Hosts, hosts) {
+			continue
+		}
+		snapshot := &Snapshot{
+			Version:  FormatVersion,
+			Registry: registry,
+			Type:     registryType,
+			Time:     time.Now().UTC(),
+			Hosts:    hosts,
+		}
+		if last != nil {
+			snapshot.Revision = last.Revision + 1
+		}
+		if err := store.Save(ctx, snapshot); err != nil {
+			log.Errorf("error saving the snapshot of registry %q: %v", registry, err)
+			continue
+		}
+		log.Debugf("saved revision %d of the snapshot of registry %q, %d hosts", snapshot.Revision, registry, len(hosts))
+		last = snapshot
+	}
+}
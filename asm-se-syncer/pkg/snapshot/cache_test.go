@@ -0,0 +1,130 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+)
+
+func sortedHosts(cache provider.Cache) []string {
+	var out []string
+	for host := range cache.Hosts() {
+		out = append(out, host)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func endpoints(address string) []*v1alpha3.WorkloadEntry {
+	return []*v1alpha3.WorkloadEntry{{Address: address}}
+}
+
+func TestWarm(t *testing.T) {
+	tests := []struct {
+		name   string
+		fill   func(cache provider.Cache)
+		synced bool
+		want   []string
+	}{
+		{
+			name: "the snapshot is served while the registry can't be reached",
+			fill: func(provider.Cache) {},
+			want: []string{"db.consul", "web.consul"},
+		},
+		{
+			name: "hosts reported by the watcher replace those of the snapshot",
+			fill: func(cache provider.Cache) {
+				cache.Update("web.consul", nil)
+				cache.Update("api.consul", endpoints("10.0.0.3"))
+			},
+			want: []string{"api.consul", "db.consul"},
+		},
+		{
+			name: "a full set replaces the snapshot",
+			fill: func(cache provider.Cache) {
+				cache.Set(map[string][]*v1alpha3.WorkloadEntry{"api.consul": endpoints("10.0.0.3")})
+			},
+			want: []string{"api.consul"},
+		},
+		{
+			name:   "the snapshot isn't served once the registry is connected",
+			fill:   func(cache provider.Cache) { cache.Update("api.consul", endpoints("10.0.0.3")) },
+			synced: true,
+			want:   []string{"api.consul"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			monitoring.Register("consul-warm", "consul")
+			defer monitoring.Forget("consul-warm")
+			s := newSnapshot("consul-warm", 3)
+			s.Hosts["db.consul"] = endpoints("10.0.0.2")
+			cache := Warm(provider.NewCache(), "consul-warm", s)
+			tt.fill(cache)
+			if tt.synced {
+				monitoring.Synced("consul-warm")
+			}
+			if got := sortedHosts(cache); !equal(got, tt.want) {
+				t.Errorf("Hosts() = %v, want %v", got, tt.want)
+			}
+			monitoring.WatchFailed("consul-warm", errors.New("connection refused"))
+			if got := sortedHosts(cache); !equal(got, tt.want) {
+				t.Errorf("Hosts() after a failure = %v, the snapshot mustn't be served again", got)
+			}
+		})
+	}
+}
+
+func TestPersist(t *testing.T) {
+	monitoring.Register("consul-persist", "consul")
+	defer monitoring.Forget("consul-persist")
+	store := NewConfigMapStore(&configMaps{}, "istio-system", "asm-se-syncer-snapshot")
+	live := provider.NewCache()
+	live.Update("web.consul", endpoints("10.0.0.1"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Persist(ctx, store, newSnapshot("consul-persist", 3), leader.Always(), "consul-persist", "consul", live, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	if s, _ := store.Load(ctx, "consul-persist"); s != nil {
+		t.Fatal("nothing must be saved before the registry is connected")
+	}
+	monitoring.Synced("consul-persist")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, err := store.Load(ctx, "consul-persist")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != nil {
+			if s.Revision != 4 || len(s.Hosts) != 1 || s.Hosts["web.consul"][0].Address != "10.0.0.1" {
+				t.Errorf("saved %+v, want revision 4 with the hosts found", s)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the snapshot must be saved once the registry is connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
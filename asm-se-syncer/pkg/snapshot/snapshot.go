@@ -0,0 +1,245 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"istio.io/api/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// FormatVersion is the version of the snapshot format written, snapshots of other versions aren't loaded
+const FormatVersion = 1
+
+const suffix = ".json"
+
+// Snapshot is the last-good state of a registry: the hosts its watcher found while it was connected
+type Snapshot struct {
+	Version  int    `json:"version"`
+	Registry string `json:"registry"`
+	Type     string `json:"type"`
+	// Revision is incremented every time the snapshot of the registry is saved
+	Revision int64                                `json:"revision"`
+	Time     time.Time                            `json:"time"`
+	Hosts    map[string][]*v1alpha3.WorkloadEntry `json:"hosts"`
+}
+
+// Store keeps the snapshots of the registries
+type Store interface {
+	// Load returns the snapshot of registry, or nil if there is none
+	Load(ctx context.Context, registry string) (*Snapshot, error)
+	Save(ctx context.Context, snapshot *Snapshot) error
+	// List returns the snapshots of all registries, sorted by registry
+	List(ctx context.Context) ([]*Snapshot, error)
+}
+
+// Endpoints returns the number of endpoints of all hosts
+func (s *Snapshot) Endpoints() int {
+	n := 0
+	for _, eps := range s.Hosts {
+		n += len(eps)
+	}
+	return n
+}
+
+func decode(data []byte, source string) (*Snapshot, error) {
+	s := &Snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the snapshot %s", source)
+	}
+	if s.Version != FormatVersion {
+		return nil, errors.Errorf("snapshot %s has version %d, only version %d is supported", source, s.Version, FormatVersion)
+	}
+	return s, nil
+}
+
+type fileStore struct {
+	dir string
+}
+
+// NewFileStore returns a store keeping the snapshot of every registry in the file <registry>.json of dir
+func NewFileStore(dir string) Store {
+	return &fileStore{dir: dir}
+}
+
+func (f *fileStore) path(registry string) (string, error) {
+	if registry == "" || strings.ContainsAny(registry, `/\`) || registry == "." || registry == ".." {
+		return "", errors.Errorf("registry %q can't be used as a file name", registry)
+	}
+	return filepath.Join(f.dir, registry+suffix), nil
+}
+
+func (f *fileStore) Load(_ context.Context, registry string) (*Snapshot, error) {
+	path, err := f.path(registry)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the snapshot of registry %q", registry)
+	}
+	return decode(data, path)
+}
+
+// Save writes the snapshot to a temporary file renamed over the previous one, so that a crash leaves either of them
+func (f *fileStore) Save(_ context.Context, snapshot *Snapshot) error {
+	path, err := f.path(snapshot.Registry)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode the snapshot of registry %q", snapshot.Registry)
+	}
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create the snapshot directory")
+	}
+	tmp, err := ioutil.TempFile(f.dir, "."+snapshot.Registry+"-*")
+	if err != nil {
+		return errors.Wrapf(err, "failed to save the snapshot of registry %q", snapshot.Registry)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return errors.Wrapf(err, "failed to save the snapshot of registry %q", snapshot.Registry)
+}
+
+func (f *fileStore) List(ctx context.Context) ([]*Snapshot, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the snapshots")
+	}
+	var out []*Snapshot
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		s, err := f.Load(ctx, strings.TrimSuffix(name, suffix))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	// ReadDir sorts by file name
+	return out, nil
+}
+
+type configMapStore struct {
+	client corev1client.ConfigMapInterface
+	name   string
+}
+
+// NewConfigMapStore returns a store keeping the snapshot of every registry under the key <registry>.json of the
+// ConfigMap name, which is created when the first snapshot is saved. All snapshots must fit in the 1MiB a
+// ConfigMap can hold.
+func NewConfigMapStore(client corev1client.ConfigMapsGetter, namespace, name string) Store {
+	return &configMapStore{client: client.ConfigMaps(namespace), name: name}
+}
+
+func key(registry string) (string, error) {
+	key := registry + suffix
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return "", errors.Errorf("registry %q can't be used as a ConfigMap key: %s", registry, strings.Join(errs, ", "))
+	}
+	return key, nil
+}
+
+func (c *configMapStore) get(ctx context.Context) (*corev1.ConfigMap, error) {
+	cm, err := c.client.Get(ctx, c.name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return cm, errors.Wrapf(err, "failed to get the snapshot ConfigMap %s", c.name)
+}
+
+func (c *configMapStore) Load(ctx context.Context, registry string) (*Snapshot, error) {
+	key, err := key(registry)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := c.get(ctx)
+	if err != nil || cm == nil {
+		return nil, err
+	}
+	data, found := cm.Data[key]
+	if !found {
+		return nil, nil
+	}
+	return decode([]byte(data), c.name+"/"+key)
+}
+
+// Save updates the key of the registry, failing if the ConfigMap was changed since it was read
+func (c *configMapStore) Save(ctx context.Context, snapshot *Snapshot) error {
+	key, err := key(snapshot.Registry)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode the snapshot of registry %q", snapshot.Registry)
+	}
+	cm, err := c.get(ctx)
+	if err != nil {
+		return err
+	}
+	if cm == nil {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: c.name},
+			Data:       map[string]string{key: string(data)},
+		}
+		_, err = c.client.Create(ctx, cm, metav1.CreateOptions{})
+		return errors.Wrapf(err, "failed to save the snapshot of registry %q", snapshot.Registry)
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[key] = string(data)
+	_, err = c.client.Update(ctx, cm, metav1.UpdateOptions{})
+	return errors.Wrapf(err, "failed to save the snapshot of registry %q", snapshot.Registry)
+}
+
+func (c *configMapStore) List(ctx context.Context) ([]*Snapshot, error) {
+	cm, err := c.get(ctx)
+	if err != nil || cm == nil {
+		return nil, err
+	}
+	var out []*Snapshot
+	for key, data := range cm.Data {
+		if !strings.HasSuffix(key, suffix) {
+			continue
+		}
+		s, err := decode([]byte(data), c.name+"/"+key)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Registry < out[j].Registry })
+	return out, nil
+}
@@ -0,0 +1,117 @@
+package snapshot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"istio.io/api/networking/v1alpha3"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+func newSnapshot(registry string, revision int64) *Snapshot {
+	return &Snapshot{
+		Version:  FormatVersion,
+		Registry: registry,
+		Type:     "consul",
+		Revision: revision,
+		Time:     time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC),
+		Hosts: map[string][]*v1alpha3.WorkloadEntry{
+			"web.consul": {{Address: "10.0.0.1", Ports: map[string]uint32{"http": 8080}, Labels: map[string]string{"v": "1"}}},
+		},
+	}
+}
+
+// configMaps is a ConfigMap client holding a single ConfigMap
+type configMaps struct {
+	corev1client.ConfigMapInterface
+	m  sync.Mutex
+	cm *corev1.ConfigMap
+}
+
+func (c *configMaps) ConfigMaps(string) corev1client.ConfigMapInterface {
+	return c
+}
+
+func (c *configMaps) Get(_ context.Context, name string, _ metav1.GetOptions) (*corev1.ConfigMap, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.cm == nil {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	return c.cm.DeepCopy(), nil
+}
+
+func (c *configMaps) Create(_ context.Context, cm *corev1.ConfigMap, _ metav1.CreateOptions) (*corev1.ConfigMap, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cm = cm.DeepCopy()
+	return cm, nil
+}
+
+func (c *configMaps) Update(_ context.Context, cm *corev1.ConfigMap, _ metav1.UpdateOptions) (*corev1.ConfigMap, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cm = cm.DeepCopy()
+	return cm, nil
+}
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	for name, store := range map[string]Store{
+		"file":      NewFileStore(filepath.Join(dir, "snapshots")),
+		"configmap": NewConfigMapStore(&configMaps{}, "istio-system", "asm-se-syncer-snapshot"),
+	} {
+		if s, err := store.Load(ctx, "consul-prod"); err != nil || s != nil {
+			t.Errorf("%s: Load() before any save = %v, %v, want nil", name, s, err)
+		}
+		if list, err := store.List(ctx); err != nil || len(list) != 0 {
+			t.Errorf("%s: List() before any save = %v, %v, want none", name, list, err)
+		}
+		for _, s := range []*Snapshot{newSnapshot("consul-prod", 0), newSnapshot("consul-prod", 1), newSnapshot("consul-dev", 0)} {
+			if err := store.Save(ctx, s); err != nil {
+				t.Fatalf("%s: Save() = %v", name, err)
+			}
+		}
+		got, err := store.Load(ctx, "consul-prod")
+		if err != nil {
+			t.Fatalf("%s: Load() = %v", name, err)
+		}
+		if want := newSnapshot("consul-prod", 1); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Load() = %+v, want the last saved %+v", name, got, want)
+		}
+		list, err := store.List(ctx)
+		if err != nil {
+			t.Fatalf("%s: List() = %v", name, err)
+		}
+		if len(list) != 2 || list[0].Registry != "consul-dev" || list[1].Registry != "consul-prod" {
+			t.Errorf("%s: List() = %v, want the snapshots of consul-dev and consul-prod", name, list)
+		}
+		if err := store.Save(ctx, newSnapshot("../consul", 0)); err == nil {
+			t.Errorf("%s: a registry name which isn't a valid key must be rejected", name)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "consul-old.json"), []byte(`{"version":0,"registry":"consul-old"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(dir).Load(ctx, "consul-old"); err == nil || !strings.Contains(err.Error(), "version 0") {
+		t.Errorf("a snapshot of another version must be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	restclient "k8s.io/client-go/rest"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/leader"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+const (
+	resource = "asmserviceregistrys"
+	// Name of the ASMServiceRegistry owning the ServiceEntries and holding the status of the registries
+	Name = "default"
+)
+
+// RegistryStatus is the status of a registry as written into the ASMServiceRegistry
+type RegistryStatus struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Connected    bool     `json:"connected"`
+	LastSyncTime *v1.Time `json:"lastSyncTime,omitempty"`
+	Services     int      `json:"services"`
+	Endpoints    int      `json:"endpoints"`
+	LastError    string   `json:"lastError,omitempty"`
+}
+
+// Conflict is a host which isn't published for some registries, as another registry or someone else than the
+// syncer publishes it, as written into the ASMServiceRegistry
+type Conflict struct {
+	Host     string   `json:"host"`
+	Owner    string   `json:"owner"`
+	Rejected []string `json:"rejected"`
+}
+
+// Client reads the ASMServiceRegistry and writes its status
+type Client struct {
+	client restclient.Interface
+}
+
+func NewClient(cfg *restclient.Config) (*Client, error) {
+	crdConfig := restclient.CopyConfig(cfg)
+	gv := schema.GroupVersion{Group: "istio.alibabacloud.com", Version: "v1beta1"}
+	crdConfig.GroupVersion = &gv
+	crdConfig.APIPath = "/apis"
+	crdConfig.ContentType = k8sruntime.ContentTypeJSON
+	crdConfig.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+	if crdConfig.UserAgent == "" {
+		crdConfig.UserAgent = restclient.DefaultKubernetesUserAgent()
+	}
+	client, err := restclient.RESTClientFor(crdConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{client: client}, nil
+}
+
+// Get returns the ASMServiceRegistry
+func (c *Client) Get(ctx context.Context) (*unstructured.Unstructured, error) {
+	var registry unstructured.Unstructured
+	err := c.client.Get().Resource(resource).Name(Name).Do(ctx).Into(&registry)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s/%s", resource, Name)
+	}
+	return &registry, nil
+}
+
+// OwnerReference returns the owner reference set on the ServiceEntries, so that they are deleted with the ASMServiceRegistry
+func (c *Client) OwnerReference(ctx context.Context) (v1.OwnerReference, error) {
+	registry, err := c.Get(ctx)
+	if err != nil {
+		return v1.OwnerReference{}, err
+	}
+	return OwnerReference(registry.GetUID()), nil
+}
+
+// OwnerReference returns the owner reference of the ASMServiceRegistry with the given UID
+func OwnerReference(uid types.UID) v1.OwnerReference {
+	controller := true
+	return v1.OwnerReference{
+		APIVersion: common.OwnerRefAPIVersion,
+		Kind:       common.OwnerRefKind,
+		Name:       Name,
+		UID:        uid,
+		Controller: &controller,
+	}
+}
+
+// UpdateStatus replaces the status of the registries and the conflicts
+func (c *Client) UpdateStatus(ctx context.Context, registries []RegistryStatus, conflicts []Conflict) error {
+	status := map[string]interface{}{
+		"registries": registries,
+		// removed by the merge patch if there are none
+		"conflicts": nil,
+	}
+	if len(conflicts) > 0 {
+		status["conflicts"] = conflicts
+	}
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	err = c.client.Patch(types.MergePatchType).Resource(resource).Name(Name).SubResource("status").
+		Body(patch).Do(ctx).Error()
+	return errors.Wrapf(err, "failed to update the status of %s/%s", resource, Name)
+}
+
+// Report writes the status of the registries and the conflicts of their hosts in claims every interval until the
+// context is cancelled. Only the leader writes, and only when the status changed.
+func Report(ctx context.Context, client *Client, elector *leader.Elector, claims *serviceentry.HostClaims, interval time.Duration) {
+	select {
+	case <-elector.Leading():
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last []RegistryStatus
+	var lastConflicts []Conflict
+	for {
+		current := Registries(monitoring.States())
+		conflicts := Conflicts(claims.Conflicts())
+		if !reflect.DeepEqual(current, last) || !reflect.DeepEqual(conflicts, lastConflicts) {
+			if err := client.UpdateStatus(ctx, current, conflicts); err != nil {
+				log.Errorf("error reporting the status of the registries: %v", err)
+			} else {
+				last, lastConflicts = current, conflicts
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Registries returns the status of the registries in the given states
+func Registries(states []monitoring.State) []RegistryStatus {
+	out := make([]RegistryStatus, 0, len(states))
+	for _, s := range states {
+		status := RegistryStatus{
+			Name:      s.Name,
+			Type:      s.Type,
+			Connected: s.Connected,
+			Services:  s.Services,
+			Endpoints: s.Endpoints,
+			LastError: s.LastError,
+		}
+		if !s.LastSync.IsZero() {
+			// the API server stores seconds only, keep the same precision to compare with the last status
+			t := v1.NewTime(s.LastSync.Truncate(time.Second))
+			status.LastSyncTime = &t
+		}
+		out = append(out, status)
+	}
+	return out
+}
+
+// Conflicts returns the status of the conflicts
+func Conflicts(conflicts []serviceentry.Conflict) []Conflict {
+	out := make([]Conflict, 0, len(conflicts))
+	for _, c := range conflicts {
+		out = append(out, Conflict{Host: c.Host, Owner: c.Owner, Rejected: c.Rejected})
+	}
+	return out
+}
@@ -0,0 +1,82 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	restclient "k8s.io/client-go/rest"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+func TestClient(t *testing.T) {
+	var patch map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/apis/istio.alibabacloud.com/v1beta1/asmserviceregistrys/default":
+			_, _ = w.Write([]byte(`{"apiVersion":"istio.alibabacloud.com/v1beta1","kind":"ASMServiceRegistry","metadata":{"name":"default","uid":"1234"}}`))
+		case r.Method == http.MethodPatch && r.URL.Path == "/apis/istio.alibabacloud.com/v1beta1/asmserviceregistrys/default/status":
+			if ct := r.Header.Get("Content-Type"); ct != "application/merge-patch+json" {
+				t.Errorf("the status must be merge patched but got %s", ct)
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &patch); err != nil {
+				t.Error(err)
+			}
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(&restclient.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := client.OwnerReference(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.UID != "1234" || ref.Kind != "ASMServiceRegistry" || ref.Name != "default" {
+		t.Errorf("unexpected owner reference %+v", ref)
+	}
+
+	lastSync := time.Date(2021, 3, 1, 8, 0, 0, 500, time.UTC)
+	registries := Registries([]monitoring.State{
+		{Name: "consul", Type: "consul", Connected: true, LastSync: lastSync, Services: 2, Endpoints: 5},
+		{Name: "eureka", Type: "eureka", LastError: "connection refused"},
+	})
+	if err := client.UpdateStatus(context.Background(), registries, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(patch)
+	want := `{"status":{"conflicts":null,"registries":[` +
+		`{"connected":true,"endpoints":5,"lastSyncTime":"2021-03-01T08:00:00Z","name":"consul","services":2,"type":"consul"},` +
+		`{"connected":false,"endpoints":0,"lastError":"connection refused","name":"eureka","services":0,"type":"eureka"}]}}`
+	if string(got) != want {
+		t.Errorf("status patch = %s, want %s", got, want)
+	}
+
+	claims := serviceentry.NewHostClaims()
+	claims.Claim("web.service.consul", "consul")
+	claims.Claim("web.service.consul", "eureka")
+	claims.Refuse("db.service.consul", "consul", "ServiceEntry default/db")
+	if err := client.UpdateStatus(context.Background(), nil, Conflicts(claims.Conflicts())); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = json.Marshal(patch["status"].(map[string]interface{})["conflicts"])
+	want = `[{"host":"db.service.consul","owner":"ServiceEntry default/db","rejected":["consul"]},` +
+		`{"host":"web.service.consul","owner":"consul","rejected":["eureka"]}]`
+	if string(got) != want {
+		t.Errorf("conflicts = %s, want %s", got, want)
+	}
+}
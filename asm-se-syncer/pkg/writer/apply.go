@@ -0,0 +1,278 @@
+package writer
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	icapi "istio.io/client-go/pkg/clientset/versioned/typed/networking/v1alpha3"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/plan"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+type (
+	// Owns reports whether the current version of an object may be overwritten or deleted
+	Owns func(current v1.Object) bool
+
+	// MergeServiceEntry adjusts se, a copy of the ServiceEntry to write, to current, the ServiceEntry found. It
+	// returns false if current is up to date, then nothing is written.
+	MergeServiceEntry func(current, se *ic.ServiceEntry) bool
+
+	// merge is a MergeServiceEntry of any kind
+	merge func(current, obj object) bool
+)
+
+// object is the object of a typed client, both a runtime.Object and a v1.Object
+type object interface {
+	runtime.Object
+	v1.Object
+}
+
+// client adapts the typed clients of the ServiceEntries, WorkloadEntries and DestinationRules
+type client interface {
+	kind() string
+	get(ctx context.Context, name string) (object, error)
+	create(ctx context.Context, obj object, opts v1.CreateOptions) error
+	update(ctx context.Context, obj object) (object, error)
+	patch(ctx context.Context, name string, data []byte, opts v1.PatchOptions) error
+	delete(ctx context.Context, name string, opts v1.DeleteOptions) error
+}
+
+// ApplyServiceEntry writes se, merged with the current ServiceEntry by merge if set, see apply
+func ApplyServiceEntry(ctx context.Context, c icapi.ServiceEntryInterface, se *ic.ServiceEntry, merge MergeServiceEntry,
+	owns Owns, fieldManager string) error {
+	if merge == nil {
+		return apply(ctx, serviceEntries{c}, se, nil, owns, fieldManager)
+	}
+	return apply(ctx, serviceEntries{c}, se, func(current, obj object) bool {
+		return merge(current.(*ic.ServiceEntry), obj.(*ic.ServiceEntry))
+	}, owns, fieldManager)
+}
+
+// DeleteServiceEntry deletes the named ServiceEntry, see remove
+func DeleteServiceEntry(ctx context.Context, c icapi.ServiceEntryInterface, name string, owns Owns) error {
+	return remove(ctx, serviceEntries{c}, name, owns)
+}
+
+// ApplyWorkloadEntry writes we, see apply
+func ApplyWorkloadEntry(ctx context.Context, c icapi.WorkloadEntryInterface, we *ic.WorkloadEntry, owns Owns, fieldManager string) error {
+	return apply(ctx, workloadEntries{c}, we, nil, owns, fieldManager)
+}
+
+// DeleteWorkloadEntry deletes the named WorkloadEntry, see remove
+func DeleteWorkloadEntry(ctx context.Context, c icapi.WorkloadEntryInterface, name string, owns Owns) error {
+	return remove(ctx, workloadEntries{c}, name, owns)
+}
+
+// ApplyDestinationRule writes dr, see apply
+func ApplyDestinationRule(ctx context.Context, c icapi.DestinationRuleInterface, dr *ic.DestinationRule, owns Owns, fieldManager string) error {
+	return apply(ctx, destinationRules{c}, dr, nil, owns, fieldManager)
+}
+
+// DeleteDestinationRule deletes the named DestinationRule, see remove
+func DeleteDestinationRule(ctx context.Context, c icapi.DestinationRuleInterface, name string, owns Owns) error {
+	return remove(ctx, destinationRules{c}, name, owns)
+}
+
+// apply writes obj with server-side apply as fieldManager, or updates it if fieldManager is empty, the clients which
+// aren't the API server don't support server-side apply. A missing object is created. The current object is read
+// first, and one owns doesn't accept is never overwritten, a serviceentry.NotOwnedError is returned instead. As it is
+// ours, the fields other field managers set on it are taken over. The write is conditional on the version read: a
+// conflict is returned, to be tried again, if the object changed in the meantime.
+func apply(ctx context.Context, c client, obj object, merge func(current, obj object) bool, owns Owns, fieldManager string) error {
+	current, err := c.get(ctx, obj.GetName())
+	if k8serrors.IsNotFound(err) {
+		if fieldManager != "" {
+			data, err := encode(c, obj)
+			if err != nil {
+				return err
+			}
+			// not forced, an object created in the meantime by someone else conflicts and is read again
+			return c.patch(ctx, obj.GetName(), data, v1.PatchOptions{FieldManager: fieldManager})
+		}
+		err = c.create(ctx, obj, v1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			// created in the meantime, it is read again
+			return k8serrors.NewConflict(ic.Resource(c.kind()), obj.GetName(), err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if !owns(current) {
+		return serviceentry.NotOwned(c.kind(), current)
+	}
+	written := obj.DeepCopyObject().(object)
+	if merge != nil && !merge(current, written) {
+		return nil
+	}
+	written.SetResourceVersion(current.GetResourceVersion())
+	if fieldManager == "" {
+		_, err = c.update(ctx, written)
+		return err
+	}
+	if updated(current) {
+		// the fields of an update belong to its own field manager, an apply leaving them out wouldn't remove them: the
+		// object is replaced by an update once, dropping the managed fields, so that the apply owns all of them
+		migrated := written.DeepCopyObject().(object)
+		migrated.SetManagedFields([]v1.ManagedFieldsEntry{{}})
+		if migrated, err = c.update(ctx, migrated); err != nil {
+			return err
+		}
+		written.SetResourceVersion(migrated.GetResourceVersion())
+	}
+	data, err := encode(c, written)
+	if err != nil {
+		return err
+	}
+	force := true
+	return c.patch(ctx, obj.GetName(), data, v1.PatchOptions{FieldManager: fieldManager, Force: &force})
+}
+
+// beforeFirstApply is the field manager of the fields an object had when it was first applied
+const beforeFirstApply = "before-first-apply"
+
+// updated reports whether the spec of obj is managed by an update, rather than by server-side apply
+func updated(obj v1.Object) bool {
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Operation != v1.ManagedFieldsOperationUpdate || entry.Manager == beforeFirstApply || entry.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if _, found := fields["f:spec"]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// encode returns obj as the body of a server-side apply
+func encode(c client, obj object) ([]byte, error) {
+	obj = obj.DeepCopyObject().(object)
+	obj.GetObjectKind().SetGroupVersionKind(ic.SchemeGroupVersion.WithKind(c.kind()))
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode %s %s/%s", c.kind(), obj.GetNamespace(), obj.GetName())
+	}
+	return data, nil
+}
+
+// remove deletes the named object unless owns doesn't accept it, then a serviceentry.NotOwnedError is returned.
+// An object which is gone already is deleted. A conflict is returned if it was replaced since it was read.
+func remove(ctx context.Context, c client, name string, owns Owns) error {
+	current, err := c.get(ctx, name)
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !owns(current) {
+		return serviceentry.NotOwned(c.kind(), current)
+	}
+	err = c.delete(ctx, name, v1.DeleteOptions{Preconditions: v1.NewUIDPreconditions(string(current.GetUID()))})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+type serviceEntries struct {
+	icapi.ServiceEntryInterface
+}
+
+func (serviceEntries) kind() string {
+	return plan.KindServiceEntry
+}
+
+func (c serviceEntries) get(ctx context.Context, name string) (object, error) {
+	return c.Get(ctx, name, v1.GetOptions{})
+}
+
+func (c serviceEntries) create(ctx context.Context, obj object, opts v1.CreateOptions) error {
+	_, err := c.Create(ctx, obj.(*ic.ServiceEntry), opts)
+	return err
+}
+
+func (c serviceEntries) update(ctx context.Context, obj object) (object, error) {
+	return c.Update(ctx, obj.(*ic.ServiceEntry), v1.UpdateOptions{})
+}
+
+func (c serviceEntries) patch(ctx context.Context, name string, data []byte, opts v1.PatchOptions) error {
+	_, err := c.Patch(ctx, name, types.ApplyPatchType, data, opts)
+	return err
+}
+
+func (c serviceEntries) delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
+	return c.Delete(ctx, name, opts)
+}
+
+type workloadEntries struct {
+	icapi.WorkloadEntryInterface
+}
+
+func (workloadEntries) kind() string {
+	return plan.KindWorkloadEntry
+}
+
+func (c workloadEntries) get(ctx context.Context, name string) (object, error) {
+	return c.Get(ctx, name, v1.GetOptions{})
+}
+
+func (c workloadEntries) create(ctx context.Context, obj object, opts v1.CreateOptions) error {
+	_, err := c.Create(ctx, obj.(*ic.WorkloadEntry), opts)
+	return err
+}
+
+func (c workloadEntries) update(ctx context.Context, obj object) (object, error) {
+	return c.Update(ctx, obj.(*ic.WorkloadEntry), v1.UpdateOptions{})
+}
+
+func (c workloadEntries) patch(ctx context.Context, name string, data []byte, opts v1.PatchOptions) error {
+	_, err := c.Patch(ctx, name, types.ApplyPatchType, data, opts)
+	return err
+}
+
+func (c workloadEntries) delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
+	return c.Delete(ctx, name, opts)
+}
+
+type destinationRules struct {
+	icapi.DestinationRuleInterface
+}
+
+func (destinationRules) kind() string {
+	return plan.KindDestinationRule
+}
+
+func (c destinationRules) get(ctx context.Context, name string) (object, error) {
+	return c.Get(ctx, name, v1.GetOptions{})
+}
+
+func (c destinationRules) create(ctx context.Context, obj object, opts v1.CreateOptions) error {
+	_, err := c.Create(ctx, obj.(*ic.DestinationRule), opts)
+	return err
+}
+
+func (c destinationRules) update(ctx context.Context, obj object) (object, error) {
+	return c.Update(ctx, obj.(*ic.DestinationRule), v1.UpdateOptions{})
+}
+
+func (c destinationRules) patch(ctx context.Context, name string, data []byte, opts v1.PatchOptions) error {
+	_, err := c.Patch(ctx, name, types.ApplyPatchType, data, opts)
+	return err
+}
+
+func (c destinationRules) delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
+	return c.Delete(ctx, name, opts)
+}
@@ -0,0 +1,221 @@
+package writer
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"istio.io/api/networking/v1alpha3"
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	"istio.io/client-go/pkg/clientset/versioned/fake"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+var identity = serviceentry.Identity{Type: "consul", Registry: "consul"}
+
+func newServiceEntry(address string, stamped bool) *ic.ServiceEntry {
+	se := &ic.ServiceEntry{
+		ObjectMeta: v1.ObjectMeta{Name: "web.service.consul", Namespace: "external"},
+		Spec: v1alpha3.ServiceEntry{
+			Hosts:     []string{"web.service.consul"},
+			Endpoints: []*v1alpha3.WorkloadEntry{{Address: address}},
+		},
+	}
+	if stamped {
+		identity.Stamp(se)
+	}
+	return se
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []runtime.Object
+		// conflicts is the number of updates failing with a conflict
+		conflicts int
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "a missing ServiceEntry is created",
+			want: "10.0.0.2",
+		},
+		{
+			name:     "a ServiceEntry of the registry is updated",
+			existing: []runtime.Object{newServiceEntry("10.0.0.1", true)},
+			want:     "10.0.0.2",
+		},
+		{
+			name:      "a ServiceEntry changed in the meantime is read again",
+			existing:  []runtime.Object{newServiceEntry("10.0.0.1", true)},
+			conflicts: 2,
+			want:      "10.0.0.2",
+		},
+		{
+			name:     "a ServiceEntry written by hand is left as is",
+			existing: []runtime.Object{newServiceEntry("10.0.0.1", false)},
+			want:     "10.0.0.1",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tt.existing...)
+			conflicts := tt.conflicts
+			clientset.PrependReactor("update", "serviceentries", func(k8stesting.Action) (bool, runtime.Object, error) {
+				if conflicts == 0 {
+					return false, nil, nil
+				}
+				conflicts--
+				return true, nil, k8serrors.NewConflict(ic.Resource("serviceentries"), "web.service.consul", nil)
+			})
+			client := clientset.NetworkingV1alpha3().ServiceEntries("external")
+			err := Do(context.Background(), func(ctx context.Context) error {
+				return ApplyServiceEntry(ctx, client, newServiceEntry("10.0.0.2", true), nil, identity.Owns, "")
+			})
+			if _, notOwned := err.(*serviceentry.NotOwnedError); notOwned != tt.wantErr || !notOwned && err != nil {
+				t.Fatalf("ApplyServiceEntry() = %v, want a NotOwnedError: %t", err, tt.wantErr)
+			}
+			se, err := client.Get(context.Background(), "web.service.consul", v1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := se.Spec.Endpoints[0].Address; got != tt.want {
+				t.Errorf("the endpoint is %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(newServiceEntry("10.0.0.1", false)).NetworkingV1alpha3().ServiceEntries("external")
+	if err := DeleteServiceEntry(ctx, client, "web.service.consul", identity.Owns); err == nil {
+		t.Error("a ServiceEntry written by hand mustn't be deleted")
+	}
+
+	client = fake.NewSimpleClientset(newServiceEntry("10.0.0.1", true)).NetworkingV1alpha3().ServiceEntries("external")
+	if err := DeleteServiceEntry(ctx, client, "web.service.consul", identity.Owns); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, "web.service.consul", v1.GetOptions{}); !k8serrors.IsNotFound(err) {
+		t.Errorf("the ServiceEntry must be deleted, got %v", err)
+	}
+	if err := DeleteServiceEntry(ctx, client, "web.service.consul", identity.Owns); err != nil {
+		t.Errorf("deleting a ServiceEntry which is gone must succeed, got %v", err)
+	}
+}
+
+// applier is a client doing server-side apply, which the fake clientset doesn't support
+type applier struct {
+	client
+	current *ic.ServiceEntry
+	updated *ic.ServiceEntry
+	patched *ic.ServiceEntry
+	forced  bool
+}
+
+func (a *applier) get(_ context.Context, name string) (object, error) {
+	if a.current == nil {
+		return nil, k8serrors.NewNotFound(ic.Resource("serviceentries"), name)
+	}
+	return a.current, nil
+}
+
+func (a *applier) update(_ context.Context, obj object) (object, error) {
+	a.updated = obj.(*ic.ServiceEntry)
+	updated := a.updated.DeepCopy()
+	updated.ResourceVersion = "43"
+	return updated, nil
+}
+
+func (a *applier) patch(_ context.Context, _ string, data []byte, opts v1.PatchOptions) error {
+	a.patched = &ic.ServiceEntry{}
+	a.forced = opts.Force != nil && *opts.Force
+	return json.Unmarshal(data, a.patched)
+}
+
+func TestServerSideApply(t *testing.T) {
+	ours := newServiceEntry("10.0.0.1", true)
+	ours.ResourceVersion = "42"
+	ours.ManagedFields = []v1.ManagedFieldsEntry{{Manager: "asm-se-syncer", Operation: v1.ManagedFieldsOperationApply,
+		FieldsV1: &v1.FieldsV1{Raw: []byte(`{"f:spec":{"f:endpoints":{}}}`)}}}
+	// created or updated by the syncer before it applied its writes, with a label it doesn't set anymore
+	updated := ours.DeepCopy()
+	updated.Labels["team"] = "payments"
+	updated.ManagedFields[0].Operation = v1.ManagedFieldsOperationUpdate
+	// written by hand like we would
+	foreign := newServiceEntry("10.0.0.2", false)
+	foreign.ResourceVersion = "42"
+	tests := []struct {
+		name        string
+		current     *ic.ServiceEntry
+		wantUpdated bool
+		wantPatched bool
+		wantForced  bool
+		wantVersion string
+		wantErr     bool
+	}{
+		{
+			name:        "created by an apply if missing, which isn't forced",
+			wantPatched: true,
+		},
+		{
+			name:        "applied if it is ours",
+			current:     ours,
+			wantPatched: true,
+			wantForced:  true,
+			wantVersion: "42",
+		},
+		{
+			name:        "replaced once if it was updated, then applied",
+			current:     updated,
+			wantUpdated: true,
+			wantPatched: true,
+			wantForced:  true,
+			wantVersion: "43",
+		},
+		{
+			name:    "never applied to a foreign ServiceEntry, even if it is alike",
+			current: foreign,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &applier{client: serviceEntries{}, current: tt.current}
+			err := apply(context.Background(), c, newServiceEntry("10.0.0.2", true), nil, identity.Owns, "asm-se-syncer")
+			if _, notOwned := err.(*serviceentry.NotOwnedError); notOwned != tt.wantErr || !notOwned && err != nil {
+				t.Fatalf("apply() = %v, want a NotOwnedError: %t", err, tt.wantErr)
+			}
+			if (c.updated != nil) != tt.wantUpdated || (c.patched != nil) != tt.wantPatched {
+				t.Fatalf("updated: %t, applied: %t, want updated: %t, applied: %t", c.updated != nil, c.patched != nil,
+					tt.wantUpdated, tt.wantPatched)
+			}
+			if c.updated != nil {
+				if !reflect.DeepEqual(c.updated.ManagedFields, []v1.ManagedFieldsEntry{{}}) {
+					t.Errorf("the update must drop the managed fields, got %v", c.updated.ManagedFields)
+				}
+				if _, found := c.updated.Labels["team"]; found || c.updated.ResourceVersion != "42" {
+					t.Errorf("the update must replace the version read, got %v", c.updated)
+				}
+			}
+			if c.patched == nil {
+				return
+			}
+			if c.patched.ResourceVersion != tt.wantVersion || c.forced != tt.wantForced {
+				t.Errorf("applied with resourceVersion %q and force %t, want %q and %t", c.patched.ResourceVersion, c.forced,
+					tt.wantVersion, tt.wantForced)
+			}
+			if c.patched.Kind != "ServiceEntry" || c.patched.ManagedFields != nil || c.patched.Spec.Endpoints[0].Address != "10.0.0.2" {
+				t.Errorf("applied %+v", c.patched)
+			}
+		})
+	}
+}
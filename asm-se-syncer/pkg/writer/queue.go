@@ -0,0 +1,197 @@
+package writer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+const (
+	// conflictRetries is how many times a write failing with a conflict is tried again at once
+	conflictRetries = 3
+
+	DefaultQPS       = 20
+	DefaultBurst     = 40
+	DefaultBaseDelay = time.Second
+	DefaultMaxDelay  = 5 * time.Minute
+)
+
+// ErrReplaced is the result of a queued write which was replaced by a later write of the same object before it was done
+var ErrReplaced = errors.New("replaced by a later write")
+
+type (
+	// Write does a write to the API server. It must read again what it updates, so that it can be tried again
+	// after a conflict.
+	Write func(ctx context.Context) error
+
+	// Config configures a Queue, the zero values are replaced by the defaults
+	Config struct {
+		// QPS and Burst limit the writes done by the queue, across all registries
+		QPS   float32
+		Burst int
+		// Workers is the number of writes done at the same time, 1 if zero
+		Workers int
+		// BaseDelay is the delay before trying a failed write again, doubled at every failure up to MaxDelay
+		BaseDelay time.Duration
+		MaxDelay  time.Duration
+	}
+
+	// Queue does the writes to the API server of all registries, at most Config.QPS per second. Writes are queued
+	// by key, the object they write: a write queued while another of the same object is pending replaces it, so
+	// that only the latest is done. Failed writes are tried again with an exponential backoff per key, until they
+	// succeed, fail for good or are replaced.
+	Queue struct {
+		queue workqueue.DelayingInterface
+		// backoff delays the keys whose write failed
+		backoff workqueue.RateLimiter
+		limiter flowcontrol.RateLimiter
+		workers int
+		m       sync.Mutex
+		pending map[string]*op
+	}
+
+	op struct {
+		write Write
+		done  func(error)
+	}
+)
+
+// NewQueue returns a queue, which does nothing until it is run
+func NewQueue(config Config) *Queue {
+	if config.QPS <= 0 {
+		config.QPS = DefaultQPS
+	}
+	if config.Burst <= 0 {
+		config.Burst = DefaultBurst
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.BaseDelay <= 0 {
+		config.BaseDelay = DefaultBaseDelay
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = DefaultMaxDelay
+	}
+	return &Queue{
+		queue:   workqueue.NewNamedDelayingQueue("writes"),
+		backoff: workqueue.NewItemExponentialFailureRateLimiter(config.BaseDelay, config.MaxDelay),
+		limiter: flowcontrol.NewTokenBucketRateLimiter(config.QPS, config.Burst),
+		workers: config.Workers,
+		pending: make(map[string]*op),
+	}
+}
+
+// Key returns the key of the writes of an object
+func Key(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// Add queues write, replacing the write of key which is pending if any. done is called by a worker once the write
+// succeeded, or failed with an error which trying again doesn't fix. The done of a write which is replaced is called
+// with ErrReplaced instead, by Add itself if the write was pending. A key backing off after a failure is written once
+// its backoff expired, with the latest write.
+func (q *Queue) Add(key string, write Write, done func(error)) {
+	q.m.Lock()
+	replaced := q.pending[key]
+	q.pending[key] = &op{write: write, done: done}
+	backingOff := q.backoff.NumRequeues(key) > 0
+	monitoring.SetPendingWrites(len(q.pending))
+	q.m.Unlock()
+	if replaced != nil {
+		replaced.done(ErrReplaced)
+	}
+	if !backingOff {
+		q.queue.Add(key)
+	}
+}
+
+// Run does the queued writes until the context is cancelled
+func (q *Queue) Run(ctx context.Context) {
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			for q.next(ctx) {
+			}
+		}()
+	}
+	<-ctx.Done()
+	q.queue.ShutDown()
+}
+
+// next does the write of the next key, it returns false once the queue is shut down
+func (q *Queue) next(ctx context.Context) bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+	key := item.(string)
+
+	q.m.Lock()
+	op, found := q.pending[key]
+	delete(q.pending, key)
+	monitoring.SetPendingWrites(len(q.pending))
+	q.m.Unlock()
+	if !found {
+		return true
+	}
+	if err := q.limiter.Wait(ctx); err != nil {
+		// stopping
+		return true
+	}
+
+	err := Do(ctx, op.write)
+	if err != nil && !permanent(err) && ctx.Err() == nil {
+		monitoring.WriteRetried(monitoring.RetryBackoff)
+		q.m.Lock()
+		_, replaced := q.pending[key]
+		if !replaced {
+			q.pending[key] = op
+			monitoring.SetPendingWrites(len(q.pending))
+		}
+		delay := q.backoff.When(key)
+		q.m.Unlock()
+		log.Warnf("error writing %s, trying again in %s: %v", key, delay, err)
+		q.queue.AddAfter(key, delay)
+		if replaced {
+			op.done(ErrReplaced)
+		}
+		return true
+	}
+	q.m.Lock()
+	q.backoff.Forget(key)
+	_, replaced := q.pending[key]
+	q.m.Unlock()
+	if replaced {
+		q.queue.Add(key)
+	}
+	op.done(err)
+	return true
+}
+
+// Do runs write, and again at once while it fails with a conflict, at most conflictRetries times
+func Do(ctx context.Context, write Write) error {
+	err := write(ctx)
+	for i := 0; i < conflictRetries && k8serrors.IsConflict(err); i++ {
+		monitoring.WriteRetried(monitoring.RetryConflict)
+		err = write(ctx)
+	}
+	return err
+}
+
+// permanent reports whether trying a write again can't fix err
+func permanent(err error) bool {
+	if _, ok := err.(*serviceentry.NotOwnedError); ok {
+		return true
+	}
+	return k8serrors.IsInvalid(err) || k8serrors.IsBadRequest(err) || k8serrors.IsNotAcceptable(err)
+}
@@ -0,0 +1,171 @@
+package writer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	ic "istio.io/client-go/pkg/apis/networking/v1alpha3"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// recorder records the writes done by a queue and their results
+type recorder struct {
+	m       sync.Mutex
+	written []string
+	results map[string]error
+	done    chan string
+	// replaced counts the writes replaced by later ones
+	replaced int
+}
+
+func newRecorder() *recorder {
+	return &recorder{results: make(map[string]error), done: make(chan string, 10)}
+}
+
+// write returns a write recorded as name, which fails with the errors given before succeeding
+func (r *recorder) write(name string, errs ...error) Write {
+	return func(context.Context) error {
+		r.m.Lock()
+		defer r.m.Unlock()
+		r.written = append(r.written, name)
+		if len(errs) == 0 {
+			return nil
+		}
+		err := errs[0]
+		errs = errs[1:]
+		return err
+	}
+}
+
+func (r *recorder) doneFunc(key string) func(error) {
+	return func(err error) {
+		r.m.Lock()
+		defer r.m.Unlock()
+		if err == ErrReplaced {
+			r.replaced++
+			return
+		}
+		r.results[key] = err
+		r.done <- key
+	}
+}
+
+func (r *recorder) wait(t *testing.T, key string) error {
+	select {
+	case done := <-r.done:
+		if done != key {
+			t.Fatalf("%s is done, want %s", done, key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s isn't done", key)
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.results[key]
+}
+
+func (r *recorder) writes() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]string(nil), r.written...)
+}
+
+func TestQueue(t *testing.T) {
+	conflict := k8serrors.NewConflict(ic.Resource("serviceentries"), "web", errors.New("changed"))
+	unavailable := k8serrors.NewServiceUnavailable("etcd is down")
+	invalid := k8serrors.NewInvalid(schema.GroupKind{Group: "networking.istio.io", Kind: "ServiceEntry"}, "web", nil)
+	key := Key("ServiceEntry", "external", "web")
+	tests := []struct {
+		name string
+		// queued are the writes of key queued before the queue runs, the last one fails with errs first
+		queued  []string
+		errs    []error
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "pending writes of the same host are replaced",
+			queued: []string{"first", "second", "third"},
+			want:   []string{"third"},
+		},
+		{
+			name:   "conflicts are tried again at once",
+			queued: []string{"first"},
+			errs:   []error{conflict, conflict},
+			want:   []string{"first", "first", "first"},
+		},
+		{
+			name:   "failures are tried again after a backoff",
+			queued: []string{"first"},
+			errs:   []error{unavailable, unavailable},
+			want:   []string{"first", "first", "first"},
+		},
+		{
+			name:    "permanent failures aren't tried again",
+			queued:  []string{"first"},
+			errs:    []error{invalid},
+			want:    []string{"first"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRecorder()
+			q := NewQueue(Config{QPS: 100, BaseDelay: 10 * time.Millisecond})
+			for i, name := range tt.queued {
+				var errs []error
+				if i == len(tt.queued)-1 {
+					errs = tt.errs
+				}
+				q.Add(key, r.write(name, errs...), r.doneFunc(key))
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go q.Run(ctx)
+
+			if err := r.wait(t, key); (err != nil) != tt.wantErr {
+				t.Errorf("done with %v, want an error: %t", err, tt.wantErr)
+			}
+			if got := r.writes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("written %v, want %v", got, tt.want)
+			}
+			r.m.Lock()
+			defer r.m.Unlock()
+			if r.replaced != len(tt.queued)-1 {
+				t.Errorf("%d writes replaced, want the %d before the last", r.replaced, len(tt.queued)-1)
+			}
+		})
+	}
+}
+
+func TestQueueReplacesBackingOff(t *testing.T) {
+	r := newRecorder()
+	key := Key("ServiceEntry", "external", "web")
+	q := NewQueue(Config{QPS: 100, BaseDelay: 50 * time.Millisecond})
+	q.Add(key, r.write("first", k8serrors.NewServiceUnavailable("etcd is down")), r.doneFunc(key))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	for len(r.writes()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// queued while the first write backs off, it waits for the backoff too
+	q.Add(key, r.write("second"), r.doneFunc(key))
+	if err := r.wait(t, key); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.writes(); !reflect.DeepEqual(got, []string{"first", "second"}) {
+		t.Errorf("written %v, the failed write must be replaced", got)
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.replaced != 1 {
+		t.Errorf("%d writes replaced, the failed write must be", r.replaced)
+	}
+}
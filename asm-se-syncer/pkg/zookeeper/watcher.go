@@ -0,0 +1,304 @@
+package zookeeper
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/monitoring"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/serviceentry"
+)
+
+const (
+	// DefaultRootPath is the znode Dubbo registers its services under
+	DefaultRootPath = "/dubbo"
+
+	providersNode = "providers"
+	// defaultWeight is the weight of Dubbo providers registered without one
+	defaultWeight = 100
+
+	// TODO: allow users to specify these
+	defaultSessionTimeout = 10 * time.Second
+	defaultResyncInterval = 60 * time.Second
+)
+
+// Labels copied from the Dubbo provider URL to the endpoints, so that they can be used in subsets
+var providerLabels = []string{"application", "version", "group"}
+
+type (
+	// conn is the subset of *zk.Conn used by the watcher
+	conn interface {
+		Children(path string) ([]string, *zk.Stat, error)
+		ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+		Close()
+	}
+
+	watcher struct {
+		conn           conn
+		store          provider.Cache
+		rootPath       string
+		resyncInterval time.Duration
+		name           string
+		prefix         string
+		hostTemplate   *common.HostTemplate
+		toNamespace    string
+		watcherType    string
+		hosts          *provider.HostTable
+		filter         *provider.Filter
+
+		m       sync.Mutex
+		watched map[string]struct{} // znodes with a pending children watch
+		changed chan struct{}
+	}
+)
+
+var _ provider.Watcher = &watcher{}
+
+// NewWatcher returns a watcher of the Dubbo providers registered in the ZooKeeper ensemble at endpoint,
+// a comma separated list of host:port. The interfaces are named by hostTemplate, common.DefaultHostTemplate if nil,
+// and selected by filter by name and provider URL parameters.
+func NewWatcher(store provider.Cache, name, endpoint, rootPath, prefix string, hostTemplate *common.HostTemplate,
+	filter *common.FilterConfig, toNamespace string) (provider.Watcher, error) {
+	if len(endpoint) == 0 {
+		return nil, errors.New("ZooKeeper endpoint not specified")
+	}
+	var servers []string
+	for _, server := range strings.Split(endpoint, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	if rootPath == "" {
+		rootPath = DefaultRootPath
+	}
+
+	c, _, err := zk.Connect(servers, defaultSessionTimeout, zk.WithLogger(log.StandardLogger()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting to ZooKeeper %s", endpoint)
+	}
+	return newWatcher(c, store, name, rootPath, prefix, hostTemplate, filter, toNamespace), nil
+}
+
+func newWatcher(c conn, store provider.Cache, name, rootPath, prefix string, hostTemplate *common.HostTemplate,
+	filter *common.FilterConfig, toNamespace string) *watcher {
+	if hostTemplate == nil {
+		hostTemplate = common.MustParseHostTemplate(common.DefaultHostTemplate)
+	}
+	return &watcher{
+		conn:           c,
+		store:          store,
+		rootPath:       path.Clean(rootPath),
+		resyncInterval: defaultResyncInterval,
+		name:           name,
+		prefix:         prefix,
+		hostTemplate:   hostTemplate,
+		toNamespace:    toNamespace,
+		watcherType:    string(common.Zookeeper),
+		hosts:          provider.NewHostTable(store, name),
+		filter:         provider.NewFilter(filter, name),
+		watched:        make(map[string]struct{}),
+		changed:        make(chan struct{}, 1),
+	}
+}
+
+func (w *watcher) Cache() provider.Cache {
+	return w.store
+}
+
+func (w *watcher) Name() string {
+	return w.name
+}
+
+func (w *watcher) Prefix() string {
+	return w.prefix
+}
+
+func (w *watcher) ToNamespace() string {
+	return w.toNamespace
+}
+
+func (w *watcher) WatcherType() string {
+	return w.watcherType
+}
+
+// Run the watcher until the context is cancelled. The store is refreshed whenever a watched znode changes,
+// and periodically in case a watch was lost.
+func (w *watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.resyncInterval)
+	defer ticker.Stop()
+	defer w.conn.Close()
+
+	w.refreshStore() // init
+	for {
+		select {
+		case <-w.changed:
+			w.refreshStore()
+		case <-ticker.C:
+			w.refreshStore()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetch the providers of every Dubbo interface and sync them with Store
+func (w *watcher) refreshStore() {
+	interfaces, err := w.children(w.rootPath)
+	if err == zk.ErrNoNode {
+		log.Infof("no Dubbo service registered under %s in ZooKeeper %s", w.rootPath, w.name)
+		w.filter.Sweep()
+		w.hosts.Set(nil)
+		monitoring.Synced(w.name)
+		return
+	} else if err != nil {
+		log.Errorf("error listing Dubbo services from ZooKeeper %s: %v", w.name, err)
+		monitoring.WatchFailed(w.name, err)
+		return
+	}
+
+	data := make(map[string]map[string][]*v1alpha3.WorkloadEntry, len(interfaces)) // host->interface->endpoints
+	for _, iface := range interfaces {
+		providers, err := w.children(path.Join(w.rootPath, iface, providersNode))
+		if err == zk.ErrNoNode {
+			continue
+		} else if err != nil {
+			// keep the last known endpoints rather than publishing a partial view
+			log.Errorf("error listing providers of %s from ZooKeeper %s: %v", iface, w.name, err)
+			monitoring.WatchFailed(w.name, err)
+			return
+		}
+		eps := make([]*v1alpha3.WorkloadEntry, 0, len(providers))
+		for _, p := range providers {
+			if ep := providerToEndpoint(p); ep != nil {
+				eps = append(eps, ep)
+			}
+		}
+		if len(eps) == 0 || !w.filter.Keep(iface, interfaceInfo(iface, providers)) {
+			continue
+		}
+		host, err := w.hostTemplate.Host(common.HostData{Registry: w.name, Prefix: w.prefix, Service: iface})
+		if err != nil {
+			log.Errorf("interface %s of ZooKeeper %s isn't published: %v", iface, w.name, err)
+			continue
+		}
+		if data[host] == nil {
+			data[host] = make(map[string][]*v1alpha3.WorkloadEntry)
+		}
+		data[host][iface] = eps
+	}
+	w.filter.Sweep()
+	w.hosts.Set(data)
+	monitoring.Synced(w.name)
+}
+
+// interfaceInfo describes the providers of an interface for the filter, their metadata are the URL parameters
+func interfaceInfo(iface string, providers []string) common.ServiceInfo {
+	info := common.ServiceInfo{Name: iface, Instances: make([]common.InstanceInfo, 0, len(providers))}
+	for _, p := range providers {
+		raw, err := url.QueryUnescape(p)
+		if err != nil {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		params := u.Query()
+		metadata := make(map[string]string, len(params))
+		for key := range params {
+			metadata[key] = params.Get(key)
+		}
+		info.Instances = append(info.Instances, common.InstanceInfo{Metadata: metadata})
+	}
+	return info
+}
+
+// children lists the children of znode, leaving a watch on it unless one is already pending
+func (w *watcher) children(znode string) ([]string, error) {
+	w.m.Lock()
+	_, pending := w.watched[znode]
+	w.m.Unlock()
+	if pending {
+		children, _, err := w.conn.Children(znode)
+		return children, err
+	}
+
+	children, _, events, err := w.conn.ChildrenW(znode)
+	if err != nil {
+		return nil, err
+	}
+	w.m.Lock()
+	w.watched[znode] = struct{}{}
+	w.m.Unlock()
+	go func() {
+		// watches fire once, on a change or when the session is lost
+		<-events
+		w.m.Lock()
+		delete(w.watched, znode)
+		w.m.Unlock()
+		select {
+		case w.changed <- struct{}{}:
+		default:
+		}
+	}()
+	return children, nil
+}
+
+// providerToEndpoint converts the URL encoded Dubbo provider znode to a service entry endpoint,
+// it returns nil for providers which are disabled or can't be parsed.
+func providerToEndpoint(znode string) *v1alpha3.WorkloadEntry {
+	raw, err := url.QueryUnescape(znode)
+	if err != nil {
+		log.Infof("ignoring Dubbo provider %q: %v", znode, err)
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		log.Infof("ignoring Dubbo provider %q: %v", raw, err)
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		log.Infof("ignoring Dubbo provider %q without port: %v", raw, err)
+		return nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 32)
+	if err != nil || port == 0 || host == "" {
+		log.Infof("ignoring Dubbo provider %q with invalid address %s", raw, u.Host)
+		return nil
+	}
+
+	params := u.Query()
+	if params.Get("enabled") == "false" || params.Get("disabled") == "true" {
+		return nil
+	}
+	// the scheme is the protocol of the provider, e.g. dubbo or grpc
+	ep := serviceentry.EndpointWithProtocol(host, uint32(port), u.Scheme)
+	metadata := make(map[string]string, len(providerLabels))
+	for _, key := range providerLabels {
+		if value := params.Get(key); value != "" {
+			metadata[key] = value
+		}
+	}
+	ep.Labels = serviceentry.Labels(metadata)
+	weight, err := strconv.ParseUint(params.Get("weight"), 10, 32)
+	if err != nil {
+		weight = defaultWeight
+	} else if weight == 0 {
+		return nil
+	}
+	ep.Weight = uint32(weight)
+	return ep
+}
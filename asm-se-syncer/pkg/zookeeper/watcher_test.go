@@ -0,0 +1,142 @@
+package zookeeper
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/go-zookeeper/zk"
+	"istio.io/api/networking/v1alpha3"
+
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/common"
+	"gitlab.alibaba-inc.com/cos/asm-se-syncer/pkg/provider"
+)
+
+// fakeConn serves znode children from a map of path->children
+type fakeConn struct {
+	nodes  map[string][]string
+	events map[string]chan zk.Event
+}
+
+func (c *fakeConn) Children(path string) ([]string, *zk.Stat, error) {
+	children, ok := c.nodes[path]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return children, &zk.Stat{}, nil
+}
+
+func (c *fakeConn) ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	children, stat, err := c.Children(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	events := make(chan zk.Event, 1)
+	c.events[path] = events
+	return children, stat, events, nil
+}
+
+func (c *fakeConn) Close() {}
+
+func provider1(query string) string {
+	return url.QueryEscape("dubbo://192.0.2.1:20880/com.foo.DemoService?" + query)
+}
+
+func TestRefreshStore(t *testing.T) {
+	c := &fakeConn{
+		nodes: map[string][]string{
+			"/dubbo": {"com.foo.DemoService", "com.foo.NoProviders", "com.foo.Empty"},
+			"/dubbo/com.foo.DemoService/providers": {
+				provider1("application=demo&version=1.0.0"),
+				url.QueryEscape("dubbo://192.0.2.2:20880/com.foo.DemoService?disabled=true"),
+			},
+			"/dubbo/com.foo.Empty/providers": {},
+		},
+		events: map[string]chan zk.Event{},
+	}
+	w := newWatcher(c, provider.NewCache(), "zk-test", DefaultRootPath, "zk-", nil, nil, "")
+	w.refreshStore()
+
+	actual := w.Cache().Hosts()
+	if len(actual) != 1 {
+		t.Fatalf("number of hosts must be 1 but got %d: %v", len(actual), actual)
+	}
+	eps := actual["zk-com.foo.demoservice"]
+	if len(eps) != 1 || eps[0].Address != "192.0.2.1" {
+		t.Fatalf("zk-com.foo.demoservice must only have the enabled provider but got %v", eps)
+	}
+	if len(c.events) != 3 {
+		t.Fatalf("watches must be left on the root and the existing providers nodes but got %v", c.events)
+	}
+
+	// a new provider fires the watch on the providers node
+	c.nodes["/dubbo/com.foo.Empty/providers"] = []string{url.QueryEscape("dubbo://192.0.2.3:20880/com.foo.Empty")}
+	c.events["/dubbo/com.foo.Empty/providers"] <- zk.Event{Type: zk.EventNodeChildrenChanged}
+	<-w.changed
+	w.refreshStore()
+	if actual := w.Cache().Hosts(); len(actual) != 2 {
+		t.Fatalf("number of hosts must be 2 but got %d: %v", len(actual), actual)
+	}
+}
+
+func TestRefreshStoreFilter(t *testing.T) {
+	c := &fakeConn{
+		nodes: map[string][]string{
+			"/dubbo":                                  {"com.foo.DemoService", "com.foo.MonitorService"},
+			"/dubbo/com.foo.DemoService/providers":    {provider1("application=demo")},
+			"/dubbo/com.foo.MonitorService/providers": {provider1("application=monitor&category=internal")},
+		},
+		events: map[string]chan zk.Event{},
+	}
+	filter := &common.FilterConfig{Exclude: []common.ServiceMatch{{Metadata: map[string]string{"category": "internal"}}}}
+	w := newWatcher(c, provider.NewCache(), "zk-test", DefaultRootPath, "", nil, filter, "")
+	w.refreshStore()
+	if actual := w.Cache().Hosts(); len(actual) != 1 || actual["com.foo.demoservice"] == nil {
+		t.Fatalf("only com.foo.demoservice must be synced but got %v", actual)
+	}
+
+	// the interface is synced once its providers don't match the rule any more
+	c.nodes["/dubbo/com.foo.MonitorService/providers"] = []string{provider1("application=monitor")}
+	w.refreshStore()
+	if actual := w.Cache().Hosts(); len(actual) != 2 {
+		t.Fatalf("number of hosts must be 2 but got %d: %v", len(actual), actual)
+	}
+}
+
+func TestProviderToEndpoint(t *testing.T) {
+	tests := []struct {
+		name  string
+		znode string
+		want  *v1alpha3.WorkloadEntry
+	}{
+		{
+			name:  "provider with labels",
+			znode: provider1("application=demo&version=1.0.0&group=g1&weight=50&side=provider"),
+			want: &v1alpha3.WorkloadEntry{
+				Address: "192.0.2.1",
+				Ports:   map[string]uint32{"tcp-dubbo-20880": 20880},
+				Labels:  map[string]string{"application": "demo", "version": "1.0.0", "group": "g1"},
+				Weight:  50,
+			},
+		},
+		{
+			name:  "provider without labels",
+			znode: provider1(""),
+			want: &v1alpha3.WorkloadEntry{
+				Address: "192.0.2.1",
+				Ports:   map[string]uint32{"tcp-dubbo-20880": 20880},
+				Weight:  defaultWeight,
+			},
+		},
+		{name: "disabled provider", znode: provider1("enabled=false")},
+		{name: "zero weight provider", znode: provider1("weight=0")},
+		{name: "provider without port", znode: url.QueryEscape("dubbo://192.0.2.1/com.foo.DemoService")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := providerToEndpoint(tt.znode); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("providerToEndpoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}